@@ -0,0 +1,129 @@
+package amazonsession
+
+import (
+	"net/http"
+	"time"
+)
+
+// The accessors below are the read-only view of a session. Maps and slices
+// are returned as copies, so the session can be shared with code that must
+// not change it. Use a SessionBuilder, see Session.Builder, to change the
+// metadata and SetCookie or DeleteCookie to change the cookies.
+
+// GetCountry returns the country code of the session.
+func (s *Session) GetCountry() string { return s.Country }
+
+// GetSessionID returns the session-id of the session.
+func (s *Session) GetSessionID() string { return s.SessionID }
+
+// GetCookies returns a copy of the cookies of the session.
+func (s *Session) GetCookies() []*http.Cookie {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cookies := s.sessionCookies()
+	copied := make([]*http.Cookie, 0, len(cookies))
+	for _, c := range cookies {
+		cookie := *c
+		copied = append(copied, &cookie)
+	}
+	return copied
+}
+
+// GetUsageCount returns the number of times the session was used.
+func (s *Session) GetUsageCount() int64 { return s.UsageCount }
+
+// GetUsageLastHour returns the number of uses within the last hour.
+func (s *Session) GetUsageLastHour() int64 { return s.UsageLastHour }
+
+// GetUsageLastDay returns the number of uses within the last 24 hours.
+func (s *Session) GetUsageLastDay() int64 { return s.UsageLastDay }
+
+// GetLastChecked returns the last time the session was checked.
+func (s *Session) GetLastChecked() time.Time { return s.LastChecked }
+
+// GetCreatedAt returns the creation time of the session.
+func (s *Session) GetCreatedAt() time.Time { return s.CreatedAt }
+
+// GetPostalCode returns the delivery location set for the session.
+func (s *Session) GetPostalCode() string { return s.PostalCode }
+
+// GetCurrency returns the preferred currency of the session.
+func (s *Session) GetCurrency() string { return s.Currency }
+
+// GetLanguage returns the preferred language of the session.
+func (s *Session) GetLanguage() string { return s.Language }
+
+// GetAccountRef returns the reference to the account backing the session,
+// empty for anonymous sessions.
+func (s *Session) GetAccountRef() string { return s.AccountRef }
+
+// GetLabels returns a copy of the labels of the session.
+func (s *Session) GetLabels() map[string]string {
+	if s.Labels == nil {
+		return nil
+	}
+	labels := make(map[string]string, len(s.Labels))
+	for name, value := range s.Labels {
+		labels[name] = value
+	}
+	return labels
+}
+
+// GetLabel returns the value of a label of the session.
+func (s *Session) GetLabel(name string) (string, bool) {
+	value, ok := s.Labels[name]
+	return value, ok
+}
+
+// GetGeneration returns the import batch the session was harvested in.
+func (s *Session) GetGeneration() string { return s.Generation }
+
+// IsCanary reports whether the session is a canary, see GetCanarySession.
+func (s *Session) IsCanary() bool { return s.Canary }
+
+// GetResidency returns the origin network type of the session.
+func (s *Session) GetResidency() string { return s.Residency }
+
+// GetASN returns the autonomous system number of the exit IP the session was
+// created from.
+func (s *Session) GetASN() string { return s.ASN }
+
+// GetExitIPHash returns the hash of the exit IP the session was created from.
+func (s *Session) GetExitIPHash() string { return s.ExitIPHash }
+
+// GetProxy returns the URL of the proxy bound to the session.
+func (s *Session) GetProxy() string { return s.Proxy }
+
+// GetTLSProfile returns the TLS fingerprint profile of the session.
+func (s *Session) GetTLSProfile() string { return s.TLSProfile }
+
+// GetBucket returns the A/B experiment bucket of the session.
+func (s *Session) GetBucket() string { return s.Bucket }
+
+// GetTier returns the priority tier of the session.
+func (s *Session) GetTier() string { return s.Tier }
+
+// GetRawSetCookies returns a copy of the raw Set-Cookie header values of the
+// session.
+func (s *Session) GetRawSetCookies() []string {
+	return append([]string(nil), s.RawSetCookies...)
+}
+
+// GetExpiresAt returns the time the session expires, in Unix time; zero when
+// unknown.
+func (s *Session) GetExpiresAt() int64 { return s.ExpiresAt }
+
+// GetFailureScore returns the decayed failure score of the session.
+func (s *Session) GetFailureScore() float64 { return s.FailureScore }
+
+// GetFailures returns the number of consecutive failed checks of the session.
+func (s *Session) GetFailures() int64 { return s.Failures }
+
+// GetCheckHistory returns a copy of the last check results of the session,
+// oldest first.
+func (s *Session) GetCheckHistory() []CheckResult {
+	return append([]CheckResult(nil), s.CheckHistory...)
+}
+
+// GetLatency returns the smoothed response latency of the session.
+func (s *Session) GetLatency() time.Duration { return s.Latency }
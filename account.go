@@ -0,0 +1,42 @@
+package amazonsession
+
+import (
+	"context"
+	"strings"
+)
+
+// authCookiePrefixes lists the prefixes of the cookies Amazon sets for a
+// signed-in customer (at-main, sess-at-main, sst-main, x-main, ...).
+var authCookiePrefixes = []string{"at-", "sess-at-", "sst-", "x-"}
+
+func isAuthCookie(name string) bool {
+	for _, prefix := range authCookiePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithAccountRef only selects sessions backed by the given account.
+func WithAccountRef(accountRef string) SelectOption {
+	return func(o *selectOptions) {
+		o.filter("account-ref", accountRef)
+	}
+}
+
+// ListAccountSessions lists the sessions of a country backed by the given
+// account.
+func (j *AmazonSession) ListAccountSessions(ctx context.Context, country, accountRef string) ([]*Session, error) {
+	sessions, err := j.ListCountrySession(ctx, country)
+	if err != nil {
+		return nil, err
+	}
+	accountSessions := make([]*Session, 0)
+	for _, session := range sessions {
+		if session.AccountRef == accountRef {
+			accountSessions = append(accountSessions, session)
+		}
+	}
+	return accountSessions, nil
+}
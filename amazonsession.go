@@ -5,17 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/publicsuffix"
 
 	"github.com/redis/go-redis/v9"
-	"github.com/spf13/cast"
 )
 
 func sessionIdsKey(country string) string {
@@ -38,6 +37,59 @@ func usageCountKey(sessionID string) string {
 	return fmt.Sprintf("%s:usage-count", sessionID)
 }
 
+// countryKeySuffixes lists the suffixes of the per-country keys holding the
+// sessions of a country and their indexes, as "<country>:<suffix>".
+var countryKeySuffixes = []string{"session-ids", "cookies", "affinity", "labels", "generations", "tiers", "canary-ids", "rr-cursor", "breaker", "borrows", "borrow-totals", "borrowers", "budget", "pins", "quarantine", "by-last-checked", "by-usage", "session-ids:shards"}
+
+// countryStateKeySuffixes lists the suffixes of the per-country keys holding
+// the configuration and state set by operators: borrow limits, drains,
+// freezes and maintenance windows. FlushCountry keeps them, so flushing a
+// pool during an incident does not unfreeze it.
+var countryStateKeySuffixes = []string{"borrow-limits", "drain", "frozen", "maintenance"}
+
+// countryIndexes lists the secondary indexes of a country. Each index is a
+// registry set "<country>:<registry>" naming the index sets stored as
+// "<country>:<prefix>:<member>".
+var countryIndexes = []struct{ registry, prefix string }{
+	{"labels", "label"},
+	{"generations", "generation"},
+	{"tiers", "tier"},
+}
+
+// countryIndexArgs returns the registry keys and index prefixes of a country
+// as pairs, in the form expected by the Lua scripts.
+func countryIndexArgs(country string) []interface{} {
+	args := make([]interface{}, 0, 2*len(countryIndexes))
+	for _, index := range countryIndexes {
+		args = append(args, fmt.Sprintf("%s:%s", country, index.registry), fmt.Sprintf("%s:%s:", country, index.prefix))
+	}
+	return args
+}
+
+func countryKeys(country string) []string {
+	keys := make([]string, len(countryKeySuffixes))
+	for i, suffix := range countryKeySuffixes {
+		keys[i] = fmt.Sprintf("%s:%s", country, suffix)
+	}
+	return keys
+}
+
+func countryStateKeys(country string) []string {
+	keys := make([]string, len(countryStateKeySuffixes))
+	for i, suffix := range countryStateKeySuffixes {
+		keys[i] = fmt.Sprintf("%s:%s", country, suffix)
+	}
+	return keys
+}
+
+func sessionFieldKey(sessionID, field string) string {
+	return fmt.Sprintf("%s:%s", sessionID, field)
+}
+
+func affinitiesKey(country string) string {
+	return fmt.Sprintf("%s:affinity", country)
+}
+
 // defaultCountryCodeDomainMap defines the default Amazon domains for various countries.
 var defaultCountryCodeDomainMap = map[string]string{
 	"BR": "https://www.amazon.com.br",
@@ -64,7 +116,47 @@ var defaultCountryCodeDomainMap = map[string]string{
 
 // AmazonSession is a struct responsible for managing cookies and sessions using Redis.
 type AmazonSession struct {
-	client redis.UniversalClient
+	client   redis.UniversalClient
+	replicas []redis.UniversalClient
+	groups   map[string][]string
+	clock    Clock
+
+	opTimeout     time.Duration
+	scriptTimeout time.Duration
+
+	fillMissingCookies bool
+	eagerCookieJar     bool
+	defaultDecodeMode  DecodeMode
+	missingSessionMode MissingSessionMode
+	experimentBuckets  []string
+	tierPreference     []string
+	maxAge             time.Duration
+	usageWindow        time.Duration
+	checkHistorySize   int
+	storeRawSetCookies bool
+	disableUnlink      bool
+	proxyExitCountry   func(ctx context.Context, proxy string) (string, error)
+	onProxyGeoMismatch func(session *Session, exitCountry string)
+	hooks              Hooks
+	webhook            *webhookDispatcher
+	selector           Selector
+	failureHalfLife    time.Duration
+	circuitBreaker     *CircuitBreakerConfig
+	timestampFormat    TimestampFormat
+	sessionIDExtractor func(cookies []*http.Cookie) (string, error)
+	cookieValidation   ValidationMode
+	crossCountryPush   CrossCountryMode
+	probeLimiter       *probeLimiter
+	httpDoer           HTTPDoer
+	requestBudget      int64
+	countryBudgets     map[string]int64
+	rotationPolicy     *RotationPolicy
+	sessionProvider    SessionProvider
+	captchaSolver      CaptchaSolver
+	idempotencyWindow  time.Duration
+	instanceName       string
+	runRetention       time.Duration
+	countryOverrides   map[string]CountryOverride
 }
 
 // Config holds configuration options for creating a RedisCookieJar instance.
@@ -77,38 +169,702 @@ type Config struct {
 
 	// Password is the optional password for authenticating with the Redis server.
 	Password string
+
+	// ReplicaAddrs are the addresses of read replicas of the Redis server.
+	// Read-only methods use them when called with a context from
+	// WithReadPreference(ctx, ReadReplica).
+	ReplicaAddrs []string
+
+	// DialTimeout is the timeout for establishing new connections.
+	// Defaults to 500ms.
+	DialTimeout time.Duration
+
+	// ReadTimeout is the timeout for socket reads. Defaults to 5s.
+	ReadTimeout time.Duration
+
+	// WriteTimeout is the timeout for socket writes. Defaults to 500ms.
+	WriteTimeout time.Duration
+
+	// MaxConcurrentOps limits the number of Redis commands in flight from
+	// this process. Callers over the limit wait for a free slot within their
+	// operation deadline (OpTimeout, ScriptTimeout or WithOpTimeout). Zero
+	// means no limit.
+	MaxConcurrentOps int
+
+	// RedisHooks are added to the Redis clients of the primary and of the
+	// replicas, after the MaxConcurrentOps limiter, e.g. for tracing or to
+	// inject failures in tests with the chaos package.
+	RedisHooks []redis.Hook
+
+	// SessionIDExtractor, when set, extracts the session-id from the cookies
+	// (and cookie jar) of pushed sessions, for harvesting pipelines that
+	// rename or wrap the session-id cookie. The extracted id is stored as
+	// the session-id cookie.
+	SessionIDExtractor func(cookies []*http.Cookie) (string, error)
+
+	// CookieValidation checks the structure of pushed cookies (session-id
+	// and ubid format, i18n-prefs currency, cookie domains). ValidationStrict
+	// rejects malformed sessions, ValidationReport stores them and reports
+	// the problems to Hooks.OnInvalidCookies. Defaults to ValidationOff.
+	CookieValidation ValidationMode
+
+	// CrossCountryPush selects how PushSession handles a session-id already
+	// stored under another country: CrossCountryAllow (the default) keeps
+	// both and records them in the session index, CrossCountryReject
+	// refuses the push and CrossCountryMerge moves the session.
+	CrossCountryPush CrossCountryMode
+
+	// ProbeRPS limits the requests per second the package sends to each
+	// Amazon marketplace (e.g. SetDeliveryLocation), shared by all callers
+	// of this AmazonSession, so bulk operations don't look like an attack.
+	// Zero means no limit.
+	ProbeRPS float64
+
+	// ProbeRPSPerCountry overrides ProbeRPS for individual marketplaces.
+	ProbeRPSPerCountry map[string]float64
+
+	// RequestBudget limits the checkouts (GetSession, GetRandomSession,
+	// PopSession, ...) per hour of each marketplace, across all processes
+	// sharing the Redis server. Checkouts beyond it fail with a
+	// *BudgetExhaustedError until the next full hour. Zero means no limit.
+	RequestBudget int64
+
+	// RequestBudgetPerCountry overrides RequestBudget for individual
+	// marketplaces.
+	RequestBudgetPerCountry map[string]int64
+
+	// CountryOverrides overrides the cleanup thresholds, circuit breaker
+	// cooldown, quotas and minimum pool size for individual marketplaces,
+	// e.g. for pools of very different sizes, see CountryOverride. Its
+	// quotas take precedence over RequestBudgetPerCountry and
+	// ProbeRPSPerCountry.
+	CountryOverrides map[string]CountryOverride
+
+	// HTTPDoer sends the requests to Amazon (e.g. SetDeliveryLocation), for
+	// injecting proxies, retries or a custom TLS stack. Defaults to an
+	// *http.Client with a 30 second timeout.
+	HTTPDoer HTTPDoer
+
+	// CountryGroups defines additional named groups of countries (e.g. "EU")
+	// that can be used with GetRandomSessionFromGroup. Groups defined here
+	// override the built-in groups of the same name.
+	CountryGroups map[string][]string
+
+	// FillMissingCookies synthesizes the session-id-time, i18n-prefs and ubid
+	// cookies for the target marketplace when a pushed session lacks them.
+	FillMissingCookies bool
+
+	// EagerCookieJar builds the cookie jar of every session returned by
+	// GetAllSessions and ListSession. By default list results leave Jar nil
+	// and it is built on demand by Session.CookieJar.
+	EagerCookieJar bool
+
+	// DecodeMode selects how stored sessions that cannot be decoded (e.g.
+	// corrupted JSON) are handled by the listings. Defaults to DecodeSkip;
+	// WithDecodeMode overrides it per call.
+	DecodeMode DecodeMode
+
+	// MissingSession selects how GetSession handles a session that was
+	// deleted meanwhile: MissingSessionError (the default) returns
+	// ErrSessionNotFound and MissingSessionFallback returns another session
+	// of the same country.
+	MissingSession MissingSessionMode
+
+	// SchemaMigration selects how NewAmazonSession handles pools written by
+	// older versions of the package: SchemaMigrationManual (the default)
+	// uses them as they are, SchemaMigrationAuto upgrades them with
+	// MigrateSchema and SchemaMigrationRefuse fails with ErrSchemaOutdated.
+	// Pools written by newer versions always fail with ErrSchemaTooNew.
+	SchemaMigration SchemaMigrationMode
+
+	// OpTimeout is the deadline applied to single-key operations such as
+	// GetSession or PushSession. Zero means only the client timeouts apply.
+	OpTimeout time.Duration
+
+	// DisableUnlink deletes keys with DEL instead of UNLINK in
+	// ClearAllCookies, FlushCountry and PurgeGeneration, for Redis servers
+	// older than 4.0. UNLINK frees the memory of large keys in the
+	// background instead of blocking Redis.
+	DisableUnlink bool
+
+	// ScriptTimeout is the deadline applied to the long-running scripts that
+	// scan whole pools (CleanupSessions, ListSession, GetAllSessions, ...).
+	// The client read timeout is raised to match it. Zero means only the
+	// client timeouts apply.
+	ScriptTimeout time.Duration
+
+	// Clock is the time source used for timestamps, cleanup thresholds and
+	// cookie expirations. It defaults to the system clock.
+	Clock Clock
+
+	// ExperimentBuckets names the A/B experiment buckets. When set, pushed
+	// sessions without a Bucket are assigned one by hashing their session-id,
+	// and WithBucket selects sessions of a single bucket.
+	ExperimentBuckets []string
+
+	// TierPreference lists the priority tiers of sessions (Session.Tier) in
+	// the order GetRandomSession prefers them, e.g. {"premium", "standard"}.
+	// Sessions of other tiers are selected last.
+	TierPreference []string
+
+	// StoreRawSetCookies persists Session.RawSetCookies, the raw Set-Cookie
+	// header values received from Amazon, next to the parsed cookies. Stored
+	// headers are rehydrated on read and take precedence over the parsed
+	// cookies of the same name, keeping their attributes and encoding.
+	StoreRawSetCookies bool
+
+	// ProxyExitCountry resolves the exit country of a proxy URL. When set, the
+	// proxy of a session is checked against the marketplace country whenever
+	// it is bound with PushSession or BindProxy, and mismatches are refused.
+	ProxyExitCountry func(ctx context.Context, proxy string) (string, error)
+
+	// OnProxyGeoMismatch, when set, is called on proxy/marketplace country
+	// mismatches instead of refusing them, and the proxy is bound anyway.
+	OnProxyGeoMismatch func(session *Session, exitCountry string)
+
+	// Hooks are optional lifecycle callbacks invoked in-process.
+	Hooks Hooks
+
+	// Webhook, when set, POSTs pool event notifications to HTTP endpoints.
+	Webhook *WebhookConfig
+
+	// Selector is the strategy used by SelectSession to pick sessions, e.g.
+	// RoundRobinSelector(). Defaults to RandomSelector().
+	Selector Selector
+
+	// CheckHistorySize is the number of check results kept per session by
+	// RecordCheck. Defaults to 10.
+	CheckHistorySize int
+
+	// FailureHalfLife is the half-life of the failure score recorded by
+	// RecordFailure, so sessions that failed in the past gradually regain
+	// weight with ScoreWeightedSelector. Defaults to 24h.
+	FailureHalfLife time.Duration
+
+	// CircuitBreaker, when set, trips a per-country breaker when failures
+	// recorded with RecordFailure spike, so GetSession and PopSession
+	// return ErrCountryTripped instead of burning through the pool.
+	CircuitBreaker *CircuitBreakerConfig
+
+	// RotationPolicy, when set, is checked for the sessions returned by
+	// GetRandomSession and SelectSession. Sessions due for rotation are
+	// deleted and replaced with a session from SessionProvider.
+	RotationPolicy *RotationPolicy
+
+	// SessionProvider creates the sessions replacing the ones rotated by
+	// RotationPolicy. Without it, another stored session is selected.
+	SessionProvider SessionProvider
+
+	// IdempotencyWindow is how long the idempotency keys of pushes are
+	// remembered, see PushOptions.IdempotencyKey. Defaults to 24 hours.
+	IdempotencyWindow time.Duration
+
+	// InstanceName identifies the process in the sweep runs it records, see
+	// LastRuns. Defaults to the host name and process id.
+	InstanceName string
+
+	// RunHistoryRetention is how long sweep runs are kept, see LastRuns.
+	// Defaults to 7 days.
+	RunHistoryRetention time.Duration
+
+	// CaptchaSolver solves the captchas handed to HandleCaptcha, so sessions
+	// are restored to the pool instead of deleted.
+	CaptchaSolver CaptchaSolver
+
+	// TimestampFormat is the format the created-at and last-checked
+	// timestamps are stored in. Both formats are read regardless of this
+	// setting, so it can be changed on an existing pool. Defaults to
+	// TimestampUnix.
+	TimestampFormat TimestampFormat
+
+	// UsageWindow, when set, makes the usageCountThreshold of CleanupSessions
+	// apply to the uses within the last UsageWindow, at most 24 hours,
+	// instead of the lifetime usage count.
+	UsageWindow time.Duration
+
+	// MaxAge is the maximum age of a session since its creation. Older
+	// sessions are removed by CleanupSessions, and Session.ExpiresAt accounts
+	// for it. Zero means sessions don't expire by age.
+	MaxAge time.Duration
 }
 
+// Session is a snapshot of a stored session. Read it with the Get*
+// accessors, which return copies of its maps and slices; Jar is a cookie jar
+// built from the cookies, nil until CookieJar is called unless
+// Config.EagerCookieJar is set. Create sessions with NewSession or
+// NewSessionBuilder, change the cookies with SetCookie and DeleteCookie so
+// the cookie jar stays in sync, change the metadata on a copy from Builder,
+// and persist the changes with PushSession or PushSessionIfDirty. Sessions
+// returned by AmazonSession are owned by the caller. The methods of Session
+// are safe for concurrent use.
+//
+// The exported fields are deprecated and kept so existing code compiles;
+// direct field access is not safe for concurrent use.
 type Session struct {
-	Jar           *cookiejar.Jar // Jar stores the cookies in a cookie jar
-	Cookies       []*http.Cookie // Cookies is a slice of HTTP cookies
-	Country       string         // Country represents the country code for the session
-	SessionID     string         // SessionID is the unique identifier for the session
-	UsageCount    int64          // UsageCount tracks how many times the session has been used
-	LastCheckedAt int64          // LastCheckedAt stores the last time the session was checked, in Unix time
-	CreatedAt     int64          // CreatedAt stores the creation time of the session, in Unix time
+	// Jar stores the cookies in a cookie jar.
+	//
+	// Deprecated: use CookieJar.
+	Jar *cookiejar.Jar
+
+	// Cookies is a slice of HTTP cookies.
+	//
+	// Deprecated: use GetCookies.
+	Cookies []*http.Cookie
+
+	// Country represents the country code for the session.
+	//
+	// Deprecated: use GetCountry.
+	Country string
+
+	// SessionID is the unique identifier for the session.
+	//
+	// Deprecated: use GetSessionID.
+	SessionID string
+
+	// UsageCount tracks how many times the session has been used.
+	//
+	// Deprecated: use GetUsageCount.
+	UsageCount int64
+
+	// UsageLastHour is the number of uses within the last hour, at a 10 minute
+	// granularity.
+	//
+	// Deprecated: use GetUsageLastHour.
+	UsageLastHour int64
+
+	// UsageLastDay is the number of uses within the last 24 hours, at a 10
+	// minute granularity.
+	//
+	// Deprecated: use GetUsageLastDay.
+	UsageLastDay int64
+
+	// LastChecked stores the last time the session was checked.
+	//
+	// Deprecated: use GetLastChecked.
+	LastChecked time.Time
+
+	// CreatedAt stores the creation time of the session.
+	//
+	// Deprecated: use GetCreatedAt.
+	CreatedAt time.Time
+
+	// PostalCode is the delivery location (zip/postal code) set for the session.
+	//
+	// Deprecated: use GetPostalCode.
+	PostalCode string
+
+	// Currency is the preferred currency of the session (i18n-prefs cookie).
+	//
+	// Deprecated: use GetCurrency.
+	Currency string
+
+	// Language is the preferred language of the session (lc-* cookie).
+	//
+	// Deprecated: use GetLanguage.
+	Language string
+
+	// AccountRef is an opaque reference to the account backing a logged-in
+	// session, empty for anonymous sessions.
+	//
+	// Deprecated: use GetAccountRef.
+	AccountRef string
+
+	// Labels are indexed key/value pairs (e.g. proxy-pool=residential-us) used
+	// to query slices of the pool.
+	//
+	// Deprecated: use GetLabels.
+	Labels map[string]string
+
+	// Generation names the import batch the session was harvested in, see
+	// PurgeGeneration.
+	//
+	// Deprecated: use GetGeneration.
+	Generation string
+
+	// Canary sessions are kept out of the main pool and only selected by
+	// GetCanarySession.
+	//
+	// Deprecated: use IsCanary.
+	Canary bool
+
+	// Residency is the origin network type of the session, e.g. "residential" or
+	// "datacenter".
+	//
+	// Deprecated: use GetResidency.
+	Residency string
+
+	// ASN is the autonomous system number of the exit IP the session was created
+	// from.
+	//
+	// Deprecated: use GetASN.
+	ASN string
+
+	// ExitIPHash is the hash of the exit IP the session was created from, see
+	// HashExitIP.
+	//
+	// Deprecated: use GetExitIPHash.
+	ExitIPHash string
+
+	// Proxy is the URL of the proxy bound to the session, see BindProxy.
+	//
+	// Deprecated: use GetProxy.
+	Proxy string
+
+	// TLSProfile identifies the TLS/JA3 fingerprint profile the session was
+	// created under (e.g. chrome_120).
+	//
+	// Deprecated: use GetTLSProfile.
+	TLSProfile string
+
+	// Bucket is the A/B experiment bucket of the session, see
+	// Config.ExperimentBuckets.
+	//
+	// Deprecated: use GetBucket.
+	Bucket string
+
+	// Tier is the priority tier of the session within its country pool (e.g.
+	// premium), see Config.TierPreference.
+	//
+	// Deprecated: use GetTier.
+	Tier string
+
+	// RawSetCookies are the raw Set-Cookie header values of the session, stored
+	// when Config.StoreRawSetCookies is set.
+	//
+	// Deprecated: use GetRawSetCookies.
+	RawSetCookies []string
+
+	// ExpiresAt is the earliest of CreatedAt plus Config.MaxAge and the session-
+	// id-time cookie, in Unix time; zero when unknown.
+	//
+	// Deprecated: use GetExpiresAt.
+	ExpiresAt int64
+
+	// FailureScore is the failure score of the session decayed to the time it
+	// was loaded, see Config.FailureHalfLife.
+	//
+	// Deprecated: use GetFailureScore.
+	FailureScore float64
+
+	// Failures counts the consecutive failed checks of the session, see
+	// RecordFailure and TouchSession.
+	//
+	// Deprecated: use GetFailures.
+	Failures int64
+
+	// CheckHistory holds the last check results of the session, oldest first,
+	// see RecordCheck.
+	//
+	// Deprecated: use GetCheckHistory.
+	CheckHistory []CheckResult
+
+	// Latency is the smoothed response latency of the session, zero when none
+	// was recorded, see RecordLatency.
+	//
+	// Deprecated: use GetLatency.
+	Latency time.Duration
+
+	failureScoredAt int64  // failureScoredAt is the time FailureScore was last updated, in Unix time
+	usageWindow     string // usageWindow is the stored usage window, see usageWithin
+
+	mu    sync.Mutex // mu guards the cookies and the cookie jar
+	dirty bool       // dirty is set when the cookies were changed since the session was loaded or pushed
+}
+
+// Default client timeouts used when they are not set in Config.
+const (
+	defaultDialTimeout  = time.Duration(500) * time.Millisecond
+	defaultReadTimeout  = time.Duration(5000) * time.Millisecond
+	defaultWriteTimeout = time.Duration(500) * time.Millisecond
+)
+
+// defaultFailureHalfLife is the half-life of failure scores used when it is
+// not set in Config.
+const defaultFailureHalfLife = 24 * time.Hour
+
+// validate checks the Config and fills unset values with their defaults.
+func (cfg *Config) validate() error {
+	if cfg.Addr == "" {
+		return errors.New("invalid config: redis address is required")
+	}
+	if cfg.Db < 0 {
+		return fmt.Errorf("invalid config: redis database number must not be negative: %d", cfg.Db)
+	}
+	if cfg.DialTimeout < 0 || cfg.ReadTimeout < 0 || cfg.WriteTimeout < 0 {
+		return errors.New("invalid config: timeouts must not be negative")
+	}
+	tiers := make(map[string]bool, len(cfg.TierPreference))
+	for _, tier := range cfg.TierPreference {
+		if tier == "" || strings.Contains(tier, ",") || tiers[tier] {
+			return fmt.Errorf("invalid config: tiers must be unique, not empty and without commas: %q", tier)
+		}
+		tiers[tier] = true
+	}
+	if cfg.UsageWindow < 0 || cfg.UsageWindow > usageWindowMax {
+		return fmt.Errorf("invalid config: usage window must be between 0 and %v", usageWindowMax)
+	}
+	if cfg.RequestBudget < 0 {
+		return errors.New("invalid config: request budget must not be negative")
+	}
+	for country, budget := range cfg.RequestBudgetPerCountry {
+		if budget < 0 {
+			return fmt.Errorf("invalid config: request budget must not be negative for country: %s", country)
+		}
+	}
+	if err := cfg.validateCountryOverrides(); err != nil {
+		return err
+	}
+	if cfg.ProbeRPS < 0 {
+		return errors.New("invalid config: probe rate must not be negative")
+	}
+	for country, rate := range cfg.ProbeRPSPerCountry {
+		if rate < 0 {
+			return fmt.Errorf("invalid config: probe rate must not be negative for country: %s", country)
+		}
+	}
+	if p := cfg.RotationPolicy; p != nil && (p.MaxRequests < 0 || p.MaxAge < 0 || p.Schedule < 0) {
+		return errors.New("invalid config: rotation policy limits must not be negative")
+	}
+	if cfg.MaxConcurrentOps < 0 {
+		return fmt.Errorf("invalid config: max concurrent operations must not be negative: %d", cfg.MaxConcurrentOps)
+	}
+	if cfg.IdempotencyWindow < 0 {
+		return errors.New("invalid config: idempotency window must not be negative")
+	}
+	if cfg.IdempotencyWindow == 0 {
+		cfg.IdempotencyWindow = defaultIdempotencyWindow
+	}
+	if cfg.RunHistoryRetention < 0 {
+		return errors.New("invalid config: run history retention must not be negative")
+	}
+	if cfg.RunHistoryRetention == 0 {
+		cfg.RunHistoryRetention = defaultRunHistoryRetention
+	}
+	if cfg.InstanceName == "" {
+		cfg.InstanceName = defaultInstanceName()
+	}
+	if cfg.CheckHistorySize < 0 {
+		return fmt.Errorf("invalid config: check history size must not be negative: %d", cfg.CheckHistorySize)
+	}
+	if cfg.CheckHistorySize == 0 {
+		cfg.CheckHistorySize = defaultCheckHistorySize
+	}
+	if cfg.FailureHalfLife < 0 {
+		return errors.New("invalid config: failure half-life must not be negative")
+	}
+	if cfg.FailureHalfLife == 0 {
+		cfg.FailureHalfLife = defaultFailureHalfLife
+	}
+	if cfg.CookieValidation < ValidationOff || cfg.CookieValidation > ValidationStrict {
+		return fmt.Errorf("invalid config: unknown cookie validation mode: %d", cfg.CookieValidation)
+	}
+	if cfg.DecodeMode < DecodeSkip || cfg.DecodeMode > DecodeRepair {
+		return fmt.Errorf("invalid config: unknown decode mode: %d", cfg.DecodeMode)
+	}
+	if cfg.MissingSession < MissingSessionError || cfg.MissingSession > MissingSessionFallback {
+		return fmt.Errorf("invalid config: unknown missing session mode: %d", cfg.MissingSession)
+	}
+	if cfg.SchemaMigration < SchemaMigrationManual || cfg.SchemaMigration > SchemaMigrationRefuse {
+		return fmt.Errorf("invalid config: unknown schema migration mode: %d", cfg.SchemaMigration)
+	}
+	if cfg.CrossCountryPush < CrossCountryAllow || cfg.CrossCountryPush > CrossCountryMerge {
+		return fmt.Errorf("invalid config: unknown cross-country push mode: %d", cfg.CrossCountryPush)
+	}
+	if cfg.TimestampFormat != TimestampUnix && cfg.TimestampFormat != TimestampRFC3339 {
+		return fmt.Errorf("invalid config: unknown timestamp format: %d", cfg.TimestampFormat)
+	}
+	if cfg.MaxAge < 0 {
+		return errors.New("invalid config: max age must not be negative")
+	}
+	if cfg.OpTimeout < 0 || cfg.ScriptTimeout < 0 {
+		return errors.New("invalid config: operation timeouts must not be negative")
+	}
+	seen := make(map[string]bool, len(cfg.ExperimentBuckets))
+	for _, bucket := range cfg.ExperimentBuckets {
+		if bucket == "" || seen[bucket] {
+			return fmt.Errorf("invalid config: experiment buckets must be unique and not empty: %q", bucket)
+		}
+		seen[bucket] = true
+	}
+	if cfg.CircuitBreaker != nil {
+		breaker := *cfg.CircuitBreaker
+		if err := breaker.validate(); err != nil {
+			return err
+		}
+		cfg.CircuitBreaker = &breaker
+	}
+	if cfg.Webhook != nil {
+		// Work on a copy so the defaults don't leak into the caller's config.
+		webhook := *cfg.Webhook
+		if err := webhook.validate(); err != nil {
+			return err
+		}
+		cfg.Webhook = &webhook
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = defaultReadTimeout
+	}
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = defaultWriteTimeout
+	}
+	return nil
 }
 
 func NewAmazonSession(cfg *Config) (*AmazonSession, error) {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:         cfg.Addr,
-		Password:     cfg.Password,
-		DB:           cfg.Db,
-		DialTimeout:  time.Duration(500) * time.Millisecond,
-		WriteTimeout: time.Duration(500) * time.Millisecond,
-		ReadTimeout:  time.Duration(5000) * time.Millisecond,
-	})
-	if err := rdb.Ping(context.Background()).Err(); err != nil {
-		return nil, fmt.Errorf("failed opening connection to redis: %v", err)
+	if cfg == nil {
+		return nil, errors.New("invalid config: config is required")
+	}
+	// Work on a copy so the defaults don't leak into the caller's Config.
+	c := *cfg
+	cfg = &c
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	readTimeout := cfg.ReadTimeout
+	if cfg.ScriptTimeout > readTimeout {
+		readTimeout = cfg.ScriptTimeout
+	}
+	var limiter *concurrencyLimiter
+	if cfg.MaxConcurrentOps > 0 {
+		limiter = newConcurrencyLimiter(cfg.MaxConcurrentOps)
+	}
+	newClient := func(addr string) (*redis.Client, error) {
+		rdb := redis.NewClient(&redis.Options{
+			Addr:                  addr,
+			Password:              cfg.Password,
+			DB:                    cfg.Db,
+			DialTimeout:           cfg.DialTimeout,
+			WriteTimeout:          cfg.WriteTimeout,
+			ReadTimeout:           readTimeout,
+			ContextTimeoutEnabled: true,
+		})
+		if limiter != nil {
+			rdb.AddHook(limiter)
+		}
+		for _, hook := range cfg.RedisHooks {
+			rdb.AddHook(hook)
+		}
+		if err := rdb.Ping(context.Background()).Err(); err != nil {
+			return nil, fmt.Errorf("failed opening connection to redis %s: %v", addr, err)
+		}
+		return rdb, nil
+	}
+	rdb, err := newClient(cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	replicas := make([]redis.UniversalClient, 0, len(cfg.ReplicaAddrs))
+	for _, addr := range cfg.ReplicaAddrs {
+		replica, err := newClient(addr)
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, replica)
+	}
+	groups := make(map[string][]string, len(defaultCountryGroups)+len(cfg.CountryGroups))
+	for name, countries := range defaultCountryGroups {
+		groups[name] = countries
 	}
-	return &AmazonSession{
-		client: rdb,
-	}, nil
+	for name, countries := range cfg.CountryGroups {
+		normalized := make([]string, len(countries))
+		for i, country := range countries {
+			normalized[i] = normalizeCountry(country)
+		}
+		groups[name] = normalized
+	}
+	clock := cfg.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	j := &AmazonSession{
+		client:             rdb,
+		replicas:           replicas,
+		groups:             groups,
+		clock:              clock,
+		opTimeout:          cfg.OpTimeout,
+		scriptTimeout:      cfg.ScriptTimeout,
+		fillMissingCookies: cfg.FillMissingCookies,
+		eagerCookieJar:     cfg.EagerCookieJar,
+		defaultDecodeMode:  cfg.DecodeMode,
+		missingSessionMode: cfg.MissingSession,
+		experimentBuckets:  cfg.ExperimentBuckets,
+		tierPreference:     cfg.TierPreference,
+		maxAge:             cfg.MaxAge,
+		usageWindow:        cfg.UsageWindow,
+		checkHistorySize:   cfg.CheckHistorySize,
+		storeRawSetCookies: cfg.StoreRawSetCookies,
+		disableUnlink:      cfg.DisableUnlink,
+		proxyExitCountry:   cfg.ProxyExitCountry,
+		onProxyGeoMismatch: cfg.OnProxyGeoMismatch,
+		hooks:              cfg.Hooks,
+		webhook:            newWebhookDispatcher(cfg.Webhook, clock),
+		failureHalfLife:    cfg.FailureHalfLife,
+		circuitBreaker:     cfg.CircuitBreaker,
+		rotationPolicy:     cfg.RotationPolicy,
+		sessionProvider:    cfg.SessionProvider,
+		captchaSolver:      cfg.CaptchaSolver,
+		idempotencyWindow:  cfg.IdempotencyWindow,
+		instanceName:       cfg.InstanceName,
+		runRetention:       cfg.RunHistoryRetention,
+		countryOverrides:   cfg.CountryOverrides,
+		timestampFormat:    cfg.TimestampFormat,
+		sessionIDExtractor: cfg.SessionIDExtractor,
+		cookieValidation:   cfg.CookieValidation,
+		crossCountryPush:   cfg.CrossCountryPush,
+		probeLimiter:       newProbeLimiter(cfg.ProbeRPS, cfg.ProbeRPSPerCountry),
+		httpDoer:           cfg.HTTPDoer,
+		requestBudget:      cfg.RequestBudget,
+	}
+	j.countryBudgets = make(map[string]int64, len(cfg.RequestBudgetPerCountry))
+	for country, budget := range cfg.RequestBudgetPerCountry {
+		j.countryBudgets[normalizeCountry(country)] = budget
+	}
+	j.selector = j.bindSelector(cfg.Selector)
+	if err := j.checkSchema(context.Background(), cfg.SchemaMigration); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *AmazonSession) GetRandomSession(ctx context.Context, country string, opts ...SelectOption) (*Session, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.checkout(ctx, country, func() (*Session, error) {
+		return j.getRandomSession(ctx, country, opts)
+	})
 }
 
-func (j *AmazonSession) GetRandomSession(ctx context.Context, country string) (*Session, error) {
+func (j *AmazonSession) getRandomSession(ctx context.Context, country string, opts []SelectOption) (*Session, error) {
+	o := newSelectOptions(opts)
+	if o.tiers == nil {
+		o.tiers = j.tierPreference
+	}
+	if len(o.filters) > 0 {
+		sessionID, err := j.getFilteredSessionID(ctx, country, o)
+		if err != nil {
+			return nil, err
+		}
+		return j.GetSession(ctx, country, sessionID)
+	}
+	if len(o.tiers) > 0 {
+		// Sessions of unlisted tiers rank last: the random pick below only
+		// finds them once the listed tiers have no session in the pool.
+		sessionID, err := j.getTierSessionID(ctx, country, o.tiers)
+		if err != nil {
+			return nil, err
+		}
+		if sessionID != "" {
+			return j.GetSession(ctx, country, sessionID)
+		}
+	}
+
 	// Get the total count of session-ids.
-	count, err := j.client.LLen(ctx, sessionIdsKey(country)).Result()
+	count, err := poolSize(ctx, j.client, country)
 	if err != nil {
 		return nil, err
 	}
@@ -117,38 +873,319 @@ func (j *AmazonSession) GetRandomSession(ctx context.Context, country string) (*
 		return nil, errors.New("no sessions available for the specified country")
 	}
 
-	// Generate a random index.
-	randIndex := rand.Int63n(count)
-
-	// Get the session-id at the random index.
-	sessionID, err := j.client.LIndex(ctx, sessionIdsKey(country), randIndex).Result()
+	// Pick a random session-id, skipping sessions expired by Amazon.
+	keys := []string{sessionIdsKey(country), cookiesKey(country)}
+	res, err := getRandomSessionCmd.Run(ctx, j.client, keys, scriptRand(), j.clock.Now().Unix()).Result()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("redis eval error: %v", err)
+	}
+	sessionID, err := replyString(res)
+	if err != nil {
+		return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
 	}
 
 	return j.GetSession(ctx, country, sessionID)
 }
 
+// GetSessionFor returns the session bound to the given affinity key (an ASIN,
+// seller ID, search term, ...). The same session is returned for the key as
+// long as it stays in the pool; once it is popped, pinned, expired by Amazon
+// or removed, a new random session is bound.
+func (j *AmazonSession) GetSessionFor(ctx context.Context, country, affinityKey string) (*Session, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	if _, err := j.getCountryURL(country); err != nil {
+		return nil, err
+	}
+	return j.checkout(ctx, country, func() (*Session, error) {
+		keys := []string{sessionIdsKey(country), cookiesKey(country), affinitiesKey(country), borrowersKey(country), pinsKey(country)}
+		res, err := getAffinitySessionCmd.Run(ctx, j.client, keys, affinityKey, scriptRand(), j.clock.Now().Unix()).Result()
+		if err != nil {
+			return nil, fmt.Errorf("redis eval error: %v", err)
+		}
+
+		sessionID, err := replyString(res)
+		if err != nil {
+			return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+		}
+
+		return j.GetSession(ctx, country, sessionID)
+	})
+}
+
+// PopSession takes a session out of the pool of a country until it is
+// returned, pushed or deleted. Sessions expired by Amazon are skipped and
+// left in the pool for CleanupSessions.
 func (j *AmazonSession) PopSession(ctx context.Context, country string) (*Session, error) {
-	// Pop a session-id from Redis and remove it from the list.
-	key := sessionIdsKey(country)
-	sessionID, err := j.client.LPop(ctx, key).Result()
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	if err := j.breakerAllow(ctx, country, true); err != nil {
+		return nil, err
+	}
+	if err := j.budgetAllow(ctx, country, true); err != nil {
+		return nil, err
+	}
+	return j.checkout(ctx, country, func() (*Session, error) {
+		// Pop the session-id and record the borrow atomically.
+		_, sessionID, err := j.borrowSession(ctx, []string{country}, callerFromContext(ctx))
+		if err != nil {
+			if strings.Contains(err.Error(), "NOT FOUND") {
+				return nil, redis.Nil
+			}
+			return nil, err
+		}
+		j.checkPoolLow(ctx, country)
+		return j.getSession(ctx, country, sessionID)
+	})
+}
+
+// ReturnSession puts a session taken with PopSession back into the pool. Only
+// the session-id is re-added: the stored cookies, usage count and timestamps
+// are kept as they are. Use PushSession to also store updated cookies.
+func (j *AmazonSession) ReturnSession(ctx context.Context, session *Session) error {
+	country := normalizeCountry(session.Country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	if session.SessionID == "" {
+		return fmt.Errorf("session-id not found in session")
+	}
+	keys := []string{sessionIdsKey(country), cookiesKey(country), canaryIdsKey(country)}
+	if err := returnSessionCmd.Run(ctx, j.client, keys, session.SessionID).Err(); err != nil {
+		return fmt.Errorf("redis eval error: %v", err)
+	}
+	return j.releaseBorrow(ctx, country, session.SessionID)
+}
+
+// PopSessionWithFallback pops a session from the primary country, or from the
+// first fallback country that still has sessions available. The countries are
+// tried in order within a single atomic script.
+func (j *AmazonSession) PopSessionWithFallback(ctx context.Context, primary string, fallbacks ...string) (*Session, error) {
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	var countries []string
+	var skipErr error
+	for _, country := range append([]string{primary}, fallbacks...) {
+		country = normalizeCountry(country)
+		if _, err := j.getCountryURL(country); err != nil {
+			return nil, err
+		}
+		// Frozen and draining countries, countries with a tripped breaker
+		// and countries with no budget left are skipped.
+		if err := j.checkoutGate(ctx, country); err == ErrDraining || err == ErrFrozen {
+			if skipErr == nil {
+				skipErr = err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err := j.breakerAllow(ctx, country, false); err == ErrCountryTripped {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err := j.budgetAllow(ctx, country, false); errors.Is(err, ErrBudgetExhausted) {
+			if skipErr == nil {
+				skipErr = err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		countries = append(countries, country)
+	}
+	if len(countries) == 0 {
+		if skipErr != nil {
+			return nil, skipErr
+		}
+		return nil, ErrCountryTripped
+	}
+
+	next := func() (*Session, error) {
+		index, sessionID, err := j.borrowSession(ctx, countries, callerFromContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		return j.takeFallbackSession(ctx, countries[index], sessionID)
+	}
+	session, err := next()
 	if err != nil {
 		return nil, err
 	}
-	return j.GetSession(ctx, country, sessionID)
+	return j.rotate(ctx, session, next)
+}
+
+// takeFallbackSession takes the request budget of a session popped by
+// PopSessionWithFallback and loads it. The budget was checked before the pop,
+// so concurrent checkouts may exceed it slightly.
+func (j *AmazonSession) takeFallbackSession(ctx context.Context, country, sessionID string) (*Session, error) {
+	if err := j.budgetAllow(ctx, country, true); err != nil && !errors.Is(err, ErrBudgetExhausted) {
+		return nil, err
+	}
+	return j.getSession(ctx, country, sessionID)
 }
 
 func (j *AmazonSession) PushSession(ctx context.Context, session *Session) error {
+	return j.PushSessionWithOptions(ctx, session, nil)
+}
+
+// PushOptions sets the initial counters and timestamps of a pushed session,
+// e.g. when importing sessions from another system. Zero values keep the
+// defaults: a usage count of zero and the current time.
+type PushOptions struct {
+	UsageCount  int64     // UsageCount is the initial usage count
+	LastChecked time.Time // LastChecked is the initial "last checked" timestamp
+	CreatedAt   time.Time // CreatedAt is the creation time
+
+	// IdempotencyKey identifies the push, e.g. by import batch and record,
+	// so a push retried after a network error is applied once. The key is
+	// claimed before the session is written, and released when the write
+	// fails. Pushes with a key already used for the same session within
+	// Config.IdempotencyWindow are skipped and return nil, pushes of another
+	// session with the key fail.
+	IdempotencyKey string
+}
+
+// PushSessionWithOptions is like PushSession but sets the counters and
+// timestamps given in opts. Values set in opts are written even when the
+// session already exists. opts may be nil.
+func (j *AmazonSession) PushSessionWithOptions(ctx context.Context, session *Session, opts *PushOptions) error {
+	problems, err := j.pushSession(ctx, session, opts)
+	if err == errIdempotentRetry {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 && j.hooks.OnInvalidCookies != nil {
+		j.hooks.OnInvalidCookies(ctx, session, problems)
+	}
+	if j.hooks.OnPush != nil {
+		j.hooks.OnPush(ctx, session)
+	}
+	return nil
+}
+
+// PushSessionIfDirty pushes the session only when its cookies were changed
+// since it was loaded or last pushed, and reports whether it was pushed.
+func (j *AmazonSession) PushSessionIfDirty(ctx context.Context, session *Session) (bool, error) {
+	if !session.Dirty() {
+		return false, nil
+	}
+	if err := j.PushSession(ctx, session); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// pushSession stores the session while holding its lock and clears its
+// dirty flag on success. In ValidationReport mode the cookie problems of
+// the stored session are returned. It returns errIdempotentRetry for a push
+// already applied, see PushOptions.IdempotencyKey.
+func (j *AmazonSession) pushSession(ctx context.Context, session *Session, opts *PushOptions) ([]string, error) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.Country = normalizeCountry(session.Country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+
+	cookiesMap, sessionID, problems, err := j.prepareSession(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	var claimKey string
+	if opts != nil {
+		claimKey = opts.IdempotencyKey
+	}
+	if claimKey != "" {
+		if err := j.claimIdempotencyKey(ctx, claimKey, sessionID); err != nil {
+			return nil, err
+		}
+	}
+	if err := j.storePrepared(ctx, session, sessionID, cookiesMap, opts); err != nil {
+		if claimKey != "" {
+			j.releaseIdempotencyKey(ctx, claimKey)
+		}
+		return nil, err
+	}
+	return problems, nil
+}
+
+// storePrepared stores a session checked by prepareSession under sessionID.
+// The caller must hold session.mu.
+func (j *AmazonSession) storePrepared(ctx context.Context, session *Session, sessionID string, cookiesMap map[string]string, opts *PushOptions) error {
+	// Amazon rotated the session-id of a loaded session: move the stored
+	// record to the new id instead of leaving the old one behind.
+	if session.SessionID != "" && session.SessionID != sessionID {
+		if _, err := j.renameSession(ctx, session.Country, session.SessionID, sessionID); err != nil {
+			return err
+		}
+		if err := j.releaseBorrow(ctx, session.Country, session.SessionID); err != nil {
+			return err
+		}
+	}
+
+	opts, others, err := j.resolveCrossCountry(ctx, session, session.Country, sessionID, opts)
+	if err != nil {
+		return err
+	}
+	if err := j.storeSession(ctx, session.Country, sessionID, cookiesMap, session, opts); err != nil {
+		return err
+	}
+	if err := j.removeFromCountries(ctx, sessionID, others); err != nil {
+		return err
+	}
+	if err := j.releaseBorrow(ctx, session.Country, sessionID); err != nil {
+		return err
+	}
+	session.SessionID = sessionID
+	session.dirty = false
+	return nil
+}
 
+// prepareSession checks a session about to be stored and returns its cookies
+// in the form they are stored, its session-id and, in ValidationReport
+// mode, its cookie problems. The caller must hold session.mu.
+func (j *AmazonSession) prepareSession(ctx context.Context, session *Session) (map[string]string, string, []string, error) {
 	if session.Country == "" {
-		return fmt.Errorf("country not found in session")
+		return nil, "", nil, fmt.Errorf("country not found in session")
 	}
 
 	if session.Jar == nil && (session.Cookies == nil || len(session.Cookies) == 0) {
-		return fmt.Errorf("cookies jar and cookies not found in session")
+		return nil, "", nil, fmt.Errorf("cookies jar and cookies not found in session")
+	}
+
+	if session.Proxy != "" {
+		if err := j.checkProxyGeo(ctx, session, session.Proxy); err != nil {
+			return nil, "", nil, err
+		}
+	}
+
+	cookiesMap, sessionID, inputCookies, err := j.storedCookies(session)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	var problems []string
+	if j.cookieValidation != ValidationOff {
+		problems = validateCookies(session.Country, cookiesMap, inputCookies)
+		if len(problems) > 0 && j.cookieValidation == ValidationStrict {
+			return nil, "", nil, &CookieValidationError{SessionID: sessionID, Problems: problems}
+		}
 	}
 
+	if session.Bucket == "" && len(j.experimentBuckets) > 0 {
+		session.Bucket = assignBucket(j.experimentBuckets, sessionID)
+	}
+	return cookiesMap, sessionID, problems, nil
+}
+
+// storedCookies returns the cookies of a session in the form they are
+// stored, its session-id and the input cookies from the session and its jar.
+// The caller must hold session.mu.
+func (j *AmazonSession) storedCookies(session *Session) (map[string]string, string, []*http.Cookie, error) {
 	cookies := session.Cookies
 
 	// Store all cookies in a map.
@@ -162,7 +1199,8 @@ func (j *AmazonSession) PushSession(ctx context.Context, session *Session) error
 			item.Name == "session-id-time" ||
 			item.Name == "session-token" ||
 			strings.HasPrefix(item.Name, "ubid-") ||
-			strings.HasPrefix(item.Name, "lc-") {
+			strings.HasPrefix(item.Name, "lc-") ||
+			(session.AccountRef != "" && isAuthCookie(item.Name)) {
 			cookiesMap[item.Name] = item.Value
 			if item.Name == "session-id" {
 				sessionID = item.Value
@@ -171,6 +1209,7 @@ func (j *AmazonSession) PushSession(ctx context.Context, session *Session) error
 	}
 
 	// Get the cookies from the jar.
+	var jarCookies []*http.Cookie
 	if session.Jar != nil {
 		var countryURL *url.URL
 		// Check if the country domain exists in the map.
@@ -178,22 +1217,50 @@ func (j *AmazonSession) PushSession(ctx context.Context, session *Session) error
 			// Attempt to parse the domain into a URL.
 			countryURL, _ = url.Parse(domain)
 		} else {
-			return fmt.Errorf("domain not found for country: %s", session.Country)
+			return nil, "", nil, fmt.Errorf("domain not found for country: %s", session.Country)
 		}
 		// merge cookies from jar
-		jarCookies := session.Jar.Cookies(countryURL)
+		jarCookies = session.Jar.Cookies(countryURL)
 		if jarCookies != nil && len(jarCookies) > 0 {
 			for _, item := range jarCookies {
+				// Auth cookies are only retained for account-backed sessions.
+				if session.AccountRef == "" && isAuthCookie(item.Name) {
+					continue
+				}
 				cookiesMap[item.Name] = item.Value
 			}
 		}
 	}
 
+	if j.sessionIDExtractor != nil {
+		id, err := j.sessionIDExtractor(append(append([]*http.Cookie(nil), cookies...), jarCookies...))
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("session-id extraction failed: %v", err)
+		}
+		sessionID = id
+		// Store the session in the standard form.
+		if sessionID != "" {
+			cookiesMap["session-id"] = sessionID
+		}
+	}
+
 	// Ensure sessionID is not empty.
 	if sessionID == "" {
-		return fmt.Errorf("session-id not found in session")
+		return nil, "", nil, fmt.Errorf("session-id not found in session")
+	}
+
+	if j.fillMissingCookies {
+		fillMissingCookies(session.Country, cookiesMap, j.clock.Now())
 	}
+	return cookiesMap, sessionID, append(append([]*http.Cookie(nil), cookies...), jarCookies...), nil
+}
 
+// storeSession writes the cookies of a session to Redis and adds the
+// session-id to the list of available session-ids. Usage stats are only
+// initialized when the session does not exist yet. The optional fields and
+// indexes of the session are taken from meta, and explicit stats from opts;
+// both may be nil.
+func (j *AmazonSession) storeSession(ctx context.Context, country, sessionID string, cookiesMap map[string]string, meta *Session, opts *PushOptions) error {
 	// Serialize the cookies to JSON.
 	cookieData, err := json.Marshal(cookiesMap)
 	if err != nil {
@@ -203,7 +1270,7 @@ func (j *AmazonSession) PushSession(ctx context.Context, session *Session) error
 	_, err = j.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 
 		// Store the cookies in Redis using Hash data structure.
-		key := cookiesKey(session.Country)
+		key := cookiesKey(country)
 
 		// Check if the session cookies already exists.
 		sessionExists, err := j.client.HExists(ctx, key, sessionID).Result()
@@ -214,18 +1281,80 @@ func (j *AmazonSession) PushSession(ctx context.Context, session *Session) error
 		// update cookies
 		pipe.HSet(ctx, key, sessionID, cookieData)
 
+		// Keep Amazon's own expiry so cleanup and selection can skip expired sessions.
+		if expiresAt, ok := parseSessionIDTime(cookiesMap["session-id-time"]); ok {
+			pipe.HSet(ctx, key, sessionFieldKey(sessionID, "amazon-expires-at"), expiresAt)
+		} else {
+			pipe.HDel(ctx, key, sessionFieldKey(sessionID, "amazon-expires-at"))
+		}
+
 		// don't exists update usage stats
 		if !sessionExists {
-			lastChecked := time.Now().Unix()
+			now := j.clock.Now()
+			lastChecked := j.formatTimestamp(now)
 			pipe.HSet(ctx, key, createdAtKey(sessionID), lastChecked)
 			pipe.HSet(ctx, key, lastCheckedKey(sessionID), lastChecked)
+			pipe.ZAdd(ctx, lastCheckedIndexKey(country), redis.Z{Score: float64(now.Unix()), Member: sessionID})
 			pipe.HSet(ctx, key, usageCountKey(sessionID), 0)
+			pipe.ZAdd(ctx, usageIndexKey(country), redis.Z{Score: 0, Member: sessionID})
+		}
+		if opts != nil {
+			if !opts.CreatedAt.IsZero() {
+				pipe.HSet(ctx, key, createdAtKey(sessionID), j.formatTimestamp(opts.CreatedAt))
+			}
+			if !opts.LastChecked.IsZero() {
+				pipe.HSet(ctx, key, lastCheckedKey(sessionID), j.formatTimestamp(opts.LastChecked))
+				pipe.ZAdd(ctx, lastCheckedIndexKey(country), redis.Z{Score: float64(opts.LastChecked.Unix()), Member: sessionID})
+			}
+			if opts.UsageCount != 0 {
+				pipe.HSet(ctx, key, usageCountKey(sessionID), opts.UsageCount)
+				pipe.ZAdd(ctx, usageIndexKey(country), redis.Z{Score: float64(opts.UsageCount), Member: sessionID})
+			}
+		}
+
+		// update session fields and indexes
+		if meta != nil {
+			for field, value := range meta.fieldValues() {
+				pipe.HSet(ctx, key, sessionFieldKey(sessionID, field), value)
+			}
+			if j.storeRawSetCookies && len(meta.RawSetCookies) > 0 {
+				raw, err := json.Marshal(filterRawSetCookies(meta.RawSetCookies, meta.AccountRef != ""))
+				if err != nil {
+					return err
+				}
+				pipe.HSet(ctx, key, sessionFieldKey(sessionID, "raw-set-cookies"), raw)
+			}
+			if err := j.updateLabelIndexes(ctx, pipe, country, sessionID, meta.Labels); err != nil {
+				return err
+			}
+			if err := j.updateGenerationIndex(ctx, pipe, country, sessionID, meta.Generation); err != nil {
+				return err
+			}
+			if err := j.updateTierIndex(ctx, pipe, country, sessionID, meta.Tier); err != nil {
+				return err
+			}
+		}
+
+		// Canaries are kept in their own list, out of the main pool.
+		poolKey, err := idListKey(ctx, j.client, country, sessionID)
+		if err != nil {
+			return err
+		}
+		idsKey := poolKey
+		if meta != nil {
+			if meta.Canary {
+				idsKey = canaryIdsKey(country)
+				pipe.LRem(ctx, poolKey, 0, sessionID)
+			} else {
+				pipe.LRem(ctx, canaryIdsKey(country), 0, sessionID)
+				pipe.HDel(ctx, key, sessionFieldKey(sessionID, "canary"))
+			}
 		}
 
 		// check if session id already exists in the list
 		// warning: performance is very poor
 		exists := false
-		ids, err := j.client.LRange(context.Background(), sessionIdsKey(session.Country), 0, -1).Result()
+		ids, err := j.client.LRange(context.Background(), idsKey, 0, -1).Result()
 		if err != nil {
 			return fmt.Errorf("error getting session IDs: %v", err)
 		}
@@ -236,10 +1365,17 @@ func (j *AmazonSession) PushSession(ctx context.Context, session *Session) error
 			}
 		}
 
+		// Pinned sessions stay out of the pool until unpinned.
+		if !exists {
+			pinned, err := j.client.ZScore(ctx, pinsKey(country), sessionID).Result()
+			exists = err == nil && pinned > 0
+		}
+
 		if !exists {
 			// Add the session-id to the list of available session-ids.
-			pipe.RPush(ctx, sessionIdsKey(session.Country), sessionID)
+			pipe.RPush(ctx, idsKey, sessionID)
 		}
+		sessionIndexAddCmd.Eval(ctx, pipe, []string{}, sessionID, country)
 
 		return nil
 	})
@@ -252,89 +1388,113 @@ func (j *AmazonSession) PushSession(ctx context.Context, session *Session) error
 	return nil
 }
 
+// buildCookies creates the cookies for a marketplace from the stored
+// name/value map.
+func buildCookies(countryURL *url.URL, cookiesMap map[string]string, expires time.Time) []*http.Cookie {
+	var cookies []*http.Cookie
+	for name, value := range cookiesMap {
+		cookies = append(cookies, &http.Cookie{
+			Name:    name,
+			Value:   value,
+			Path:    "/",
+			Domain:  countryURL.Host,
+			Expires: expires,
+		})
+	}
+
+	return cookies
+}
+
+// newCookieJar creates a new cookiejar holding the cookies of a marketplace.
+func newCookieJar(countryURL *url.URL, cookies []*http.Cookie) *cookiejar.Jar {
+	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	jar.SetCookies(countryURL, cookies)
+	return jar
+}
+
+// GetSession loads a session of a country by its session-id. It is not a
+// checkout: it also serves frozen and draining pools, so callers holding a
+// session taken with PopSession or Pin can load it again.
 func (j *AmazonSession) GetSession(ctx context.Context, country, sessionID string) (*Session, error) {
-	countryURL, err := j.getCountryURL(country)
-	if err != nil {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	if err := j.breakerAllow(ctx, country, true); err != nil {
 		return nil, err
 	}
-
-	keys := []string{cookiesKey(country)}
-	argv := []interface{}{
-		sessionID,
-		usageCountKey(sessionID),
-		lastCheckedKey(sessionID),
-		createdAtKey(sessionID),
+	if err := j.budgetAllow(ctx, country, true); err != nil {
+		return nil, err
 	}
-
-	res, err := getSessionCmd.Run(ctx, j.client, keys, argv...).Result()
+	session, err := j.getSession(ctx, country, sessionID)
 	if err != nil {
-		return nil, fmt.Errorf("redis eval error: %v", err)
+		return j.missingSession(ctx, country, err)
 	}
+	return session, nil
+}
 
-	values, err := cast.ToSliceE(res)
+// getSession loads a session and increments its usage count, without
+// checking the circuit breaker.
+func (j *AmazonSession) getSession(ctx context.Context, country, sessionID string) (*Session, error) {
+	countryURL, err := j.getCountryURL(country)
 	if err != nil {
-		return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
-	}
-
-	if len(values) != 4 {
-		return nil, fmt.Errorf("unepxected number of values returned from Lua script")
+		return nil, err
 	}
 
-	cookieData, err := cast.ToStringE(values[0])
-	if err != nil {
-		return nil, fmt.Errorf("unexpected value returned from Lua script")
-	}
+	keys := []string{cookiesKey(country), usageIndexKey(country)}
+	argv := append([]interface{}{sessionID, j.clock.Now().Unix()}, sessionFieldArgs()...)
 
-	usageCount, err := cast.ToInt64E(values[1])
+	res, err := getSessionCmd.Run(ctx, j.client, keys, argv...).Result()
 	if err != nil {
-		return nil, fmt.Errorf("unexpected value returned from Lua script")
+		return nil, sessionNotFound(err, sessionID)
 	}
 
-	lastCheckedAt, err := cast.ToInt64E(values[2])
+	values, err := replySlice(res)
 	if err != nil {
-		return nil, fmt.Errorf("unexpected value returned from Lua script")
+		return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
 	}
 
-	createdAt, err := cast.ToInt64E(values[3])
-	if err != nil {
-		return nil, fmt.Errorf("unexpected value returned from Lua script")
+	if len(values) != len(sessionFields)+1 {
+		return nil, fmt.Errorf("unepxected number of values returned from Lua script")
 	}
 
-	// Deserialize the JSON data to recreate the cookiejar.Jar.
-	cookiesMap := make(map[string]string)
-	err = json.Unmarshal([]byte(cookieData), &cookiesMap)
+	session, err := j.newSessionFromReply(countryURL, country, sessionID, values, true)
 	if err != nil {
+		if derr := j.decodeFailed(ctx, country, sessionID, err); derr != nil {
+			return nil, derr
+		}
 		return nil, err
 	}
-
-	var cookies []*http.Cookie
-	for name, value := range cookiesMap {
-		cookies = append(cookies, &http.Cookie{
-			Name:    name,
-			Value:   value,
-			Path:    "/",
-			Domain:  countryURL.Host,
-			Expires: time.Now().AddDate(1, 0, 0),
-		})
+	if j.hooks.OnGet != nil {
+		j.hooks.OnGet(ctx, session)
 	}
+	return session, nil
+}
 
-	// Create a new cookiejar and set the cookies.
-	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
-	jar.SetCookies(countryURL, cookies)
+func (j *AmazonSession) GetCountrySessionIDs(ctx context.Context, country string) ([]string, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return poolIDs(ctx, j.readClient(ctx), country)
+}
 
-	return &Session{
-		Country:       country,
-		Cookies:       cookies,
-		Jar:           jar,
-		SessionID:     sessionID,
-		UsageCount:    usageCount,
-		LastCheckedAt: lastCheckedAt,
-		CreatedAt:     createdAt,
-	}, nil
+// ExistsSession reports whether a session is stored for the country.
+func (j *AmazonSession) ExistsSession(ctx context.Context, country, sessionID string) (bool, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.readClient(ctx).HExists(ctx, cookiesKey(country), sessionID).Result()
 }
 
-func (j *AmazonSession) GetCountrySessionIDs(ctx context.Context, country string) ([]string, error) {
-	return j.client.LRange(ctx, sessionIdsKey(country), 0, -1).Result()
+// HasSessions reports whether the country has sessions available.
+func (j *AmazonSession) HasSessions(ctx context.Context, country string) (bool, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	count, err := poolSize(ctx, j.readClient(ctx), country)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
 }
 
 func (j *AmazonSession) getCountryURL(country string) (*url.URL, error) {
@@ -351,67 +1511,81 @@ func (j *AmazonSession) getCountryURL(country string) (*url.URL, error) {
 	return countryURL, nil
 }
 
+// allSessionsPageSize is the number of sessions fetched per script by
+// GetAllSessions, and allSessionsWorkers the number of countries fetched
+// concurrently.
+const (
+	allSessionsPageSize = 500
+	allSessionsWorkers  = 4
+)
+
+// GetAllSessions returns the sessions of all countries, including custom
+// ones. Each country is fetched in pages of allSessionsPageSize sessions,
+// several countries at a time, to keep the replies small and avoid blocking
+// Redis with a single long script. The listing is not a snapshot: sessions
+// popped or pushed meanwhile may be missed or listed twice.
 func (j *AmazonSession) GetAllSessions(ctx context.Context) ([]*Session, error) {
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
 
-	res, err := allSessionCmd.Run(ctx, j.client, nil).Result()
+	countries, err := j.storedCountries(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("redis eval error: %v", err)
+		return nil, err
 	}
 
-	data, err := cast.ToSliceE(res)
-	if err != nil {
-		return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+	results := make([][]*Session, len(countries))
+	errs := make([]error, len(countries))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < allSessionsWorkers && w < len(countries); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i], errs[i] = j.listAllCountrySessions(ctx, countries[i])
+			}
+		}()
+	}
+	for i := range countries {
+		next <- i
 	}
+	close(next)
+	wg.Wait()
 
 	sessions := make([]*Session, 0)
-
-	for i := 0; i < len(data); i += 6 {
-
-		country := cast.ToString(data[i])
-		countryURL, err := j.getCountryURL(country)
-		if err != nil {
-			return nil, err
+	for i := range countries {
+		if errs[i] != nil {
+			return nil, errs[i]
 		}
+		sessions = append(sessions, results[i]...)
+	}
+	return sessions, nil
+}
 
-		cookieData := cast.ToString(data[i+2])
-
-		// Deserialize the JSON data to recreate the cookiejar.Jar.
-		cookiesMap := make(map[string]string)
-		err = json.Unmarshal([]byte(cookieData), &cookiesMap)
+// listAllCountrySessions returns the sessions of a country in list order,
+// fetched page by page.
+func (j *AmazonSession) listAllCountrySessions(ctx context.Context, country string) ([]*Session, error) {
+	countryURL, err := j.getCountryURL(country)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]*Session, 0)
+	for start := int64(0); ; start += allSessionsPageSize {
+		page, scanned, err := j.listSessionRange(ctx, countryURL, country, start, start+allSessionsPageSize-1)
 		if err != nil {
 			return nil, err
 		}
-
-		var cookies []*http.Cookie
-		for name, value := range cookiesMap {
-			cookies = append(cookies, &http.Cookie{
-				Name:    name,
-				Value:   value,
-				Path:    "/",
-				Domain:  countryURL.Host,
-				Expires: time.Now().AddDate(1, 0, 0),
-			})
-		}
-
-		// Create a new cookiejar and set the cookies.
-		jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
-		jar.SetCookies(countryURL, cookies)
-
-		sessions = append(sessions, &Session{
-			Jar:           jar,
-			Cookies:       cookies,
-			Country:       cast.ToString(data[i]),
-			SessionID:     cast.ToString(data[i+1]),
-			UsageCount:    cast.ToInt64(data[i+4]),
-			LastCheckedAt: cast.ToInt64(data[i+3]),
-			CreatedAt:     cast.ToInt64(data[i+5]),
-		})
+		sessions = append(sessions, page...)
+		if scanned < allSessionsPageSize {
+			return sessions, nil
+		}
 	}
-
-	return sessions, nil
 }
 
 func (j *AmazonSession) ListSession(ctx context.Context, country string, pgn Pagination) ([]*Session, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
 	countryURL, err := j.getCountryURL(country)
 	if err != nil {
 		return nil, err
@@ -420,47 +1594,41 @@ func (j *AmazonSession) ListSession(ctx context.Context, country string, pgn Pag
 	// correct range and reverse the list to get the tasks with pagination.
 	stop := -pgn.start() - 1
 	start := -pgn.stop() - 1
-	res, err := listSessionCmd.Run(ctx, j.client, []string{sessionIdsKey(country), cookiesKey(country)}, start, stop).Result()
+	sessions, _, err := j.listSessionRange(ctx, countryURL, country, start, stop)
+	return sessions, err
+}
+
+// listSessionRange returns the sessions of a country between the start and
+// stop offsets of its id list, with the number of session-ids scanned,
+// including the undecodable sessions that were skipped.
+func (j *AmazonSession) listSessionRange(ctx context.Context, countryURL *url.URL, country string, start, stop int64) ([]*Session, int, error) {
+	argv := append([]interface{}{start, stop}, sessionFieldArgs()...)
+	res, err := listSessionCmd.Run(ctx, j.readClient(ctx), []string{sessionIdsKey(country), cookiesKey(country)}, argv...).Result()
 	if err != nil {
-		return nil, fmt.Errorf("redis eval error: %v", err)
+		return nil, 0, fmt.Errorf("redis eval error: %v", err)
 	}
-	data, err := cast.ToStringSliceE(res)
+	data, err := replySlice(res)
 	if err != nil {
-		return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+		return nil, 0, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
 	}
 	allSession := make([]*Session, 0)
-	for i := 0; i < len(data); i += 5 {
-		cookieData := cast.ToString(data[i+1])
-		// Deserialize the JSON data to recreate the cookiejar.Jar.
-		cookiesMap := make(map[string]string)
-		err = json.Unmarshal([]byte(cookieData), &cookiesMap)
+	// Each session is returned as session-id, cookies and fields.
+	stride := len(sessionFields) + 2
+	for i := 0; i+stride <= len(data); i += stride {
+		sessionID, err := replyString(data[i])
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		var cookies []*http.Cookie
-		for name, value := range cookiesMap {
-			cookies = append(cookies, &http.Cookie{
-				Name:    name,
-				Value:   value,
-				Path:    "/",
-				Domain:  countryURL.Host,
-				Expires: time.Now().AddDate(1, 0, 0),
-			})
-		}
-		// Create a new cookiejar and set the cookies.
-		jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
-		jar.SetCookies(countryURL, cookies)
-		allSession = append(allSession, &Session{
-			Jar:           jar,
-			Cookies:       cookies,
-			Country:       country,
-			SessionID:     cast.ToString(data[i]),
-			UsageCount:    cast.ToInt64(data[i+2]),
-			LastCheckedAt: cast.ToInt64(data[i+3]),
-			CreatedAt:     cast.ToInt64(data[i+4]),
-		})
+		session, err := j.newSessionFromReply(countryURL, country, sessionID, data[i+1:i+stride], j.eagerCookieJar)
+		if err != nil {
+			if err := j.decodeFailed(ctx, country, sessionID, err); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		allSession = append(allSession, session)
 	}
-	return allSession, nil
+	return allSession, len(data) / stride, nil
 }
 
 func (j *AmazonSession) ListCountrySession(ctx context.Context, country string) ([]*Session, error) {
@@ -471,49 +1639,247 @@ func (j *AmazonSession) ListCountrySession(ctx context.Context, country string)
 }
 
 func (j *AmazonSession) UpdateLastCheckedTimestamp(ctx context.Context, country, sessionID string) error {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
 	// Store the current time as the "last checked" timestamp.
-	lastChecked := time.Now().Unix()
-	_, err := j.client.HSet(ctx, cookiesKey(country), lastCheckedKey(sessionID), lastChecked).Result()
-	if err != nil {
-		return err
+	now := j.clock.Now()
+	_, err := j.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, cookiesKey(country), lastCheckedKey(sessionID), j.formatTimestamp(now))
+		pipe.ZAdd(ctx, lastCheckedIndexKey(country), redis.Z{Score: float64(now.Unix()), Member: sessionID})
+		return nil
+	})
+	return err
+}
+
+// UpdateLastChecked stamps the "last checked" timestamp of many sessions of
+// a country in a single transaction, e.g. after a revalidation sweep.
+func (j *AmazonSession) UpdateLastChecked(ctx context.Context, country string, sessionIDs []string) error {
+	country = normalizeCountry(country)
+	if len(sessionIDs) == 0 {
+		return nil
 	}
-	return nil
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	now := j.clock.Now()
+	lastChecked := j.formatTimestamp(now)
+	values := make([]interface{}, 0, 2*len(sessionIDs))
+	members := make([]redis.Z, 0, len(sessionIDs))
+	for _, sessionID := range sessionIDs {
+		values = append(values, lastCheckedKey(sessionID), lastChecked)
+		members = append(members, redis.Z{Score: float64(now.Unix()), Member: sessionID})
+	}
+	_, err := j.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, cookiesKey(country), values...)
+		pipe.ZAdd(ctx, lastCheckedIndexKey(country), members...)
+		return nil
+	})
+	return err
 }
 
-func (j *AmazonSession) DeleteSession(ctx context.Context, country, sessionID string) error {
-	err := j.client.LRem(ctx, sessionIdsKey(country), 1, sessionID).Err()
+// DeleteSession atomically removes a session with its fields and index
+// entries, and reports whether it existed.
+func (j *AmazonSession) DeleteSession(ctx context.Context, country, sessionID string) (bool, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	args := append([]interface{}{sessionID}, sessionFieldArgs()...)
+	res, err := deleteSessionCmd.Run(ctx, j.client, []string{country}, args...).Result()
 	if err != nil {
-		return err
+		return false, fmt.Errorf("redis eval error: %v", err)
 	}
-	err = j.client.HDel(ctx, cookiesKey(country), sessionID, lastCheckedKey(sessionID), createdAtKey(sessionID), usageCountKey(sessionID)).Err()
+	existed, err := replyInt64(res)
 	if err != nil {
-		return err
+		return false, fmt.Errorf("cast error: Lua script returned unexpected value: %v", err)
 	}
-	return nil
+	if existed == 0 {
+		return false, nil
+	}
+	if err := j.checkDrained(ctx, country); err != nil {
+		return false, err
+	}
+	if j.hooks.OnDelete != nil {
+		j.hooks.OnDelete(ctx, country, sessionID)
+	}
+	j.checkPoolLow(ctx, country)
+	return true, nil
 }
 
-func (j *AmazonSession) CleanupSessions(ctx context.Context, timeDiffThreshold int64, usageCountThreshold int64) error {
-	args := []interface{}{
-		time.Now().Unix(),
-		timeDiffThreshold,
-		usageCountThreshold,
+// clearBatchSize is the number of keys scanned and deleted per pipeline by
+// ClearAllCookies.
+const clearBatchSize = 100
+
+// ClearResult reports the keys deleted by ClearAllCookiesWithResult.
+type ClearResult struct {
+	Deleted map[string]int64 // Deleted is the number of keys deleted per country, the empty country for keys not tied to one
+	Failed  map[string]int64 // Failed is the number of keys that could not be deleted per country
+}
+
+// ClearAllCookies deletes every structure stored by the package, for the
+// known marketplaces and the custom countries found in the database, and its
+// global keys. Keys of other applications in the same database are left
+// alone, even when their names look alike (e.g. user:42:cookies).
+func (j *AmazonSession) ClearAllCookies(ctx context.Context) error {
+	_, err := j.ClearAllCookiesWithResult(ctx)
+	return err
+}
+
+// ClearAllCookiesWithResult is like ClearAllCookies and reports the keys
+// deleted per country. Keys are unlinked in pipelines of clearBatchSize, so
+// Redis frees large hashes in the background, see Config.DisableUnlink. Keys that fail to delete do
+// not stop the run: they are counted in the result and the first error is
+// returned once every key was tried.
+func (j *AmazonSession) ClearAllCookiesWithResult(ctx context.Context) (*ClearResult, error) {
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+	result := &ClearResult{Deleted: make(map[string]int64), Failed: make(map[string]int64)}
+	countries, err := j.clearedCountries(ctx)
+	if err != nil {
+		return result, err
 	}
-	if err := cleanupSessionsCmd.Run(ctx, j.client, []string{}, args...).Err(); err != nil {
-		return fmt.Errorf("redis eval error: %v", err)
+	// The index sets and session-id shards are named after their members,
+	// so they are scanned for and kept only for the countries found.
+	patterns := make([]string, 0, len(countryIndexes)+3)
+	for _, index := range countryIndexes {
+		patterns = append(patterns, "*:"+index.prefix+":*")
 	}
-	return nil
+	patterns = append(patterns, "*:session-ids:*", idempotencyKeyPrefix+"*", importStagingPrefix+"*")
+
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, key := range []string{sessionIndexKey, runHistoryKey, schemaVersionKey} {
+		if err := j.unlink(ctx, j.client, key).Err(); err != nil {
+			fail(fmt.Errorf("failed to delete key %s: %v", key, err))
+		}
+	}
+	for country := range countries {
+		j.unlinkKeys(ctx, append(countryKeys(country), countryStateKeys(country)...), result, fail)
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+	}
+	for _, pattern := range patterns {
+		var cursor uint64
+		for {
+			keys, next, err := j.client.Scan(ctx, cursor, pattern, clearBatchSize).Result()
+			if err != nil {
+				fail(fmt.Errorf("failed to scan keys: %v", err))
+				break
+			}
+			owned := keys[:0]
+			for _, key := range keys {
+				if ownedKey(countries, key) {
+					owned = append(owned, key)
+				}
+			}
+			j.unlinkKeys(ctx, owned, result, fail)
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+	}
+	return result, firstErr
 }
 
-func (j *AmazonSession) ClearAllCookies(ctx context.Context) error {
+// clearedCountries returns the countries cleared by ClearAllCookies: the
+// known marketplaces and the countries with a session-ids list or a cookies
+// hash, e.g. custom ones.
+func (j *AmazonSession) clearedCountries(ctx context.Context) (map[string]bool, error) {
+	countries := make(map[string]bool, len(defaultCountryCodeDomainMap))
 	for country := range defaultCountryCodeDomainMap {
-		err := j.client.Del(ctx, sessionIdsKey(country)).Err()
-		if err != nil {
-			return fmt.Errorf("failed to delete session IDs for country %s: %v", country, err)
+		countries[country] = true
+	}
+	for _, suffix := range []string{"session-ids", "cookies"} {
+		iter := j.client.Scan(ctx, 0, "*:"+suffix, clearBatchSize).Iterator()
+		for iter.Next(ctx) {
+			if country := strings.TrimSuffix(iter.Val(), ":"+suffix); isCountryCode(country) {
+				countries[country] = true
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return nil, fmt.Errorf("failed to scan keys: %v", err)
 		}
-		err = j.client.Del(ctx, cookiesKey(country)).Err()
+	}
+	return countries, nil
+}
+
+// ownedKey reports whether a scanned key belongs to the package: a global
+// key, or a per-country key of one of countries.
+func ownedKey(countries map[string]bool, key string) bool {
+	if strings.HasPrefix(key, idempotencyKeyPrefix) || strings.HasPrefix(key, importStagingPrefix) {
+		return true
+	}
+	country, _, _ := strings.Cut(key, ":")
+	return countries[country]
+}
+
+// unlink deletes keys with UNLINK, which frees their memory in the
+// background, or with DEL when Config.DisableUnlink is set.
+func (j *AmazonSession) unlink(ctx context.Context, c redis.Cmdable, keys ...string) *redis.IntCmd {
+	if j.disableUnlink {
+		return c.Del(ctx, keys...)
+	}
+	return c.Unlink(ctx, keys...)
+}
+
+// deleteCommand returns the command deleting large keys in the Lua scripts,
+// see unlink.
+func (j *AmazonSession) deleteCommand() string {
+	if j.disableUnlink {
+		return "DEL"
+	}
+	return "UNLINK"
+}
+
+// unlinkKeys deletes a batch of per-country keys in one pipeline and counts
+// them in the result.
+func (j *AmazonSession) unlinkKeys(ctx context.Context, keys []string, result *ClearResult, fail func(error)) {
+	if len(keys) == 0 {
+		return
+	}
+	cmds := make([]*redis.IntCmd, len(keys))
+	pipe := j.client.Pipeline()
+	for i, key := range keys {
+		cmds[i] = j.unlink(ctx, pipe, key)
+	}
+	// Errors are reported per command below.
+	_, _ = pipe.Exec(ctx)
+	for i, cmd := range cmds {
+		country, _, _ := strings.Cut(keys[i], ":")
+		if strings.HasPrefix(keys[i], idempotencyKeyPrefix) || strings.HasPrefix(keys[i], importStagingPrefix) {
+			country = ""
+		}
+		n, err := cmd.Result()
 		if err != nil {
-			return fmt.Errorf("failed to delete cookies for country %s: %v", country, err)
+			result.Failed[country]++
+			fail(fmt.Errorf("failed to delete key %s: %v", keys[i], err))
+			continue
 		}
+		// SCAN may return a key more than once.
+		result.Deleted[country] += n
+	}
+}
+
+// FlushCountry atomically deletes the sessions of one country (session-ids,
+// cookies and all per-country indexes), e.g. to start fresh after a pool got
+// poisoned. The borrow limits, drain, freeze and maintenance window of the
+// country are kept.
+func (j *AmazonSession) FlushCountry(ctx context.Context, country string) error {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	args := append([]interface{}{country, j.deleteCommand()}, countryIndexArgs(country)...)
+	err := flushCountryCmd.Run(ctx, j.client, countryKeys(country), args...).Err()
+	if err != nil {
+		return fmt.Errorf("failed to flush country %s: %v", country, err)
 	}
 	return nil
 }
@@ -2,9 +2,22 @@ package amazonsession
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/amzapi/amazon-redis-session/chaos"
+	"github.com/redis/go-redis/v9"
 )
 
 func TestNewAmazonSession(t *testing.T) {
@@ -49,6 +62,27 @@ func TestNewAmazonSession(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name:    "Empty address",
+			args:    args{cfg: &Config{}},
+			wantErr: true,
+		},
+		{
+			name:    "Nil config",
+			args:    args{cfg: nil},
+			wantErr: true,
+		},
+		{
+			name: "Negative timeout",
+			args: args{
+				cfg: &Config{
+					Addr:        "127.0.0.1:6379",
+					Password:    "123456",
+					ReadTimeout: -time.Second,
+				},
+			},
+			wantErr: true,
+		},
 		{
 			name: "Invalid database number",
 			args: args{
@@ -190,3 +224,3837 @@ func TestAmazonSessionOperations1(t *testing.T) {
 		t.Fatalf("PushSession failed: %v", err)
 	}
 }
+
+func newTestSessionManager(t *testing.T, cfg *Config) *AmazonSession {
+	t.Helper()
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	cfg.Addr = "127.0.0.1:6379"
+	cfg.Password = "123456"
+	cfg.Db = 10
+
+	sessionManager, err := NewAmazonSession(cfg)
+	if err != nil {
+		t.Fatalf("无法连接到 Redis: %v", err)
+	}
+	if err := sessionManager.ClearAllCookies(context.Background()); err != nil {
+		t.Fatalf("ClearAllCookies failed: %v", err)
+	}
+	return sessionManager
+}
+
+func TestGetRandomSessionFromGroup(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{
+		CountryGroups: map[string][]string{"TEST": {"DE", "FR"}},
+	})
+
+	if _, err := sessionManager.GetRandomSessionFromGroup(ctx, "TEST"); err == nil {
+		t.Fatalf("Expected error for empty group pool")
+	}
+	if _, err := sessionManager.GetRandomSessionFromGroup(ctx, "UNKNOWN"); err == nil {
+		t.Fatalf("Expected error for unknown group")
+	}
+
+	if err := sessionManager.PushSession(ctx, createTestSession("FR", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+
+	session, err := sessionManager.GetRandomSessionFromGroup(ctx, "TEST")
+	if err != nil {
+		t.Fatalf("GetRandomSessionFromGroup failed: %v", err)
+	}
+	if session.Country != "FR" || session.SessionID != "session1" {
+		t.Fatalf("Unexpected session: %v/%v", session.Country, session.SessionID)
+	}
+
+	// Picks spread over the sessions of all countries.
+	for _, id := range []string{"session2", "session3", "session4"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("DE", id, "token")); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		session, err := sessionManager.GetRandomSessionFromGroup(ctx, "TEST")
+		if err != nil {
+			t.Fatalf("GetRandomSessionFromGroup failed: %v", err)
+		}
+		seen[session.Country+"/"+session.SessionID] = true
+	}
+	if len(seen) < 3 || !seen["FR/session1"] {
+		t.Fatalf("Expected picks across the group, got %v", seen)
+	}
+
+	// Frozen countries are skipped, a fully frozen group fails.
+	if err := sessionManager.FreezeCountry(ctx, "DE"); err != nil {
+		t.Fatalf("FreezeCountry failed: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if session, err := sessionManager.GetRandomSessionFromGroup(ctx, "TEST"); err != nil || session.Country != "FR" {
+			t.Fatalf("Expected a session of FR while DE is frozen, got %v (%v)", session, err)
+		}
+	}
+	if err := sessionManager.FreezeCountry(ctx, "FR"); err != nil {
+		t.Fatalf("FreezeCountry failed: %v", err)
+	}
+	if _, err := sessionManager.GetRandomSessionFromGroup(ctx, "TEST"); !errors.Is(err, ErrFrozen) {
+		t.Fatalf("Expected ErrFrozen, got %v", err)
+	}
+}
+
+func TestCloneSessionToCountry(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	session := createTestSession("US", "session1", "token1")
+	session.Cookies = append(session.Cookies,
+		&http.Cookie{Name: "ubid-main", Value: "ubid1"},
+		&http.Cookie{Name: "i18n-prefs", Value: "USD"},
+	)
+	if err := sessionManager.PushSession(ctx, session); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+
+	if err := sessionManager.CloneSessionToCountry(ctx, "US", "session1", "CA"); err != nil {
+		t.Fatalf("CloneSessionToCountry failed: %v", err)
+	}
+
+	cloned, err := sessionManager.GetSession(ctx, "CA", "session1")
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	names := make(map[string]string)
+	for _, c := range cloned.Cookies {
+		names[c.Name] = c.Value
+	}
+	if names["ubid-acbca"] != "ubid1" || names["session-token"] != "token1" {
+		t.Fatalf("Unexpected cloned cookies: %v", names)
+	}
+	if _, found := names["i18n-prefs"]; found {
+		t.Fatalf("Currency cookie should not be cloned")
+	}
+
+	if err := sessionManager.CloneSessionToCountry(ctx, "US", "missing", "CA"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("Expected ErrSessionNotFound for missing session, got %v", err)
+	}
+
+	// The clone is a push, so the cross-country mode applies to it.
+	sessionManager = newTestSessionManager(t, &Config{CrossCountryPush: CrossCountryReject})
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session2", "token2")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	var conflict *SessionConflictError
+	if err := sessionManager.CloneSessionToCountry(ctx, "US", "session2", "CA"); !errors.As(err, &conflict) {
+		t.Fatalf("Expected *SessionConflictError, got %v", err)
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "CA", "session2"); exists {
+		t.Fatalf("Rejected clone was stored")
+	}
+}
+
+func TestPopSessionWithFallback(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	if err := sessionManager.PushSession(ctx, createTestSession("DE", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+
+	session, err := sessionManager.PopSessionWithFallback(ctx, "UK", "FR", "DE")
+	if err != nil {
+		t.Fatalf("PopSessionWithFallback failed: %v", err)
+	}
+	if session.Country != "DE" || session.SessionID != "session1" {
+		t.Fatalf("Unexpected session: %v/%v", session.Country, session.SessionID)
+	}
+
+	if _, err := sessionManager.PopSessionWithFallback(ctx, "UK", "FR", "DE"); err == nil {
+		t.Fatalf("Expected error when all pools are empty")
+	}
+}
+
+func TestGetSessionFor(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	for _, id := range []string{"session1", "session2", "session3"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+
+	first, err := sessionManager.GetSessionFor(ctx, "US", "B000000001")
+	if err != nil {
+		t.Fatalf("GetSessionFor failed: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		again, err := sessionManager.GetSessionFor(ctx, "US", "B000000001")
+		if err != nil {
+			t.Fatalf("GetSessionFor failed: %v", err)
+		}
+		if again.SessionID != first.SessionID {
+			t.Fatalf("Expected sticky session %v, got %v", first.SessionID, again.SessionID)
+		}
+	}
+
+	if _, err := sessionManager.DeleteSession(ctx, "US", first.SessionID); err != nil {
+		t.Fatalf("DeleteSession failed: %v", err)
+	}
+	rebound, err := sessionManager.GetSessionFor(ctx, "US", "B000000001")
+	if err != nil {
+		t.Fatalf("GetSessionFor failed: %v", err)
+	}
+	if rebound.SessionID == first.SessionID {
+		t.Fatalf("Expected a new session after deletion")
+	}
+}
+
+func TestPopSessionSkipsExpired(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	expired := createTestSession("US", "session1", "token")
+	expired.Cookies = append(expired.Cookies, &http.Cookie{Name: "session-id-time", Value: "1700000600l"})
+	if err := sessionManager.PushSession(ctx, expired); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	if _, err := sessionManager.PopSession(ctx, "US"); err != redis.Nil {
+		t.Fatalf("Expected the expired session to be skipped, got %v", err)
+	}
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session2", "token")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	popped, err := sessionManager.PopSession(ctx, "US")
+	if err != nil || popped.SessionID != "session2" {
+		t.Fatalf("Expected session2, got %v, %v", popped, err)
+	}
+	if session, err := sessionManager.PopSessionWithFallback(ctx, "US"); err == nil {
+		t.Fatalf("Expected the expired session to be skipped, got %s", session.SessionID)
+	}
+	// The expired session is left for the cleanup.
+	if ids, _ := sessionManager.GetCountrySessionIDs(ctx, "US"); strings.Join(ids, ",") != "session1" {
+		t.Fatalf("Expected the expired session to stay in the pool, got %v", ids)
+	}
+}
+
+func TestGetSessionForRebindsUnavailable(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	if bound, err := sessionManager.GetSessionFor(ctx, "US", "asin1"); err != nil || bound.SessionID != "session1" {
+		t.Fatalf("GetSessionFor failed: %v, %v", bound, err)
+	}
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session2", "token")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+
+	// A popped session is held by its caller.
+	popped, err := sessionManager.PopSession(ctx, "US")
+	if err != nil || popped.SessionID != "session1" {
+		t.Fatalf("PopSession failed: %v, %v", popped, err)
+	}
+	if rebound, err := sessionManager.GetSessionFor(ctx, "US", "asin1"); err != nil || rebound.SessionID != "session2" {
+		t.Fatalf("Expected the popped session to be rebound, got %v, %v", rebound, err)
+	}
+	if err := sessionManager.ReturnSession(ctx, popped); err != nil {
+		t.Fatalf("ReturnSession failed: %v", err)
+	}
+
+	// A pinned session is not given to other callers.
+	if err := sessionManager.Pin(ctx, "session2", time.Minute); err != nil {
+		t.Fatalf("Pin failed: %v", err)
+	}
+	if rebound, err := sessionManager.GetSessionFor(ctx, "US", "asin1"); err != nil || rebound.SessionID != "session1" {
+		t.Fatalf("Expected the pinned session to be rebound, got %v, %v", rebound, err)
+	}
+	if err := sessionManager.Unpin(ctx, "session2"); err != nil {
+		t.Fatalf("Unpin failed: %v", err)
+	}
+
+	// An expired session is not reused.
+	expired := createTestSession("US", "session1", "token")
+	expired.Cookies = append(expired.Cookies, &http.Cookie{Name: "session-id-time", Value: "1700000600l"})
+	if err := sessionManager.PushSession(ctx, expired); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	if rebound, err := sessionManager.GetSessionFor(ctx, "US", "asin1"); err != nil || rebound.SessionID != "session2" {
+		t.Fatalf("Expected the expired session to be rebound, got %v, %v", rebound, err)
+	}
+}
+
+func TestGetRandomSessionWithPostalCode(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	session1 := createTestSession("US", "session1", "token1")
+	session1.PostalCode = "10001"
+	session1.TLSProfile = "chrome_120"
+	session2 := createTestSession("US", "session2", "token2")
+	session2.PostalCode = "90210"
+	for _, session := range []*Session{session1, session2} {
+		if err := sessionManager.PushSession(ctx, session); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		session, err := sessionManager.GetRandomSession(ctx, "US", WithPostalCode("90210"))
+		if err != nil {
+			t.Fatalf("GetRandomSession failed: %v", err)
+		}
+		if session.SessionID != "session2" || session.PostalCode != "90210" {
+			t.Fatalf("Unexpected session: %v/%v", session.SessionID, session.PostalCode)
+		}
+	}
+
+	if _, err := sessionManager.GetRandomSession(ctx, "US", WithPostalCode("00000")); err == nil {
+		t.Fatalf("Expected error for unknown postal code")
+	}
+
+	session, err := sessionManager.GetRandomSession(ctx, "US", WithTLSProfile("chrome_120"))
+	if err != nil {
+		t.Fatalf("GetRandomSession failed: %v", err)
+	}
+	if session.SessionID != "session1" || session.TLSProfile != "chrome_120" {
+		t.Fatalf("Unexpected session: %v/%v", session.SessionID, session.TLSProfile)
+	}
+	if _, err := sessionManager.GetRandomSession(ctx, "US", WithTLSProfile("chrome_120"), WithPostalCode("90210")); err == nil {
+		t.Fatalf("Expected error when no session matches all filters")
+	}
+}
+
+func TestGetRandomSessionWithResidency(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	residential := createTestSession("US", "session1", "token1")
+	residential.Residency = "residential"
+	residential.ASN = "7922"
+	residential.ExitIPHash = HashExitIP("203.0.113.7")
+	datacenter := createTestSession("US", "session2", "token2")
+	datacenter.Residency = "datacenter"
+	datacenter.ASN = "16509"
+	for _, session := range []*Session{residential, datacenter} {
+		if err := sessionManager.PushSession(ctx, session); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		session, err := sessionManager.GetRandomSession(ctx, "US", WithResidency("residential"))
+		if err != nil {
+			t.Fatalf("GetRandomSession failed: %v", err)
+		}
+		if session.SessionID != "session1" || session.ASN != "7922" || session.ExitIPHash != HashExitIP("203.0.113.7") {
+			t.Fatalf("Unexpected session: %+v", session)
+		}
+	}
+	session, err := sessionManager.GetRandomSession(ctx, "US", WithASN("16509"))
+	if err != nil || session.SessionID != "session2" {
+		t.Fatalf("Expected session2 for ASN 16509, got %v, %v", session, err)
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	session1 := createTestSession("US", "session1", "token1")
+	session1.PostalCode = "10001"
+	for _, session := range []*Session{session1, createTestSession("US", "session2", "token2"), createTestSession("DE", "session3", "token3")} {
+		if err := sessionManager.PushSession(ctx, session); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+
+	sessions, err := sessionManager.ListCountrySession(ctx, "US")
+	if err != nil {
+		t.Fatalf("ListCountrySession failed: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %v", len(sessions))
+	}
+	for _, session := range sessions {
+		if session.SessionID == "session1" && session.PostalCode != "10001" {
+			t.Fatalf("Expected postal code 10001, got %v", session.PostalCode)
+		}
+		if session.CreatedAt.IsZero() || session.LastChecked.IsZero() {
+			t.Fatalf("Expected timestamps to be set for %v", session.SessionID)
+		}
+	}
+
+	for _, session := range sessions {
+		if session.Jar != nil {
+			t.Fatalf("Expected list results without cookie jar")
+		}
+		if jar, err := session.CookieJar(); err != nil || jar == nil {
+			t.Fatalf("CookieJar failed: %v", err)
+		}
+	}
+
+	metas, err := sessionManager.ListSessionMeta(ctx, "US", Pagination{})
+	if err != nil {
+		t.Fatalf("ListSessionMeta failed: %v", err)
+	}
+	if len(metas) != 2 || metas[0].CreatedAt.IsZero() || metas[0].SessionID == "" {
+		t.Fatalf("Unexpected session meta: %+v", metas)
+	}
+
+	all, err := sessionManager.GetAllSessions(ctx)
+	if err != nil {
+		t.Fatalf("GetAllSessions failed: %v", err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("Expected 3 sessions, got %v", len(all))
+	}
+}
+
+func TestEnsurePreferences(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	session := createTestSession("DE", "session1", "token1")
+	session.Language = "en_GB"
+	if err := sessionManager.EnsurePreferences(ctx, session); err != nil {
+		t.Fatalf("EnsurePreferences failed: %v", err)
+	}
+
+	stored, err := sessionManager.GetSession(ctx, "DE", "session1")
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if stored.Currency != "EUR" || stored.Language != "en_GB" {
+		t.Fatalf("Unexpected preferences: %v/%v", stored.Currency, stored.Language)
+	}
+	names := make(map[string]string)
+	for _, c := range stored.Cookies {
+		names[c.Name] = c.Value
+	}
+	if names["i18n-prefs"] != "EUR" || names["lc-acbde"] != "en_GB" {
+		t.Fatalf("Unexpected cookies: %v", names)
+	}
+}
+
+func TestAccountSessions(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	anonymous := createTestSession("US", "session1", "token1")
+	anonymous.Cookies = append(anonymous.Cookies, &http.Cookie{Name: "at-main", Value: "secret"})
+	account := createTestSession("US", "session2", "token2")
+	account.AccountRef = "account-1"
+	account.Cookies = append(account.Cookies, &http.Cookie{Name: "at-main", Value: "secret"})
+	for _, session := range []*Session{anonymous, account} {
+		if err := sessionManager.PushSession(ctx, session); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+
+	sessions, err := sessionManager.ListAccountSessions(ctx, "US", "account-1")
+	if err != nil {
+		t.Fatalf("ListAccountSessions failed: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].SessionID != "session2" {
+		t.Fatalf("Unexpected account sessions: %v", sessions)
+	}
+
+	for _, id := range []string{"session1", "session2"} {
+		session, err := sessionManager.GetSession(ctx, "US", id)
+		if err != nil {
+			t.Fatalf("GetSession failed: %v", err)
+		}
+		hasAuth := false
+		for _, c := range session.Cookies {
+			if c.Name == "at-main" {
+				hasAuth = true
+			}
+		}
+		if hasAuth != (session.AccountRef != "") {
+			t.Fatalf("Unexpected auth cookie retention for %v", id)
+		}
+	}
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func TestCleanupSessionsWithClock(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{Clock: clock})
+
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	clock.now = clock.now.Add(30 * time.Minute)
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session2", "token2")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+
+	// One hour after the first push only session1 is stale.
+	clock.now = clock.now.Add(30 * time.Minute)
+	if err := sessionManager.CleanupSessions(ctx, int64(time.Hour/time.Second), 100); err != nil {
+		t.Fatalf("CleanupSessions failed: %v", err)
+	}
+
+	ids, err := sessionManager.GetCountrySessionIDs(ctx, "US")
+	if err != nil {
+		t.Fatalf("GetCountrySessionIDs failed: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != "session2" {
+		t.Fatalf("Unexpected session IDs after cleanup: %v", ids)
+	}
+}
+
+func TestWithOpTimeout(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{OpTimeout: time.Second})
+
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+
+	if _, err := sessionManager.GetSession(WithOpTimeout(ctx, time.Nanosecond), "US", "session1"); err == nil {
+		t.Fatalf("Expected deadline error with a nanosecond timeout")
+	}
+	if _, err := sessionManager.GetSession(WithOpTimeout(ctx, time.Second), "US", "session1"); err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+}
+
+func TestClearCookies(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	for _, country := range []string{"US", "DE"} {
+		if err := sessionManager.PushSession(ctx, createTestSession(country, "session1", "token1")); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+	// Keys of a country that is not in the built-in map are cleared too.
+	if err := sessionManager.client.RPush(ctx, sessionIdsKey("XX"), "session1").Err(); err != nil {
+		t.Fatalf("RPush failed: %v", err)
+	}
+
+	if err := sessionManager.FlushCountry(ctx, "DE"); err != nil {
+		t.Fatalf("FlushCountry failed: %v", err)
+	}
+	if n, _ := sessionManager.client.Exists(ctx, countryKeys("DE")...).Result(); n != 0 {
+		t.Fatalf("Expected DE keys to be deleted")
+	}
+	if n, _ := sessionManager.client.Exists(ctx, sessionIdsKey("US")).Result(); n != 1 {
+		t.Fatalf("Expected US keys to be kept")
+	}
+
+	if err := sessionManager.ClearAllCookies(ctx); err != nil {
+		t.Fatalf("ClearAllCookies failed: %v", err)
+	}
+	if n, _ := sessionManager.client.Exists(ctx, sessionIdsKey("US"), cookiesKey("US"), sessionIdsKey("XX")).Result(); n != 0 {
+		t.Fatalf("Expected all keys to be deleted")
+	}
+}
+
+func TestExistsSession(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	if has, err := sessionManager.HasSessions(ctx, "US"); err != nil || has {
+		t.Fatalf("HasSessions = %v, %v; want false", has, err)
+	}
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	if has, err := sessionManager.HasSessions(ctx, "US"); err != nil || !has {
+		t.Fatalf("HasSessions = %v, %v; want true", has, err)
+	}
+	if exists, err := sessionManager.ExistsSession(ctx, "US", "session1"); err != nil || !exists {
+		t.Fatalf("ExistsSession = %v, %v; want true", exists, err)
+	}
+	if exists, err := sessionManager.ExistsSession(ctx, "US", "session2"); err != nil || exists {
+		t.Fatalf("ExistsSession = %v, %v; want false", exists, err)
+	}
+}
+
+func TestSearchSessionIDs(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	for _, id := range []string{"131-0000001-0000001", "131-0000002-0000002", "262-0000003-0000003"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+
+	ids, err := sessionManager.SearchSessionIDs(ctx, "US", "131-", 0)
+	if err != nil {
+		t.Fatalf("SearchSessionIDs failed: %v", err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("Expected 2 matches, got %v", ids)
+	}
+
+	ids, err = sessionManager.SearchSessionIDs(ctx, "US", "131-", 1)
+	if err != nil {
+		t.Fatalf("SearchSessionIDs failed: %v", err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("Expected 1 match with limit, got %v", ids)
+	}
+
+	ids, err = sessionManager.SearchSessionIDs(ctx, "US", "*", 0)
+	if err != nil {
+		t.Fatalf("SearchSessionIDs failed: %v", err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("Expected glob characters to be matched literally, got %v", ids)
+	}
+}
+
+func TestListSessionsByLabel(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	residential := createTestSession("US", "session1", "token1")
+	residential.Labels = map[string]string{"proxy-pool": "residential-us"}
+	datacenter := createTestSession("US", "session2", "token2")
+	datacenter.Labels = map[string]string{"proxy-pool": "datacenter"}
+	for _, session := range []*Session{residential, datacenter} {
+		if err := sessionManager.PushSession(ctx, session); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+
+	sessions, err := sessionManager.ListSessionsByLabel(ctx, "US", "proxy-pool", "residential-us")
+	if err != nil {
+		t.Fatalf("ListSessionsByLabel failed: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].SessionID != "session1" {
+		t.Fatalf("Expected session1, got %v", sessions)
+	}
+	if sessions[0].Labels["proxy-pool"] != "residential-us" {
+		t.Errorf("Expected labels to be loaded, got %v", sessions[0].Labels)
+	}
+
+	// Relabeling moves the session to the new index.
+	residential.Labels = map[string]string{"proxy-pool": "datacenter"}
+	if err := sessionManager.PushSession(ctx, residential); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	ids, err := sessionManager.ListSessionIDsByLabel(ctx, "US", "proxy-pool", "residential-us")
+	if err != nil || len(ids) != 0 {
+		t.Fatalf("Expected the old index to be empty, got %v, %v", ids, err)
+	}
+
+	if existed, err := sessionManager.DeleteSession(ctx, "US", "session2"); err != nil || !existed {
+		t.Fatalf("DeleteSession = %v, %v; want true", existed, err)
+	}
+	if existed, err := sessionManager.DeleteSession(ctx, "US", "session2"); err != nil || existed {
+		t.Fatalf("DeleteSession = %v, %v; want false for a deleted session", existed, err)
+	}
+	ids, err = sessionManager.ListSessionIDsByLabel(ctx, "US", "proxy-pool", "datacenter")
+	if err != nil || len(ids) != 1 || ids[0] != "session1" {
+		t.Fatalf("Expected only session1 in the index, got %v, %v", ids, err)
+	}
+
+	// Empty labels clear the stored ones, pushed or imported.
+	for _, commit := range []func(*Session) error{
+		func(session *Session) error { return sessionManager.PushSession(ctx, session) },
+		func(session *Session) error {
+			_, err := sessionManager.commitImport(ctx, []*Session{session})
+			return err
+		},
+	} {
+		residential.Labels = map[string]string{"proxy-pool": "datacenter"}
+		if err := sessionManager.PushSession(ctx, residential); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+		residential.Labels = map[string]string{}
+		if err := commit(residential); err != nil {
+			t.Fatalf("Storing empty labels failed: %v", err)
+		}
+		stored, err := sessionManager.GetSession(ctx, "US", "session1")
+		if err != nil || len(stored.Labels) != 0 {
+			t.Fatalf("Expected the labels to be cleared, got %v, %v", stored, err)
+		}
+		ids, err = sessionManager.ListSessionIDsByLabel(ctx, "US", "proxy-pool", "datacenter")
+		if err != nil || len(ids) != 0 {
+			t.Fatalf("Expected the index to be empty, got %v, %v", ids, err)
+		}
+	}
+
+	if err := sessionManager.FlushCountry(ctx, "US"); err != nil {
+		t.Fatalf("FlushCountry failed: %v", err)
+	}
+	ids, err = sessionManager.ListSessionIDsByLabel(ctx, "US", "proxy-pool", "datacenter")
+	if err != nil || len(ids) != 0 {
+		t.Fatalf("Expected FlushCountry to drop the index, got %v, %v", ids, err)
+	}
+}
+
+func TestPurgeGeneration(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	for id, generation := range map[string]string{"session1": "run-1", "session2": "run-1", "session3": "run-2"} {
+		session := createTestSession("US", id, "token")
+		session.Generation = generation
+		session.Labels = map[string]string{"proxy-pool": "residential-us"}
+		if err := sessionManager.PushSession(ctx, session); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+
+	generations, err := sessionManager.ListGenerations(ctx, "US")
+	if err != nil || len(generations) != 2 {
+		t.Fatalf("Expected 2 generations, got %v, %v", generations, err)
+	}
+
+	n, err := sessionManager.PurgeGeneration(ctx, "US", "run-1")
+	if err != nil {
+		t.Fatalf("PurgeGeneration failed: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("Expected 2 sessions purged, got %d", n)
+	}
+	ids, err := sessionManager.GetCountrySessionIDs(ctx, "US")
+	if err != nil || len(ids) != 1 || ids[0] != "session3" {
+		t.Fatalf("Expected only session3 to remain, got %v, %v", ids, err)
+	}
+	ids, err = sessionManager.ListSessionIDsByLabel(ctx, "US", "proxy-pool", "residential-us")
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("Expected purged sessions to leave the label index, got %v, %v", ids, err)
+	}
+	generations, err = sessionManager.ListGenerations(ctx, "US")
+	if err != nil || len(generations) != 1 || generations[0] != "run-2" {
+		t.Fatalf("Expected only run-2 to remain, got %v, %v", generations, err)
+	}
+}
+
+func TestCanarySessions(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	canary := createTestSession("US", "canary1", "token2")
+	canary.Canary = true
+	if err := sessionManager.PushSession(ctx, canary); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		session, err := sessionManager.GetRandomSession(ctx, "US")
+		if err != nil {
+			t.Fatalf("GetRandomSession failed: %v", err)
+		}
+		if session.SessionID != "session1" {
+			t.Fatalf("Expected the canary to stay out of the main pool, got %s", session.SessionID)
+		}
+	}
+
+	session, err := sessionManager.GetCanarySession(ctx, "US")
+	if err != nil {
+		t.Fatalf("GetCanarySession failed: %v", err)
+	}
+	if session.SessionID != "canary1" || !session.Canary {
+		t.Fatalf("Expected canary1, got %s (canary=%v)", session.SessionID, session.Canary)
+	}
+
+	metas, err := sessionManager.ListCanarySessionMeta(ctx, "US", Pagination{})
+	if err != nil {
+		t.Fatalf("ListCanarySessionMeta failed: %v", err)
+	}
+	if len(metas) != 1 || metas[0].UsageCount != 1 {
+		t.Fatalf("Expected one canary used once, got %v", metas)
+	}
+
+	// Pushing the session without the flag moves it back to the main pool.
+	session.Canary = false
+	if err := sessionManager.PushSession(ctx, session); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	if _, err := sessionManager.GetCanarySession(ctx, "US"); err == nil {
+		t.Fatalf("Expected no canary sessions left")
+	}
+	ids, err := sessionManager.GetCountrySessionIDs(ctx, "US")
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("Expected 2 sessions in the main pool, got %v, %v", ids, err)
+	}
+}
+
+func TestExperimentBuckets(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{ExperimentBuckets: []string{"rotate", "sticky"}})
+
+	buckets := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		id := "session" + strconv.Itoa(i)
+		session := createTestSession("US", id, "token")
+		if err := sessionManager.PushSession(ctx, session); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+		if session.Bucket != assignBucket([]string{"rotate", "sticky"}, id) {
+			t.Fatalf("Unexpected bucket %q for %s", session.Bucket, id)
+		}
+		buckets[id] = session.Bucket
+	}
+
+	for _, bucket := range []string{"rotate", "sticky"} {
+		session, err := sessionManager.GetRandomSession(ctx, "US", WithBucket(bucket))
+		if err != nil {
+			t.Fatalf("GetRandomSession(%s) failed: %v", bucket, err)
+		}
+		if session.Bucket != bucket || buckets[session.SessionID] != bucket {
+			t.Fatalf("Expected a session from bucket %s, got %s in %s", bucket, session.SessionID, session.Bucket)
+		}
+	}
+
+	if _, err := NewAmazonSession(&Config{Addr: "127.0.0.1:6379", ExperimentBuckets: []string{"a", "a"}}); err == nil {
+		t.Fatalf("Expected duplicate buckets to be rejected")
+	}
+}
+
+func TestUpdateLastChecked(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{Clock: clock})
+
+	for _, id := range []string{"session1", "session2", "session3"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+
+	clock.now = clock.now.Add(time.Hour)
+	if err := sessionManager.UpdateLastChecked(ctx, "US", []string{"session1", "session2"}); err != nil {
+		t.Fatalf("UpdateLastChecked failed: %v", err)
+	}
+
+	metas, err := sessionManager.ListSessionMeta(ctx, "US", Pagination{})
+	if err != nil {
+		t.Fatalf("ListSessionMeta failed: %v", err)
+	}
+	for _, meta := range metas {
+		want := clock.now
+		if meta.SessionID == "session3" {
+			want = time.Unix(1700000000, 0)
+		}
+		if !meta.LastChecked.Equal(want) {
+			t.Errorf("LastChecked of %s = %v, want %v", meta.SessionID, meta.LastChecked, want)
+		}
+	}
+}
+
+func TestTouchSession(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{Clock: clock})
+
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	for i := int64(1); i <= 2; i++ {
+		n, err := sessionManager.RecordFailure(ctx, "US", "session1")
+		if err != nil || n != i {
+			t.Fatalf("RecordFailure = %d, %v; want %d", n, err, i)
+		}
+	}
+
+	clock.now = clock.now.Add(time.Hour)
+	if err := sessionManager.TouchSession(ctx, "US", "session1"); err != nil {
+		t.Fatalf("TouchSession failed: %v", err)
+	}
+	session, err := sessionManager.GetSession(ctx, "US", "session1")
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if !session.LastChecked.Equal(clock.now) || session.Failures != 2 {
+		t.Fatalf("Unexpected session after touch: last-checked %v, failures %d", session.LastChecked, session.Failures)
+	}
+
+	if err := sessionManager.TouchSession(ctx, "US", "session1", WithResetFailures()); err != nil {
+		t.Fatalf("TouchSession failed: %v", err)
+	}
+	session, err = sessionManager.GetSession(ctx, "US", "session1")
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if session.Failures != 0 {
+		t.Fatalf("Expected failures to be reset, got %d", session.Failures)
+	}
+
+	if err := sessionManager.TouchSession(ctx, "US", "missing"); err == nil {
+		t.Fatalf("Expected TouchSession to fail for a missing session")
+	}
+}
+
+func TestReturnSession(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	session, err := sessionManager.PopSession(ctx, "US")
+	if err != nil {
+		t.Fatalf("PopSession failed: %v", err)
+	}
+	if err := sessionManager.ReturnSession(ctx, session); err != nil {
+		t.Fatalf("ReturnSession failed: %v", err)
+	}
+	// Returning twice must not duplicate the session-id.
+	if err := sessionManager.ReturnSession(ctx, session); err != nil {
+		t.Fatalf("ReturnSession failed: %v", err)
+	}
+
+	ids, err := sessionManager.GetCountrySessionIDs(ctx, "US")
+	if err != nil || len(ids) != 1 || ids[0] != "session1" {
+		t.Fatalf("Expected session1 back in the pool, got %v, %v", ids, err)
+	}
+	session, err = sessionManager.GetSession(ctx, "US", "session1")
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if session.UsageCount != 2 {
+		t.Fatalf("Expected the usage count to be preserved, got %d", session.UsageCount)
+	}
+
+	if err := sessionManager.ReturnSession(ctx, &Session{Country: "US", SessionID: "missing"}); err == nil {
+		t.Fatalf("Expected ReturnSession to fail for a deleted session")
+	}
+}
+
+func TestPushSessionWithOptions(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{Clock: clock})
+
+	opts := &PushOptions{UsageCount: 7, LastChecked: time.Unix(1690000000, 0), CreatedAt: time.Unix(1680000000, 0)}
+	if err := sessionManager.PushSessionWithOptions(ctx, createTestSession("US", "session1", "token1"), opts); err != nil {
+		t.Fatalf("PushSessionWithOptions failed: %v", err)
+	}
+	if err := sessionManager.PushSessionWithOptions(ctx, createTestSession("US", "session2", "token2"), &PushOptions{CreatedAt: time.Unix(1680000000, 0)}); err != nil {
+		t.Fatalf("PushSessionWithOptions failed: %v", err)
+	}
+
+	metas, err := sessionManager.ListSessionMeta(ctx, "US", Pagination{})
+	if err != nil {
+		t.Fatalf("ListSessionMeta failed: %v", err)
+	}
+	for _, meta := range metas {
+		want := SessionMeta{Country: "US", SessionID: meta.SessionID, UsageCount: 7, LastChecked: time.Unix(1690000000, 0), CreatedAt: time.Unix(1680000000, 0)}
+		if meta.SessionID == "session2" {
+			want.UsageCount = 0
+			want.LastChecked = clock.now
+		}
+		if !reflect.DeepEqual(*meta, want) {
+			t.Errorf("Unexpected meta %+v, want %+v", *meta, want)
+		}
+	}
+
+	// The imported timestamps drive the age-based cleanup.
+	if err := sessionManager.CleanupSessions(ctx, int64(time.Hour/time.Second), 100); err != nil {
+		t.Fatalf("CleanupSessions failed: %v", err)
+	}
+	ids, err := sessionManager.GetCountrySessionIDs(ctx, "US")
+	if err != nil || len(ids) != 1 || ids[0] != "session2" {
+		t.Fatalf("Expected only session2 to survive cleanup, got %v, %v", ids, err)
+	}
+}
+
+func TestCleanupSessionsMaxAge(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{Clock: clock, MaxAge: time.Hour})
+
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	session, err := sessionManager.GetSession(ctx, "US", "session1")
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if session.ExpiresAt != clock.now.Add(time.Hour).Unix() {
+		t.Fatalf("Unexpected ExpiresAt %d", session.ExpiresAt)
+	}
+
+	// Recently checked, but older than MaxAge.
+	clock.now = clock.now.Add(time.Hour)
+	if err := sessionManager.UpdateLastCheckedTimestamp(ctx, "US", "session1"); err != nil {
+		t.Fatalf("UpdateLastCheckedTimestamp failed: %v", err)
+	}
+	if err := sessionManager.CleanupSessions(ctx, int64(24*time.Hour/time.Second), 100); err != nil {
+		t.Fatalf("CleanupSessions failed: %v", err)
+	}
+	if exists, err := sessionManager.ExistsSession(ctx, "US", "session1"); err != nil || exists {
+		t.Fatalf("Expected session1 to be removed by max age, got %v, %v", exists, err)
+	}
+}
+
+func TestSessionIDTimeExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{Clock: clock})
+
+	expired := createTestSession("US", "session1", "token1")
+	expired.Cookies = append(expired.Cookies, &http.Cookie{Name: "session-id-time", Value: "1700000600l"})
+	valid := createTestSession("US", "session2", "token2")
+	valid.Cookies = append(valid.Cookies, &http.Cookie{Name: "session-id-time", Value: "2082787201l"})
+	for _, session := range []*Session{expired, valid} {
+		if err := sessionManager.PushSession(ctx, session); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+
+	session, err := sessionManager.GetSession(ctx, "US", "session2")
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	for _, cookie := range session.Cookies {
+		if !cookie.Expires.Equal(time.Unix(2082787201, 0)) {
+			t.Errorf("Expected cookie %s to expire with session-id-time, got %v", cookie.Name, cookie.Expires)
+		}
+	}
+
+	clock.now = clock.now.Add(time.Hour)
+	for i := 0; i < 10; i++ {
+		session, err := sessionManager.GetRandomSession(ctx, "US")
+		if err != nil {
+			t.Fatalf("GetRandomSession failed: %v", err)
+		}
+		if session.SessionID != "session2" {
+			t.Fatalf("Expected the expired session to be skipped, got %s", session.SessionID)
+		}
+	}
+
+	if err := sessionManager.CleanupSessions(ctx, int64(24*time.Hour/time.Second), 100); err != nil {
+		t.Fatalf("CleanupSessions failed: %v", err)
+	}
+	ids, err := sessionManager.GetCountrySessionIDs(ctx, "US")
+	if err != nil || len(ids) != 1 || ids[0] != "session2" {
+		t.Fatalf("Expected cleanup to remove the expired session, got %v, %v", ids, err)
+	}
+}
+
+func TestRawSetCookies(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{StoreRawSetCookies: true})
+
+	session := createTestSession("US", "session1", "token1")
+	session.RawSetCookies = []string{
+		`session-token="quoted+token=="; Domain=.amazon.com; Path=/; Secure; HttpOnly`,
+		`csm-hit=tb:s-XYZ|1700000000000; Domain=.amazon.com; Path=/`,
+		`at-main=secret; Domain=.amazon.com; Path=/`,
+	}
+	if err := sessionManager.PushSession(ctx, session); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+
+	got, err := sessionManager.GetSession(ctx, "US", "session1")
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if len(got.RawSetCookies) != 2 {
+		t.Fatalf("Expected the auth cookie to be dropped for an anonymous session, got %v", got.RawSetCookies)
+	}
+	cookies := make(map[string]*http.Cookie)
+	for _, cookie := range got.Cookies {
+		cookies[cookie.Name] = cookie
+	}
+	if token := cookies["session-token"]; token == nil || token.Value != "quoted+token==" || !token.Secure || !token.HttpOnly {
+		t.Fatalf("Expected session-token to be rehydrated from its raw header, got %+v", token)
+	}
+	if cookies["csm-hit"] == nil || cookies["session-id"] == nil {
+		t.Fatalf("Expected raw and parsed cookies to be merged, got %v", got.Cookies)
+	}
+}
+
+func TestBindProxy(t *testing.T) {
+	ctx := context.Background()
+	exitCountries := map[string]string{"http://us-proxy:8080": "us", "http://de-proxy:8080": "DE"}
+	sessionManager := newTestSessionManager(t, &Config{
+		ProxyExitCountry: func(ctx context.Context, proxy string) (string, error) {
+			return exitCountries[proxy], nil
+		},
+	})
+
+	session := createTestSession("US", "session1", "token1")
+	session.Proxy = "http://de-proxy:8080"
+	if err := sessionManager.PushSession(ctx, session); err == nil {
+		t.Fatalf("Expected PushSession to refuse a geo-inconsistent proxy")
+	}
+	session.Proxy = "http://us-proxy:8080"
+	if err := sessionManager.PushSession(ctx, session); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+
+	if err := sessionManager.BindProxy(ctx, "US", "session1", "http://de-proxy:8080"); err == nil {
+		t.Fatalf("Expected BindProxy to refuse a geo-inconsistent proxy")
+	}
+	if err := sessionManager.BindProxy(ctx, "US", "missing", "http://us-proxy:8080"); err == nil {
+		t.Fatalf("Expected BindProxy to fail for a missing session")
+	}
+
+	var warned string
+	warnManager := newTestSessionManager(t, &Config{
+		ProxyExitCountry: func(ctx context.Context, proxy string) (string, error) {
+			return exitCountries[proxy], nil
+		},
+		OnProxyGeoMismatch: func(session *Session, exitCountry string) {
+			warned = exitCountry
+		},
+	})
+	if err := warnManager.PushSession(ctx, session); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	if err := warnManager.BindProxy(ctx, "US", "session1", "http://de-proxy:8080"); err != nil {
+		t.Fatalf("BindProxy failed: %v", err)
+	}
+	if warned != "DE" {
+		t.Fatalf("Expected a mismatch warning for DE, got %q", warned)
+	}
+	got, err := warnManager.GetSession(ctx, "US", "session1")
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if got.Proxy != "http://de-proxy:8080" {
+		t.Fatalf("Expected the proxy to be bound, got %q", got.Proxy)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	ctx := context.Background()
+	var events []string
+	sessionManager := newTestSessionManager(t, &Config{Hooks: Hooks{
+		OnPush: func(ctx context.Context, session *Session) {
+			events = append(events, "push:"+session.Country)
+		},
+		OnGet: func(ctx context.Context, session *Session) {
+			events = append(events, "get:"+session.SessionID)
+		},
+		OnDelete: func(ctx context.Context, country, sessionID string) {
+			events = append(events, "delete:"+sessionID)
+		},
+		OnCleanup: func(ctx context.Context) {
+			events = append(events, "cleanup")
+		},
+		OnValidationFail: func(ctx context.Context, country, sessionID string, failures int64) {
+			events = append(events, "fail:"+sessionID+":"+strconv.FormatInt(failures, 10))
+		},
+	}})
+
+	if err := sessionManager.PushSession(ctx, createTestSession("us", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	if _, err := sessionManager.GetRandomSession(ctx, "US"); err != nil {
+		t.Fatalf("GetRandomSession failed: %v", err)
+	}
+	if _, err := sessionManager.RecordFailure(ctx, "US", "session1"); err != nil {
+		t.Fatalf("RecordFailure failed: %v", err)
+	}
+	if _, err := sessionManager.DeleteSession(ctx, "US", "session1"); err != nil {
+		t.Fatalf("DeleteSession failed: %v", err)
+	}
+	if err := sessionManager.CleanupSessions(ctx, 3600, 100); err != nil {
+		t.Fatalf("CleanupSessions failed: %v", err)
+	}
+
+	want := []string{"push:US", "get:session1", "fail:session1:1", "delete:session1", "cleanup"}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Fatalf("Unexpected hook events %v, want %v", events, want)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	ctx := context.Background()
+	events := make(chan WebhookEvent, 10)
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first delivery to exercise the retries.
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Signature-256") != "sha256="+signWebhookPayload("secret", body) {
+			t.Errorf("Invalid webhook signature %q", r.Header.Get("X-Signature-256"))
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("Invalid webhook payload: %v", err)
+		}
+		events <- event
+	}))
+	defer server.Close()
+
+	sessionManager := newTestSessionManager(t, &Config{Webhook: &WebhookConfig{
+		URLs:             []string{server.URL},
+		Secret:           "secret",
+		PoolLowThreshold: 2,
+		RetryBackoff:     time.Millisecond,
+	}})
+	for _, id := range []string{"session1", "session2"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+	if _, err := sessionManager.PopSession(ctx, "US"); err != nil {
+		t.Fatalf("PopSession failed: %v", err)
+	}
+	event := waitWebhookEvent(t, events)
+	if event.Type != WebhookPoolLow || event.Country != "US" || event.Data["size"] != float64(1) {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+
+	if err := sessionManager.CleanupSessions(ctx, 3600, 100); err != nil {
+		t.Fatalf("CleanupSessions failed: %v", err)
+	}
+	event = waitWebhookEvent(t, events)
+	if event.Type != WebhookCleanupSummary || event.Data["total_removed"] != float64(0) {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+	// The pool is still low, so no new pool-low event is sent.
+	select {
+	case event := <-events:
+		t.Fatalf("Unexpected event %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Repairing a corrupt session reports its quarantine.
+	ids, err := sessionManager.GetCountrySessionIDs(ctx, "US")
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("GetCountrySessionIDs = %v, %v", ids, err)
+	}
+	if err := sessionManager.client.HSet(ctx, cookiesKey("US"), ids[0], "{not json").Err(); err != nil {
+		t.Fatalf("HSet error: %v", err)
+	}
+	if _, err := sessionManager.ListCountrySession(WithDecodeMode(ctx, DecodeRepair), "US"); err != nil {
+		t.Fatalf("ListCountrySession error: %v", err)
+	}
+	event = waitWebhookEvent(t, events)
+	if event.Type != WebhookSessionQuarantined || event.Country != "US" || event.Data["session_id"] != ids[0] || event.Data["error"] == "" {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+
+	if _, err := NewAmazonSession(&Config{Addr: "127.0.0.1:6379", Webhook: &WebhookConfig{URLs: []string{"ftp://example.com"}}}); err == nil {
+		t.Fatalf("Expected invalid webhook URLs to be rejected")
+	}
+}
+
+func waitWebhookEvent(t *testing.T, events chan WebhookEvent) WebhookEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for a webhook event")
+	}
+	return WebhookEvent{}
+}
+
+func TestSummaryHandler(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{Clock: clock})
+
+	for _, id := range []string{"session1", "session2"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+	if _, err := sessionManager.RecordFailure(ctx, "US", "session1"); err != nil {
+		t.Fatalf("RecordFailure failed: %v", err)
+	}
+	clock.now = clock.now.Add(time.Hour)
+
+	rec := httptest.NewRecorder()
+	sessionManager.SummaryHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/summary", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	var summary Summary
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("Invalid summary: %v", err)
+	}
+	for _, cs := range summary.Countries {
+		if cs.Country != "US" {
+			if cs.PoolSize != 0 {
+				t.Errorf("Unexpected pool size %d for %s", cs.PoolSize, cs.Country)
+			}
+			continue
+		}
+		want := CountrySummary{Country: "US", PoolSize: 2, FailingCount: 1, FailureRate: 0.5, StalestAge: 3600}
+		if *cs != want {
+			t.Fatalf("Unexpected US summary %+v, want %+v", *cs, want)
+		}
+		return
+	}
+	t.Fatalf("US missing from summary %+v", summary)
+}
+
+func TestCleanupSessionsWithResult(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{Clock: clock})
+
+	// More sessions than fit in one chunk, half of them stale.
+	for i := 0; i < cleanupChunkSize+100; i++ {
+		if i == (cleanupChunkSize+100)/2 {
+			clock.now = clock.now.Add(time.Hour)
+		}
+		if err := sessionManager.PushSession(ctx, createTestSession("US", "session"+strconv.Itoa(i), "token")); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+	if err := sessionManager.PushSession(ctx, createTestSession("DE", "session-de", "token")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	result, err := sessionManager.CleanupSessionsWithResult(canceled, 1800, 100)
+	if err == nil || result == nil || result.Scanned != 0 {
+		t.Fatalf("Expected a canceled cleanup with no progress, got %+v, %v", result, err)
+	}
+
+	result, err = sessionManager.CleanupSessionsWithResult(ctx, 1800, 100)
+	if err != nil {
+		t.Fatalf("CleanupSessionsWithResult failed: %v", err)
+	}
+	half := int64(cleanupChunkSize+100) / 2
+	if result.Scanned != 2*half+1 || result.Removed["US"] != half || result.Remaining["US"] != half || result.Remaining["DE"] != 1 {
+		t.Fatalf("Unexpected cleanup result %+v", result)
+	}
+}
+
+func TestRandomPickDistribution(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+	for i := 0; i < 12; i++ {
+		session := createTestSession("US", "130-2200000-00000"+strconv.Itoa(10+i), "token")
+		session.Canary = i >= 8
+		session.PostalCode = "10001"
+		if err := sessionManager.PushSession(ctx, session); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+
+	// Each pick spreads over the sessions, not only the first one.
+	picks := map[string]func() (*Session, error){
+		"GetRandomSession": func() (*Session, error) { return sessionManager.GetRandomSession(ctx, "US") },
+		"SelectSession":    func() (*Session, error) { return sessionManager.SelectSession(ctx, "US") },
+		"GetCanarySession": func() (*Session, error) { return sessionManager.GetCanarySession(ctx, "US") },
+	}
+	for name, pick := range picks {
+		seen := make(map[string]bool)
+		for i := 0; i < 200; i++ {
+			session, err := pick()
+			if err != nil {
+				t.Fatalf("%s error: %v", name, err)
+			}
+			seen[session.SessionID] = true
+		}
+		if len(seen) < 3 {
+			t.Errorf("%s picked only %v", name, seen)
+		}
+	}
+
+	// New affinity keys are bound across the pool.
+	bound := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		session, err := sessionManager.GetSessionFor(ctx, "US", "B00000"+strconv.Itoa(1000+i))
+		if err != nil {
+			t.Fatalf("GetSessionFor error: %v", err)
+		}
+		bound[session.SessionID] = true
+	}
+	if len(bound) < 3 {
+		t.Errorf("GetSessionFor bound new keys only to %v", bound)
+	}
+
+	// Filtered picks spread over the matching sessions.
+	filtered := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		session, err := sessionManager.GetRandomSession(ctx, "US", WithPostalCode("10001"))
+		if err != nil {
+			t.Fatalf("GetRandomSession error: %v", err)
+		}
+		filtered[session.SessionID] = true
+	}
+	if len(filtered) < 3 {
+		t.Errorf("GetRandomSession with a filter picked only %v", filtered)
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	ctx := context.Background()
+	push := func(sessionManager *AmazonSession) {
+		for _, id := range []string{"session1", "session2", "session3"} {
+			if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+				t.Fatalf("PushSession failed: %v", err)
+			}
+		}
+	}
+
+	sessionManager := newTestSessionManager(t, &Config{Selector: RoundRobinSelector()})
+	push(sessionManager)
+	var order []string
+	for i := 0; i < 4; i++ {
+		session, err := sessionManager.SelectSession(ctx, "US")
+		if err != nil {
+			t.Fatalf("SelectSession failed: %v", err)
+		}
+		order = append(order, session.SessionID)
+	}
+	if strings.Join(order, ",") != "session1,session2,session3,session1" {
+		t.Fatalf("Unexpected round-robin order %v", order)
+	}
+
+	sessionManager = newTestSessionManager(t, &Config{Selector: LeastUsedSelector()})
+	push(sessionManager)
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		session, err := sessionManager.SelectSession(ctx, "US")
+		if err != nil {
+			t.Fatalf("SelectSession failed: %v", err)
+		}
+		seen[session.SessionID] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("Expected the least-used selector to spread usage, got %v", seen)
+	}
+
+	sessionManager = newTestSessionManager(t, &Config{Selector: ScoreWeightedSelector()})
+	push(sessionManager)
+	if _, err := sessionManager.SelectSession(ctx, "US"); err != nil {
+		t.Fatalf("SelectSession failed: %v", err)
+	}
+	if _, err := sessionManager.SelectSession(ctx, "DE"); err == nil {
+		t.Fatalf("Expected an error for an empty pool")
+	}
+
+	sessionManager = newTestSessionManager(t, nil)
+	push(sessionManager)
+	if _, err := sessionManager.SelectSession(ctx, "US"); err != nil {
+		t.Fatalf("SelectSession with the default selector failed: %v", err)
+	}
+}
+
+func TestFailureScoreDecay(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{Clock: clock, FailureHalfLife: time.Hour})
+
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := sessionManager.RecordFailure(ctx, "US", "session1"); err != nil {
+			t.Fatalf("RecordFailure failed: %v", err)
+		}
+	}
+
+	score := func() float64 {
+		session, err := sessionManager.GetSession(ctx, "US", "session1")
+		if err != nil {
+			t.Fatalf("GetSession failed: %v", err)
+		}
+		return session.FailureScore
+	}
+	if got := score(); got != 2 {
+		t.Fatalf("Expected a failure score of 2, got %v", got)
+	}
+	clock.now = clock.now.Add(2 * time.Hour)
+	if got := score(); got != 0.5 {
+		t.Fatalf("Expected the score to decay to 0.5 after two half-lives, got %v", got)
+	}
+	if _, err := sessionManager.RecordFailure(ctx, "US", "session1"); err != nil {
+		t.Fatalf("RecordFailure failed: %v", err)
+	}
+	if got := score(); got != 1.5 {
+		t.Fatalf("Expected the decayed score plus one, got %v", got)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{
+		Clock:          clock,
+		CircuitBreaker: &CircuitBreakerConfig{FailureThreshold: 2, Window: time.Minute, Cooldown: 30 * time.Second},
+	})
+
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	if err := sessionManager.PushSession(ctx, createTestSession("CA", "session2", "token2")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := sessionManager.RecordFailure(ctx, "US", "session1"); err != nil {
+			t.Fatalf("RecordFailure failed: %v", err)
+		}
+	}
+	if _, err := sessionManager.GetSession(ctx, "US", "session1"); err != ErrCountryTripped {
+		t.Fatalf("Expected ErrCountryTripped, got %v", err)
+	}
+	session, err := sessionManager.PopSessionWithFallback(ctx, "US", "CA")
+	if err != nil || session.Country != "CA" {
+		t.Fatalf("Expected the fallback to skip the tripped country, got %v, %v", session, err)
+	}
+
+	// After the cooldown a single probe is let through.
+	clock.now = clock.now.Add(time.Minute)
+	if _, err := sessionManager.GetSession(ctx, "US", "session1"); err != nil {
+		t.Fatalf("Expected a half-open probe, got %v", err)
+	}
+	if _, err := sessionManager.GetSession(ctx, "US", "session1"); err != ErrCountryTripped {
+		t.Fatalf("Expected ErrCountryTripped while probing, got %v", err)
+	}
+	if err := sessionManager.TouchSession(ctx, "US", "session1"); err != nil {
+		t.Fatalf("TouchSession failed: %v", err)
+	}
+	if _, err := sessionManager.GetSession(ctx, "US", "session1"); err != nil {
+		t.Fatalf("Expected the breaker to be closed, got %v", err)
+	}
+}
+
+func TestMaxConcurrentOps(t *testing.T) {
+	limiter := newConcurrencyLimiter(1)
+	if err := limiter.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the second acquire to time out, got %v", err)
+	}
+	limiter.release()
+
+	ctx = context.Background()
+	sessionManager := newTestSessionManager(t, &Config{MaxConcurrentOps: 2})
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := sessionManager.GetRandomSession(ctx, "US")
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("GetRandomSession failed: %v", err)
+		}
+	}
+}
+
+func TestRepairPool(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{})
+
+	session := createTestSession("US", "session1", "token1")
+	session.Generation = "g1"
+	if err := sessionManager.PushSession(ctx, session); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session2", "token2")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	// Drop session1 from the list and leave a dangling id and field behind.
+	client := sessionManager.client
+	if err := client.LRem(ctx, sessionIdsKey("US"), 0, "session1").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SRem(ctx, generationIndexKey("US", "g1"), "session1").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RPush(ctx, sessionIdsKey("US"), "ghost").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.HSet(ctx, cookiesKey("US"), usageCountKey("stale"), 3).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := sessionManager.RepairPool(ctx, "US")
+	if err != nil {
+		t.Fatalf("RepairPool failed: %v", err)
+	}
+	if strings.Join(report.RemovedIDs, ",") != "ghost" || strings.Join(report.RestoredIDs, ",") != "session1" || report.OrphanFields != 1 {
+		t.Fatalf("Unexpected repair report: %+v", report)
+	}
+	ids, _ := sessionManager.GetCountrySessionIDs(ctx, "US")
+	if strings.Join(ids, ",") != "session2,session1" {
+		t.Fatalf("Unexpected pool after repair: %v", ids)
+	}
+	if members, _ := client.SMembers(ctx, generationIndexKey("US", "g1")).Result(); len(members) != 1 {
+		t.Fatalf("Expected session1 to be re-indexed, got %v", members)
+	}
+
+	report, err = sessionManager.RepairPool(ctx, "US")
+	if err != nil || len(report.RemovedIDs)+len(report.RestoredIDs) != 0 || report.OrphanFields != 0 {
+		t.Fatalf("Expected a consistent pool, got %+v, %v", report, err)
+	}
+}
+
+func TestRepairPoolSkipsBorrowed(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{})
+
+	for _, id := range []string{"130-0000001-0000001", "130-0000001-0000002"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+	popped, err := sessionManager.PopSession(ctx, "US")
+	if err != nil {
+		t.Fatalf("PopSession failed: %v", err)
+	}
+
+	// The popped session is held by its caller, not missing from the pool.
+	report, err := sessionManager.RepairPool(ctx, "US")
+	if err != nil {
+		t.Fatalf("RepairPool failed: %v", err)
+	}
+	if len(report.RestoredIDs) != 0 {
+		t.Fatalf("Expected the borrowed session not to be restored, got %+v", report)
+	}
+	ids, _ := sessionManager.GetCountrySessionIDs(ctx, "US")
+	for _, id := range ids {
+		if id == popped.SessionID {
+			t.Fatalf("Expected the borrowed session to stay out of the pool, got %v", ids)
+		}
+	}
+}
+
+func TestIntegrityHandler(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{})
+
+	for _, id := range []string{"session1", "session2"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+	report, err := sessionManager.VerifyIntegrity(ctx)
+	if err != nil || !report.OK() {
+		t.Fatalf("Expected a consistent pool, got %+v, %v", report, err)
+	}
+
+	// A checked out session is not unlisted.
+	popped, err := sessionManager.PopSession(ctx, "US")
+	if err != nil {
+		t.Fatalf("PopSession failed: %v", err)
+	}
+	report, err = sessionManager.VerifyIntegrity(ctx)
+	if err != nil || !report.OK() {
+		t.Fatalf("Expected a consistent pool with a borrowed session, got %+v, %v", report, err)
+	}
+	if err := sessionManager.ReturnSession(ctx, popped); err != nil {
+		t.Fatalf("ReturnSession failed: %v", err)
+	}
+
+	client := sessionManager.client
+	if err := client.RPush(ctx, sessionIdsKey("US"), "session1", "ghost").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.HDel(ctx, cookiesKey("US"), usageCountKey("session2")).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.HSet(ctx, affinitiesKey("US"), "B000000001", "ghost").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	sessionManager.IntegrityHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/integrity", nil))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid report: %v", err)
+	}
+	var kinds []string
+	for _, v := range report.Violations {
+		kinds = append(kinds, v.Kind+":"+v.SessionID)
+	}
+	want := "duplicate-id:session1,missing-cookies:ghost,missing-counter:session2,stale-affinity:ghost"
+	if got := strings.Join(kinds, ","); got != want {
+		t.Fatalf("Unexpected violations %s, want %s", got, want)
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{})
+
+	usage, err := sessionManager.MemoryUsage(ctx, "US")
+	if err != nil || usage.Total != 0 {
+		t.Fatalf("Expected no memory usage for an empty pool, got %+v, %v", usage, err)
+	}
+	session := createTestSession("US", "session1", "token1")
+	session.Labels = map[string]string{"proxy-pool": "residential-us"}
+	if err := sessionManager.PushSession(ctx, session); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	usage, err = sessionManager.MemoryUsage(ctx, "us")
+	if err != nil {
+		t.Fatalf("MemoryUsage failed: %v", err)
+	}
+	if usage.Country != "US" || usage.Cookies == 0 || usage.Lists == 0 || usage.Indexes == 0 {
+		t.Fatalf("Unexpected memory usage %+v", usage)
+	}
+	if usage.Total != usage.Cookies+usage.Lists+usage.Indexes+usage.Other {
+		t.Fatalf("Total does not add up: %+v", usage)
+	}
+}
+
+func TestTimestampFormatRFC3339(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{Clock: clock, TimestampFormat: TimestampRFC3339})
+
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	stored, err := sessionManager.client.HGet(ctx, cookiesKey("US"), createdAtKey("session1")).Result()
+	if err != nil || stored != "2023-11-14T22:13:20Z" {
+		t.Fatalf("Expected an RFC 3339 timestamp, got %q, %v", stored, err)
+	}
+	// Timestamps written in the other format stay readable.
+	if err := sessionManager.PushSessionWithOptions(ctx, createTestSession("US", "session2", "token2"), nil); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	if err := sessionManager.client.HSet(ctx, cookiesKey("US"), lastCheckedKey("session2"), 1690000000).Err(); err != nil {
+		t.Fatal(err)
+	}
+	session, err := sessionManager.GetSession(ctx, "US", "session1")
+	if err != nil || !session.CreatedAt.Equal(clock.now) || !session.LastChecked.Equal(clock.now) {
+		t.Fatalf("Unexpected timestamps %v, %v: %v", session.CreatedAt, session.LastChecked, err)
+	}
+
+	clock.now = clock.now.Add(time.Hour)
+	summary, err := sessionManager.GetSummary(ctx)
+	if err != nil {
+		t.Fatalf("GetSummary failed: %v", err)
+	}
+	for _, cs := range summary.Countries {
+		if cs.Country == "US" && cs.StalestAge != clock.now.Unix()-1690000000 {
+			t.Fatalf("Unexpected stalest age %d", cs.StalestAge)
+		}
+	}
+	if err := sessionManager.CleanupSessions(ctx, 1800, 100); err != nil {
+		t.Fatalf("CleanupSessions failed: %v", err)
+	}
+	if ids, _ := sessionManager.GetCountrySessionIDs(ctx, "US"); len(ids) != 0 {
+		t.Fatalf("Expected stale RFC 3339 and Unix sessions to be cleaned up, got %v", ids)
+	}
+}
+
+func TestPushSessionIfDirty(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{})
+
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	session, err := sessionManager.GetSession(ctx, "US", "session1")
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if pushed, err := sessionManager.PushSessionIfDirty(ctx, session); err != nil || pushed {
+		t.Fatalf("PushSessionIfDirty = %v, %v; want false for a loaded session", pushed, err)
+	}
+
+	done := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			if err := sessionManager.RefreshTelemetryCookies(session); err != nil {
+				t.Errorf("RefreshTelemetryCookies failed: %v", err)
+			}
+			session.CookieHeader()
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+	if pushed, err := sessionManager.PushSessionIfDirty(ctx, session); err != nil || pushed {
+		t.Fatalf("PushSessionIfDirty = %v, %v; want false after RefreshTelemetryCookies", pushed, err)
+	}
+
+	for i := 0; i < 8; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			session.SetCookie("i18n-prefs", "EUR", time.Now().Add(time.Hour))
+			session.CookieHeader()
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+	if pushed, err := sessionManager.PushSessionIfDirty(ctx, session); err != nil || !pushed {
+		t.Fatalf("PushSessionIfDirty = %v, %v; want true after SetCookie", pushed, err)
+	}
+	if session.Dirty() {
+		t.Fatalf("Expected the dirty flag to be cleared after the push")
+	}
+	stored, err := sessionManager.GetSession(ctx, "US", "session1")
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if c, ok := stored.Cookie("i18n-prefs"); !ok || c.Value != "EUR" {
+		t.Fatalf("Expected the changed cookie to be stored, got %v", c)
+	}
+}
+
+func TestSessionIDExtractor(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{
+		SessionIDExtractor: func(cookies []*http.Cookie) (string, error) {
+			for _, c := range cookies {
+				if c.Name == "x-amz-sid" {
+					return strings.TrimPrefix(c.Value, "wrapped:"), nil
+				}
+			}
+			return "", nil
+		},
+	})
+
+	session := NewSession("US", "", []*http.Cookie{
+		{Name: "x-amz-sid", Value: "wrapped:session1"},
+		{Name: "session-token", Value: "token1"},
+	})
+	if err := sessionManager.PushSession(ctx, session); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	stored, err := sessionManager.GetSession(ctx, "US", "session1")
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if c, ok := stored.Cookie("session-id"); !ok || c.Value != "session1" {
+		t.Fatalf("Expected the extracted session-id to be stored, got %v", c)
+	}
+
+	if err := sessionManager.PushSession(ctx, NewSession("US", "", []*http.Cookie{{Name: "session-token", Value: "token2"}})); err == nil {
+		t.Fatalf("Expected PushSession to fail when no session-id is extracted")
+	}
+}
+
+func TestCookieValidation(t *testing.T) {
+	ctx := context.Background()
+	valid := func() *Session {
+		return NewSession("US", "", []*http.Cookie{
+			{Name: "session-id", Value: "123-1234567-1234567"},
+			{Name: "ubid-main", Value: "123-7654321-7654321"},
+			{Name: "i18n-prefs", Value: "USD", Domain: ".amazon.com"},
+		})
+	}
+	malformed := func() *Session {
+		return NewSession("US", "", []*http.Cookie{
+			{Name: "session-id", Value: "session1"},
+			{Name: "ubid-main", Value: "123-7654321-7654321"},
+			{Name: "i18n-prefs", Value: "XXX", Domain: ".amazon.de"},
+		})
+	}
+
+	sessionManager := newTestSessionManager(t, &Config{CookieValidation: ValidationStrict})
+	if err := sessionManager.PushSession(ctx, valid()); err != nil {
+		t.Fatalf("PushSession failed for a valid session: %v", err)
+	}
+	err := sessionManager.PushSession(ctx, malformed())
+	verr, ok := err.(*CookieValidationError)
+	if !ok || len(verr.Problems) != 3 {
+		t.Fatalf("Expected a CookieValidationError with 3 problems, got %v", err)
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "US", "session1"); exists {
+		t.Fatalf("Expected the malformed session to be rejected")
+	}
+
+	var reported []string
+	sessionManager = newTestSessionManager(t, &Config{
+		CookieValidation: ValidationReport,
+		Hooks: Hooks{OnInvalidCookies: func(ctx context.Context, session *Session, problems []string) {
+			reported = problems
+		}},
+	})
+	if err := sessionManager.PushSession(ctx, malformed()); err != nil {
+		t.Fatalf("PushSession failed in report mode: %v", err)
+	}
+	if len(reported) != 3 {
+		t.Fatalf("Expected 3 reported problems, got %v", reported)
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "US", "session1"); !exists {
+		t.Fatalf("Expected the malformed session to be stored in report mode")
+	}
+}
+
+func TestCrossCountryPush(t *testing.T) {
+	ctx := context.Background()
+
+	sessionManager := newTestSessionManager(t, &Config{})
+	for _, country := range []string{"US", "CA"} {
+		if err := sessionManager.PushSession(ctx, createTestSession(country, "session1", "token1")); err != nil {
+			t.Fatalf("PushSession failed: %v", err)
+		}
+	}
+	if countries, err := sessionManager.sessionCountries(ctx, "session1"); err != nil || strings.Join(countries, ",") != "US,CA" {
+		t.Fatalf("Expected the index to reference both countries, got %v, %v", countries, err)
+	}
+	if _, err := sessionManager.DeleteSession(ctx, "US", "session1"); err != nil {
+		t.Fatalf("DeleteSession failed: %v", err)
+	}
+	if countries, _ := sessionManager.sessionCountries(ctx, "session1"); strings.Join(countries, ",") != "CA" {
+		t.Fatalf("Expected the index to drop the deleted country, got %v", countries)
+	}
+
+	sessionManager = newTestSessionManager(t, &Config{CrossCountryPush: CrossCountryReject})
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token1")); err != nil {
+		t.Fatalf("Expected a re-push to the same country to succeed, got %v", err)
+	}
+	err := sessionManager.PushSession(ctx, createTestSession("CA", "session1", "token1"))
+	if conflict, ok := err.(*SessionConflictError); !ok || strings.Join(conflict.Countries, ",") != "US" {
+		t.Fatalf("Expected a SessionConflictError, got %v", err)
+	}
+
+	sessionManager = newTestSessionManager(t, &Config{CrossCountryPush: CrossCountryMerge})
+	session := createTestSession("US", "session1", "token1")
+	session.PostalCode = "10001"
+	if err := sessionManager.PushSessionWithOptions(ctx, session, &PushOptions{UsageCount: 5}); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	if err := sessionManager.PushSession(ctx, createTestSession("CA", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "US", "session1"); exists {
+		t.Fatalf("Expected the session to be moved out of US")
+	}
+	merged, err := sessionManager.GetSession(ctx, "CA", "session1")
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if merged.PostalCode != "10001" || merged.UsageCount != 6 {
+		t.Fatalf("Expected the metadata to be merged, got postal code %q, usage count %d", merged.PostalCode, merged.UsageCount)
+	}
+}
+
+func TestLookupSession(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{})
+
+	if err := sessionManager.PushSession(ctx, createTestSession("DE", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	session, err := sessionManager.LookupSession(ctx, "session1")
+	if err != nil || session.Country != "DE" || session.SessionID != "session1" {
+		t.Fatalf("LookupSession = %+v, %v", session, err)
+	}
+	if err := sessionManager.FlushCountry(ctx, "DE"); err != nil {
+		t.Fatalf("FlushCountry failed: %v", err)
+	}
+	if _, err := sessionManager.LookupSession(ctx, "session1"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("Expected ErrSessionNotFound after the country was flushed, got %v", err)
+	}
+	if _, err := sessionManager.LookupSession(ctx, "missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("Expected ErrSessionNotFound for an unknown session, got %v", err)
+	}
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{})
+
+	session := createTestSession("US", "session1", "token1")
+	session.Generation = "g1"
+	if err := sessionManager.PushSession(ctx, session); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	// Simulate a pool created before the indexes existed, plus a stale entry.
+	client := sessionManager.client
+	if err := client.Del(ctx, sessionIndexKey, generationIndexKey("US", "g1"), generationRegistryKey("US")).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.HSet(ctx, sessionIndexKey, "ghost", "US").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := sessionManager.RebuildIndexes(ctx)
+	if err != nil {
+		t.Fatalf("RebuildIndexes failed: %v", err)
+	}
+	if result.Indexed["US"] != 1 || result.Pruned != 1 {
+		t.Fatalf("Unexpected rebuild result %+v", result)
+	}
+	if found, err := sessionManager.LookupSession(ctx, "session1"); err != nil || found.Country != "US" {
+		t.Fatalf("Expected the session index to be backfilled, got %v", err)
+	}
+	if generations, _ := sessionManager.ListGenerations(ctx, "US"); strings.Join(generations, ",") != "g1" {
+		t.Fatalf("Expected the generation index to be backfilled, got %v", generations)
+	}
+	if countries, _ := sessionManager.LookupSessionCountries(ctx, "ghost"); len(countries) != 0 {
+		t.Fatalf("Expected the stale entry to be pruned, got %v", countries)
+	}
+}
+
+func TestReadPreference(t *testing.T) {
+	ctx := context.Background()
+	replica := miniredis.RunT(t)
+	replica.RequireAuth("123456")
+	sessionManager := newTestSessionManager(t, &Config{ReplicaAddrs: []string{replica.Addr()}})
+
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "session1", "token1")); err != nil {
+		t.Fatalf("PushSession failed: %v", err)
+	}
+	// The replica lags behind and holds an older pool.
+	if _, err := replica.DB(10).Push(sessionIdsKey("US"), "stale"); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := sessionManager.GetCountrySessionIDs(ctx, "US")
+	if err != nil || strings.Join(ids, ",") != "session1" {
+		t.Fatalf("Expected primary reads by default, got %v, %v", ids, err)
+	}
+	ids, err = sessionManager.GetCountrySessionIDs(WithReadPreference(ctx, ReadReplica), "US")
+	if err != nil || strings.Join(ids, ",") != "stale" {
+		t.Fatalf("Expected replica reads, got %v, %v", ids, err)
+	}
+	if _, err := sessionManager.GetSession(WithReadPreference(ctx, ReadReplica), "US", "session1"); err != nil {
+		t.Fatalf("Expected GetSession to use the primary, got %v", err)
+	}
+}
+
+type doerFunc func(req *http.Request) (*http.Response, error)
+
+func (f doerFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestSetDeliveryLocationWithHTTPDoer(t *testing.T) {
+	ctx := context.Background()
+	var paths []string
+	doer := doerFunc(func(req *http.Request) (*http.Response, error) {
+		if _, err := req.Cookie("session-token"); err != nil {
+			t.Errorf("session cookies not sent to %s", req.URL.Path)
+		}
+		paths = append(paths, req.URL.Path)
+		resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Request: req}
+		var body string
+		switch {
+		case req.URL.Path == "/":
+			body = `{"anti-csrftoken-a2z":"modal-token"}`
+		case strings.HasSuffix(req.URL.Path, "/get-rendered-address-selections"):
+			body = `CSRF_TOKEN : "csrf-token"`
+		default:
+			if req.Header.Get("anti-csrftoken-a2z") != "csrf-token" {
+				t.Errorf("unexpected csrf token: %q", req.Header.Get("anti-csrftoken-a2z"))
+			}
+			resp.Header.Add("Set-Cookie", "glow-location=10001; Path=/; Domain=.amazon.com")
+			body = `{"isValidAddress":1}`
+		}
+		resp.Body = io.NopCloser(strings.NewReader(body))
+		return resp, nil
+	})
+	sessionManager := newTestSessionManager(t, &Config{HTTPDoer: doer})
+
+	session := createTestSession("US", "130-5049578-3628049", "token")
+	if err := sessionManager.SetDeliveryLocation(ctx, session, "10001"); err != nil {
+		t.Fatalf("SetDeliveryLocation error: %v", err)
+	}
+	if len(paths) != 3 {
+		t.Fatalf("expected 3 requests, got %v", paths)
+	}
+
+	stored, err := sessionManager.GetSession(ctx, "US", "130-5049578-3628049")
+	if err != nil {
+		t.Fatalf("GetSession error: %v", err)
+	}
+	if stored.PostalCode != "10001" {
+		t.Fatalf("expected postal code 10001, got %q", stored.PostalCode)
+	}
+	if c, found := stored.Cookie("glow-location"); !found || c.Value != "10001" {
+		t.Fatalf("expected cookie from the doer response to be stored, got %v", c)
+	}
+}
+
+func TestPushSessionMigratesRotatedSessionID(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	for _, id := range []string{"130-0000001-0000001", "130-0000002-0000002", "130-0000003-0000003"} {
+		session := createTestSession("US", id, "token")
+		if id == "130-0000002-0000002" {
+			session.Labels = map[string]string{"pool": "residential"}
+		}
+		if err := sessionManager.PushSession(ctx, session); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+	if err := sessionManager.TouchSession(ctx, "US", "130-0000002-0000002"); err != nil {
+		t.Fatalf("TouchSession error: %v", err)
+	}
+
+	session, err := sessionManager.GetSession(ctx, "US", "130-0000002-0000002")
+	if err != nil {
+		t.Fatalf("GetSession error: %v", err)
+	}
+	if err := session.SetCookie("session-id", "130-0000004-0000004", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("SetCookie error: %v", err)
+	}
+	if err := sessionManager.PushSession(ctx, session); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if session.SessionID != "130-0000004-0000004" {
+		t.Fatalf("expected session id to be updated, got %s", session.SessionID)
+	}
+
+	ids, err := sessionManager.GetCountrySessionIDs(ctx, "US")
+	if err != nil {
+		t.Fatalf("GetCountrySessionIDs error: %v", err)
+	}
+	if want := []string{"130-0000001-0000001", "130-0000004-0000004", "130-0000003-0000003"}; strings.Join(ids, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected ids %v, got %v", want, ids)
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "US", "130-0000002-0000002"); exists {
+		t.Fatal("expected old session id to be removed")
+	}
+
+	migrated, err := sessionManager.GetSession(ctx, "US", "130-0000004-0000004")
+	if err != nil {
+		t.Fatalf("GetSession error: %v", err)
+	}
+	if migrated.UsageCount != session.UsageCount+1 || migrated.Labels["pool"] != "residential" {
+		t.Fatalf("expected stats and labels to be kept, got usage %d labels %v", migrated.UsageCount, migrated.Labels)
+	}
+	labeled, err := sessionManager.ListSessionIDsByLabel(ctx, "US", "pool", "residential")
+	if err != nil || len(labeled) != 1 || labeled[0] != "130-0000004-0000004" {
+		t.Fatalf("expected label index to be migrated, got %v (%v)", labeled, err)
+	}
+	countries, err := sessionManager.LookupSessionCountries(ctx, "130-0000002-0000002")
+	if err != nil || len(countries) != 0 {
+		t.Fatalf("expected old id to be removed from the session index, got %v (%v)", countries, err)
+	}
+
+	renamed, err := sessionManager.RenameSession(ctx, "US", "130-0000002-0000002", "130-0000005-0000005")
+	if err != nil || renamed {
+		t.Fatalf("expected renaming a missing session to be a no-op, got %v (%v)", renamed, err)
+	}
+}
+
+type providerFunc func(ctx context.Context, country string) (*Session, error)
+
+func (f providerFunc) NewSession(ctx context.Context, country string) (*Session, error) {
+	return f(ctx, country)
+}
+
+func TestGetRandomSessionRotationPolicy(t *testing.T) {
+	ctx := context.Background()
+	provided := 0
+	provider := providerFunc(func(ctx context.Context, country string) (*Session, error) {
+		provided++
+		return createTestSession(country, "130-9000000-000000"+strconv.Itoa(provided), "fresh"), nil
+	})
+	sessionManager := newTestSessionManager(t, &Config{
+		RotationPolicy:  &RotationPolicy{MaxRequests: 2},
+		SessionProvider: provider,
+	})
+
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "130-1000000-0000001", "token")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		session, err := sessionManager.GetRandomSession(ctx, "US")
+		if err != nil {
+			t.Fatalf("GetRandomSession error: %v", err)
+		}
+		if session.SessionID != "130-1000000-0000001" {
+			t.Fatalf("expected stored session, got %s", session.SessionID)
+		}
+	}
+
+	// The third checkout exceeds MaxRequests.
+	session, err := sessionManager.GetRandomSession(ctx, "US")
+	if err != nil {
+		t.Fatalf("GetRandomSession error: %v", err)
+	}
+	if session.SessionID != "130-9000000-0000001" || provided != 1 {
+		t.Fatalf("expected session from the provider, got %s", session.SessionID)
+	}
+	ids, err := sessionManager.GetCountrySessionIDs(ctx, "US")
+	if err != nil {
+		t.Fatalf("GetCountrySessionIDs error: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != "130-9000000-0000001" {
+		t.Fatalf("expected rotated session to be replaced, got %v", ids)
+	}
+
+	// Without a provider, rotated sessions are removed until none are left.
+	sessionManager = newTestSessionManager(t, &Config{RotationPolicy: &RotationPolicy{RotateOnFailure: true}})
+	for _, id := range []string{"130-1000000-0000001", "130-1000000-0000002"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+	if _, err := sessionManager.RecordFailure(ctx, "US", "130-1000000-0000001"); err != nil {
+		t.Fatalf("RecordFailure error: %v", err)
+	}
+	session, err = sessionManager.GetRandomSession(ctx, "US")
+	if err != nil {
+		t.Fatalf("GetRandomSession error: %v", err)
+	}
+	if session.SessionID != "130-1000000-0000002" {
+		t.Fatalf("expected healthy session, got %s", session.SessionID)
+	}
+}
+
+func TestPopSessionRotationPolicy(t *testing.T) {
+	ctx := context.Background()
+	provided := 0
+	provider := providerFunc(func(ctx context.Context, country string) (*Session, error) {
+		provided++
+		return createTestSession(country, "130-9000000-000000"+strconv.Itoa(provided), "fresh"), nil
+	})
+	sessionManager := newTestSessionManager(t, &Config{
+		RotationPolicy:  &RotationPolicy{RotateOnFailure: true},
+		SessionProvider: provider,
+	})
+
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "130-1000000-0000001", "token")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if _, err := sessionManager.RecordFailure(ctx, "US", "130-1000000-0000001"); err != nil {
+		t.Fatalf("RecordFailure error: %v", err)
+	}
+	session, err := sessionManager.PopSession(ctx, "US")
+	if err != nil {
+		t.Fatalf("PopSession error: %v", err)
+	}
+	if session.SessionID != "130-9000000-0000001" {
+		t.Fatalf("expected the replacement to be popped, got %s", session.SessionID)
+	}
+	status, err := sessionManager.GetDrainStatus(ctx, "US")
+	if err != nil || status.CheckedOut != 1 {
+		t.Fatalf("expected only the replacement to be checked out, got %+v, %v", status, err)
+	}
+	if err := sessionManager.ReturnSession(ctx, session); err != nil {
+		t.Fatalf("ReturnSession error: %v", err)
+	}
+
+	// A bound session due for rotation is replaced and the key rebound.
+	bound, err := sessionManager.GetSessionFor(ctx, "US", "B000000001")
+	if err != nil {
+		t.Fatalf("GetSessionFor error: %v", err)
+	}
+	if _, err := sessionManager.RecordFailure(ctx, "US", bound.SessionID); err != nil {
+		t.Fatalf("RecordFailure error: %v", err)
+	}
+	session, err = sessionManager.GetSessionFor(ctx, "US", "B000000001")
+	if err != nil {
+		t.Fatalf("GetSessionFor error: %v", err)
+	}
+	if session.SessionID == bound.SessionID || session.SessionID != "130-9000000-0000002" {
+		t.Fatalf("expected the replacement to be bound, got %s", session.SessionID)
+	}
+
+	// A provider returning no session fails the checkout.
+	sessionManager = newTestSessionManager(t, &Config{
+		RotationPolicy: &RotationPolicy{RotateOnFailure: true},
+		SessionProvider: providerFunc(func(ctx context.Context, country string) (*Session, error) {
+			return nil, nil
+		}),
+	})
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "130-1000000-0000001", "token")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if _, err := sessionManager.RecordFailure(ctx, "US", "130-1000000-0000001"); err != nil {
+		t.Fatalf("RecordFailure error: %v", err)
+	}
+	if _, err := sessionManager.PopSessionWithFallback(ctx, "US"); err == nil {
+		t.Fatalf("expected an error for a provider returning no session")
+	}
+}
+
+func TestPriorityTiers(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{TierPreference: []string{"premium", "standard"}})
+
+	tiers := map[string]string{
+		"130-2000000-0000001": "standard",
+		"130-2000000-0000002": "premium",
+		"130-2000000-0000003": "",
+	}
+	for id, tier := range tiers {
+		session := createTestSession("US", id, "token")
+		session.Tier = tier
+		if err := sessionManager.PushSession(ctx, session); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		session, err := sessionManager.GetRandomSession(ctx, "US")
+		if err != nil {
+			t.Fatalf("GetRandomSession error: %v", err)
+		}
+		if session.Tier != "premium" {
+			t.Fatalf("expected premium session, got %q", session.Tier)
+		}
+	}
+	// Sessions out of the pool are skipped: the next tier is used until the
+	// premium session is unpinned.
+	if err := sessionManager.Pin(ctx, "130-2000000-0000002", time.Minute); err != nil {
+		t.Fatalf("Pin error: %v", err)
+	}
+	if session, err := sessionManager.GetRandomSession(ctx, "US"); err != nil || session.Tier != "standard" {
+		t.Fatalf("expected standard session while premium is pinned, got %v (%v)", session, err)
+	}
+	if err := sessionManager.Unpin(ctx, "130-2000000-0000002"); err != nil {
+		t.Fatalf("Unpin error: %v", err)
+	}
+
+	session, err := sessionManager.GetRandomSession(ctx, "US", WithTierPreference("standard"))
+	if err != nil || session.SessionID != "130-2000000-0000001" {
+		t.Fatalf("expected standard session, got %v (%v)", session, err)
+	}
+	session, err = sessionManager.GetRandomSession(ctx, "US", WithTier("standard"), WithTierPreference("premium"))
+	if err != nil || session.SessionID != "130-2000000-0000001" {
+		t.Fatalf("expected standard session, got %v (%v)", session, err)
+	}
+
+	// Once the premium tier is empty the next tier is used.
+	if _, err := sessionManager.DeleteSession(ctx, "US", "130-2000000-0000002"); err != nil {
+		t.Fatalf("DeleteSession error: %v", err)
+	}
+	session, err = sessionManager.GetRandomSession(ctx, "US")
+	if err != nil || session.Tier != "standard" {
+		t.Fatalf("expected standard session, got %v (%v)", session, err)
+	}
+
+	stats, err := sessionManager.TierStats(ctx, "US")
+	if err != nil {
+		t.Fatalf("TierStats error: %v", err)
+	}
+	byTier := make(map[string]TierStat)
+	for _, stat := range stats {
+		byTier[stat.Tier] = stat
+	}
+	if len(byTier) != 2 || byTier["standard"].Sessions != 1 || byTier["standard"].UsageCount != 4 || byTier[""].UsageCount != 0 {
+		t.Fatalf("unexpected tier stats: %+v", stats)
+	}
+
+	// Deleted sessions leave the tier index, unlisted tiers rank last.
+	if _, err := sessionManager.DeleteSession(ctx, "US", "130-2000000-0000001"); err != nil {
+		t.Fatalf("DeleteSession error: %v", err)
+	}
+	if ids, err := sessionManager.client.SMembers(ctx, tierIndexKey("US", "standard")).Result(); err != nil || len(ids) != 0 {
+		t.Fatalf("expected the standard tier index to be empty, got %v (%v)", ids, err)
+	}
+	if session, err := sessionManager.GetRandomSession(ctx, "US"); err != nil || session.SessionID != "130-2000000-0000003" {
+		t.Fatalf("expected the untiered session, got %v (%v)", session, err)
+	}
+	if report, err := sessionManager.VerifyIntegrity(ctx); err != nil || !report.OK() {
+		t.Fatalf("VerifyIntegrity = %+v, %v", report, err)
+	}
+
+	// A tier larger than the sample of the pick is scanned when the sample
+	// is out of the pool.
+	for i := 0; i < 20; i++ {
+		session := createTestSession("US", "130-2100000-00000"+strconv.Itoa(10+i), "token")
+		session.Tier = "premium"
+		if err := sessionManager.PushSession(ctx, session); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+		if i > 0 {
+			if err := sessionManager.Pin(ctx, session.SessionID, time.Minute); err != nil {
+				t.Fatalf("Pin error: %v", err)
+			}
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if session, err := sessionManager.GetRandomSession(ctx, "US"); err != nil || session.SessionID != "130-2100000-0000010" {
+			t.Fatalf("expected the only premium session in the pool, got %v (%v)", session, err)
+		}
+	}
+}
+
+func TestPopSessionBorrowLimit(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+	for _, id := range []string{"130-3000000-0000001", "130-3000000-0000002", "130-3000000-0000003"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+
+	handler := sessionManager.BorrowHandler()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/borrows?country=US&limit=1", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	workerA := WithCaller(ctx, "worker-a")
+	borrowed, err := sessionManager.PopSession(workerA, "US")
+	if err != nil {
+		t.Fatalf("PopSession error: %v", err)
+	}
+	if _, err := sessionManager.PopSession(workerA, "US"); err != ErrFairShareExceeded {
+		t.Fatalf("expected ErrFairShareExceeded, got %v", err)
+	}
+	if _, err := sessionManager.PopSessionWithFallback(workerA, "US"); err != ErrFairShareExceeded {
+		t.Fatalf("expected ErrFairShareExceeded from fallback, got %v", err)
+	}
+	if _, err := sessionManager.PopSession(WithCaller(ctx, "worker-b"), "US"); err != nil {
+		t.Fatalf("expected other caller to borrow, got %v", err)
+	}
+	if _, err := sessionManager.PopSession(ctx, "US"); err != nil {
+		t.Fatalf("expected untracked caller to borrow, got %v", err)
+	}
+
+	if err := sessionManager.ReturnSession(workerA, borrowed); err != nil {
+		t.Fatalf("ReturnSession error: %v", err)
+	}
+	if _, err := sessionManager.PopSession(workerA, "US"); err != nil {
+		t.Fatalf("expected borrow after return, got %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/borrows?country=US", nil))
+	var stats []BorrowStat
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	want := []BorrowStat{
+		{Caller: "*", Limit: 1},
+		{Caller: "worker-a", Borrowed: 1, Total: 2},
+		{Caller: "worker-b", Borrowed: 1, Total: 1},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("expected stats %+v, got %+v", want, stats)
+	}
+	for i := range want {
+		if stats[i] != want[i] {
+			t.Fatalf("expected stats %+v, got %+v", want, stats)
+		}
+	}
+}
+
+func TestUsageWindows(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{
+		Clock:       clock,
+		UsageWindow: time.Hour,
+		Selector:    LeastRecentlyUsedSelector(time.Hour),
+	})
+	for _, id := range []string{"130-4000000-0000001", "130-4000000-0000002"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+
+	// The first session is used heavily, then the second one an hour later.
+	for i := 0; i < 3; i++ {
+		if _, err := sessionManager.GetSession(ctx, "US", "130-4000000-0000001"); err != nil {
+			t.Fatalf("GetSession error: %v", err)
+		}
+	}
+	clock.now = clock.now.Add(2 * time.Hour)
+	if _, err := sessionManager.GetSession(ctx, "US", "130-4000000-0000002"); err != nil {
+		t.Fatalf("GetSession error: %v", err)
+	}
+
+	session, err := sessionManager.GetSession(ctx, "US", "130-4000000-0000001")
+	if err != nil {
+		t.Fatalf("GetSession error: %v", err)
+	}
+	if session.UsageCount != 4 || session.UsageLastHour != 1 || session.UsageLastDay != 4 {
+		t.Fatalf("unexpected usage: total %d, hour %d, day %d", session.UsageCount, session.UsageLastHour, session.UsageLastDay)
+	}
+
+	clock.now = clock.now.Add(25 * time.Hour)
+	session, err = sessionManager.GetSession(ctx, "US", "130-4000000-0000002")
+	if err != nil {
+		t.Fatalf("GetSession error: %v", err)
+	}
+	if session.UsageCount != 2 || session.UsageLastHour != 1 || session.UsageLastDay != 1 {
+		t.Fatalf("expected old uses to expire, got total %d, hour %d, day %d", session.UsageCount, session.UsageLastHour, session.UsageLastDay)
+	}
+
+	// Only the second session was used within the last hour.
+	selected, err := sessionManager.SelectSession(ctx, "US")
+	if err != nil {
+		t.Fatalf("SelectSession error: %v", err)
+	}
+	if selected.SessionID != "130-4000000-0000001" {
+		t.Fatalf("expected least recently used session, got %s", selected.SessionID)
+	}
+
+	// Cleanup compares the threshold with recent uses, not lifetime totals.
+	if err := sessionManager.UpdateLastCheckedTimestamp(ctx, "US", "130-4000000-0000001"); err != nil {
+		t.Fatalf("UpdateLastCheckedTimestamp error: %v", err)
+	}
+	if err := sessionManager.UpdateLastCheckedTimestamp(ctx, "US", "130-4000000-0000002"); err != nil {
+		t.Fatalf("UpdateLastCheckedTimestamp error: %v", err)
+	}
+	if err := sessionManager.CleanupSessions(ctx, 3600, 2); err != nil {
+		t.Fatalf("CleanupSessions error: %v", err)
+	}
+	ids, err := sessionManager.GetCountrySessionIDs(ctx, "US")
+	if err != nil {
+		t.Fatalf("GetCountrySessionIDs error: %v", err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("expected both sessions to be kept, got %v", ids)
+	}
+}
+
+func TestRequestBudget(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{
+		Clock:                   clock,
+		RequestBudget:           2,
+		RequestBudgetPerCountry: map[string]int64{"de": 0},
+	})
+	for _, country := range []string{"US", "DE"} {
+		for _, id := range []string{"130-5000000-0000001", "130-5000000-0000002"} {
+			if err := sessionManager.PushSession(ctx, createTestSession(country, id, "token")); err != nil {
+				t.Fatalf("PushSession error: %v", err)
+			}
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := sessionManager.GetRandomSession(ctx, "US"); err != nil {
+			t.Fatalf("GetRandomSession error: %v", err)
+		}
+	}
+	_, err := sessionManager.GetRandomSession(ctx, "US")
+	var budgetErr *BudgetExhaustedError
+	if !errors.As(err, &budgetErr) || !errors.Is(err, ErrBudgetExhausted) {
+		t.Fatalf("expected budget exhausted error, got %v", err)
+	}
+	resetAt := time.Unix(1700002800, 0)
+	if !budgetErr.ResetAt.Equal(resetAt) {
+		t.Fatalf("expected reset at %v, got %v", resetAt, budgetErr.ResetAt)
+	}
+	if _, err := sessionManager.PopSession(ctx, "US"); !errors.Is(err, ErrBudgetExhausted) {
+		t.Fatalf("expected PopSession to be rejected, got %v", err)
+	}
+	remaining, reset, err := sessionManager.RemainingBudget(ctx, "US")
+	if err != nil || remaining != 0 || !reset.Equal(resetAt) {
+		t.Fatalf("unexpected remaining budget: %d until %v (%v)", remaining, reset, err)
+	}
+
+	// Fallback countries with budget left are still used; DE is unlimited.
+	session, err := sessionManager.PopSessionWithFallback(ctx, "US", "DE")
+	if err != nil || session.Country != "DE" {
+		t.Fatalf("expected fallback to DE, got %v (%v)", session, err)
+	}
+	if remaining, _, _ := sessionManager.RemainingBudget(ctx, "DE"); remaining != -1 {
+		t.Fatalf("expected DE to be unlimited, got %d", remaining)
+	}
+
+	clock.now = resetAt
+	if _, err := sessionManager.GetRandomSession(ctx, "US"); err != nil {
+		t.Fatalf("expected budget to renew, got %v", err)
+	}
+	if remaining, _, _ := sessionManager.RemainingBudget(ctx, "US"); remaining != 1 {
+		t.Fatalf("expected 1 request left, got %d", remaining)
+	}
+}
+
+func TestPinSession(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{Clock: clock})
+	for _, id := range []string{"130-6000000-0000001", "130-6000000-0000002"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+
+	if err := sessionManager.Pin(ctx, "130-6000000-0000001", time.Minute); err != nil {
+		t.Fatalf("Pin error: %v", err)
+	}
+	if err := sessionManager.Pin(ctx, "130-0000000-0000000", time.Minute); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound pinning an unknown session, got %v", err)
+	}
+
+	// Pinned sessions are not handed out or cleaned up, but can be loaded.
+	for i := 0; i < 5; i++ {
+		session, err := sessionManager.GetRandomSession(ctx, "US")
+		if err != nil {
+			t.Fatalf("GetRandomSession error: %v", err)
+		}
+		if session.SessionID == "130-6000000-0000001" {
+			t.Fatal("pinned session handed out")
+		}
+	}
+	pinned, err := sessionManager.GetSession(ctx, "US", "130-6000000-0000001")
+	if err != nil {
+		t.Fatalf("GetSession error: %v", err)
+	}
+	if err := sessionManager.PushSession(ctx, pinned); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	clock.now = clock.now.Add(30 * time.Second)
+	if err := sessionManager.CleanupSessions(ctx, 10, 1000); err != nil {
+		t.Fatalf("CleanupSessions error: %v", err)
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "US", "130-6000000-0000001"); !exists {
+		t.Fatal("pinned session removed by cleanup")
+	}
+	report, err := sessionManager.VerifyIntegrity(ctx)
+	if err != nil || !report.OK() {
+		t.Fatalf("expected pinned session not to be a violation, got %+v (%v)", report, err)
+	}
+
+	if err := sessionManager.Unpin(ctx, "130-6000000-0000001"); err != nil {
+		t.Fatalf("Unpin error: %v", err)
+	}
+	ids, err := sessionManager.GetCountrySessionIDs(ctx, "US")
+	if err != nil || len(ids) != 1 || ids[0] != "130-6000000-0000001" {
+		t.Fatalf("expected unpinned session back in the pool, got %v (%v)", ids, err)
+	}
+
+	// Expired pins are put back on the next checkout.
+	if err := sessionManager.Pin(ctx, "130-6000000-0000001", time.Minute); err != nil {
+		t.Fatalf("Pin error: %v", err)
+	}
+	if _, err := sessionManager.PopSession(ctx, "US"); err != redis.Nil {
+		t.Fatalf("expected empty pool while pinned, got %v", err)
+	}
+	clock.now = clock.now.Add(2 * time.Minute)
+	session, err := sessionManager.PopSession(ctx, "US")
+	if err != nil || session.SessionID != "130-6000000-0000001" {
+		t.Fatalf("expected session after pin expiry, got %v (%v)", session, err)
+	}
+}
+
+func TestDrainMode(t *testing.T) {
+	ctx := context.Background()
+	var drained []string
+	sessionManager := newTestSessionManager(t, &Config{
+		CountryGroups: map[string][]string{"TEST": {"US"}},
+		Hooks: Hooks{
+			OnDrained: func(ctx context.Context, country string) { drained = append(drained, country) },
+		},
+	})
+	for _, id := range []string{"130-7000000-0000001", "130-7000000-0000002"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+	canary := createTestSession("US", "130-7000000-0000003", "token")
+	canary.Canary = true
+	if err := sessionManager.PushSession(ctx, canary); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	borrowed, err := sessionManager.PopSession(ctx, "US")
+	if err != nil {
+		t.Fatalf("PopSession error: %v", err)
+	}
+	if err := sessionManager.BeginDrain(ctx, "US"); err != nil {
+		t.Fatalf("BeginDrain error: %v", err)
+	}
+
+	// New checkouts are refused, sessions in use can still be loaded.
+	if _, err := sessionManager.GetRandomSession(ctx, "US"); err != ErrDraining {
+		t.Fatalf("expected ErrDraining from GetRandomSession, got %v", err)
+	}
+	if _, err := sessionManager.PopSession(ctx, "US"); err != ErrDraining {
+		t.Fatalf("expected ErrDraining from PopSession, got %v", err)
+	}
+	if _, err := sessionManager.GetCanarySession(ctx, "US"); err != ErrDraining {
+		t.Fatalf("expected ErrDraining from GetCanarySession, got %v", err)
+	}
+	if _, err := sessionManager.GetRandomSessionFromGroup(ctx, "TEST"); err != ErrDraining {
+		t.Fatalf("expected ErrDraining from GetRandomSessionFromGroup, got %v", err)
+	}
+	if _, err := sessionManager.GetSession(ctx, "US", borrowed.SessionID); err != nil {
+		t.Fatalf("GetSession error: %v", err)
+	}
+	status, err := sessionManager.GetDrainStatus(ctx, "US")
+	if err != nil || !status.Draining || status.CheckedOut != 1 || !status.DrainedAt.IsZero() {
+		t.Fatalf("unexpected drain status %+v (%v)", status, err)
+	}
+	if len(drained) != 0 {
+		t.Fatalf("OnDrained called while a session is checked out: %v", drained)
+	}
+
+	if err := sessionManager.ReturnSession(ctx, borrowed); err != nil {
+		t.Fatalf("ReturnSession error: %v", err)
+	}
+	if len(drained) != 1 || drained[0] != "US" {
+		t.Fatalf("expected OnDrained for US, got %v", drained)
+	}
+	status, err = sessionManager.GetDrainStatus(ctx, "US")
+	if err != nil || status.CheckedOut != 0 || status.DrainedAt.IsZero() {
+		t.Fatalf("unexpected drain status %+v (%v)", status, err)
+	}
+	if len(drained) != 1 {
+		t.Fatalf("expected OnDrained to be called once, got %v", drained)
+	}
+
+	if err := sessionManager.EndDrain(ctx, "US"); err != nil {
+		t.Fatalf("EndDrain error: %v", err)
+	}
+	if _, err := sessionManager.PopSession(ctx, "US"); err != nil {
+		t.Fatalf("PopSession error after EndDrain: %v", err)
+	}
+}
+
+func TestBatchMultiError(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+
+	sessions := []*Session{
+		createTestSession("US", "130-8100000-0000001", "token"),
+		{Country: "US"},
+		createTestSession("US", "130-8100000-0000002", "token"),
+		{Country: "US", SessionID: "130-8100000-0000003", Cookies: []*http.Cookie{{Name: "ubid-main", Value: "130-8100000-0000003"}}},
+	}
+	err := sessionManager.PushSessions(ctx, sessions)
+	var multi *MultiError
+	if !errors.As(err, &multi) {
+		t.Fatalf("expected *MultiError, got %v", err)
+	}
+	if failed := multi.Failed(); multi.Total != 4 || len(failed) != 2 || failed[0] != 1 || failed[1] != 3 {
+		t.Fatalf("unexpected failures %v of %d", failed, multi.Total)
+	}
+	if multi.Errors[1].SessionID != "130-8100000-0000003" {
+		t.Fatalf("expected the session-id of the failed item, got %q", multi.Errors[1].SessionID)
+	}
+	for _, id := range []string{"130-8100000-0000001", "130-8100000-0000002"} {
+		if exists, _ := sessionManager.ExistsSession(ctx, "US", id); !exists {
+			t.Fatalf("session %s not pushed", id)
+		}
+	}
+
+	err = sessionManager.ValidateSessions([]*Session{
+		createTestSession("US", "130-8100000-0000004", "token"),
+		createTestSession("US", "malformed", "token"),
+	})
+	var validation *CookieValidationError
+	if !errors.As(err, &multi) || len(multi.Errors) != 1 || multi.Errors[0].Index != 1 || !errors.As(err, &validation) {
+		t.Fatalf("expected the malformed session to fail validation, got %v", err)
+	}
+
+	if err := sessionManager.DeleteSessions(ctx, "US", []string{"130-8100000-0000001", "130-0000000-0000000"}); err != nil {
+		t.Fatalf("DeleteSessions error: %v", err)
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "US", "130-8100000-0000001"); exists {
+		t.Fatal("session not deleted")
+	}
+}
+
+func TestCorruptSessionSkipped(t *testing.T) {
+	ctx := context.Background()
+	var corrupt []string
+	hooks := Hooks{OnCorruptSession: func(ctx context.Context, country, sessionID string, err error) {
+		corrupt = append(corrupt, country+"/"+sessionID)
+	}}
+	sessionManager := newTestSessionManager(t, &Config{Hooks: hooks})
+	for _, id := range []string{"130-8200000-0000001", "130-8200000-0000002"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+	if err := sessionManager.client.HSet(ctx, cookiesKey("US"), "130-8200000-0000001", "{not json").Err(); err != nil {
+		t.Fatalf("HSet error: %v", err)
+	}
+
+	sessions, err := sessionManager.ListCountrySession(ctx, "US")
+	if err != nil {
+		t.Fatalf("ListCountrySession error: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].SessionID != "130-8200000-0000002" {
+		t.Fatalf("expected the corrupt session to be skipped, got %v", sessions)
+	}
+	if len(corrupt) != 1 || corrupt[0] != "US/130-8200000-0000001" {
+		t.Fatalf("expected the corrupt session to be reported, got %v", corrupt)
+	}
+
+	// Strict listings fail, repair moves the session out of the pool.
+	if _, err := sessionManager.GetAllSessions(WithDecodeMode(ctx, DecodeStrict)); err == nil {
+		t.Fatal("expected strict listing to fail")
+	}
+	sessionManager.defaultDecodeMode = DecodeRepair
+	if sessions, err := sessionManager.GetAllSessions(ctx); err != nil || len(sessions) != 1 {
+		t.Fatalf("expected one decodable session, got %v (%v)", sessions, err)
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "US", "130-8200000-0000001"); exists {
+		t.Fatal("corrupt session not quarantined")
+	}
+	quarantined, err := sessionManager.ListQuarantined(ctx, "US")
+	if err != nil || quarantined["130-8200000-0000001"] != "{not json" {
+		t.Fatalf("unexpected quarantine %v (%v)", quarantined, err)
+	}
+	if ids, _ := sessionManager.GetCountrySessionIDs(ctx, "US"); len(ids) != 1 {
+		t.Fatalf("expected the quarantined id to leave the pool, got %v", ids)
+	}
+}
+
+func TestSummaryConcurrency(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+	for _, id := range []string{"130-8300000-0000001", "130-8300000-0000002", "130-8300000-0000003", "130-8300000-0000004"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+	if _, err := sessionManager.PopSession(WithCaller(ctx, "worker-1"), "US"); err != nil {
+		t.Fatalf("PopSession error: %v", err)
+	}
+	if _, err := sessionManager.PopSession(ctx, "US"); err != nil {
+		t.Fatalf("PopSession error: %v", err)
+	}
+	if err := sessionManager.Pin(ctx, "130-8300000-0000004", time.Minute); err != nil {
+		t.Fatalf("Pin error: %v", err)
+	}
+
+	summary, err := sessionManager.GetSummary(ctx)
+	if err != nil {
+		t.Fatalf("GetSummary error: %v", err)
+	}
+	for _, cs := range summary.Countries {
+		if cs.Country != "US" {
+			continue
+		}
+		if cs.PoolSize != 1 || cs.CheckedOut != 2 || cs.Pinned != 1 || cs.Utilization != 0.75 {
+			t.Fatalf("unexpected concurrency stats %+v", cs)
+		}
+		return
+	}
+	t.Fatal("US missing from summary")
+}
+
+func TestLastCheckedIndex(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{Clock: clock})
+	for _, id := range []string{"130-8400000-0000001", "130-8400000-0000002", "130-8400000-0000003"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+	clock.now = clock.now.Add(time.Hour)
+	if err := sessionManager.TouchSession(ctx, "US", "130-8400000-0000002"); err != nil {
+		t.Fatalf("TouchSession error: %v", err)
+	}
+	if err := sessionManager.UpdateLastChecked(ctx, "US", []string{"130-8400000-0000003"}); err != nil {
+		t.Fatalf("UpdateLastChecked error: %v", err)
+	}
+	if _, err := sessionManager.RenameSession(ctx, "US", "130-8400000-0000003", "130-8400000-0000004"); err != nil {
+		t.Fatalf("RenameSession error: %v", err)
+	}
+
+	stale, err := sessionManager.StaleSessionIDs(ctx, "US", 30*time.Minute)
+	if err != nil || len(stale) != 1 || stale[0] != "130-8400000-0000001" {
+		t.Fatalf("expected the untouched session to be stale, got %v (%v)", stale, err)
+	}
+	score, err := sessionManager.client.ZScore(ctx, lastCheckedIndexKey("US"), "130-8400000-0000004").Result()
+	if err != nil || int64(score) != clock.now.Unix() {
+		t.Fatalf("expected the renamed session to keep its index entry, got %v (%v)", score, err)
+	}
+
+	// Stale sessions are removed through the index, except pinned ones.
+	if err := sessionManager.Pin(ctx, "130-8400000-0000001", time.Minute); err != nil {
+		t.Fatalf("Pin error: %v", err)
+	}
+	result, err := sessionManager.CleanupSessionsWithResult(ctx, 1800, 1000)
+	if err != nil || result.Removed["US"] != 0 {
+		t.Fatalf("expected the pinned session to survive cleanup, got %+v (%v)", result, err)
+	}
+	if err := sessionManager.Unpin(ctx, "130-8400000-0000001"); err != nil {
+		t.Fatalf("Unpin error: %v", err)
+	}
+	result, err = sessionManager.CleanupSessionsWithResult(ctx, 1800, 1000)
+	if err != nil || result.Removed["US"] != 1 {
+		t.Fatalf("expected the stale session to be removed, got %+v (%v)", result, err)
+	}
+	if n, _ := sessionManager.client.ZCard(ctx, lastCheckedIndexKey("US")).Result(); n != 2 {
+		t.Fatalf("expected the removed session to leave the index, got %d entries", n)
+	}
+}
+
+func TestUsageIndex(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{Selector: LeastUsedSelector()})
+	for i, id := range []string{"130-8500000-0000001", "130-8500000-0000002", "130-8500000-0000003"} {
+		opts := &PushOptions{UsageCount: int64(10 * (3 - i))}
+		if err := sessionManager.PushSessionWithOptions(ctx, createTestSession("US", id, "token"), opts); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+
+	// The least used session is pinned, so the next one is selected.
+	if err := sessionManager.Pin(ctx, "130-8500000-0000003", time.Minute); err != nil {
+		t.Fatalf("Pin error: %v", err)
+	}
+	session, err := sessionManager.SelectSession(ctx, "US")
+	if err != nil || session.SessionID != "130-8500000-0000002" {
+		t.Fatalf("expected the least used session in the pool, got %v (%v)", session, err)
+	}
+	if score, _ := sessionManager.client.ZScore(ctx, usageIndexKey("US"), "130-8500000-0000002").Result(); score != 21 {
+		t.Fatalf("expected GetSession to update the usage index, got %v", score)
+	}
+
+	histogram, err := sessionManager.UsageHistogram(ctx, "US", 10, 25)
+	if err != nil {
+		t.Fatalf("UsageHistogram error: %v", err)
+	}
+	if len(histogram) != 3 || histogram[0] != 0 || histogram[1] != 2 || histogram[2] != 1 {
+		t.Fatalf("unexpected histogram %v", histogram)
+	}
+	if _, err := sessionManager.UsageHistogram(ctx, "US", 10, 10); err == nil {
+		t.Fatal("expected error for non-increasing bounds")
+	}
+
+	result, err := sessionManager.CleanupSessionsWithResult(ctx, 3600, 25)
+	if err != nil || result.Removed["US"] != 1 {
+		t.Fatalf("expected the overused session to be removed, got %+v (%v)", result, err)
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "US", "130-8500000-0000001"); exists {
+		t.Fatal("overused session not removed")
+	}
+}
+
+func TestShardedPool(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+	for i := 0; i < 20; i++ {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", "130-8600000-"+strconv.Itoa(1000000+i), "token")); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+	if err := sessionManager.ShardPool(ctx, "US", 4); err != nil {
+		t.Fatalf("ShardPool error: %v", err)
+	}
+	if shards, _ := sessionManager.PoolShards(ctx, "US"); shards != 4 {
+		t.Fatalf("expected 4 shards, got %d", shards)
+	}
+	if n, _ := sessionManager.client.Exists(ctx, sessionIdsKey("US")).Result(); n != 0 {
+		t.Fatal("expected the unsharded list to be moved")
+	}
+	for shard := 0; shard < 4; shard++ {
+		ids, _ := sessionManager.client.LRange(ctx, shardKey("US", shard), 0, -1).Result()
+		for _, id := range ids {
+			if shardOf(id, 4) != shard {
+				t.Fatalf("session %s stored in shard %d, expected %d", id, shard, shardOf(id, 4))
+			}
+		}
+	}
+
+	// Pushes go to the shard of the session-id.
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "130-8600000-9999999", "token")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if pos, err := sessionManager.client.LPos(ctx, shardKey("US", shardOf("130-8600000-9999999", 4)), "130-8600000-9999999", redis.LPosArgs{}).Result(); err != nil || pos < 0 {
+		t.Fatalf("expected the new session in its shard, got %v", err)
+	}
+	ids, err := sessionManager.GetCountrySessionIDs(ctx, "US")
+	if err != nil || len(ids) != 21 {
+		t.Fatalf("expected 21 session ids, got %d (%v)", len(ids), err)
+	}
+
+	// Pages span the shards.
+	seen := make(map[string]bool)
+	for page := 0; page < 3; page++ {
+		sessions, err := sessionManager.ListSession(ctx, "US", Pagination{Size: 8, Page: page})
+		if err != nil {
+			t.Fatalf("ListSession error: %v", err)
+		}
+		for _, session := range sessions {
+			seen[session.SessionID] = true
+		}
+	}
+	if len(seen) != 21 {
+		t.Fatalf("expected the pages to list 21 sessions, got %d", len(seen))
+	}
+
+	if _, err := sessionManager.GetRandomSession(ctx, "US"); err != nil {
+		t.Fatalf("GetRandomSession error: %v", err)
+	}
+	session, err := sessionManager.PopSession(ctx, "US")
+	if err != nil {
+		t.Fatalf("PopSession error: %v", err)
+	}
+	if err := sessionManager.ReturnSession(ctx, session); err != nil {
+		t.Fatalf("ReturnSession error: %v", err)
+	}
+	if _, err := sessionManager.DeleteSession(ctx, "US", "130-8600000-1000000"); err != nil {
+		t.Fatalf("DeleteSession error: %v", err)
+	}
+	report, err := sessionManager.VerifyIntegrity(ctx)
+	if err != nil || len(report.Violations) != 0 {
+		t.Fatalf("expected a consistent sharded pool, got %+v (%v)", report, err)
+	}
+
+	// Merging the shards restores a single list.
+	if err := sessionManager.ShardPool(ctx, "US", 0); err != nil {
+		t.Fatalf("ShardPool error: %v", err)
+	}
+	if size, _ := sessionManager.client.LLen(ctx, sessionIdsKey("US")).Result(); size != 20 {
+		t.Fatalf("expected 20 sessions after merging, got %d", size)
+	}
+	if shards, _ := sessionManager.PoolShards(ctx, "US"); shards != 0 {
+		t.Fatalf("expected no shards after merging, got %d", shards)
+	}
+	if err := sessionManager.ShardPool(ctx, "US", -1); err == nil {
+		t.Fatal("expected error for a negative shard count")
+	}
+}
+
+func TestGetAllSessionsPaged(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+	// One more session than a page in US, to fetch a second page.
+	for i := 0; i <= allSessionsPageSize; i++ {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", "130-8700000-"+strconv.Itoa(1000000+i), "token")); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+	for _, country := range []string{"DE", "JP", "UK", "FR", "IT"} {
+		if err := sessionManager.PushSession(ctx, createTestSession(country, "130-8700000-0000001", "token")); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+
+	sessions, err := sessionManager.GetAllSessions(ctx)
+	if err != nil {
+		t.Fatalf("GetAllSessions error: %v", err)
+	}
+	if len(sessions) != allSessionsPageSize+6 {
+		t.Fatalf("expected %d sessions, got %d", allSessionsPageSize+6, len(sessions))
+	}
+	seen := make(map[string]bool)
+	for _, session := range sessions {
+		key := session.Country + ":" + session.SessionID
+		if seen[key] {
+			t.Fatalf("session %s listed twice", key)
+		}
+		seen[key] = true
+	}
+}
+
+func TestClearAllCookiesWithResult(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+	for _, country := range []string{"US", "DE"} {
+		session := createTestSession(country, "130-8800000-0000001", "token")
+		session.Tier = "premium"
+		session.Labels = map[string]string{"proxy-pool": "residential"}
+		if err := sessionManager.PushSession(ctx, session); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+	// Keys of other applications sharing the database.
+	unrelated := []string{"user:42:cookies", "plan:tier:gold", "app:label:x", "cache:session-ids:1"}
+	for _, key := range unrelated {
+		if err := sessionManager.client.Set(ctx, key, "1", 0).Err(); err != nil {
+			t.Fatalf("Set error: %v", err)
+		}
+	}
+	defer sessionManager.client.Del(ctx, unrelated...)
+
+	result, err := sessionManager.ClearAllCookiesWithResult(ctx)
+	if err != nil {
+		t.Fatalf("ClearAllCookiesWithResult error: %v", err)
+	}
+	// The session-ids list and cookie hash of each country at least.
+	if result.Deleted["US"] < 2 || result.Deleted["DE"] < 2 || len(result.Failed) != 0 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	keys, _ := sessionManager.client.Keys(ctx, "*").Result()
+	sort.Strings(keys)
+	sort.Strings(unrelated)
+	if !reflect.DeepEqual(keys, unrelated) {
+		t.Fatalf("expected only the unrelated keys left, got %v", keys)
+	}
+}
+
+func TestFlushCountryKeepsState(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "130-8800000-0000001", "token")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if err := sessionManager.FreezeCountry(ctx, "US"); err != nil {
+		t.Fatalf("FreezeCountry error: %v", err)
+	}
+	if err := sessionManager.BeginDrain(ctx, "US"); err != nil {
+		t.Fatalf("BeginDrain error: %v", err)
+	}
+	if err := sessionManager.SetBorrowLimit(ctx, "US", "crawler", 2); err != nil {
+		t.Fatalf("SetBorrowLimit error: %v", err)
+	}
+	window := MaintenanceWindow{Start: time.Now(), End: time.Now().Add(time.Hour), Mode: MaintenancePause}
+	if err := sessionManager.ScheduleMaintenance(ctx, "US", window); err != nil {
+		t.Fatalf("ScheduleMaintenance error: %v", err)
+	}
+
+	if err := sessionManager.FlushCountry(ctx, "US"); err != nil {
+		t.Fatalf("FlushCountry error: %v", err)
+	}
+	if n, _ := sessionManager.client.Exists(ctx, countryKeys("US")...).Result(); n != 0 {
+		t.Fatalf("expected the US sessions to be deleted, %d keys left", n)
+	}
+	if _, frozen, err := sessionManager.FrozenSince(ctx, "US"); err != nil || !frozen {
+		t.Fatalf("expected the pool to stay frozen, got %v (%v)", frozen, err)
+	}
+	if status, err := sessionManager.GetDrainStatus(ctx, "US"); err != nil || !status.Draining {
+		t.Fatalf("expected the pool to stay draining, got %+v (%v)", status, err)
+	}
+	if _, active, err := sessionManager.ActiveMaintenance(ctx, "US"); err != nil || !active {
+		t.Fatalf("expected the maintenance window to be kept, got %v (%v)", active, err)
+	}
+	stats, err := sessionManager.BorrowStats(ctx, "US")
+	if err != nil || len(stats) != 1 || stats[0].Limit != 2 {
+		t.Fatalf("expected the borrow limit to be kept, got %+v (%v)", stats, err)
+	}
+}
+
+func TestDisableUnlink(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{DisableUnlink: true})
+	if sessionManager.deleteCommand() != "DEL" {
+		t.Fatalf("expected DEL, got %s", sessionManager.deleteCommand())
+	}
+	for _, country := range []string{"US", "DE"} {
+		if err := sessionManager.PushSession(ctx, createTestSession(country, "130-8900000-0000001", "token")); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+	if err := sessionManager.FlushCountry(ctx, "DE"); err != nil {
+		t.Fatalf("FlushCountry error: %v", err)
+	}
+	if n, _ := sessionManager.client.Exists(ctx, countryKeys("DE")...).Result(); n != 0 {
+		t.Fatalf("expected the DE keys to be deleted, %d left", n)
+	}
+	if err := sessionManager.ClearAllCookies(ctx); err != nil {
+		t.Fatalf("ClearAllCookies error: %v", err)
+	}
+	if keys, _ := sessionManager.client.Keys(ctx, "*").Result(); len(keys) != 0 {
+		t.Fatalf("expected no keys left, got %v", keys)
+	}
+}
+
+func TestMissingSession(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "130-9000000-0000001", "token")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if _, err := sessionManager.GetSession(ctx, "US", "130-9000000-0000002"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	sessionManager.missingSessionMode = MissingSessionFallback
+	session, err := sessionManager.GetSession(ctx, "US", "130-9000000-0000002")
+	if err != nil || session.SessionID != "130-9000000-0000001" {
+		t.Fatalf("expected the fallback session, got %v (%v)", session, err)
+	}
+	if _, err := sessionManager.GetSession(ctx, "DE", "130-9000000-0000002"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound without fallback session, got %v", err)
+	}
+}
+
+func TestGetSessionMeta(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+	session := createTestSession("US", "130-9100000-0000001", "token")
+	session.Labels = map[string]string{"account": "a1"}
+	if err := sessionManager.PushSessionWithOptions(ctx, session, &PushOptions{UsageCount: 3}); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if _, err := sessionManager.RecordFailure(ctx, "US", "130-9100000-0000001"); err != nil {
+		t.Fatalf("RecordFailure error: %v", err)
+	}
+
+	meta, err := sessionManager.GetSessionMeta(ctx, "US", "130-9100000-0000001")
+	if err != nil {
+		t.Fatalf("GetSessionMeta error: %v", err)
+	}
+	if meta.UsageCount != 3 || meta.Failures != 1 || meta.Labels["account"] != "a1" || meta.CreatedAt.IsZero() {
+		t.Fatalf("unexpected meta %+v", meta)
+	}
+	// Reading the meta does not count a use.
+	if meta, _ := sessionManager.GetSessionMeta(ctx, "US", "130-9100000-0000001"); meta.UsageCount != 3 {
+		t.Fatalf("expected the usage count to be unchanged, got %d", meta.UsageCount)
+	}
+	if _, err := sessionManager.GetSessionMeta(ctx, "US", "130-9100000-0000002"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestCheckHistory(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	sessionManager := newTestSessionManager(t, &Config{Clock: clock, CheckHistorySize: 3})
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "130-9200000-0000001", "token")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		result := CheckResult{OK: i%2 == 0, Latency: time.Duration(100*(i+1)) * time.Millisecond, Status: 200}
+		if i == 3 {
+			result.Status = 503
+		}
+		if err := sessionManager.RecordCheck(ctx, "US", "130-9200000-0000001", result); err != nil {
+			t.Fatalf("RecordCheck error: %v", err)
+		}
+		clock.now = clock.now.Add(time.Minute)
+	}
+
+	session, err := sessionManager.GetSession(ctx, "US", "130-9200000-0000001")
+	if err != nil {
+		t.Fatalf("GetSession error: %v", err)
+	}
+	// The oldest result was dropped.
+	history := session.CheckHistory
+	if len(history) != 3 {
+		t.Fatalf("expected 3 check results, got %+v", history)
+	}
+	if history[0].Latency != 200*time.Millisecond || history[0].OK || !history[0].Time.Equal(time.Unix(1700000060, 0)) {
+		t.Fatalf("unexpected oldest result %+v", history[0])
+	}
+	if last := history[2]; last.Status != 503 || last.OK || last.Latency != 400*time.Millisecond {
+		t.Fatalf("unexpected last result %+v", last)
+	}
+	if err := sessionManager.RecordCheck(ctx, "US", "130-9200000-0000002", CheckResult{OK: true}); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestLatencyRanking(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{Selector: LowLatencySelector()})
+	for _, id := range []string{"130-9300000-0000001", "130-9300000-0000002"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+	if err := sessionManager.RecordLatency(ctx, "US", "130-9300000-0000001", 100*time.Millisecond); err != nil {
+		t.Fatalf("RecordLatency error: %v", err)
+	}
+	if err := sessionManager.RecordCheck(ctx, "US", "130-9300000-0000001", CheckResult{OK: true, Latency: 200 * time.Millisecond}); err != nil {
+		t.Fatalf("RecordCheck error: %v", err)
+	}
+	if err := sessionManager.RecordLatency(ctx, "US", "130-9300000-0000002", time.Minute); err != nil {
+		t.Fatalf("RecordLatency error: %v", err)
+	}
+	session, err := sessionManager.GetSession(ctx, "US", "130-9300000-0000001")
+	if err != nil || session.Latency != 130*time.Millisecond {
+		t.Fatalf("expected a smoothed latency of 130ms, got %v (%v)", session.Latency, err)
+	}
+	if err := sessionManager.RecordLatency(ctx, "US", "130-9300000-0000003", time.Second); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	// The slow session has about 1% of the weight of the fast one.
+	fast := 0
+	for i := 0; i < 50; i++ {
+		session, err := sessionManager.SelectSession(ctx, "US")
+		if err != nil {
+			t.Fatalf("SelectSession error: %v", err)
+		}
+		if session.SessionID == "130-9300000-0000001" {
+			fast++
+		}
+	}
+	if fast < 45 {
+		t.Fatalf("expected the fast session to be preferred, picked %d of 50 times", fast)
+	}
+}
+
+type testCaptchaSolver struct {
+	err error
+}
+
+func (s *testCaptchaSolver) SolveCaptcha(ctx context.Context, session *Session, page []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	return session.SetCookie("session-token", "solved", time.Now().Add(time.Hour))
+}
+
+func TestHandleCaptcha(t *testing.T) {
+	ctx := context.Background()
+	solver := &testCaptchaSolver{}
+	sessionManager := newTestSessionManager(t, &Config{CaptchaSolver: solver})
+	page := []byte(`<form method="get" action="/errors/validateCaptcha">`)
+	if !IsCaptchaPage(page) || IsCaptchaPage([]byte("<html>results</html>")) {
+		t.Fatal("unexpected captcha page detection")
+	}
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "130-9400000-0000001", "token")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+
+	// A solved captcha restores the popped session with its new cookies.
+	session, err := sessionManager.PopSession(ctx, "US")
+	if err != nil {
+		t.Fatalf("PopSession error: %v", err)
+	}
+	if _, err := sessionManager.RecordFailure(ctx, "US", session.SessionID); err != nil {
+		t.Fatalf("RecordFailure error: %v", err)
+	}
+	restored, err := sessionManager.HandleCaptcha(ctx, session, page)
+	if err != nil || !restored {
+		t.Fatalf("expected the session to be restored, got %v (%v)", restored, err)
+	}
+	stored, err := sessionManager.GetSession(ctx, "US", "130-9400000-0000001")
+	if err != nil {
+		t.Fatalf("GetSession error: %v", err)
+	}
+	if c, _ := stored.Cookie("session-token"); c == nil || c.Value != "solved" || stored.Failures != 0 {
+		t.Fatalf("expected the refreshed cookies without failures, got %v and %d failures", c, stored.Failures)
+	}
+	if has, _ := sessionManager.HasSessions(ctx, "US"); !has {
+		t.Fatal("expected the session back in the pool")
+	}
+
+	// An unsolved captcha discards the session.
+	solver.err = errors.New("solver unavailable")
+	if restored, err := sessionManager.HandleCaptcha(ctx, stored, page); restored || err == nil {
+		t.Fatalf("expected the captcha not to be solved, got %v (%v)", restored, err)
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "US", "130-9400000-0000001"); exists {
+		t.Fatal("expected the session to be deleted")
+	}
+}
+
+func TestPushIdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+	opts := &PushOptions{UsageCount: 5, IdempotencyKey: "import-1:record-1"}
+	if err := sessionManager.PushSessionWithOptions(ctx, createTestSession("US", "130-9500000-0000001", "token"), opts); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	// The retried push is skipped, it would reset the usage count.
+	if _, err := sessionManager.GetSession(ctx, "US", "130-9500000-0000001"); err != nil {
+		t.Fatalf("GetSession error: %v", err)
+	}
+	if err := sessionManager.PushSessionWithOptions(ctx, createTestSession("US", "130-9500000-0000001", "token"), opts); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if meta, _ := sessionManager.GetSessionMeta(ctx, "US", "130-9500000-0000001"); meta.UsageCount != 6 {
+		t.Fatalf("expected the retried push to be skipped, got usage count %d", meta.UsageCount)
+	}
+	if ttl, _ := sessionManager.client.TTL(ctx, idempotencyKey("import-1:record-1")).Result(); ttl <= 0 || ttl > defaultIdempotencyWindow {
+		t.Fatalf("unexpected idempotency key ttl %v", ttl)
+	}
+
+	// A failed push can be retried with the same key.
+	failed := &PushOptions{IdempotencyKey: "import-1:record-2"}
+	if err := sessionManager.PushSessionWithOptions(ctx, createTestSession("", "130-9500000-0000002", "token"), failed); err == nil {
+		t.Fatal("expected error for a session without country")
+	}
+	if err := sessionManager.PushSessionWithOptions(ctx, createTestSession("US", "130-9500000-0000002", "token"), failed); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "US", "130-9500000-0000002"); !exists {
+		t.Fatal("expected the retried push to be applied")
+	}
+	if id, _ := sessionManager.client.Get(ctx, idempotencyKey("import-1:record-2")).Result(); id != "130-9500000-0000002" {
+		t.Fatalf("expected the idempotency key to record the session-id, got %q", id)
+	}
+
+	// A key used for another session is an error, not a skipped retry.
+	if err := sessionManager.PushSessionWithOptions(ctx, createTestSession("US", "130-9500000-0000004", "token"), failed); err == nil {
+		t.Fatal("expected error for an idempotency key used for another session")
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "US", "130-9500000-0000004"); exists {
+		t.Fatal("expected the push with a reused key not to be applied")
+	}
+}
+
+func TestPushIdempotencyKeyConcurrent(t *testing.T) {
+	ctx := context.Background()
+	var pushes atomic.Int64
+	sessionManager := newTestSessionManager(t, &Config{Hooks: Hooks{
+		OnPush: func(ctx context.Context, session *Session) { pushes.Add(1) },
+	}})
+	opts := &PushOptions{UsageCount: 5, IdempotencyKey: "import-3:record-1"}
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- sessionManager.PushSessionWithOptions(ctx, createTestSession("US", "130-9500000-0000005", "token"), opts)
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+	if n := pushes.Load(); n != 1 {
+		t.Fatalf("expected the concurrent retries to be applied once, got %d pushes", n)
+	}
+}
+
+func TestPushIdempotencyKeyCancelled(t *testing.T) {
+	ctx := context.Background()
+	// The push context is cancelled in the middle of the push, after the
+	// idempotency key was checked.
+	pushCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sessionManager := newTestSessionManager(t, &Config{
+		ProxyExitCountry: func(ctx context.Context, proxy string) (string, error) {
+			cancel()
+			return "", ctx.Err()
+		},
+	})
+	session := createTestSession("US", "130-9500000-0000003", "token")
+	session.Proxy = "http://proxy-us:8080"
+	opts := &PushOptions{IdempotencyKey: "import-2:record-1"}
+	if err := sessionManager.PushSessionWithOptions(pushCtx, session, opts); err == nil {
+		t.Fatal("expected the push to fail with the cancelled context")
+	}
+
+	// The retry is applied, the failed push did not use the key.
+	retry := createTestSession("US", "130-9500000-0000003", "token")
+	if err := sessionManager.PushSessionWithOptions(ctx, retry, opts); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "US", "130-9500000-0000003"); !exists {
+		t.Fatal("expected the retried push to be applied")
+	}
+}
+
+func TestImportSessionsAtomic(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{
+		ProxyExitCountry: func(ctx context.Context, proxy string) (string, error) {
+			return "DE", nil
+		},
+	})
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "130-9600000-0000001", "old")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	records := func(sessions ...*Session) io.Reader {
+		var b strings.Builder
+		for _, session := range sessions {
+			data, err := json.Marshal(session)
+			if err != nil {
+				t.Fatalf("Marshal error: %v", err)
+			}
+			b.Write(data)
+			b.WriteString("\n")
+		}
+		return strings.NewReader(b.String())
+	}
+	token := func(sessionID string) string {
+		stored, err := sessionManager.listSessionsByIDs(ctx, "US", []string{sessionID})
+		if err != nil || len(stored) == 0 {
+			return ""
+		}
+		c, _ := stored[0].Cookie("session-token")
+		return c.Value
+	}
+
+	// An invalid record stores nothing.
+	input := io.MultiReader(records(createTestSession("US", "130-9600000-0000002", "new")), strings.NewReader("{broken\n"))
+	n, err := sessionManager.ImportSessions(ctx, input, &ImportOptions{Atomic: true})
+	var multi *MultiError
+	if n != 0 || !errors.As(err, &multi) || !reflect.DeepEqual(multi.Failed(), []int{1}) {
+		t.Fatalf("expected record 1 to fail, got %d imported (%v)", n, err)
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "US", "130-9600000-0000002"); exists {
+		t.Fatal("expected nothing to be imported")
+	}
+
+	// A record failing the push checks stores nothing either.
+	mismatch := createTestSession("US", "130-9600000-0000003", "new")
+	mismatch.Proxy = "http://proxy.example:8080"
+	input = records(createTestSession("US", "130-9600000-0000001", "new"), createTestSession("US", "130-9600000-0000002", "new"), mismatch)
+	n, err = sessionManager.ImportSessions(ctx, input, &ImportOptions{Atomic: true})
+	var item *ItemError
+	if n != 0 || !errors.As(err, &item) || item.Index != 2 {
+		t.Fatalf("expected record 2 to fail, got %d imported (%v)", n, err)
+	}
+	if got := token("130-9600000-0000001"); got != "old" {
+		t.Fatalf("expected the previous session to be kept, got token %q", got)
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "US", "130-9600000-0000002"); exists {
+		t.Fatal("expected the new session not to be stored")
+	}
+
+	// An empty import stores nothing and succeeds.
+	if n, err := sessionManager.ImportSessions(ctx, strings.NewReader("\n"), &ImportOptions{Atomic: true}); n != 0 || err != nil {
+		t.Fatalf("expected an empty import to succeed, got %d (%v)", n, err)
+	}
+
+	// A valid import is committed at once, with its counters.
+	imported := createTestSession("US", "130-9600000-0000002", "new")
+	imported.UsageCount = 7
+	imported.Labels = map[string]string{"pool": "res"}
+	input = records(createTestSession("US", "130-9600000-0000001", "new"), imported)
+	if n, err := sessionManager.ImportSessions(ctx, input, &ImportOptions{Atomic: true}); n != 2 || err != nil {
+		t.Fatalf("expected 2 imported, got %d (%v)", n, err)
+	}
+	if got := token("130-9600000-0000001"); got != "new" {
+		t.Fatalf("expected the imported session, got token %q", got)
+	}
+	if meta, err := sessionManager.GetSessionMeta(ctx, "US", "130-9600000-0000002"); err != nil || meta.UsageCount != 7 {
+		t.Fatalf("expected the imported usage count, got %+v (%v)", meta, err)
+	}
+	if ids, _ := sessionManager.ListSessionIDsByLabel(ctx, "US", "pool", "res"); !reflect.DeepEqual(ids, []string{"130-9600000-0000002"}) {
+		t.Fatalf("expected the imported session to be indexed, got %v", ids)
+	}
+	if ids, _ := sessionManager.GetCountrySessionIDs(ctx, "US"); len(ids) != 2 {
+		t.Fatalf("expected 2 sessions listed, got %v", ids)
+	}
+	if keys, _ := sessionManager.client.Keys(ctx, importStagingPrefix+"*").Result(); len(keys) != 0 {
+		t.Fatalf("expected the staging key to be deleted, got %v", keys)
+	}
+	if report, err := sessionManager.VerifyIntegrity(ctx); err != nil || !report.OK() {
+		t.Fatalf("expected a consistent pool, got %+v (%v)", report, err)
+	}
+
+	// Without Atomic the valid records are stored.
+	input = records(createTestSession("US", "130-9600000-0000001", "newer"), mismatch, createTestSession("US", "130-9600000-0000002", "new"))
+	n, err = sessionManager.ImportSessions(ctx, input, nil)
+	if n != 2 || !errors.As(err, &multi) || !reflect.DeepEqual(multi.Failed(), []int{1}) {
+		t.Fatalf("expected 2 imported and record 1 to fail, got %d (%v)", n, err)
+	}
+	if got := token("130-9600000-0000001"); got != "newer" {
+		t.Fatalf("expected the imported session, got token %q", got)
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+	for _, id := range []string{"130-9700000-0000001", "130-9700000-0000002", "130-9700000-0000003"} {
+		if err := sessionManager.PushSession(ctx, createTestSession("US", id, "token")); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+	var before strings.Builder
+	if err := sessionManager.ExportSessions(ctx, &before); err != nil {
+		t.Fatalf("ExportSessions error: %v", err)
+	}
+
+	// Uses alone are not changes.
+	if _, err := sessionManager.GetSession(ctx, "US", "130-9700000-0000001"); err != nil {
+		t.Fatalf("GetSession error: %v", err)
+	}
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "130-9700000-0000002", "refreshed")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if _, err := sessionManager.DeleteSession(ctx, "US", "130-9700000-0000003"); err != nil {
+		t.Fatalf("DeleteSession error: %v", err)
+	}
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "130-9700000-0000004", "token")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	var after strings.Builder
+	if err := sessionManager.ExportSessions(ctx, &after); err != nil {
+		t.Fatalf("ExportSessions error: %v", err)
+	}
+
+	diff, err := DiffSnapshots(strings.NewReader(before.String()), strings.NewReader(after.String()))
+	if err != nil {
+		t.Fatalf("DiffSnapshots error: %v", err)
+	}
+	if len(diff.Added) != 1 || diff.Added[0].SessionID != "130-9700000-0000004" {
+		t.Fatalf("unexpected added sessions %v", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0].SessionID != "130-9700000-0000003" {
+		t.Fatalf("unexpected removed sessions %v", diff.Removed)
+	}
+	if len(diff.Changed) != 1 || diff.Changed[0].After.SessionID != "130-9700000-0000002" || !reflect.DeepEqual(diff.Changed[0].Fields, []string{"cookies"}) {
+		t.Fatalf("unexpected changed sessions %v", diff.Changed)
+	}
+	if _, err := DiffSnapshots(strings.NewReader("{broken\n"), strings.NewReader(after.String())); err == nil {
+		t.Fatal("expected error for an invalid snapshot")
+	}
+}
+
+func TestFreezeCountry(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, &Config{CountryGroups: map[string][]string{"TEST": {"US", "DE"}}})
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "130-9800000-0000001", "token")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if err := sessionManager.PushSession(ctx, createTestSession("DE", "130-9800000-0000002", "token")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	canary := createTestSession("US", "130-9800000-0000004", "token")
+	canary.Canary = true
+	if err := sessionManager.PushSession(ctx, canary); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if err := sessionManager.FreezeCountry(ctx, "us"); err != nil {
+		t.Fatalf("FreezeCountry error: %v", err)
+	}
+	if _, frozen, err := sessionManager.FrozenSince(ctx, "US"); !frozen || err != nil {
+		t.Fatalf("expected US to be frozen, got %v (%v)", frozen, err)
+	}
+
+	// Checkouts are refused, pushes and reads are served.
+	if _, err := sessionManager.GetRandomSession(ctx, "US"); err != ErrFrozen {
+		t.Fatalf("expected ErrFrozen from GetRandomSession, got %v", err)
+	}
+	if _, err := sessionManager.PopSession(ctx, "US"); err != ErrFrozen {
+		t.Fatalf("expected ErrFrozen from PopSession, got %v", err)
+	}
+	if _, err := sessionManager.GetCanarySession(ctx, "US"); err != ErrFrozen {
+		t.Fatalf("expected ErrFrozen from GetCanarySession, got %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		session, err := sessionManager.GetRandomSessionFromGroup(ctx, "TEST")
+		if err != nil || session.Country != "DE" {
+			t.Fatalf("expected the group to skip US, got %v (%v)", session, err)
+		}
+	}
+	if _, err := sessionManager.GetSession(ctx, "US", "130-9800000-0000001"); err != nil {
+		t.Fatalf("GetSession error: %v", err)
+	}
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "130-9800000-0000003", "token")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if ids, err := sessionManager.GetCountrySessionIDs(ctx, "US"); err != nil || len(ids) != 2 {
+		t.Fatalf("expected 2 sessions listed, got %v (%v)", ids, err)
+	}
+	session, err := sessionManager.PopSessionWithFallback(ctx, "US", "DE")
+	if err != nil || session.Country != "DE" {
+		t.Fatalf("expected the fallback country, got %v (%v)", session, err)
+	}
+
+	if err := sessionManager.UnfreezeCountry(ctx, "US"); err != nil {
+		t.Fatalf("UnfreezeCountry error: %v", err)
+	}
+	if _, err := sessionManager.PopSession(ctx, "US"); err != nil {
+		t.Fatalf("PopSession error: %v", err)
+	}
+}
+
+func TestMaintenanceWindows(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Now()}
+	sessionManager := newTestSessionManager(t, &Config{Clock: clock})
+	push := func(country, id string, checkedAgo time.Duration) {
+		opts := &PushOptions{LastChecked: clock.now.Add(-checkedAgo)}
+		if err := sessionManager.PushSessionWithOptions(ctx, createTestSession(country, id, "token"), opts); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+	}
+	push("US", "130-9900000-0000001", 70*time.Second)
+	push("US", "130-9900000-0000002", 10*time.Second)
+	push("DE", "130-9900000-0000003", time.Hour)
+
+	window := MaintenanceWindow{Start: clock.now.Add(-time.Minute), End: clock.now.Add(time.Hour), Mode: MaintenanceIntensify}
+	if err := sessionManager.ScheduleMaintenance(ctx, "US", window); err != nil {
+		t.Fatalf("ScheduleMaintenance error: %v", err)
+	}
+	window.Mode = MaintenancePause
+	if err := sessionManager.ScheduleMaintenance(ctx, "DE", window); err != nil {
+		t.Fatalf("ScheduleMaintenance error: %v", err)
+	}
+	if mode, active, err := sessionManager.ActiveMaintenance(ctx, "de"); err != nil || !active || mode != MaintenancePause {
+		t.Fatalf("expected DE to be paused, got %v %v (%v)", mode, active, err)
+	}
+	if err := sessionManager.ScheduleMaintenance(ctx, "FR", MaintenanceWindow{Start: clock.now, End: clock.now, Mode: MaintenancePause}); err == nil {
+		t.Fatal("expected error for an empty window")
+	}
+
+	// The intensified country is cleaned up with halved thresholds, the
+	// paused one is skipped.
+	result, err := sessionManager.CleanupSessionsWithResult(ctx, 100, 1000)
+	if err != nil {
+		t.Fatalf("CleanupSessions error: %v", err)
+	}
+	if result.Removed["US"] != 1 || !reflect.DeepEqual(result.Paused, []string{"DE"}) {
+		t.Fatalf("unexpected cleanup result %+v", result)
+	}
+	if exists, _ := sessionManager.ExistsSession(ctx, "DE", "130-9900000-0000003"); !exists {
+		t.Fatal("expected the paused country not to be cleaned up")
+	}
+
+	// Windows apply only while they are in progress.
+	clock.now = clock.now.Add(-2 * time.Minute)
+	if _, active, err := sessionManager.ActiveMaintenance(ctx, "DE"); err != nil || active {
+		t.Fatalf("expected no maintenance before the window, got %v (%v)", active, err)
+	}
+	if err := sessionManager.CancelMaintenance(ctx, "DE"); err != nil {
+		t.Fatalf("CancelMaintenance error: %v", err)
+	}
+	if w, err := sessionManager.GetMaintenance(ctx, "DE"); err != nil || w != nil {
+		t.Fatalf("expected the window to be canceled, got %v (%v)", w, err)
+	}
+}
+
+func TestLastRuns(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Now()}
+	sessionManager := newTestSessionManager(t, &Config{Clock: clock, InstanceName: "worker-1", RunHistoryRetention: time.Hour})
+	old := SweepRun{Name: "validate", Start: clock.now.Add(-2 * time.Hour), End: clock.now.Add(-2 * time.Hour)}
+	if err := sessionManager.RecordRun(ctx, old); err != nil {
+		t.Fatalf("RecordRun error: %v", err)
+	}
+	if err := sessionManager.RecordRun(ctx, SweepRun{Name: "validate", Instance: "worker-2", Start: clock.now.Add(-time.Minute), End: clock.now, Error: "timeout"}); err != nil {
+		t.Fatalf("RecordRun error: %v", err)
+	}
+	if err := sessionManager.PushSessionWithOptions(ctx, createTestSession("US", "130-9910000-0000001", "token"), &PushOptions{LastChecked: clock.now.Add(-time.Hour)}); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if err := sessionManager.CleanupSessions(ctx, 60, 1000); err != nil {
+		t.Fatalf("CleanupSessions error: %v", err)
+	}
+
+	// The run older than the retention is dropped, the others are listed
+	// newest first.
+	runs, err := sessionManager.LastRuns(ctx)
+	if err != nil {
+		t.Fatalf("LastRuns error: %v", err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("expected 2 runs, got %d", len(runs))
+	}
+	if runs[0].Name != "cleanup" || runs[0].Instance != "worker-1" || !runs[0].OK() || runs[0].Removed != 1 {
+		t.Fatalf("unexpected cleanup run %+v", runs[0])
+	}
+	if runs[1].Instance != "worker-2" || runs[1].OK() || runs[1].Duration != time.Minute {
+		t.Fatalf("unexpected validate run %+v", runs[1])
+	}
+	if err := sessionManager.RecordRun(ctx, SweepRun{}); err == nil {
+		t.Fatal("expected error for a run without name")
+	}
+}
+
+func TestRedisHooksChaos(t *testing.T) {
+	ctx := context.Background()
+	injector := chaos.New(chaos.Faults{NoScript: 1, Seed: 1})
+	sessionManager := newTestSessionManager(t, &Config{RedisHooks: []redis.Hook{injector}})
+
+	// Scripts missing from the cache are loaded again.
+	if err := sessionManager.PushSession(ctx, createTestSession("US", "130-9920000-0000001", "token")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if _, err := sessionManager.GetRandomSession(ctx, "US"); err != nil {
+		t.Fatalf("GetRandomSession error: %v", err)
+	}
+	if injector.Stats().NoScripts == 0 {
+		t.Fatal("expected NOSCRIPT errors to be injected")
+	}
+
+	// Timeouts surface as errors without corrupting the pool.
+	injector.SetFaults(chaos.Faults{Timeout: 1, Commands: []string{"evalsha"}})
+	if _, err := sessionManager.GetRandomSession(ctx, "US"); err == nil {
+		t.Fatal("expected error from GetRandomSession")
+	}
+	injector.SetFaults(chaos.Faults{})
+	if report, err := sessionManager.VerifyIntegrity(ctx); err != nil || !report.OK() {
+		t.Fatalf("unexpected integrity report %+v (%v)", report, err)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	sessionManager := newTestSessionManager(t, nil)
+	t.Cleanup(func() { sessionManager.client.Del(ctx, schemaVersionKey) })
+	connect := func(mode SchemaMigrationMode) (*AmazonSession, error) {
+		return NewAmazonSession(&Config{Addr: "127.0.0.1:6379", Password: "123456", Db: 10, SchemaMigration: mode})
+	}
+	session := createTestSession("US", "130-9930000-0000001", "token")
+	session.Tier = "premium"
+	if err := sessionManager.PushSession(ctx, session); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+
+	// A pool of an unversioned release, without the last-checked and tier
+	// indexes.
+	sessionManager.client.Del(ctx, schemaVersionKey)
+	sessionManager.client.ZRem(ctx, lastCheckedIndexKey("US"), "130-9930000-0000001")
+	sessionManager.client.Del(ctx, tierIndexKey("US", "premium"), tierRegistryKey("US"))
+	if version, err := sessionManager.StoredSchemaVersion(ctx); err != nil || version != 1 {
+		t.Fatalf("expected schema version 1, got %d (%v)", version, err)
+	}
+	if _, err := connect(SchemaMigrationRefuse); !errors.Is(err, ErrSchemaOutdated) {
+		t.Fatalf("expected ErrSchemaOutdated, got %v", err)
+	}
+	if _, err := connect(SchemaMigrationManual); err != nil {
+		t.Fatalf("NewAmazonSession error: %v", err)
+	}
+	if _, err := connect(SchemaMigrationAuto); err != nil {
+		t.Fatalf("NewAmazonSession error: %v", err)
+	}
+	if version, err := sessionManager.StoredSchemaVersion(ctx); err != nil || version != SchemaVersion {
+		t.Fatalf("expected schema version %d, got %d (%v)", SchemaVersion, version, err)
+	}
+	if err := sessionManager.client.ZScore(ctx, lastCheckedIndexKey("US"), "130-9930000-0000001").Err(); err != nil {
+		t.Fatalf("expected the last-checked index to be rebuilt: %v", err)
+	}
+	if ok, err := sessionManager.client.SIsMember(ctx, tierIndexKey("US", "premium"), "130-9930000-0000001").Result(); err != nil || !ok {
+		t.Fatalf("expected the tier index to be rebuilt, got %v (%v)", ok, err)
+	}
+
+	// Pools of a newer release are refused whatever the mode.
+	sessionManager.client.Set(ctx, schemaVersionKey, SchemaVersion+1, 0)
+	if _, err := connect(SchemaMigrationAuto); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected ErrSchemaTooNew, got %v", err)
+	}
+	if err := sessionManager.MigrateSchema(ctx); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected ErrSchemaTooNew from MigrateSchema, got %v", err)
+	}
+}
+
+func TestCountryOverrides(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Now()}
+	sessionManager := newTestSessionManager(t, &Config{
+		Clock:                   clock,
+		RequestBudgetPerCountry: map[string]int64{"us": 100},
+		CountryOverrides: map[string]CountryOverride{
+			"us": {CleanupMaxIdle: 30 * time.Second, RequestBudget: 1},
+		},
+	})
+	for _, country := range []string{"US", "DE"} {
+		for i, checkedAgo := range []time.Duration{10 * time.Second, time.Minute} {
+			id := "130-9940000-" + country + strconv.Itoa(i)
+			opts := &PushOptions{LastChecked: clock.now.Add(-checkedAgo)}
+			if err := sessionManager.PushSessionWithOptions(ctx, createTestSession(country, id, "token"), opts); err != nil {
+				t.Fatalf("PushSession error: %v", err)
+			}
+		}
+	}
+
+	// US sessions idle for more than 30s are removed, DE keeps the global
+	// threshold.
+	result, err := sessionManager.CleanupSessionsWithResult(ctx, 100, 1000)
+	if err != nil {
+		t.Fatalf("CleanupSessions error: %v", err)
+	}
+	if result.Removed["US"] != 1 || result.Removed["DE"] != 0 {
+		t.Fatalf("unexpected cleanup result %+v", result)
+	}
+
+	// The override replaces the per-country budget.
+	if _, err := sessionManager.GetRandomSession(ctx, "US"); err != nil {
+		t.Fatalf("GetRandomSession error: %v", err)
+	}
+	if _, err := sessionManager.GetRandomSession(ctx, "US"); !errors.Is(err, ErrBudgetExhausted) {
+		t.Fatalf("expected ErrBudgetExhausted, got %v", err)
+	}
+
+	_, err = NewAmazonSession(&Config{Addr: "127.0.0.1:6379", Password: "123456", Db: 10,
+		CountryOverrides: map[string]CountryOverride{"US": {MinPoolSize: -1}}})
+	if err == nil {
+		t.Fatal("expected error for a negative override")
+	}
+}
@@ -0,0 +1,283 @@
+// Package amazonsessiontest provides helpers to test code using
+// amazonsession against an in-memory Redis, and a harness running pops,
+// pushes and cleanups concurrently to check the atomicity of the pool
+// operations.
+package amazonsessiontest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	amazonsession "github.com/amzapi/amazon-redis-session"
+	"github.com/redis/go-redis/v9"
+)
+
+// New starts a miniredis server for the duration of the test and returns an
+// AmazonSession connected to it. cfg may be nil; its Addr, Password and Db
+// are overwritten.
+func New(t testing.TB, cfg *amazonsession.Config) (*amazonsession.AmazonSession, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	var c amazonsession.Config
+	if cfg != nil {
+		c = *cfg
+	}
+	c.Addr = server.Addr()
+	c.Password = ""
+	c.Db = 0
+	sessions, err := amazonsession.NewAmazonSession(&c)
+	if err != nil {
+		t.Fatalf("NewAmazonSession error: %v", err)
+	}
+	return sessions, server
+}
+
+// NewSession returns a session of a country with the given session-id, not
+// pushed yet.
+func NewSession(country, sessionID string) *amazonsession.Session {
+	expires := time.Now().Add(24 * time.Hour)
+	return &amazonsession.Session{
+		Country: country,
+		Cookies: []*http.Cookie{
+			{Name: "session-id", Value: sessionID, Path: "/", Expires: expires},
+			{Name: "session-token", Value: "token-" + sessionID, Path: "/", Expires: expires},
+		},
+	}
+}
+
+// SwarmOptions configures Swarm. Zero values select the defaults.
+type SwarmOptions struct {
+	Country    string // Country is the pool hammered by the swarm, defaults to US
+	Sessions   int    // Sessions is the number of sessions pushed before the swarm starts, defaults to 50
+	Workers    int    // Workers is the number of concurrent goroutines, defaults to 8
+	Iterations int    // Iterations is the number of operations per worker, defaults to 200
+	Seed       int64  // Seed seeds the choice of the operations, defaults to the current time
+}
+
+// SwarmResult counts the operations run by Swarm.
+type SwarmResult struct {
+	Pushes   int64 // Pushes is the number of sessions pushed, new or popped ones
+	Pops     int64 // Pops is the number of sessions popped
+	Returns  int64 // Returns is the number of popped sessions returned
+	Deletes  int64 // Deletes is the number of popped sessions deleted
+	Gets     int64 // Gets is the number of sessions loaded with GetRandomSession
+	Cleanups int64 // Cleanups is the number of cleanup runs
+	Empty    int64 // Empty is the number of pops or gets finding the pool empty
+}
+
+// swarm tracks the sessions expected in the pool.
+type swarm struct {
+	mu       sync.Mutex
+	expected map[string]bool
+	result   SwarmResult
+}
+
+func (s *swarm) count(counter *int64) {
+	s.mu.Lock()
+	*counter++
+	s.mu.Unlock()
+}
+
+// Swarm pushes opts.Sessions sessions, then runs opts.Workers goroutines
+// concurrently popping sessions and returning, pushing back or deleting
+// them, pushing new sessions, loading random sessions and running
+// cleanups, which remove nothing as their thresholds are never reached.
+// Every popped session is given back before its worker goes on. Once all
+// workers are done, the invariants are checked with CheckInvariants against
+// the sessions pushed and not deleted, and the violations are reported with
+// t.Errorf.
+func Swarm(t testing.TB, sessions *amazonsession.AmazonSession, opts SwarmOptions) SwarmResult {
+	t.Helper()
+	ctx := context.Background()
+	if opts.Country == "" {
+		opts.Country = "US"
+	}
+	if opts.Sessions == 0 {
+		opts.Sessions = 50
+	}
+	if opts.Workers == 0 {
+		opts.Workers = 8
+	}
+	if opts.Iterations == 0 {
+		opts.Iterations = 200
+	}
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+
+	s := &swarm{expected: make(map[string]bool)}
+	for i := 0; i < opts.Sessions; i++ {
+		id := swarmSessionID(0, i)
+		if err := sessions.PushSession(ctx, NewSession(opts.Country, id)); err != nil {
+			t.Fatalf("PushSession error: %v", err)
+		}
+		s.expected[id] = true
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, opts.Workers)
+	for w := 1; w <= opts.Workers; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(opts.Seed + int64(worker)))
+			for i := 0; i < opts.Iterations; i++ {
+				if err := s.step(ctx, sessions, opts.Country, rnd, worker, i); err != nil {
+					errs <- fmt.Errorf("worker %d: %v", worker, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("swarm: %v", err)
+	}
+
+	expected := make([]string, 0, len(s.expected))
+	for id := range s.expected {
+		expected = append(expected, id)
+	}
+	if err := CheckInvariants(ctx, sessions, opts.Country, expected); err != nil {
+		t.Errorf("swarm (seed %d): %v", opts.Seed, err)
+	}
+	return s.result
+}
+
+func swarmSessionID(worker, i int) string {
+	return fmt.Sprintf("130-%07d-%07d", worker, i)
+}
+
+// step runs one random operation of a worker.
+func (s *swarm) step(ctx context.Context, sessions *amazonsession.AmazonSession, country string, rnd *rand.Rand, worker, i int) error {
+	switch op := rnd.Intn(10); {
+	case op < 5:
+		session, err := sessions.PopSession(ctx, country)
+		if err == redis.Nil {
+			s.count(&s.result.Empty)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("PopSession: %v", err)
+		}
+		s.count(&s.result.Pops)
+		switch rnd.Intn(4) {
+		case 0:
+			// The session is removed from the expected sessions first, so
+			// it is never expected while it is deleted.
+			s.mu.Lock()
+			delete(s.expected, session.SessionID)
+			s.mu.Unlock()
+			if _, err := sessions.DeleteSession(ctx, country, session.SessionID); err != nil {
+				return fmt.Errorf("DeleteSession: %v", err)
+			}
+			s.count(&s.result.Deletes)
+		case 1:
+			if err := sessions.PushSession(ctx, session); err != nil {
+				return fmt.Errorf("PushSession: %v", err)
+			}
+			s.count(&s.result.Pushes)
+		default:
+			if err := sessions.ReturnSession(ctx, session); err != nil {
+				return fmt.Errorf("ReturnSession: %v", err)
+			}
+			s.count(&s.result.Returns)
+		}
+	case op < 7:
+		id := swarmSessionID(worker, i)
+		if err := sessions.PushSession(ctx, NewSession(country, id)); err != nil {
+			return fmt.Errorf("PushSession: %v", err)
+		}
+		s.mu.Lock()
+		s.expected[id] = true
+		s.result.Pushes++
+		s.mu.Unlock()
+	case op < 9:
+		_, err := sessions.GetRandomSession(ctx, country)
+		if err == redis.Nil {
+			s.count(&s.result.Empty)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("GetRandomSession: %v", err)
+		}
+		s.count(&s.result.Gets)
+	default:
+		if err := sessions.CleanupSessions(ctx, int64(24*time.Hour/time.Second), 1<<40); err != nil {
+			return fmt.Errorf("CleanupSessions: %v", err)
+		}
+		s.count(&s.result.Cleanups)
+	}
+	return nil
+}
+
+// CheckInvariants checks that the pool of a country holds exactly the
+// expected session-ids, each once and with its cookie data, that no session
+// is checked out anymore and that VerifyIntegrity finds no violation.
+func CheckInvariants(ctx context.Context, sessions *amazonsession.AmazonSession, country string, expected []string) error {
+	ids, err := sessions.GetCountrySessionIDs(ctx, country)
+	if err != nil {
+		return fmt.Errorf("GetCountrySessionIDs: %v", err)
+	}
+	listed := make(map[string]int, len(ids))
+	for _, id := range ids {
+		listed[id]++
+	}
+	var problems []string
+	for id, n := range listed {
+		if n > 1 {
+			problems = append(problems, fmt.Sprintf("%s listed %d times", id, n))
+		}
+	}
+	want := make(map[string]bool, len(expected))
+	for _, id := range expected {
+		want[id] = true
+		if listed[id] == 0 {
+			problems = append(problems, fmt.Sprintf("%s lost", id))
+		}
+	}
+	for id := range listed {
+		if !want[id] {
+			problems = append(problems, fmt.Sprintf("%s not expected", id))
+		}
+	}
+
+	status, err := sessions.GetDrainStatus(ctx, country)
+	if err != nil {
+		return fmt.Errorf("GetDrainStatus: %v", err)
+	}
+	if status.CheckedOut != 0 {
+		problems = append(problems, fmt.Sprintf("%d sessions still checked out", status.CheckedOut))
+	}
+	stats, err := sessions.BorrowStats(ctx, country)
+	if err != nil {
+		return fmt.Errorf("BorrowStats: %v", err)
+	}
+	for _, stat := range stats {
+		if stat.Borrowed != 0 {
+			problems = append(problems, fmt.Sprintf("%d sessions still borrowed by %q", stat.Borrowed, stat.Caller))
+		}
+	}
+
+	report, err := sessions.VerifyIntegrity(ctx)
+	if err != nil {
+		return fmt.Errorf("VerifyIntegrity: %v", err)
+	}
+	for _, v := range report.Violations {
+		problems = append(problems, fmt.Sprintf("%s: %s %s", v.Country, v.Kind, v.SessionID))
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%d invariant violations: %v", len(problems), problems)
+	}
+	return nil
+}
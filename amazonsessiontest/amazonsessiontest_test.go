@@ -0,0 +1,34 @@
+package amazonsessiontest
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSwarm(t *testing.T) {
+	sessions, _ := New(t, nil)
+	result := Swarm(t, sessions, SwarmOptions{Workers: 8, Iterations: 100})
+	if result.Pops == 0 || result.Pushes == 0 || result.Cleanups == 0 {
+		t.Fatalf("expected every operation to run, got %+v", result)
+	}
+}
+
+func TestCheckInvariants(t *testing.T) {
+	ctx := context.Background()
+	sessions, _ := New(t, nil)
+	if err := sessions.PushSession(ctx, NewSession("US", "130-0000001-0000001")); err != nil {
+		t.Fatalf("PushSession error: %v", err)
+	}
+	if err := CheckInvariants(ctx, sessions, "US", []string{"130-0000001-0000001"}); err != nil {
+		t.Fatalf("CheckInvariants error: %v", err)
+	}
+	if err := CheckInvariants(ctx, sessions, "US", []string{"130-0000001-0000002"}); err == nil {
+		t.Fatal("expected the lost and unexpected sessions to be reported")
+	}
+	if _, err := sessions.PopSession(ctx, "US"); err != nil {
+		t.Fatalf("PopSession error: %v", err)
+	}
+	if err := CheckInvariants(ctx, sessions, "US", nil); err == nil {
+		t.Fatal("expected the borrowed session to be reported")
+	}
+}
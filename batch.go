@@ -0,0 +1,148 @@
+package amazonsession
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ItemError is the error of one item of a batch operation.
+type ItemError struct {
+	Index     int    // Index is the position of the item in the batch
+	SessionID string // SessionID is the session-id of the item, when known
+	Err       error  // Err is the error of the item
+}
+
+func (e *ItemError) Error() string {
+	if e.SessionID == "" {
+		return fmt.Sprintf("item %d: %v", e.Index, e.Err)
+	}
+	return fmt.Sprintf("item %d (%s): %v", e.Index, e.SessionID, e.Err)
+}
+
+func (e *ItemError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is returned by the batch operations when some items failed.
+// The other items succeeded, so callers can retry only the failed ones.
+type MultiError struct {
+	Total  int          // Total is the number of items in the batch
+	Errors []*ItemError // Errors are the errors of the failed items, in batch order
+}
+
+func (e *MultiError) Error() string {
+	items := make([]string, 0, len(e.Errors))
+	for _, item := range e.Errors {
+		items = append(items, item.Error())
+	}
+	return fmt.Sprintf("%d of %d items failed: %s", len(e.Errors), e.Total, strings.Join(items, "; "))
+}
+
+// Unwrap returns the item errors, so errors.Is and errors.As match the
+// error of any failed item.
+func (e *MultiError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, item := range e.Errors {
+		errs = append(errs, item)
+	}
+	return errs
+}
+
+// Failed returns the indexes of the failed items.
+func (e *MultiError) Failed() []int {
+	indexes := make([]int, 0, len(e.Errors))
+	for _, item := range e.Errors {
+		indexes = append(indexes, item.Index)
+	}
+	return indexes
+}
+
+// multiError collects the errors of a batch operation.
+type multiError struct {
+	err MultiError
+}
+
+func (m *multiError) add(index int, sessionID string, err error) {
+	m.err.Errors = append(m.err.Errors, &ItemError{Index: index, SessionID: sessionID, Err: err})
+}
+
+// result returns the *MultiError of the batch, or nil when no item failed.
+func (m *multiError) result(total int) error {
+	if len(m.err.Errors) == 0 {
+		return nil
+	}
+	m.err.Total = total
+	return &m.err
+}
+
+// PushSessions pushes each session like PushSession. Sessions that fail to
+// push are reported in a *MultiError, the others are stored.
+func (j *AmazonSession) PushSessions(ctx context.Context, sessions []*Session) error {
+	var errs multiError
+	for i, session := range sessions {
+		if err := j.PushSession(ctx, session); err != nil {
+			errs.add(i, itemSessionID(session), err)
+		}
+	}
+	return errs.result(len(sessions))
+}
+
+// DeleteSessions deletes the sessions of a country like DeleteSession.
+// Session-ids that do not exist are not errors. Deletions that fail are
+// reported in a *MultiError.
+func (j *AmazonSession) DeleteSessions(ctx context.Context, country string, sessionIDs []string) error {
+	var errs multiError
+	for i, sessionID := range sessionIDs {
+		if _, err := j.DeleteSession(ctx, country, sessionID); err != nil {
+			errs.add(i, sessionID, err)
+		}
+	}
+	return errs.result(len(sessionIDs))
+}
+
+// ValidateSessions checks the cookies of the sessions the way PushSession
+// does in ValidationStrict mode, without storing them, whatever the
+// configured Config.CookieValidation. Invalid sessions are reported in a
+// *MultiError, with a *CookieValidationError for malformed cookies.
+func (j *AmazonSession) ValidateSessions(sessions []*Session) error {
+	var errs multiError
+	for i, session := range sessions {
+		if err := j.validateSession(session); err != nil {
+			errs.add(i, itemSessionID(session), err)
+		}
+	}
+	return errs.result(len(sessions))
+}
+
+func (j *AmazonSession) validateSession(session *Session) error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.Country = normalizeCountry(session.Country)
+	if session.Country == "" {
+		return fmt.Errorf("country not found in session")
+	}
+	if session.Jar == nil && len(session.Cookies) == 0 {
+		return fmt.Errorf("cookies jar and cookies not found in session")
+	}
+	cookiesMap, sessionID, inputCookies, err := j.storedCookies(session)
+	if err != nil {
+		return err
+	}
+	if problems := validateCookies(session.Country, cookiesMap, inputCookies); len(problems) > 0 {
+		return &CookieValidationError{SessionID: sessionID, Problems: problems}
+	}
+	return nil
+}
+
+// itemSessionID returns the session-id of a batch item, taken from its
+// session-id cookie for sessions not pushed yet.
+func itemSessionID(session *Session) string {
+	if session.SessionID != "" {
+		return session.SessionID
+	}
+	if c, ok := session.Cookie("session-id"); ok {
+		return c.Value
+	}
+	return ""
+}
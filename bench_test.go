@@ -0,0 +1,111 @@
+package amazonsession
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// benchPoolSize is the number of sessions seeded before each benchmark.
+const benchPoolSize = 1000
+
+// benchBackends returns the Redis configurations the benchmarks run against:
+// an in-process miniredis, and a real Redis when AMAZON_SESSION_BENCH_REDIS
+// is set to its address (AMAZON_SESSION_BENCH_PASSWORD for its password).
+func benchBackends(b *testing.B) map[string]*Config {
+	b.Helper()
+	m := miniredis.NewMiniRedis()
+	if err := m.Start(); err != nil {
+		b.Fatalf("failed to start miniredis: %v", err)
+	}
+	b.Cleanup(m.Close)
+
+	backends := map[string]*Config{
+		"miniredis": {Addr: m.Addr()},
+	}
+	if addr := os.Getenv("AMAZON_SESSION_BENCH_REDIS"); addr != "" {
+		backends["redis"] = &Config{
+			Addr:     addr,
+			Password: os.Getenv("AMAZON_SESSION_BENCH_PASSWORD"),
+			Db:       11,
+		}
+	}
+	return backends
+}
+
+func runBenchmark(b *testing.B, fn func(b *testing.B, ctx context.Context, sessionManager *AmazonSession)) {
+	for name, cfg := range benchBackends(b) {
+		b.Run(name, func(b *testing.B) {
+			ctx := context.Background()
+			sessionManager, err := NewAmazonSession(cfg)
+			if err != nil {
+				b.Fatalf("无法连接到 Redis: %v", err)
+			}
+			if err := sessionManager.ClearAllCookies(ctx); err != nil {
+				b.Fatalf("ClearAllCookies failed: %v", err)
+			}
+			for i := 0; i < benchPoolSize; i++ {
+				if err := sessionManager.PushSession(ctx, createTestSession("US", fmt.Sprintf("session%d", i), "token")); err != nil {
+					b.Fatalf("PushSession failed: %v", err)
+				}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			fn(b, ctx, sessionManager)
+		})
+	}
+}
+
+func BenchmarkGetSession(b *testing.B) {
+	runBenchmark(b, func(b *testing.B, ctx context.Context, sessionManager *AmazonSession) {
+		for i := 0; i < b.N; i++ {
+			if _, err := sessionManager.GetSession(ctx, "US", fmt.Sprintf("session%d", i%benchPoolSize)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkGetRandomSession(b *testing.B) {
+	runBenchmark(b, func(b *testing.B, ctx context.Context, sessionManager *AmazonSession) {
+		for i := 0; i < b.N; i++ {
+			if _, err := sessionManager.GetRandomSession(ctx, "US"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkPushSession(b *testing.B) {
+	runBenchmark(b, func(b *testing.B, ctx context.Context, sessionManager *AmazonSession) {
+		for i := 0; i < b.N; i++ {
+			if err := sessionManager.PushSession(ctx, createTestSession("US", fmt.Sprintf("push%d", i), "token")); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkListSession(b *testing.B) {
+	runBenchmark(b, func(b *testing.B, ctx context.Context, sessionManager *AmazonSession) {
+		for i := 0; i < b.N; i++ {
+			if _, err := sessionManager.ListSession(ctx, "US", Pagination{Size: 100, Page: i % 10}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkCleanupSessions(b *testing.B) {
+	runBenchmark(b, func(b *testing.B, ctx context.Context, sessionManager *AmazonSession) {
+		for i := 0; i < b.N; i++ {
+			// Thresholds are high enough that the pool is scanned but kept.
+			if err := sessionManager.CleanupSessions(ctx, 1<<40, 1<<40); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package amazonsession
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrFairShareExceeded is returned by PopSession when the caller already
+// holds as many sessions of the country as its borrow limit allows, see
+// SetBorrowLimit.
+var ErrFairShareExceeded = errors.New("borrow limit exceeded for the specified caller")
+
+// defaultBorrower is the caller name of the default borrow limit.
+const defaultBorrower = "*"
+
+func borrowsKey(country string) string {
+	return fmt.Sprintf("%s:borrows", country)
+}
+
+func borrowTotalsKey(country string) string {
+	return fmt.Sprintf("%s:borrow-totals", country)
+}
+
+func borrowersKey(country string) string {
+	return fmt.Sprintf("%s:borrowers", country)
+}
+
+func borrowLimitsKey(country string) string {
+	return fmt.Sprintf("%s:borrow-limits", country)
+}
+
+type callerKey struct{}
+
+// WithCaller returns a context that attributes the sessions borrowed with
+// PopSession and PopSessionWithFallback to caller, e.g. an API key or a
+// worker group. Borrowed sessions are counted per caller until they are
+// returned, pushed or deleted, and borrows beyond the limit of the caller
+// fail with ErrFairShareExceeded. Sessions popped without a caller are
+// tracked as checked out but not counted against any limit.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+func callerFromContext(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+// BorrowStat holds the borrow accounting of a caller in a country.
+type BorrowStat struct {
+	Caller   string `json:"caller"`   // Caller is the name passed to WithCaller, "*" for the default limit
+	Borrowed int64  `json:"borrowed"` // Borrowed is the number of sessions currently held by the caller
+	Total    int64  `json:"total"`    // Total is the number of sessions borrowed by the caller so far
+	Limit    int64  `json:"limit"`    // Limit is the maximum number of sessions held at once, zero when unlimited
+}
+
+// borrowSession pops a session-id from the first of the countries that has
+// one not expired by Amazon and whose borrow limit the caller has not
+// reached, and returns the index of that country.
+func (j *AmazonSession) borrowSession(ctx context.Context, countries []string, caller string) (int, string, error) {
+	res, err := borrowSessionCmd.Run(ctx, j.client, countries, caller, defaultBorrower, j.clock.Now().Unix()).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "FAIR SHARE EXCEEDED") {
+			return 0, "", ErrFairShareExceeded
+		}
+		return 0, "", fmt.Errorf("redis eval error: %v", err)
+	}
+	values, err := replySlice(res)
+	if err != nil || len(values) != 2 {
+		return 0, "", fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+	}
+	index, err := replyInt64(values[0])
+	if err != nil || index < 1 || index > int64(len(countries)) {
+		return 0, "", fmt.Errorf("unexpected value returned from Lua script")
+	}
+	sessionID, err := replyString(values[1])
+	if err != nil {
+		return 0, "", err
+	}
+	return int(index - 1), sessionID, nil
+}
+
+// releaseBorrow ends the borrow of a session, if it was borrowed.
+func (j *AmazonSession) releaseBorrow(ctx context.Context, country, sessionID string) error {
+	res, err := releaseBorrowCmd.Run(ctx, j.client, []string{country}, sessionID).Result()
+	if err != nil {
+		return fmt.Errorf("redis eval error: %v", err)
+	}
+	if released, _ := replyInt64(res); released == 1 {
+		return j.checkDrained(ctx, country)
+	}
+	return nil
+}
+
+// SetBorrowLimit sets the maximum number of sessions of a country the caller
+// may hold at once. An empty caller sets the default limit of all callers
+// without their own limit; a limit of zero removes the limit.
+func (j *AmazonSession) SetBorrowLimit(ctx context.Context, country, caller string, limit int64) error {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	if limit < 0 {
+		return errors.New("borrow limit must not be negative")
+	}
+	if caller == "" {
+		caller = defaultBorrower
+	}
+	if limit == 0 {
+		return j.client.HDel(ctx, borrowLimitsKey(country), caller).Err()
+	}
+	return j.client.HSet(ctx, borrowLimitsKey(country), caller, limit).Err()
+}
+
+// BorrowStats returns the borrow accounting of each caller in a country,
+// including the callers that only have a limit set, sorted by caller.
+func (j *AmazonSession) BorrowStats(ctx context.Context, country string) ([]BorrowStat, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	pipe := j.readClient(ctx).Pipeline()
+	borrowed := pipe.HGetAll(ctx, borrowsKey(country))
+	totals := pipe.HGetAll(ctx, borrowTotalsKey(country))
+	limits := pipe.HGetAll(ctx, borrowLimitsKey(country))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]*BorrowStat)
+	var order []string
+	set := func(values map[string]string, field func(*BorrowStat) *int64) error {
+		for caller, value := range values {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid borrow count for caller %s: %v", caller, err)
+			}
+			if _, found := stats[caller]; !found {
+				stats[caller] = &BorrowStat{Caller: caller}
+				order = append(order, caller)
+			}
+			*field(stats[caller]) = n
+		}
+		return nil
+	}
+	if err := set(borrowed.Val(), func(s *BorrowStat) *int64 { return &s.Borrowed }); err != nil {
+		return nil, err
+	}
+	if err := set(totals.Val(), func(s *BorrowStat) *int64 { return &s.Total }); err != nil {
+		return nil, err
+	}
+	if err := set(limits.Val(), func(s *BorrowStat) *int64 { return &s.Limit }); err != nil {
+		return nil, err
+	}
+	sort.Strings(order)
+
+	result := make([]BorrowStat, 0, len(order))
+	for _, caller := range order {
+		result = append(result, *stats[caller])
+	}
+	return result, nil
+}
+
+// BorrowHandler returns an HTTP handler for administering the borrow limits.
+// GET ?country=US serves BorrowStats as JSON; POST
+// ?country=US&caller=worker-1&limit=100 calls SetBorrowLimit.
+func (j *AmazonSession) BorrowHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		country := query.Get("country")
+		if _, err := j.getCountryURL(normalizeCountry(country)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			stats, err := j.BorrowStats(r.Context(), country)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(stats)
+		case http.MethodPost:
+			limit, err := strconv.ParseInt(query.Get("limit"), 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid limit: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := j.SetBorrowLimit(r.Context(), country, query.Get("caller"), limit); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package amazonsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrCountryTripped is returned when the circuit breaker of a country is
+// tripped, see Config.CircuitBreaker.
+var ErrCountryTripped = errors.New("circuit breaker tripped for the specified country")
+
+// Defaults used when they are not set in CircuitBreakerConfig.
+const (
+	defaultBreakerWindow    = time.Minute
+	defaultBreakerCooldown  = 30 * time.Second
+	defaultBreakerHalfOpen  = 1
+	defaultBreakerThreshold = 50
+)
+
+// CircuitBreakerConfig configures the per-country circuit breakers. The
+// breaker state is stored in Redis and shared by all processes.
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of failures recorded with
+	// RecordFailure within Window that trips the breaker of a country.
+	// Defaults to 50.
+	FailureThreshold int64
+
+	// Window is the period over which failures are counted. Defaults to 1m.
+	Window time.Duration
+
+	// Cooldown is the time a tripped breaker rejects requests before it
+	// lets probes through (half-open). Defaults to 30s.
+	Cooldown time.Duration
+
+	// HalfOpenProbes is the number of sessions handed out while half-open.
+	// A successful TouchSession closes the breaker, a failure trips it
+	// again. Defaults to 1.
+	HalfOpenProbes int64
+}
+
+// validate checks the CircuitBreakerConfig and fills unset values with their
+// defaults.
+func (cfg *CircuitBreakerConfig) validate() error {
+	if cfg.FailureThreshold < 0 || cfg.Window < 0 || cfg.Cooldown < 0 || cfg.HalfOpenProbes < 0 {
+		return errors.New("invalid config: circuit breaker settings must not be negative")
+	}
+	if cfg.FailureThreshold == 0 {
+		cfg.FailureThreshold = defaultBreakerThreshold
+	}
+	if cfg.Window == 0 {
+		cfg.Window = defaultBreakerWindow
+	}
+	if cfg.Cooldown == 0 {
+		cfg.Cooldown = defaultBreakerCooldown
+	}
+	if cfg.HalfOpenProbes == 0 {
+		cfg.HalfOpenProbes = defaultBreakerHalfOpen
+	}
+	return nil
+}
+
+func breakerKey(country string) string {
+	return fmt.Sprintf("%s:breaker", country)
+}
+
+// breakerAllow returns ErrCountryTripped when the breaker of a country
+// rejects requests. With probe set, a half-open breaker consumes a probe.
+func (j *AmazonSession) breakerAllow(ctx context.Context, country string, probe bool) error {
+	cfg := j.circuitBreaker
+	if cfg == nil {
+		return nil
+	}
+	consume := "0"
+	if probe {
+		consume = "1"
+	}
+	args := []interface{}{j.clock.Now().Unix(), int64(j.breakerCooldown(country) / time.Second), cfg.HalfOpenProbes, consume}
+	res, err := breakerAllowCmd.Run(ctx, j.client, []string{breakerKey(country)}, args...).Result()
+	if err != nil {
+		return fmt.Errorf("redis eval error: %v", err)
+	}
+	if allowed, err := replyInt64(res); err != nil || allowed == 0 {
+		return ErrCountryTripped
+	}
+	return nil
+}
+
+// breakerRecord records the outcome of a session check in the breaker of a
+// country.
+func (j *AmazonSession) breakerRecord(ctx context.Context, country string, failure bool) error {
+	cfg := j.circuitBreaker
+	if cfg == nil {
+		return nil
+	}
+	outcome := "0"
+	if failure {
+		outcome = "1"
+	}
+	args := []interface{}{j.clock.Now().Unix(), outcome, int64(cfg.Window / time.Second), cfg.FailureThreshold}
+	if err := breakerRecordCmd.Run(ctx, j.client, []string{breakerKey(country)}, args...).Err(); err != nil {
+		return fmt.Errorf("redis eval error: %v", err)
+	}
+	return nil
+}
+
+// ResetCircuitBreaker closes the breaker of a country.
+func (j *AmazonSession) ResetCircuitBreaker(ctx context.Context, country string) error {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.client.Del(ctx, breakerKey(country)).Err()
+}
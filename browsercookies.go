@@ -0,0 +1,138 @@
+package amazonsession
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChromiumDecrypter decrypts the encrypted_value column of a Chromium
+// cookie (e.g. with the key of the OS keychain, DPAPI or "peanuts" on
+// Linux) and returns the plain value, including the "v10"/"v11" prefix
+// handling specific to the platform.
+type ChromiumDecrypter func(encrypted []byte) ([]byte, error)
+
+// chromiumEpochOffset is the number of microseconds between the Windows
+// epoch (1601-01-01) used by Chromium timestamps and the Unix epoch.
+const chromiumEpochOffset = 11644473600 * 1000000
+
+// ImportChromiumCookies reads the Amazon cookies of a Chromium "Cookies"
+// SQLite file and pushes one session per marketplace. db must be opened by
+// the caller with a SQLite driver of its choice, preferably on a copy of the
+// file since the browser locks it. decrypt is called for encrypted values
+// and may be nil when all values are stored in plain text. Expired cookies
+// are skipped. It returns the pushed sessions.
+func (j *AmazonSession) ImportChromiumCookies(ctx context.Context, db *sql.DB, decrypt ChromiumDecrypter) ([]*Session, error) {
+	rows, err := db.QueryContext(ctx, `SELECT host_key, name, value, encrypted_value, path, expires_utc, is_secure, is_httponly FROM cookies WHERE host_key LIKE '%amazon.%'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chromium cookies: %v", err)
+	}
+	defer rows.Close()
+
+	now := j.clock.Now()
+	cookies := make(map[string][]*http.Cookie)
+	for rows.Next() {
+		var host, name, value, path string
+		var encrypted []byte
+		var expires, secure, httpOnly int64
+		if err := rows.Scan(&host, &name, &value, &encrypted, &path, &expires, &secure, &httpOnly); err != nil {
+			return nil, fmt.Errorf("failed to scan chromium cookie: %v", err)
+		}
+		if value == "" && len(encrypted) > 0 {
+			if decrypt == nil {
+				return nil, fmt.Errorf("chromium cookie %s is encrypted but no decrypter is set", name)
+			}
+			plain, err := decrypt(encrypted)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt chromium cookie %s: %v", name, err)
+			}
+			// Recent Chromium versions prefix the value with the SHA-256 of the host.
+			if hash := sha256.Sum256([]byte(host)); bytes.HasPrefix(plain, hash[:]) {
+				plain = plain[len(hash):]
+			}
+			value = string(plain)
+		}
+		cookie := &http.Cookie{Name: name, Value: value, Path: path, Domain: host, Secure: secure != 0, HttpOnly: httpOnly != 0}
+		// An expiry of zero marks a cookie without expiry.
+		if expires != 0 {
+			cookie.Expires = time.UnixMicro(expires - chromiumEpochOffset)
+		}
+		addBrowserCookie(cookies, cookie, now)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read chromium cookies: %v", err)
+	}
+	return j.pushBrowserSessions(ctx, cookies)
+}
+
+// ImportFirefoxCookies reads the Amazon cookies of a Firefox cookies.sqlite
+// file and pushes one session per marketplace, like ImportChromiumCookies.
+func (j *AmazonSession) ImportFirefoxCookies(ctx context.Context, db *sql.DB) ([]*Session, error) {
+	rows, err := db.QueryContext(ctx, `SELECT host, name, value, path, expiry, isSecure, isHttpOnly FROM moz_cookies WHERE host LIKE '%amazon.%'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query firefox cookies: %v", err)
+	}
+	defer rows.Close()
+
+	now := j.clock.Now()
+	cookies := make(map[string][]*http.Cookie)
+	for rows.Next() {
+		var host, name, value, path string
+		var expiry, secure, httpOnly int64
+		if err := rows.Scan(&host, &name, &value, &path, &expiry, &secure, &httpOnly); err != nil {
+			return nil, fmt.Errorf("failed to scan firefox cookie: %v", err)
+		}
+		cookie := &http.Cookie{Name: name, Value: value, Path: path, Domain: host, Secure: secure != 0, HttpOnly: httpOnly != 0}
+		if expiry != 0 {
+			// Recent versions store the expiry in milliseconds.
+			if expiry > 1e11 {
+				cookie.Expires = time.UnixMilli(expiry)
+			} else {
+				cookie.Expires = time.Unix(expiry, 0)
+			}
+		}
+		addBrowserCookie(cookies, cookie, now)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read firefox cookies: %v", err)
+	}
+	return j.pushBrowserSessions(ctx, cookies)
+}
+
+// addBrowserCookie adds a cookie to the cookies of its marketplace, skipping
+// expired cookies and cookies of other sites.
+func addBrowserCookie(cookies map[string][]*http.Cookie, cookie *http.Cookie, now time.Time) {
+	if !cookie.Expires.IsZero() && !cookie.Expires.After(now) {
+		return
+	}
+	country, found := countryFromURL(strings.TrimPrefix(cookie.Domain, "."))
+	if !found {
+		return
+	}
+	cookies[country] = append(cookies[country], cookie)
+}
+
+// pushBrowserSessions pushes the cookies of each marketplace as a session,
+// in country order.
+func (j *AmazonSession) pushBrowserSessions(ctx context.Context, cookies map[string][]*http.Cookie) ([]*Session, error) {
+	countries := make([]string, 0, len(cookies))
+	for country := range cookies {
+		countries = append(countries, country)
+	}
+	sort.Strings(countries)
+	sessions := make([]*Session, 0, len(countries))
+	for _, country := range countries {
+		session := NewSession(country, "", cookies[country])
+		if err := j.PushSession(ctx, session); err != nil {
+			return sessions, fmt.Errorf("failed to push %s session: %v", country, err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
@@ -0,0 +1,126 @@
+package amazonsession
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cookieDBDriver is a database/sql driver serving fixed rows for the
+// cookie queries of the browser imports, in place of a SQLite driver.
+type cookieDBDriver struct {
+	tables map[string][][]driver.Value // tables maps a table name to its rows
+}
+
+type cookieDBConn struct{ d *cookieDBDriver }
+
+type cookieDBStmt struct {
+	d     *cookieDBDriver
+	query string
+}
+
+type cookieDBRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (d *cookieDBDriver) Open(string) (driver.Conn, error) { return &cookieDBConn{d}, nil }
+
+func (c *cookieDBConn) Prepare(query string) (driver.Stmt, error) {
+	return &cookieDBStmt{c.d, query}, nil
+}
+func (c *cookieDBConn) Close() error              { return nil }
+func (c *cookieDBConn) Begin() (driver.Tx, error) { return nil, driver.ErrSkip }
+
+func (s *cookieDBStmt) Close() error  { return nil }
+func (s *cookieDBStmt) NumInput() int { return -1 }
+func (s *cookieDBStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, driver.ErrSkip
+}
+func (s *cookieDBStmt) Query([]driver.Value) (driver.Rows, error) {
+	columns := strings.Split(strings.TrimSpace(strings.Split(strings.TrimPrefix(s.query, "SELECT "), " FROM ")[0]), ", ")
+	table := strings.Fields(strings.Split(s.query, " FROM ")[1])[0]
+	return &cookieDBRows{columns: columns, rows: s.d.tables[table]}, nil
+}
+
+func (r *cookieDBRows) Columns() []string { return r.columns }
+func (r *cookieDBRows) Close() error      { return nil }
+func (r *cookieDBRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestImportBrowserCookies(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	sessionManager := newTestSessionManager(t, &Config{Clock: &testClock{now: now}})
+
+	chromiumExpiry := now.Add(time.Hour).UnixMicro() + chromiumEpochOffset
+	hostHash := sha256.Sum256([]byte(".amazon.de"))
+	sql.Register("cookiedb-chromium", &cookieDBDriver{tables: map[string][][]driver.Value{
+		"cookies": {
+			{".amazon.com", "session-id", "130-8000000-0000001", []byte{}, "/", chromiumExpiry, int64(1), int64(0)},
+			{".amazon.com", "ubid-main", "130-8000000-0000002", []byte{}, "/", chromiumExpiry, int64(1), int64(0)},
+			{".amazon.com", "session-token", "expired", []byte{}, "/", now.Add(-time.Hour).UnixMicro() + chromiumEpochOffset, int64(1), int64(1)},
+			{".amazon.de", "session-id", "", append(hostHash[:], "v10:260-8000000-0000003"...), "/", int64(0), int64(1), int64(0)},
+		},
+	}})
+	db, err := sql.Open("cookiedb-chromium", "")
+	if err != nil {
+		t.Fatalf("sql.Open error: %v", err)
+	}
+	defer db.Close()
+
+	decrypt := func(encrypted []byte) ([]byte, error) {
+		return []byte(strings.Replace(string(encrypted), "v10:", "", 1)), nil
+	}
+	sessions, err := sessionManager.ImportChromiumCookies(ctx, db, decrypt)
+	if err != nil {
+		t.Fatalf("ImportChromiumCookies error: %v", err)
+	}
+	if len(sessions) != 2 || sessions[0].Country != "DE" || sessions[0].SessionID != "260-8000000-0000003" ||
+		sessions[1].Country != "US" || sessions[1].SessionID != "130-8000000-0000001" {
+		t.Fatalf("unexpected sessions %v", sessions)
+	}
+	stored, err := sessionManager.GetSession(ctx, "US", "130-8000000-0000001")
+	if err != nil {
+		t.Fatalf("GetSession error: %v", err)
+	}
+	if c, ok := stored.Cookie("ubid-main"); !ok || c.Value != "130-8000000-0000002" {
+		t.Fatalf("expected ubid-main cookie, got %v", c)
+	}
+	if _, ok := stored.Cookie("session-token"); ok {
+		t.Fatal("expired cookie imported")
+	}
+	if _, err := sessionManager.ImportChromiumCookies(ctx, db, nil); err == nil {
+		t.Fatal("expected error for encrypted cookie without decrypter")
+	}
+
+	sql.Register("cookiedb-firefox", &cookieDBDriver{tables: map[string][][]driver.Value{
+		"moz_cookies": {
+			{".amazon.co.uk", "session-id", "260-8000000-0000004", "/", now.Add(time.Hour).UnixMilli(), int64(1), int64(0)},
+			{".example.com", "session-id", "other", "/", now.Add(time.Hour).Unix(), int64(1), int64(0)},
+		},
+	}})
+	db, err = sql.Open("cookiedb-firefox", "")
+	if err != nil {
+		t.Fatalf("sql.Open error: %v", err)
+	}
+	defer db.Close()
+	sessions, err = sessionManager.ImportFirefoxCookies(ctx, db)
+	if err != nil {
+		t.Fatalf("ImportFirefoxCookies error: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].Country != "UK" || sessions[0].SessionID != "260-8000000-0000004" {
+		t.Fatalf("unexpected sessions %v", sessions)
+	}
+}
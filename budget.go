@@ -0,0 +1,104 @@
+package amazonsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrBudgetExhausted is matched by the *BudgetExhaustedError returned when
+// the hourly request budget of a country is used up, see
+// Config.RequestBudget.
+var ErrBudgetExhausted = errors.New("request budget exhausted for the specified country")
+
+// BudgetExhaustedError is returned when the hourly request budget of a
+// country is used up. ResetAt is the time the budget is renewed.
+type BudgetExhaustedError struct {
+	Country string
+	ResetAt time.Time
+}
+
+func (e *BudgetExhaustedError) Error() string {
+	return fmt.Sprintf("request budget exhausted for country %s until %s", e.Country, e.ResetAt.UTC().Format(time.RFC3339))
+}
+
+// Is reports whether target is ErrBudgetExhausted.
+func (e *BudgetExhaustedError) Is(target error) bool {
+	return target == ErrBudgetExhausted
+}
+
+// budgetWindow is the period of the request budgets. Windows start at the
+// full hour.
+const budgetWindow = time.Hour
+
+func budgetKey(country string) string {
+	return fmt.Sprintf("%s:budget", country)
+}
+
+// countryBudget returns the hourly request budget of a country, zero when
+// unlimited.
+func (j *AmazonSession) countryBudget(country string) int64 {
+	if budget, found := j.countryBudgets[country]; found {
+		return budget
+	}
+	return j.requestBudget
+}
+
+// budgetAllow returns a *BudgetExhaustedError when the request budget of a
+// country is used up. With consume set, a request is taken from the budget.
+func (j *AmazonSession) budgetAllow(ctx context.Context, country string, consume bool) error {
+	budget := j.countryBudget(country)
+	if budget <= 0 {
+		return nil
+	}
+	take := "0"
+	if consume {
+		take = "1"
+	}
+	args := []interface{}{j.clock.Now().Unix(), int64(budgetWindow / time.Second), budget, take}
+	res, err := budgetAllowCmd.Run(ctx, j.client, []string{budgetKey(country)}, args...).Result()
+	if err != nil {
+		return fmt.Errorf("redis eval error: %v", err)
+	}
+	resetAt, err := replyInt64(res)
+	if err != nil {
+		return fmt.Errorf("cast error: Lua script returned unexpected value: %v", err)
+	}
+	if resetAt > 0 {
+		return &BudgetExhaustedError{Country: country, ResetAt: time.Unix(resetAt, 0)}
+	}
+	return nil
+}
+
+// RemainingBudget returns the requests left in the current hourly budget of
+// a country and the time the budget is renewed. It returns -1 when the
+// country has no budget.
+func (j *AmazonSession) RemainingBudget(ctx context.Context, country string) (int64, time.Time, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	budget := j.countryBudget(country)
+	if budget <= 0 {
+		return -1, time.Time{}, nil
+	}
+	now := j.clock.Now()
+	resetAt := now.Truncate(budgetWindow).Add(budgetWindow)
+	values, err := j.client.HMGet(ctx, budgetKey(country), "window-start", "used").Result()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	start, err := replyInt64(values[0])
+	if err != nil || start != now.Truncate(budgetWindow).Unix() {
+		// No requests were made in the current window.
+		return budget, resetAt, nil
+	}
+	used, err := replyInt64(values[1])
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid request budget: %v", err)
+	}
+	if used > budget {
+		used = budget
+	}
+	return budget - used, resetAt, nil
+}
@@ -0,0 +1,138 @@
+package amazonsession
+
+import (
+	"net/http"
+)
+
+// SessionBuilder builds a session or a changed copy of one, see
+// NewSessionBuilder and Session.Builder. The counters and timestamps of a
+// session are maintained by AmazonSession and cannot be set; persist the
+// built session with PushSession or PushSessionIfDirty.
+type SessionBuilder struct {
+	session *Session
+	stored  bool // stored is set when building from an existing session, see Builder
+}
+
+// NewSessionBuilder returns a builder for a new session of a country.
+func NewSessionBuilder(country, sessionID string) *SessionBuilder {
+	return &SessionBuilder{session: NewSession(country, sessionID, nil)}
+}
+
+// Builder returns a builder starting from a copy of the session, so the
+// session itself is left unchanged.
+func (s *Session) Builder() *SessionBuilder {
+	return &SessionBuilder{session: s.Clone(), stored: true}
+}
+
+// Cookies replaces the cookies of the session with a copy of cookies. A copy
+// of an existing session is marked dirty, see Session.Dirty.
+func (b *SessionBuilder) Cookies(cookies []*http.Cookie) *SessionBuilder {
+	b.session.Cookies = nil
+	for _, c := range cookies {
+		cookie := *c
+		b.session.Cookies = append(b.session.Cookies, &cookie)
+	}
+	if b.stored {
+		b.session.dirty = true
+	}
+	return b
+}
+
+// PostalCode sets the delivery location of the session.
+func (b *SessionBuilder) PostalCode(postalCode string) *SessionBuilder {
+	b.session.PostalCode = postalCode
+	return b
+}
+
+// Currency sets the preferred currency of the session.
+func (b *SessionBuilder) Currency(currency string) *SessionBuilder {
+	b.session.Currency = currency
+	return b
+}
+
+// Language sets the preferred language of the session.
+func (b *SessionBuilder) Language(language string) *SessionBuilder {
+	b.session.Language = language
+	return b
+}
+
+// AccountRef sets the reference to the account backing the session.
+func (b *SessionBuilder) AccountRef(accountRef string) *SessionBuilder {
+	b.session.AccountRef = accountRef
+	return b
+}
+
+// Label sets a label of the session.
+func (b *SessionBuilder) Label(name, value string) *SessionBuilder {
+	if b.session.Labels == nil {
+		b.session.Labels = make(map[string]string)
+	}
+	b.session.Labels[name] = value
+	return b
+}
+
+// Generation sets the import batch the session was harvested in.
+func (b *SessionBuilder) Generation(generation string) *SessionBuilder {
+	b.session.Generation = generation
+	return b
+}
+
+// Canary sets whether the session is a canary.
+func (b *SessionBuilder) Canary(canary bool) *SessionBuilder {
+	b.session.Canary = canary
+	return b
+}
+
+// Residency sets the origin network type of the session.
+func (b *SessionBuilder) Residency(residency string) *SessionBuilder {
+	b.session.Residency = residency
+	return b
+}
+
+// ASN sets the autonomous system number of the exit IP of the session.
+func (b *SessionBuilder) ASN(asn string) *SessionBuilder {
+	b.session.ASN = asn
+	return b
+}
+
+// ExitIPHash sets the hash of the exit IP of the session, see HashExitIP.
+func (b *SessionBuilder) ExitIPHash(hash string) *SessionBuilder {
+	b.session.ExitIPHash = hash
+	return b
+}
+
+// Proxy sets the URL of the proxy bound to the session.
+func (b *SessionBuilder) Proxy(proxy string) *SessionBuilder {
+	b.session.Proxy = proxy
+	return b
+}
+
+// TLSProfile sets the TLS fingerprint profile of the session.
+func (b *SessionBuilder) TLSProfile(profile string) *SessionBuilder {
+	b.session.TLSProfile = profile
+	return b
+}
+
+// Bucket sets the A/B experiment bucket of the session.
+func (b *SessionBuilder) Bucket(bucket string) *SessionBuilder {
+	b.session.Bucket = bucket
+	return b
+}
+
+// Tier sets the priority tier of the session.
+func (b *SessionBuilder) Tier(tier string) *SessionBuilder {
+	b.session.Tier = tier
+	return b
+}
+
+// RawSetCookies sets the raw Set-Cookie header values of the session.
+func (b *SessionBuilder) RawSetCookies(values []string) *SessionBuilder {
+	b.session.RawSetCookies = append([]string(nil), values...)
+	return b
+}
+
+// Build returns the built session. The builder can be changed and built
+// again without affecting the returned session.
+func (b *SessionBuilder) Build() *Session {
+	return b.session.Clone()
+}
@@ -0,0 +1,49 @@
+package amazonsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// canaryIdsKey returns the key of the list of canary session-ids of a
+// country. Canaries are not part of the main pool kept at sessionIdsKey.
+func canaryIdsKey(country string) string {
+	return fmt.Sprintf("%s:canary-ids", country)
+}
+
+// GetCanarySession returns a random canary session of a country, skipping
+// canaries expired by Amazon. Sessions are designated as canaries by pushing
+// them with Session.Canary set.
+func (j *AmazonSession) GetCanarySession(ctx context.Context, country string) (*Session, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	if err := j.checkoutGate(ctx, country); err != nil {
+		return nil, err
+	}
+
+	// Pick in one script, so a concurrent removal cannot empty the list
+	// between its length and the pick.
+	keys := []string{canaryIdsKey(country), cookiesKey(country)}
+	res, err := getRandomSessionCmd.Run(ctx, j.client, keys, scriptRand(), j.clock.Now().Unix()).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "NOT FOUND") {
+			return nil, errors.New("no canary sessions available for the specified country")
+		}
+		return nil, fmt.Errorf("redis eval error: %v", err)
+	}
+	sessionID, err := replyString(res)
+	if err != nil {
+		return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+	}
+	return j.GetSession(ctx, country, sessionID)
+}
+
+// ListCanarySessionMeta lists the counters and timestamps of the canary
+// sessions of a country with pagination, tracked apart from ListSessionMeta.
+func (j *AmazonSession) ListCanarySessionMeta(ctx context.Context, country string, pgn Pagination) ([]*SessionMeta, error) {
+	country = normalizeCountry(country)
+	return j.listSessionMeta(ctx, country, canaryIdsKey(country), pgn)
+}
@@ -0,0 +1,64 @@
+package amazonsession
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+)
+
+// captchaMarkers are found in the captcha pages served by Amazon.
+var captchaMarkers = [][]byte{
+	[]byte("/errors/validateCaptcha"),
+	[]byte("opfcaptcha.amazon"),
+	[]byte("Type the characters you see in this image"),
+}
+
+// IsCaptchaPage reports whether a response body is an Amazon captcha page.
+func IsCaptchaPage(body []byte) bool {
+	for _, marker := range captchaMarkers {
+		if bytes.Contains(body, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// CaptchaSolver solves the captchas served to sessions, see HandleCaptcha.
+type CaptchaSolver interface {
+	// SolveCaptcha solves the captcha of the given page and sets the
+	// cookies received on the session, e.g. with Session.SetCookie.
+	SolveCaptcha(ctx context.Context, session *Session, page []byte) error
+}
+
+// HandleCaptcha handles a captcha served to a session, as detected by the
+// caller with IsCaptchaPage. With a Config.CaptchaSolver, the captcha is
+// solved, the refreshed cookies are stored, the consecutive failures are
+// reset and the session is returned to the pool if it was popped. Sessions
+// whose captcha is not solved, or all sessions without a solver, are deleted.
+// It reports whether the session was restored.
+func (j *AmazonSession) HandleCaptcha(ctx context.Context, session *Session, page []byte) (bool, error) {
+	country := normalizeCountry(session.Country)
+	if session.SessionID == "" {
+		return false, fmt.Errorf("session-id not found in session")
+	}
+	if j.captchaSolver == nil {
+		_, err := j.DeleteSession(ctx, country, session.SessionID)
+		return false, err
+	}
+	if err := j.captchaSolver.SolveCaptcha(ctx, session, page); err != nil {
+		if _, derr := j.DeleteSession(ctx, country, session.SessionID); derr != nil {
+			return false, derr
+		}
+		return false, fmt.Errorf("captcha not solved: %w", err)
+	}
+	if err := j.PushSession(ctx, session); err != nil {
+		return false, err
+	}
+	if err := j.TouchSession(ctx, country, session.SessionID, WithResetFailures()); err != nil {
+		return false, err
+	}
+	if err := j.ReturnSession(ctx, session); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,236 @@
+// Package chaos injects Redis failures into the clients of an AmazonSession,
+// so the services using it, and the package itself, can be tested against a
+// degraded Redis: network timeouts, scripts missing from the script cache
+// and pipelines losing their replies. It is meant for tests only.
+//
+//	injector := chaos.New(chaos.Faults{Timeout: 0.05, NoScript: 0.5})
+//	sessions, err := amazonsession.NewAmazonSession(&amazonsession.Config{
+//		Addr:       addr,
+//		RedisHooks: []redis.Hook{injector},
+//	})
+package chaos
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Faults configures the failures injected by an Injector. Rates are
+// probabilities between 0 and 1, zero disables the failure.
+type Faults struct {
+	// Timeout is the rate of commands and pipelines failing with a network
+	// timeout before they are sent, as if the client retries were
+	// exhausted.
+	Timeout float64
+
+	// NoScript is the rate of EVALSHA commands failing with a NOSCRIPT
+	// error, as after a SCRIPT FLUSH or a failover. go-redis retries them
+	// with EVAL.
+	NoScript float64
+
+	// PartialPipeline is the rate of pipelines losing the replies of their
+	// commands from a random position on: the commands are applied by
+	// Redis, but fail with a network error for the client.
+	PartialPipeline float64
+
+	// Latency is added to every command and pipeline.
+	Latency time.Duration
+
+	// Commands limits the failures to the named commands, e.g. "evalsha"
+	// or "hgetall". All commands fail when empty. Pipelines fail when they
+	// contain one of the commands.
+	Commands []string
+
+	// Seed seeds the random source deciding the failures, for reproducible
+	// runs. The current time is used when zero.
+	Seed int64
+}
+
+// Stats counts the failures injected by an Injector.
+type Stats struct {
+	Timeouts         int64 // Timeouts is the number of commands and pipelines failed with a timeout
+	NoScripts        int64 // NoScripts is the number of EVALSHA commands failed with NOSCRIPT
+	PartialPipelines int64 // PartialPipelines is the number of pipelines that lost replies
+}
+
+// Injector is a redis.Hook injecting the failures configured by Faults.
+// It is safe for concurrent use.
+type Injector struct {
+	mu     sync.Mutex
+	faults Faults
+	rand   *rand.Rand
+	stats  Stats
+}
+
+// New returns an Injector for the given faults.
+func New(faults Faults) *Injector {
+	i := &Injector{}
+	i.SetFaults(faults)
+	return i
+}
+
+// SetFaults replaces the faults injected from now on, e.g. to heal Redis in
+// the middle of a test. The random source is reseeded when Seed is set.
+func (i *Injector) SetFaults(faults Faults) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	faults.Commands = append([]string(nil), faults.Commands...)
+	for k, name := range faults.Commands {
+		faults.Commands[k] = strings.ToLower(name)
+	}
+	if i.rand == nil || faults.Seed != 0 {
+		seed := faults.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		i.rand = rand.New(rand.NewSource(seed))
+	}
+	i.faults = faults
+}
+
+// Stats returns the number of failures injected so far.
+func (i *Injector) Stats() Stats {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.stats
+}
+
+// timeoutError is the error of the injected timeouts. Like the errors of
+// the net package, it reports Timeout() true.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "chaos: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+// redisError is an error reply, which go-redis tells apart from network
+// errors.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+func (redisError) RedisError()     {}
+
+// errNoScript is the reply of Redis to EVALSHA for an unknown script.
+const errNoScript = redisError("NOSCRIPT No matching script. Please use EVAL.")
+
+// roll reports whether a failure of the given rate happens. The caller must
+// hold i.mu.
+func (i *Injector) roll(rate float64) bool {
+	return rate > 0 && i.rand.Float64() < rate
+}
+
+// targeted reports whether the faults apply to a command. The caller must
+// hold i.mu.
+func (i *Injector) targeted(cmd redis.Cmder) bool {
+	if len(i.faults.Commands) == 0 {
+		return true
+	}
+	name := strings.ToLower(cmd.Name())
+	for _, target := range i.faults.Commands {
+		if name == target {
+			return true
+		}
+	}
+	return false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DialHook implements redis.Hook.
+func (i *Injector) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+// ProcessHook implements redis.Hook.
+func (i *Injector) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		i.mu.Lock()
+		latency := i.faults.Latency
+		var err error
+		if i.targeted(cmd) {
+			switch {
+			case i.roll(i.faults.Timeout):
+				i.stats.Timeouts++
+				err = timeoutError{}
+			case strings.EqualFold(cmd.Name(), "evalsha") && i.roll(i.faults.NoScript):
+				i.stats.NoScripts++
+				err = errNoScript
+			}
+		}
+		i.mu.Unlock()
+
+		if sleepErr := sleep(ctx, latency); sleepErr != nil {
+			err = sleepErr
+		}
+		if err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+// ProcessPipelineHook implements redis.Hook.
+func (i *Injector) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		i.mu.Lock()
+		latency := i.faults.Latency
+		targeted := false
+		for _, cmd := range cmds {
+			if i.targeted(cmd) {
+				targeted = true
+				break
+			}
+		}
+		var err error
+		lostFrom := -1
+		if targeted && len(cmds) > 0 {
+			switch {
+			case i.roll(i.faults.Timeout):
+				i.stats.Timeouts++
+				err = timeoutError{}
+			case i.roll(i.faults.PartialPipeline):
+				i.stats.PartialPipelines++
+				lostFrom = i.rand.Intn(len(cmds))
+			}
+		}
+		i.mu.Unlock()
+
+		if sleepErr := sleep(ctx, latency); sleepErr != nil {
+			err = sleepErr
+		}
+		if err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		if err := next(ctx, cmds); err != nil || lostFrom < 0 {
+			return err
+		}
+		for _, cmd := range cmds[lostFrom:] {
+			cmd.SetErr(timeoutError{})
+		}
+		return timeoutError{}
+	}
+}
@@ -0,0 +1,93 @@
+package chaos
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestClient(t *testing.T, injector *Injector) *redis.Client {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	client.AddHook(injector)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestNoScript(t *testing.T) {
+	ctx := context.Background()
+	injector := New(Faults{NoScript: 1, Seed: 1})
+	client := newTestClient(t, injector)
+	script := redis.NewScript(`return redis.call("INCR", KEYS[1])`)
+	for want := int64(1); want <= 3; want++ {
+		// go-redis falls back to EVAL on NOSCRIPT.
+		n, err := script.Run(ctx, client, []string{"counter"}).Int64()
+		if err != nil || n != want {
+			t.Fatalf("expected %d, got %d (%v)", want, n, err)
+		}
+	}
+	if stats := injector.Stats(); stats.NoScripts != 3 {
+		t.Fatalf("expected 3 NOSCRIPT errors, got %+v", stats)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	ctx := context.Background()
+	injector := New(Faults{Timeout: 1, Commands: []string{"GET"}, Seed: 1})
+	client := newTestClient(t, injector)
+	if err := client.Set(ctx, "key", "value", 0).Err(); err != nil {
+		t.Fatalf("SET error: %v", err)
+	}
+	err := client.Get(ctx, "key").Err()
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+
+	// Healed, commands are served again.
+	injector.SetFaults(Faults{})
+	if value, err := client.Get(ctx, "key").Result(); err != nil || value != "value" {
+		t.Fatalf("expected the value, got %q (%v)", value, err)
+	}
+	if stats := injector.Stats(); stats.Timeouts != 1 {
+		t.Fatalf("expected 1 timeout, got %+v", stats)
+	}
+}
+
+func TestPartialPipeline(t *testing.T) {
+	ctx := context.Background()
+	injector := New(Faults{PartialPipeline: 1, Seed: 1})
+	client := newTestClient(t, injector)
+	cmds := make([]*redis.IntCmd, 10)
+	_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := range cmds {
+			cmds[i] = pipe.Incr(ctx, "counter")
+		}
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected the pipeline to fail")
+	}
+	lost := 0
+	for i, cmd := range cmds {
+		if cmd.Err() != nil {
+			lost++
+		} else if lost > 0 {
+			t.Fatalf("command %d succeeded after a lost reply", i)
+		}
+	}
+	if lost == 0 {
+		t.Fatal("expected replies to be lost")
+	}
+
+	// The commands were applied by Redis all the same.
+	injector.SetFaults(Faults{})
+	if n, err := client.Get(ctx, "counter").Int(); err != nil || n != len(cmds) {
+		t.Fatalf("expected %d increments, got %d (%v)", len(cmds), n, err)
+	}
+}
@@ -0,0 +1,87 @@
+package amazonsession
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// defaultCheckHistorySize is the number of check results kept per session
+// when Config.CheckHistorySize is not set.
+const defaultCheckHistorySize = 10
+
+// CheckResult is the outcome of one validation of a session, see
+// RecordCheck.
+type CheckResult struct {
+	Time    time.Time     // Time is when the check ran, the current time when zero
+	OK      bool          // OK reports whether the session passed the check
+	Latency time.Duration // Latency is the duration of the check request
+	Status  int           // Status is the HTTP status code of the check response, zero when none was received
+}
+
+// checkRecord is the stored form of a CheckResult.
+type checkRecord struct {
+	Time    int64 `json:"t"`
+	OK      bool  `json:"ok"`
+	Latency int64 `json:"ms"`
+	Status  int   `json:"status,omitempty"`
+}
+
+// RecordCheck appends the result of a validation to the check history of a
+// session, which keeps the last Config.CheckHistorySize results, and records
+// its latency like RecordLatency. It does not touch the session: use
+// TouchSession or RecordFailure to also update the last-checked time and the
+// failure counters.
+func (j *AmazonSession) RecordCheck(ctx context.Context, country, sessionID string, result CheckResult) error {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	if result.Time.IsZero() {
+		result.Time = j.clock.Now()
+	}
+	record, err := json.Marshal(newCheckRecord(result))
+	if err != nil {
+		return err
+	}
+	err = recordCheckCmd.Run(ctx, j.client, []string{cookiesKey(country)}, sessionID, string(record), j.checkHistorySize).Err()
+	if err != nil {
+		return sessionNotFound(err, sessionID)
+	}
+	return nil
+}
+
+// decodeCheckHistory decodes a stored check history, oldest first.
+func decodeCheckHistory(data string) ([]CheckResult, error) {
+	var records []checkRecord
+	if err := json.Unmarshal([]byte(data), &records); err != nil {
+		return nil, fmt.Errorf("invalid check history: %v", err)
+	}
+	return checkResults(records), nil
+}
+
+func newCheckRecord(result CheckResult) checkRecord {
+	return checkRecord{
+		Time:    result.Time.Unix(),
+		OK:      result.OK,
+		Latency: result.Latency.Milliseconds(),
+		Status:  result.Status,
+	}
+}
+
+// checkResults converts stored check records, nil when there are none.
+func checkResults(records []checkRecord) []CheckResult {
+	if len(records) == 0 {
+		return nil
+	}
+	history := make([]CheckResult, len(records))
+	for i, record := range records {
+		history[i] = CheckResult{
+			Time:    time.Unix(record.Time, 0),
+			OK:      record.OK,
+			Latency: time.Duration(record.Latency) * time.Millisecond,
+			Status:  record.Status,
+		}
+	}
+	return history
+}
@@ -0,0 +1,171 @@
+package amazonsession
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cleanupChunkSize is the number of sessions checked by one cleanup script
+// call. The context is checked between chunks.
+const cleanupChunkSize = 500
+
+// CleanupResult reports the progress of a cleanup run.
+type CleanupResult struct {
+	Scanned   int64            // Scanned is the number of sessions checked
+	Removed   map[string]int64 // Removed is the number of sessions removed per country
+	Remaining map[string]int64 // Remaining is the pool size per fully processed country
+	Paused    []string         // Paused are the countries skipped for a maintenance window, see MaintenancePause
+}
+
+// CleanupSessions removes the sessions not checked within timeDiffThreshold
+// seconds, used at least usageCountThreshold times (within
+// Config.UsageWindow, if set), older than
+// Config.MaxAge or past their session-id-time expiry, in all countries.
+// The thresholds of a country can be overridden with
+// Config.CountryOverrides. Countries in a maintenance window are skipped or
+// cleaned up with halved thresholds, see ScheduleMaintenance.
+func (j *AmazonSession) CleanupSessions(ctx context.Context, timeDiffThreshold int64, usageCountThreshold int64) error {
+	_, err := j.CleanupSessionsWithResult(ctx, timeDiffThreshold, usageCountThreshold)
+	return err
+}
+
+// CleanupSessionsWithResult is like CleanupSessions and reports its
+// progress. Sessions are checked in chunks and the context is honored
+// between chunks, so a long sweep can be aborted safely: on cancellation
+// the partial result is returned along with the context error. Each run is
+// recorded in the run history, see LastRuns.
+func (j *AmazonSession) CleanupSessionsWithResult(ctx context.Context, timeDiffThreshold int64, usageCountThreshold int64) (*CleanupResult, error) {
+	start := j.clock.Now()
+	result, err := j.cleanupSessions(ctx, timeDiffThreshold, usageCountThreshold)
+	j.recordCleanupRun(ctx, start, result, err)
+	return result, err
+}
+
+func (j *AmazonSession) cleanupSessions(ctx context.Context, timeDiffThreshold int64, usageCountThreshold int64) (*CleanupResult, error) {
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+	result := &CleanupResult{Removed: make(map[string]int64), Remaining: make(map[string]int64)}
+
+	countries, err := j.storedCountries(ctx)
+	if err != nil {
+		return result, err
+	}
+	for _, country := range countries {
+		maxIdle, maxUsage := j.cleanupThresholds(country, timeDiffThreshold, usageCountThreshold)
+		mode, inMaintenance, err := j.activeMaintenance(ctx, country)
+		if err != nil {
+			return result, err
+		}
+		if inMaintenance && mode == MaintenancePause {
+			result.Paused = append(result.Paused, country)
+			continue
+		}
+		if inMaintenance && mode == MaintenanceIntensify {
+			maxIdle, maxUsage = maxIdle/2, (maxUsage+1)/2
+		}
+		args := []interface{}{
+			j.clock.Now().Unix(),
+			maxIdle,
+			maxUsage,
+			int64(j.maxAge / time.Second),
+			int64(j.usageWindow / time.Second),
+		}
+		args = append(args, sessionFieldArgs()...)
+
+		// Sessions whose pin expired are cleaned up like any other.
+		if err := j.restoreExpiredPins(ctx, country); err != nil {
+			return result, err
+		}
+		// Stale and overused sessions are found with range queries on the
+		// last-checked and usage indexes, the scan below applies the other
+		// thresholds.
+		cutoff := strconv.FormatInt(j.clock.Now().Unix()-maxIdle, 10)
+		if err := j.cleanupIndex(ctx, country, lastCheckedIndexKey(country), "-inf", cutoff, result); err != nil {
+			return result, err
+		}
+		if j.usageWindow == 0 {
+			if err := j.cleanupIndex(ctx, country, usageIndexKey(country), strconv.FormatInt(maxUsage, 10), "+inf", result); err != nil {
+				return result, err
+			}
+		}
+		listKeys, err := poolListKeys(ctx, j.client, country)
+		if err != nil {
+			return result, err
+		}
+		for _, idsKey := range append(listKeys, canaryIdsKey(country)) {
+			if err := j.cleanupList(ctx, country, idsKey, args, result); err != nil {
+				return result, err
+			}
+		}
+		size, err := poolSize(ctx, j.client, country)
+		if err != nil {
+			return result, err
+		}
+		result.Remaining[country] = size
+	}
+
+	if j.webhook != nil {
+		j.webhook.cleanupSummary(result, j.poolLowThreshold)
+	}
+	if j.hooks.OnCleanup != nil {
+		j.hooks.OnCleanup(ctx)
+	}
+	return result, nil
+}
+
+// cleanupList runs the cleanup script over an id list chunk by chunk.
+func (j *AmazonSession) cleanupList(ctx context.Context, country, idsKey string, args []interface{}, result *CleanupResult) error {
+	var start int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		argv := append([]interface{}{start, cleanupChunkSize}, args...)
+		res, err := cleanupChunkCmd.Run(ctx, j.client, []string{country, idsKey}, argv...).Result()
+		if err != nil {
+			return fmt.Errorf("redis eval error: %v", err)
+		}
+		data, err := replySlice(res)
+		if err != nil || len(data) != 2 {
+			return fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+		}
+		scanned, err := replyInt64(data[0])
+		if err != nil {
+			return err
+		}
+		removed, err := replyInt64(data[1])
+		if err != nil {
+			return err
+		}
+		result.Scanned += scanned
+		result.Removed[country] += removed
+		if scanned < cleanupChunkSize {
+			return nil
+		}
+		// Removed sessions shift the following ones down the list.
+		start += scanned - removed
+	}
+}
+
+// storedCountries returns the countries with stored sessions, including
+// custom ones, by scanning for their cookies keys. Keys whose prefix is not
+// a country code belong to other applications and are skipped.
+func (j *AmazonSession) storedCountries(ctx context.Context) ([]string, error) {
+	var countries []string
+	seen := make(map[string]bool)
+	iter := j.client.Scan(ctx, 0, "*:cookies", 100).Iterator()
+	for iter.Next(ctx) {
+		// SCAN may return a key more than once.
+		if country := strings.TrimSuffix(iter.Val(), ":cookies"); isCountryCode(country) && !seen[country] {
+			seen[country] = true
+			countries = append(countries, country)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan keys: %v", err)
+	}
+	return countries, nil
+}
@@ -0,0 +1,16 @@
+package amazonsession
+
+import "time"
+
+// Clock provides the current time. It can be replaced in Config to control
+// time-dependent logic such as timestamps and cleanup thresholds.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock backed by time.Now.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,60 @@
+package amazonsession
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// CloneSessionToCountry copies the identity cookies (session-id,
+// session-id-time, session-token and ubid) of a stored session to another
+// marketplace. Marketplace-scoped cookie names are rewritten for the target
+// country, while currency and language cookies are dropped because they
+// belong to the source marketplace. The clone is pushed with PushSession, so
+// it fails with a *SessionConflictError in CrossCountryReject mode and
+// moves the session in CrossCountryMerge mode.
+func (j *AmazonSession) CloneSessionToCountry(ctx context.Context, fromCountry, sessionID, toCountry string) error {
+	fromCountry = normalizeCountry(fromCountry)
+	toCountry = normalizeCountry(toCountry)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	if _, err := j.getCountryURL(fromCountry); err != nil {
+		return err
+	}
+	toSuffix, found := defaultCountryCookieSuffixMap[toCountry]
+	if !found {
+		return fmt.Errorf("domain not found for country: %s", toCountry)
+	}
+
+	cookieData, err := j.client.HGet(ctx, cookiesKey(fromCountry), sessionID).Result()
+	if errors.Is(err, redis.Nil) {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+	if err != nil {
+		return err
+	}
+
+	cookiesMap := make(map[string]string)
+	if err := json.Unmarshal([]byte(cookieData), &cookiesMap); err != nil {
+		return err
+	}
+
+	var cloned []*http.Cookie
+	for name, value := range cookiesMap {
+		switch {
+		case name == "session-id" || name == "session-id-time" || name == "session-token":
+			cloned = append(cloned, &http.Cookie{Name: name, Value: value})
+		case strings.HasPrefix(name, "ubid-"):
+			cloned = append(cloned, &http.Cookie{Name: "ubid-" + toSuffix, Value: value})
+		}
+	}
+
+	// Push like any other session, so Config.CrossCountryPush and the push
+	// hooks apply to the clone.
+	return j.PushSession(ctx, NewSession(toCountry, sessionID, cloned))
+}
@@ -0,0 +1,37 @@
+package amazonsession
+
+import (
+	"strings"
+)
+
+// CurlCommand renders the session as a curl command requesting rawURL with
+// the session cookies, the given User-Agent (omitted when empty) and the
+// proxy bound to the session, to check by hand whether a session still
+// works. A rawURL starting with "/" is resolved against the marketplace of
+// the session.
+func (s *Session) CurlCommand(rawURL, userAgent string) (string, error) {
+	if strings.HasPrefix(rawURL, "/") {
+		countryURL, err := s.countryURL()
+		if err != nil {
+			return "", err
+		}
+		rawURL = strings.TrimSuffix(countryURL.String(), "/") + rawURL
+	}
+	args := []string{"curl"}
+	if s.Proxy != "" {
+		args = append(args, "--proxy", shellQuote(s.Proxy))
+	}
+	if userAgent != "" {
+		args = append(args, "-A", shellQuote(userAgent))
+	}
+	if header := s.CookieHeader(); header != "" {
+		args = append(args, "-b", shellQuote(header))
+	}
+	args = append(args, shellQuote(rawURL))
+	return strings.Join(args, " "), nil
+}
+
+// shellQuote quotes a value for POSIX shells.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
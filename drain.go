@@ -0,0 +1,129 @@
+package amazonsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrDraining is returned by the checkout functions for a country whose pool
+// is draining, see BeginDrain.
+var ErrDraining = errors.New("session pool is draining for the specified country")
+
+func drainKey(country string) string {
+	return fmt.Sprintf("%s:drain", country)
+}
+
+// DrainStatus reports the progress of draining the pool of a country.
+type DrainStatus struct {
+	Country    string    `json:"country"`
+	Draining   bool      `json:"draining"`    // Draining is set between BeginDrain and EndDrain
+	Since      time.Time `json:"since"`       // Since is the time BeginDrain was called
+	DrainedAt  time.Time `json:"drained_at"`  // DrainedAt is the time the pool became idle, zero while in use
+	CheckedOut int64     `json:"checked_out"` // CheckedOut is the number of sessions taken with PopSession and not returned
+	Pinned     int64     `json:"pinned"`      // Pinned is the number of pinned sessions
+}
+
+// BeginDrain marks the pool of a country as draining, e.g. to replace it
+// during an incident. Callers already holding a session finish their work:
+// sessions taken with PopSession or Pin can still be loaded with GetSession,
+// returned and pushed. New checkouts (GetRandomSession, SelectSession,
+// GetSessionFor, GetCanarySession, PopSession, Pin) fail with ErrDraining,
+// while PopSessionWithFallback and GetRandomSessionFromGroup skip the
+// country. Hooks.OnDrained is called once no session of the country is
+// checked out or pinned anymore, by the process that releases the last one.
+func (j *AmazonSession) BeginDrain(ctx context.Context, country string) error {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	if err := j.client.HSetNX(ctx, drainKey(country), "since", j.clock.Now().Unix()).Err(); err != nil {
+		return err
+	}
+	return j.checkDrained(ctx, country)
+}
+
+// EndDrain ends draining the pool of a country, so checkouts are served
+// again.
+func (j *AmazonSession) EndDrain(ctx context.Context, country string) error {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.client.Del(ctx, drainKey(country)).Err()
+}
+
+// GetDrainStatus returns the drain status of the pool of a country.
+func (j *AmazonSession) GetDrainStatus(ctx context.Context, country string) (*DrainStatus, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	if err := j.checkDrained(ctx, country); err != nil {
+		return nil, err
+	}
+	pipe := j.client.Pipeline()
+	drain := pipe.HMGet(ctx, drainKey(country), "since", "drained-at")
+	checkedOut := pipe.HLen(ctx, borrowersKey(country))
+	pinned := pipe.ZCard(ctx, pinsKey(country))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	status := &DrainStatus{Country: country, CheckedOut: checkedOut.Val(), Pinned: pinned.Val()}
+	values := drain.Val()
+	if values[0] != nil {
+		status.Draining = true
+		since, err := replyInt64(values[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid drain state: %v", err)
+		}
+		status.Since = time.Unix(since, 0)
+		if values[1] != nil {
+			drainedAt, err := replyInt64(values[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid drain state: %v", err)
+			}
+			status.DrainedAt = time.Unix(drainedAt, 0)
+		}
+	}
+	return status, nil
+}
+
+// checkoutGate runs before a session of a country is checked out. It puts
+// the sessions whose pin expired back into the pool and returns ErrFrozen
+// when the pool is frozen, ErrDraining when it is draining.
+func (j *AmazonSession) checkoutGate(ctx context.Context, country string) error {
+	res, err := checkoutGateCmd.Run(ctx, j.client, []string{country}, j.clock.Now().Unix()).Result()
+	if err != nil {
+		return fmt.Errorf("redis eval error: %v", err)
+	}
+	draining, err := replyInt64(res)
+	if err != nil {
+		return fmt.Errorf("cast error: Lua script returned unexpected value: %v", err)
+	}
+	if draining == 2 {
+		return ErrFrozen
+	}
+	if draining == 1 {
+		// Expired pins may have been the last sessions in use.
+		if err := j.checkDrained(ctx, country); err != nil {
+			return err
+		}
+		return ErrDraining
+	}
+	return nil
+}
+
+// checkDrained calls Hooks.OnDrained when a draining pool became idle.
+func (j *AmazonSession) checkDrained(ctx context.Context, country string) error {
+	res, err := drainIdleCmd.Run(ctx, j.client, []string{country}, j.clock.Now().Unix()).Result()
+	if err != nil {
+		return fmt.Errorf("redis eval error: %v", err)
+	}
+	drained, err := replyInt64(res)
+	if err != nil {
+		return fmt.Errorf("cast error: Lua script returned unexpected value: %v", err)
+	}
+	if drained == 1 && j.hooks.OnDrained != nil {
+		j.hooks.OnDrained(ctx, country)
+	}
+	return nil
+}
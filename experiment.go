@@ -0,0 +1,11 @@
+package amazonsession
+
+import "hash/fnv"
+
+// assignBucket deterministically maps a session-id to one of the experiment
+// buckets, so a session stays in the same bucket when it is pushed again.
+func assignBucket(buckets []string, sessionID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(sessionID))
+	return buckets[h.Sum32()%uint32(len(buckets))]
+}
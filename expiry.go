@@ -0,0 +1,58 @@
+package amazonsession
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseSessionIDTime parses the value of the session-id-time cookie, the
+// Unix time at which Amazon expires the session suffixed with "l" (e.g.
+// "2082787201l").
+func parseSessionIDTime(value string) (int64, bool) {
+	n, err := strconv.ParseInt(strings.TrimSuffix(value, "l"), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// cookieExpiry returns the expiration of the cookies rebuilt from a stored
+// cookie map: the session-id-time expiry when present, one year from now
+// otherwise.
+func cookieExpiry(cookiesMap map[string]string, now time.Time) time.Time {
+	if t, ok := parseSessionIDTime(cookiesMap["session-id-time"]); ok {
+		return time.Unix(t, 0)
+	}
+	return now.AddDate(1, 0, 0)
+}
+
+// sessionExpiry returns the earliest of the creation time plus the
+// configured max age and the session-id-time cookie, or zero when neither is
+// known.
+func (j *AmazonSession) sessionExpiry(createdAt int64, cookiesMap map[string]string) int64 {
+	var expiresAt int64
+	if j.maxAge > 0 && createdAt > 0 {
+		expiresAt = createdAt + int64(j.maxAge/time.Second)
+	}
+	if value, found := cookiesMap["session-id-time"]; found {
+		if t, ok := parseSessionIDTime(value); ok && (expiresAt == 0 || t < expiresAt) {
+			expiresAt = t
+		}
+	}
+	return expiresAt
+}
+
+// RemainingTTL returns the time left until the session expires at now, or
+// zero once it has expired. ok is false when the expiry of the session is
+// unknown.
+func (s *Session) RemainingTTL(now time.Time) (ttl time.Duration, ok bool) {
+	if s.ExpiresAt == 0 {
+		return 0, false
+	}
+	ttl = time.Unix(s.ExpiresAt, 0).Sub(now)
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, true
+}
@@ -0,0 +1,57 @@
+package amazonsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrFrozen is returned by the checkout functions for a country whose pool
+// is frozen, see FreezeCountry.
+var ErrFrozen = errors.New("session pool is frozen for the specified country")
+
+func frozenKey(country string) string {
+	return fmt.Sprintf("%s:frozen", country)
+}
+
+// FreezeCountry freezes the pool of a country, e.g. while it is inspected or
+// repaired: new checkouts (GetRandomSession, SelectSession, GetSessionFor,
+// GetCanarySession, PopSession, Pin) fail with ErrFrozen, while
+// PopSessionWithFallback and GetRandomSessionFromGroup skip the country.
+// Sessions can still be pushed, returned, loaded by id with GetSession and
+// read by the admin functions. Unlike BeginDrain, freezing does not track
+// the sessions in use. The pool stays frozen until UnfreezeCountry.
+func (j *AmazonSession) FreezeCountry(ctx context.Context, country string) error {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.client.SetNX(ctx, frozenKey(country), j.clock.Now().Unix(), 0).Err()
+}
+
+// UnfreezeCountry unfreezes the pool of a country, so checkouts are served
+// again.
+func (j *AmazonSession) UnfreezeCountry(ctx context.Context, country string) error {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.client.Del(ctx, frozenKey(country)).Err()
+}
+
+// FrozenSince returns the time the pool of a country was frozen, and false
+// when it is not frozen.
+func (j *AmazonSession) FrozenSince(ctx context.Context, country string) (time.Time, bool, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	since, err := j.client.Get(ctx, frozenKey(country)).Int64()
+	if err == redis.Nil {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error getting freeze state: %v", err)
+	}
+	return time.Unix(since, 0), true, nil
+}
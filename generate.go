@@ -0,0 +1,80 @@
+package amazonsession
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GenerateSessionID returns a random ID in Amazon's "xxx-xxxxxxx-xxxxxxx"
+// session-id format. The same format is used by the ubid cookies.
+func GenerateSessionID() string {
+	return fmt.Sprintf("%s-%s-%s", randomDigits(3), randomDigits(7), randomDigits(7))
+}
+
+func randomDigits(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteByte(byte('0' + rand.Intn(10)))
+	}
+	return b.String()
+}
+
+// NewCookieSet builds a minimal cookie set (session-id, session-id-time,
+// i18n-prefs and ubid) for a marketplace, which can be pushed as a session
+// to seed a pool.
+func NewCookieSet(country string) ([]*http.Cookie, error) {
+	marketplace, found := LookupMarketplace(country)
+	if !found {
+		return nil, fmt.Errorf("domain not found for country: %s", country)
+	}
+	countryURL, err := url.Parse(marketplace.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().AddDate(1, 0, 0)
+	domain := "." + marketplaceHost(countryURL.Hostname())
+	values := []struct{ name, value string }{
+		{"session-id", GenerateSessionID()},
+		{"session-id-time", fmt.Sprintf("%dl", expires.Unix())},
+		{"i18n-prefs", marketplace.Currency},
+		{"ubid-" + defaultCountryCookieSuffixMap[marketplace.Country], GenerateSessionID()},
+	}
+
+	cookies := make([]*http.Cookie, len(values))
+	for i, v := range values {
+		cookies[i] = &http.Cookie{
+			Name:    v.name,
+			Value:   v.value,
+			Path:    "/",
+			Domain:  domain,
+			Expires: expires,
+		}
+	}
+	return cookies, nil
+}
+
+// fillMissingCookies adds default session-id-time, i18n-prefs and ubid
+// cookies for the marketplace to a stored cookie map that lacks them.
+func fillMissingCookies(country string, cookiesMap map[string]string, now time.Time) {
+	if _, found := cookiesMap["session-id-time"]; !found {
+		cookiesMap["session-id-time"] = fmt.Sprintf("%dl", now.AddDate(1, 0, 0).Unix())
+	}
+	if _, found := cookiesMap["i18n-prefs"]; !found {
+		if currency, found := defaultCountryCurrencyMap[country]; found {
+			cookiesMap["i18n-prefs"] = currency
+		}
+	}
+	for name := range cookiesMap {
+		if strings.HasPrefix(name, "ubid-") {
+			return
+		}
+	}
+	if suffix, found := defaultCountryCookieSuffixMap[country]; found {
+		cookiesMap["ubid-"+suffix] = GenerateSessionID()
+	}
+}
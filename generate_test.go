@@ -0,0 +1,81 @@
+package amazonsession
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateSessionID(t *testing.T) {
+	pattern := regexp.MustCompile(`^\d{3}-\d{7}-\d{7}$`)
+	for i := 0; i < 10; i++ {
+		if id := GenerateSessionID(); !pattern.MatchString(id) {
+			t.Fatalf("Unexpected session ID format: %v", id)
+		}
+	}
+}
+
+func TestNewCookieSet(t *testing.T) {
+	cookies, err := NewCookieSet("de")
+	if err != nil {
+		t.Fatalf("NewCookieSet failed: %v", err)
+	}
+	names := make(map[string]string)
+	for _, c := range cookies {
+		names[c.Name] = c.Value
+		if c.Domain != ".amazon.de" {
+			t.Fatalf("Unexpected cookie domain: %v", c.Domain)
+		}
+	}
+	for _, name := range []string{"session-id", "session-id-time", "i18n-prefs", "ubid-acbde"} {
+		if names[name] == "" {
+			t.Fatalf("Missing cookie %v in %v", name, names)
+		}
+	}
+	if names["i18n-prefs"] != "EUR" {
+		t.Fatalf("Unexpected currency: %v", names["i18n-prefs"])
+	}
+
+	if _, err := NewCookieSet("XX"); err == nil {
+		t.Fatalf("Expected error for unknown country")
+	}
+}
+
+func TestFillMissingCookies(t *testing.T) {
+	cookiesMap := map[string]string{"session-id": "123-1234567-1234567", "i18n-prefs": "USD"}
+	fillMissingCookies("CA", cookiesMap, time.Now())
+	if cookiesMap["i18n-prefs"] != "USD" {
+		t.Fatalf("Existing i18n-prefs should be kept, got %v", cookiesMap["i18n-prefs"])
+	}
+	if cookiesMap["session-id-time"] == "" || cookiesMap["ubid-acbca"] == "" {
+		t.Fatalf("Missing defaults in %v", cookiesMap)
+	}
+
+	cookiesMap = map[string]string{"session-id": "123-1234567-1234567", "ubid-acbca": "ubid"}
+	fillMissingCookies("CA", cookiesMap, time.Now())
+	if cookiesMap["i18n-prefs"] != "CAD" || cookiesMap["ubid-acbca"] != "ubid" {
+		t.Fatalf("Unexpected defaults in %v", cookiesMap)
+	}
+}
+
+func TestNewCSMHit(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	value := NewCSMHit(now)
+	if !regexp.MustCompile(`^tb:s-[A-Z0-9]{20}\|1700000000000&t:1700000000000&adb:adblk_no$`).MatchString(value) {
+		t.Fatalf("Unexpected csm-hit value: %s", value)
+	}
+
+	j := &AmazonSession{clock: &testClock{now: now}}
+	session := createTestSession("US", "session1", "token1")
+	if err := j.RefreshTelemetryCookies(session); err != nil {
+		t.Fatalf("RefreshTelemetryCookies failed: %v", err)
+	}
+	first := session.CookieHeader()
+	if err := j.RefreshTelemetryCookies(session); err != nil {
+		t.Fatalf("RefreshTelemetryCookies failed: %v", err)
+	}
+	if session.CookieHeader() == first || strings.Count(session.CookieHeader(), "csm-hit=") != 1 {
+		t.Fatalf("Expected csm-hit to be replaced, got %s", session.CookieHeader())
+	}
+}
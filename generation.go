@@ -0,0 +1,66 @@
+package amazonsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// generationIndexKey returns the key of the set indexing the sessions of a
+// country imported in a generation.
+func generationIndexKey(country, generation string) string {
+	return fmt.Sprintf("%s:generation:%s", country, generation)
+}
+
+// generationRegistryKey returns the key of the set of all generations
+// indexed for a country.
+func generationRegistryKey(country string) string {
+	return fmt.Sprintf("%s:generations", country)
+}
+
+// updateGenerationIndex queues the index update for the generation of a
+// session on the pipeline. An empty generation keeps the stored one.
+func (j *AmazonSession) updateGenerationIndex(ctx context.Context, pipe redis.Pipeliner, country, sessionID, generation string) error {
+	if generation == "" {
+		return nil
+	}
+	old, err := j.client.HGet(ctx, cookiesKey(country), sessionFieldKey(sessionID, "generation")).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("error getting session generation: %v", err)
+	}
+	if old != "" && old != generation {
+		pipe.SRem(ctx, generationIndexKey(country, old), sessionID)
+	}
+	pipe.SAdd(ctx, generationIndexKey(country, generation), sessionID)
+	pipe.SAdd(ctx, generationRegistryKey(country), generation)
+	return nil
+}
+
+// ListGenerations returns the generations of the sessions stored for a
+// country.
+func (j *AmazonSession) ListGenerations(ctx context.Context, country string) ([]string, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.readClient(ctx).SMembers(ctx, generationRegistryKey(country)).Result()
+}
+
+// PurgeGeneration deletes all sessions of a country imported in a
+// generation, so a bad harvesting run can be rolled back at once. It returns
+// the number of sessions deleted.
+func (j *AmazonSession) PurgeGeneration(ctx context.Context, country, generation string) (int64, error) {
+	country = normalizeCountry(country)
+	if generation == "" {
+		return 0, errors.New("generation must not be empty")
+	}
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+	args := append([]interface{}{generation, j.deleteCommand()}, sessionFieldArgs()...)
+	res, err := purgeGenerationCmd.Run(ctx, j.client, []string{country}, args...).Result()
+	if err != nil {
+		return 0, fmt.Errorf("redis eval error: %v", err)
+	}
+	return replyInt64(res)
+}
@@ -0,0 +1,126 @@
+package amazonsession
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+var (
+	glowModalTokenRegexp = regexp.MustCompile(`"anti-csrftoken-a2z"\s*:\s*"([^"]+)"`)
+	glowCSRFTokenRegexp  = regexp.MustCompile(`CSRF_TOKEN\s*:\s*"([^"]+)"`)
+)
+
+// SetDeliveryLocation changes the delivery location (GLOW widget) of the
+// session to the given zip/postal code using the session cookies, and stores
+// the resulting cookies and postal code in Redis.
+func (j *AmazonSession) SetDeliveryLocation(ctx context.Context, session *Session, postalCode string) error {
+	session.mu.Lock()
+	session.Country = normalizeCountry(session.Country)
+	country := session.Country
+	session.mu.Unlock()
+	countryURL, err := j.getCountryURL(country)
+	if err != nil {
+		return err
+	}
+
+	jar, err := session.CookieJar()
+	if err != nil {
+		return err
+	}
+	client := j.probeDoer(jar)
+
+	// The home page carries the token required to open the location modal.
+	body, err := j.glowRequest(ctx, country, client, http.MethodGet, countryURL.String()+"/", nil, nil)
+	if err != nil {
+		return err
+	}
+	match := glowModalTokenRegexp.FindSubmatch(body)
+	if match == nil {
+		return fmt.Errorf("glow modal token not found")
+	}
+
+	// The location modal carries the token required to change the address.
+	modalURL := countryURL.String() + "/portal-migration/hz/glow/get-rendered-address-selections?" + url.Values{
+		"deviceType":   {"desktop"},
+		"pageType":     {"Gateway"},
+		"storeContext": {"NoStoreName"},
+		"actionSource": {"desktop-modal"},
+	}.Encode()
+	body, err = j.glowRequest(ctx, country, client, http.MethodGet, modalURL, map[string]string{
+		"anti-csrftoken-a2z": string(match[1]),
+	}, nil)
+	if err != nil {
+		return err
+	}
+	match = glowCSRFTokenRegexp.FindSubmatch(body)
+	if match == nil {
+		return fmt.Errorf("glow csrf token not found")
+	}
+
+	payload, err := json.Marshal(map[string]string{
+		"locationType": "LOCATION_INPUT",
+		"zipCode":      postalCode,
+		"storeContext": "generic",
+		"deviceType":   "web",
+		"pageType":     "Gateway",
+		"actionSource": "glow",
+	})
+	if err != nil {
+		return err
+	}
+	body, err = j.glowRequest(ctx, country, client, http.MethodPost, countryURL.String()+"/portal-migration/hz/glow/address-change?actionSource=glow", map[string]string{
+		"anti-csrftoken-a2z": string(match[1]),
+		"Content-Type":       "application/json",
+	}, payload)
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		IsValidAddress int `json:"isValidAddress"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("unexpected address change response: %v", err)
+	}
+	if result.IsValidAddress != 1 {
+		return fmt.Errorf("postal code rejected by amazon: %s", postalCode)
+	}
+
+	session.mu.Lock()
+	session.PostalCode = postalCode
+	session.Cookies = jar.Cookies(countryURL)
+	session.mu.Unlock()
+	return j.PushSession(ctx, session)
+}
+
+// glowRequest sends a request to the marketplace of country within the probe
+// rate limit and returns the response body.
+func (j *AmazonSession) glowRequest(ctx context.Context, country string, client HTTPDoer, method, rawURL string, header map[string]string, payload []byte) ([]byte, error) {
+	if err := j.probeLimiter.wait(ctx, country); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from %s: %d", req.URL.Path, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -3,12 +3,13 @@ module github.com/amzapi/amazon-redis-session
 go 1.22.0
 
 require (
+	github.com/alicebob/miniredis/v2 v2.39.0
 	github.com/redis/go-redis/v9 v9.5.1
-	github.com/spf13/cast v1.6.0
 	golang.org/x/net v0.25.0
 )
 
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 )
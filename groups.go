@@ -0,0 +1,95 @@
+package amazonsession
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// defaultCountryGroups defines the built-in groups of marketplaces that
+// usually accept the same session cookies.
+var defaultCountryGroups = map[string][]string{
+	"EU": {"DE", "FR", "IT", "ES", "NL", "BE", "SE", "PL"},
+	"NA": {"US", "CA", "MX"},
+}
+
+// GetCountryGroup returns the countries belonging to the named group.
+func (j *AmazonSession) GetCountryGroup(group string) ([]string, error) {
+	countries, found := j.groups[group]
+	if !found || len(countries) == 0 {
+		return nil, fmt.Errorf("country group not found: %s", group)
+	}
+	return countries, nil
+}
+
+// GetRandomSessionFromGroup picks a country from the named group, weighted
+// by the number of sessions available in each country, and returns a random
+// session from it. Sessions expired by Amazon are skipped, and so are the
+// frozen and draining countries; Config.TierPreference and
+// Config.RotationPolicy apply as in GetRandomSession.
+func (j *AmazonSession) GetRandomSessionFromGroup(ctx context.Context, group string) (*Session, error) {
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	countries, err := j.GetCountryGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	var open []string
+	var skipErr error
+	for _, country := range countries {
+		country = normalizeCountry(country)
+		if err := j.checkoutGate(ctx, country); err == ErrDraining || err == ErrFrozen {
+			if skipErr == nil {
+				skipErr = err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		open = append(open, country)
+	}
+	if len(open) == 0 {
+		return nil, skipErr
+	}
+
+	next := func() (*Session, error) {
+		return j.getGroupSession(ctx, group, open)
+	}
+	session, err := next()
+	if err != nil {
+		return nil, err
+	}
+	return j.rotate(ctx, session, next)
+}
+
+// getGroupSession picks a session across the pools of the countries of a
+// group. With a tier preference, only the country is taken from the pick
+// and the session is picked within it by tier.
+func (j *AmazonSession) getGroupSession(ctx context.Context, group string, countries []string) (*Session, error) {
+	// Pick across the pools in one script, so a concurrent pop cannot
+	// shorten a list between its length and the pick.
+	res, err := getGroupSessionCmd.Run(ctx, j.client, countries, scriptRand(), j.clock.Now().Unix()).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "NOT FOUND") {
+			return nil, fmt.Errorf("no sessions available for country group: %s", group)
+		}
+		return nil, fmt.Errorf("redis eval error: %v", err)
+	}
+	values, err := replySlice(res)
+	if err != nil || len(values) != 2 {
+		return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+	}
+	index, err := replyInt64(values[0])
+	if err != nil || index < 1 || index > int64(len(countries)) {
+		return nil, fmt.Errorf("unexpected value returned from Lua script")
+	}
+	sessionID, err := replyString(values[1])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected value returned from Lua script")
+	}
+	if len(j.tierPreference) > 0 {
+		return j.getRandomSession(ctx, countries[index-1], nil)
+	}
+	return j.GetSession(ctx, countries[index-1], sessionID)
+}
@@ -0,0 +1,137 @@
+package amazonsession
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// harLog is the subset of a HAR capture read by ImportFromHAR.
+type harLog struct {
+	Log struct {
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Request         struct {
+		URL     string      `json:"url"`
+		Cookies []harCookie `json:"cookies"`
+	} `json:"request"`
+	Response struct {
+		Headers []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"headers"`
+		Cookies []harCookie `json:"cookies"`
+	} `json:"response"`
+}
+
+type harCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path"`
+	Domain   string     `json:"domain"`
+	Expires  *time.Time `json:"expires"`
+	HTTPOnly bool       `json:"httpOnly"`
+	Secure   bool       `json:"secure"`
+}
+
+// ImportFromHAR parses a HAR capture, e.g. exported from the network tab of
+// the browser devtools, and returns one session per marketplace with the
+// final state of its Amazon cookies, ready to be pushed. Entries are
+// replayed in order: cookies sent by requests are taken as they are and
+// cookies set by responses replace or delete them. Marketplaces without a
+// session-id cookie are skipped.
+func ImportFromHAR(r io.Reader) ([]*Session, error) {
+	var har harLog
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, fmt.Errorf("failed to decode HAR: %v", err)
+	}
+	entries := har.Log.Entries
+	sort.SliceStable(entries, func(i, k int) bool {
+		return entries[i].StartedDateTime.Before(entries[k].StartedDateTime)
+	})
+
+	// states maps a country to its cookies by name.
+	states := make(map[string]map[string]*http.Cookie)
+	set := func(country string, cookie *http.Cookie, now time.Time) {
+		if states[country] == nil {
+			states[country] = make(map[string]*http.Cookie)
+		}
+		if cookie.MaxAge < 0 || (!cookie.Expires.IsZero() && !cookie.Expires.After(now)) {
+			delete(states[country], cookie.Name)
+			return
+		}
+		states[country][cookie.Name] = cookie
+	}
+	for _, entry := range entries {
+		u, err := url.Parse(entry.Request.URL)
+		if err != nil {
+			continue
+		}
+		requestCountry, found := countryFromURL(u.Hostname())
+		if found {
+			for _, c := range entry.Request.Cookies {
+				set(requestCountry, &http.Cookie{Name: c.Name, Value: c.Value, Path: "/", Domain: u.Hostname()}, entry.StartedDateTime)
+			}
+		}
+
+		// Set-Cookie headers are authoritative, the cookies array is only
+		// read when the capture dropped them.
+		var setCookies []*http.Cookie
+		for _, header := range entry.Response.Headers {
+			if strings.EqualFold(header.Name, "Set-Cookie") {
+				setCookies = append(setCookies, parseSetCookies([]string{header.Value})...)
+			}
+		}
+		if len(setCookies) == 0 {
+			for _, c := range entry.Response.Cookies {
+				cookie := &http.Cookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, HttpOnly: c.HTTPOnly, Secure: c.Secure}
+				if c.Expires != nil {
+					cookie.Expires = *c.Expires
+				}
+				setCookies = append(setCookies, cookie)
+			}
+		}
+		for _, cookie := range setCookies {
+			country := requestCountry
+			if cookie.Domain != "" {
+				country, found = countryFromURL(strings.TrimPrefix(cookie.Domain, "."))
+			} else {
+				cookie.Domain = u.Hostname()
+			}
+			if found {
+				set(country, cookie, entry.StartedDateTime)
+			}
+		}
+	}
+
+	countries := make([]string, 0, len(states))
+	for country := range states {
+		if states[country]["session-id"] != nil {
+			countries = append(countries, country)
+		}
+	}
+	sort.Strings(countries)
+	sessions := make([]*Session, 0, len(countries))
+	for _, country := range countries {
+		names := make([]string, 0, len(states[country]))
+		for name := range states[country] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		cookies := make([]*http.Cookie, 0, len(names))
+		for _, name := range names {
+			cookies = append(cookies, states[country][name])
+		}
+		sessions = append(sessions, NewSession(country, states[country]["session-id"].Value, cookies))
+	}
+	return sessions, nil
+}
@@ -0,0 +1,37 @@
+package amazonsession
+
+import "context"
+
+// Hooks holds optional callbacks invoked in-process after the lifecycle
+// events of sessions, e.g. for custom accounting. Callbacks run
+// synchronously on the calling goroutine and should return quickly.
+type Hooks struct {
+	// OnPush is called after a session is stored by PushSession.
+	OnPush func(ctx context.Context, session *Session)
+
+	// OnGet is called after a session is loaded by GetSession, including
+	// the sessions returned by GetRandomSession, PopSession and the like.
+	OnGet func(ctx context.Context, session *Session)
+
+	// OnDelete is called after a session is deleted by DeleteSession.
+	OnDelete func(ctx context.Context, country, sessionID string)
+
+	// OnCleanup is called after CleanupSessions completes.
+	OnCleanup func(ctx context.Context)
+
+	// OnValidationFail is called after RecordFailure with the new number
+	// of consecutive failures of the session.
+	OnValidationFail func(ctx context.Context, country, sessionID string, failures int64)
+
+	// OnDrained is called once a pool marked with BeginDrain has no session
+	// checked out or pinned anymore.
+	OnDrained func(ctx context.Context, country string)
+
+	// OnCorruptSession is called when a stored session cannot be decoded.
+	// Listings skip such sessions, see DecodeMode.
+	OnCorruptSession func(ctx context.Context, country, sessionID string, err error)
+
+	// OnInvalidCookies is called after PushSession stored a session with
+	// malformed cookies in ValidationReport mode, see Config.CookieValidation.
+	OnInvalidCookies func(ctx context.Context, session *Session, problems []string)
+}
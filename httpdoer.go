@@ -0,0 +1,47 @@
+package amazonsession
+
+import (
+	"net/http"
+	"time"
+)
+
+// defaultProbeTimeout is the timeout of the default HTTP client used for
+// requests to Amazon.
+const defaultProbeTimeout = 30 * time.Second
+
+// HTTPDoer sends HTTP requests to Amazon. *http.Client implements it; custom
+// implementations can add proxies, retries or a different TLS stack. The
+// session cookies are added to each request and the returned cookies are
+// stored by the package, so the doer should not manage cookies itself.
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// jarDoer sends requests with a doer, keeping the cookies in a cookie jar.
+type jarDoer struct {
+	doer HTTPDoer
+	jar  http.CookieJar
+}
+
+func (d *jarDoer) Do(req *http.Request) (*http.Response, error) {
+	for _, c := range d.jar.Cookies(req.URL) {
+		req.AddCookie(c)
+	}
+	resp, err := d.doer.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if cookies := resp.Cookies(); len(cookies) > 0 {
+		d.jar.SetCookies(req.URL, cookies)
+	}
+	return resp, nil
+}
+
+// probeDoer returns the doer used for requests to Amazon with the cookies of
+// jar: Config.HTTPDoer if set, or an *http.Client using the jar.
+func (j *AmazonSession) probeDoer(jar http.CookieJar) HTTPDoer {
+	if j.httpDoer == nil {
+		return &http.Client{Jar: jar, Timeout: defaultProbeTimeout}
+	}
+	return &jarDoer{doer: j.httpDoer, jar: jar}
+}
@@ -0,0 +1,54 @@
+package amazonsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultIdempotencyWindow is how long idempotency keys are remembered when
+// Config.IdempotencyWindow is not set.
+const defaultIdempotencyWindow = 24 * time.Hour
+
+// idempotencyKeyPrefix prefixes the keys remembering the idempotency keys of
+// pushes, which are not tied to a country.
+const idempotencyKeyPrefix = "push-idempotency:"
+
+func idempotencyKey(key string) string {
+	return idempotencyKeyPrefix + key
+}
+
+// errIdempotentRetry is returned by pushSession when the idempotency key of
+// the push was already used for the same session-id.
+var errIdempotentRetry = errors.New("push already applied")
+
+// claimIdempotencyKey claims the idempotency key of a push for sessionID
+// before the session is written, so concurrent retries are applied once. It
+// returns errIdempotentRetry when the key was already used for sessionID and
+// an error when it was used for another session. A claim is released with
+// releaseIdempotencyKey when the write fails.
+func (j *AmazonSession) claimIdempotencyKey(ctx context.Context, key, sessionID string) error {
+	res, err := claimIdempotencyKeyCmd.Run(ctx, j.client, []string{idempotencyKey(key)}, sessionID, j.idempotencyWindow.Milliseconds()).Result()
+	if err != nil {
+		return fmt.Errorf("error claiming idempotency key: %v", err)
+	}
+	stored, err := replyString(res)
+	if err != nil {
+		return fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+	}
+	switch stored {
+	case "":
+		return nil
+	case sessionID:
+		return errIdempotentRetry
+	default:
+		return fmt.Errorf("idempotency key %s already used for session %s", key, stored)
+	}
+}
+
+// releaseIdempotencyKey releases the claim of a push that failed, so it can
+// be retried with the same key. It runs even when ctx was cancelled.
+func (j *AmazonSession) releaseIdempotencyKey(ctx context.Context, key string) {
+	j.client.Del(context.WithoutCancel(ctx), idempotencyKey(key))
+}
@@ -0,0 +1,266 @@
+package amazonsession
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// importStagingPrefix prefixes the staging keys of atomic imports, which
+// are not tied to a country.
+const importStagingPrefix = "import-staging:"
+
+// importStagingTTL bounds the lifetime of the staging key of an atomic
+// import that was interrupted before it could clean up.
+const importStagingTTL = time.Hour
+
+// maxImportRecordSize is the largest record accepted by ImportSessions.
+const maxImportRecordSize = 1 << 20
+
+// ImportOptions configures ImportSessions.
+type ImportOptions struct {
+	// Atomic imports all the records or none: every record is decoded,
+	// validated and staged before they are stored together in one script.
+	Atomic bool
+}
+
+// ImportSessions stores the sessions read from r, one JSON session per line
+// in the format of Session.MarshalJSON as written by ExportSessions, and
+// returns the number of sessions stored. The usage counts and timestamps of the records are kept, see
+// PushOptions. Blank lines are skipped.
+//
+// By default each record is pushed on its own and the records that fail to
+// decode or push are reported in a *MultiError, indexed by record. With
+// ImportOptions.Atomic nothing is stored unless every record is valid and
+// passes the checks of PushSession: the records are staged in Redis under a
+// key of the import, then stored all at once by one script. Readers never
+// see a partial import, and an import interrupted before its commit stores
+// nothing. Atomic imports do not rename sessions: a record whose session_id
+// differs from its session-id cookie fails.
+func (j *AmazonSession) ImportSessions(ctx context.Context, r io.Reader, opts *ImportOptions) (int, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	sessions, decodeErrs, err := readImportRecords(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if !opts.Atomic {
+		imported := 0
+		for i, session := range sessions {
+			if session == nil {
+				continue
+			}
+			if err := j.PushSessionWithOptions(ctx, session, importPushOptions(session)); err != nil {
+				decodeErrs.add(i, itemSessionID(session), err)
+				continue
+			}
+			imported++
+		}
+		sortItemErrors(decodeErrs.err.Errors)
+		return imported, decodeErrs.result(len(sessions))
+	}
+
+	errs := decodeErrs
+	for i, session := range sessions {
+		if session == nil {
+			continue
+		}
+		if err := j.validateSession(session); err != nil {
+			errs.add(i, itemSessionID(session), err)
+		}
+	}
+	if len(errs.err.Errors) > 0 {
+		sortItemErrors(errs.err.Errors)
+		return 0, errs.result(len(sessions))
+	}
+	return j.commitImport(ctx, sessions)
+}
+
+// readImportRecords decodes the records of an import. Records that fail to
+// decode are nil in the returned slice and reported in the multiError.
+func readImportRecords(r io.Reader) ([]*Session, multiError, error) {
+	var errs multiError
+	var sessions []*Session
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportRecordSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		session := &Session{}
+		if err := json.Unmarshal([]byte(line), session); err != nil {
+			errs.add(len(sessions), "", fmt.Errorf("invalid record: %v", err))
+			session = nil
+		}
+		sessions = append(sessions, session)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errs, fmt.Errorf("failed to read import: %v", err)
+	}
+	return sessions, errs, nil
+}
+
+// importPushOptions keeps the counters and timestamps of an imported record.
+func importPushOptions(session *Session) *PushOptions {
+	return &PushOptions{
+		UsageCount:  session.UsageCount,
+		LastChecked: session.LastChecked,
+		CreatedAt:   session.CreatedAt,
+	}
+}
+
+// sortItemErrors orders the errors of a batch by item, as the decode errors
+// are collected before the push errors.
+func sortItemErrors(items []*ItemError) {
+	sort.SliceStable(items, func(a, b int) bool { return items[a].Index < items[b].Index })
+}
+
+// stagedSession is a session of an atomic import in the form applied by
+// commitImportCmd. Hash values are strings, scores numbers; nil Labels keep
+// the stored labels.
+type stagedSession struct {
+	Country         string                 `json:"country"`
+	SessionID       string                 `json:"id"`
+	Cookies         string                 `json:"cookies"`
+	ExpiresAt       string                 `json:"expires_at,omitempty"`
+	CreatedAt       string                 `json:"created_at,omitempty"`
+	LastChecked     string                 `json:"last_checked,omitempty"`
+	LastCheckedUnix int64                  `json:"last_checked_unix,omitempty"`
+	UsageCount      int64                  `json:"usage_count,omitempty"`
+	Fields          map[string]interface{} `json:"fields"`
+	RawSetCookies   string                 `json:"raw_set_cookies,omitempty"`
+	Labels          map[string]string      `json:"labels"`
+	Generation      string                 `json:"generation,omitempty"`
+	Canary          bool                   `json:"canary,omitempty"`
+	RemoveFrom      []string               `json:"remove_from,omitempty"`
+}
+
+// stageSession checks a validated session of an atomic import like
+// pushSession does and returns it in its staged form, with its cookie
+// problems in ValidationReport mode.
+func (j *AmazonSession) stageSession(ctx context.Context, session *Session) (*stagedSession, []string, error) {
+	session.Country = normalizeCountry(session.Country)
+	cookiesMap, sessionID, problems, err := j.prepareSession(ctx, session)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Renames are not staged: the record would leave the old session behind.
+	if session.SessionID != "" && session.SessionID != sessionID {
+		return nil, nil, fmt.Errorf("session-id %s does not match the session-id cookie %s", session.SessionID, sessionID)
+	}
+	opts, others, err := j.resolveCrossCountry(ctx, session, session.Country, sessionID, importPushOptions(session))
+	if err != nil {
+		return nil, nil, err
+	}
+	cookieData, err := json.Marshal(cookiesMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	staged := &stagedSession{
+		Country:    session.Country,
+		SessionID:  sessionID,
+		Cookies:    string(cookieData),
+		Fields:     session.fieldValues(),
+		Labels:     session.Labels,
+		Generation: session.Generation,
+		Canary:     session.Canary,
+		RemoveFrom: others,
+	}
+	if expiresAt, ok := parseSessionIDTime(cookiesMap["session-id-time"]); ok {
+		staged.ExpiresAt = strconv.FormatInt(expiresAt, 10)
+	}
+	if opts != nil {
+		if !opts.CreatedAt.IsZero() {
+			staged.CreatedAt = fmt.Sprint(j.formatTimestamp(opts.CreatedAt))
+		}
+		if !opts.LastChecked.IsZero() {
+			staged.LastChecked = fmt.Sprint(j.formatTimestamp(opts.LastChecked))
+			staged.LastCheckedUnix = opts.LastChecked.Unix()
+		}
+		staged.UsageCount = opts.UsageCount
+	}
+	if j.storeRawSetCookies && len(session.RawSetCookies) > 0 {
+		raw, err := json.Marshal(filterRawSetCookies(session.RawSetCookies, session.AccountRef != ""))
+		if err != nil {
+			return nil, nil, err
+		}
+		staged.RawSetCookies = string(raw)
+	}
+	return staged, problems, nil
+}
+
+// commitImport stages validated sessions under a key of their own and
+// stores them all in one script, so readers never see a partial import and
+// an interrupted import stores nothing: its staging key just expires.
+func (j *AmazonSession) commitImport(ctx context.Context, sessions []*Session) (int, error) {
+	if len(sessions) == 0 {
+		return 0, nil
+	}
+	var errs multiError
+	records := make([]interface{}, 0, len(sessions))
+	problems := make([][]string, len(sessions))
+	for i, session := range sessions {
+		staged, p, err := j.stageSession(ctx, session)
+		if err != nil {
+			errs.add(i, itemSessionID(session), err)
+			continue
+		}
+		data, err := json.Marshal(staged)
+		if err != nil {
+			errs.add(i, staged.SessionID, err)
+			continue
+		}
+		records = append(records, data)
+		problems[i] = p
+		session.SessionID = staged.SessionID
+	}
+	if err := errs.result(len(sessions)); err != nil {
+		return 0, err
+	}
+
+	stagingKey := fmt.Sprintf("%s%d-%d", importStagingPrefix, j.clock.Now().UnixNano(), rand.Int63())
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+	pipe := j.client.TxPipeline()
+	pipe.RPush(ctx, stagingKey, records...)
+	pipe.Expire(ctx, stagingKey, importStagingTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("failed to stage import: %v", err)
+	}
+
+	now := j.clock.Now()
+	args := append([]interface{}{j.formatTimestamp(now), now.Unix()}, sessionFieldArgs()...)
+	if err := commitImportCmd.Run(ctx, j.client, []string{stagingKey}, args...).Err(); err != nil {
+		j.client.Del(context.WithoutCancel(ctx), stagingKey)
+		return 0, fmt.Errorf("failed to commit import: %v", err)
+	}
+
+	countries := make(map[string]bool)
+	for i, session := range sessions {
+		session.dirty = false
+		if !countries[session.Country] {
+			countries[session.Country] = true
+			// The import may have ended the last borrow of a draining pool.
+			if err := j.checkDrained(ctx, session.Country); err != nil {
+				return len(sessions), err
+			}
+		}
+		if len(problems[i]) > 0 && j.hooks.OnInvalidCookies != nil {
+			j.hooks.OnInvalidCookies(ctx, session, problems[i])
+		}
+		if j.hooks.OnPush != nil {
+			j.hooks.OnPush(ctx, session)
+		}
+	}
+	return len(sessions), nil
+}
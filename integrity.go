@@ -0,0 +1,86 @@
+package amazonsession
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Kinds of IntegrityViolation.
+const (
+	ViolationDuplicateID    = "duplicate-id"    // the session-id is listed more than once
+	ViolationMissingCookies = "missing-cookies" // the session-id is listed without cookie data
+	ViolationUnlisted       = "unlisted"        // the session has cookie data but is neither listed, pinned nor checked out
+	ViolationMissingCounter = "missing-counter" // the usage-count, last-checked or created-at field is missing
+	ViolationStaleAffinity  = "stale-affinity"  // an affinity key is bound to a deleted session
+	ViolationStaleIndex     = "stale-index"     // a label or generation index holds a deleted session
+)
+
+// IntegrityViolation is a broken invariant found by VerifyIntegrity.
+type IntegrityViolation struct {
+	Country   string `json:"country"`    // Country is the country code
+	Kind      string `json:"kind"`       // Kind is one of the Violation constants
+	SessionID string `json:"session_id"` // SessionID is the session the violation refers to
+}
+
+// IntegrityReport is the result of VerifyIntegrity.
+type IntegrityReport struct {
+	Time       int64                 `json:"time"`      // Time is the time of the check, in Unix time
+	Countries  []string              `json:"countries"` // Countries are the country codes checked
+	Violations []*IntegrityViolation `json:"violations"`
+}
+
+// OK reports whether no violations were found.
+func (r *IntegrityReport) OK() bool {
+	return len(r.Violations) == 0
+}
+
+// VerifyIntegrity checks the invariants of the stored pools of all
+// countries, one script per country, without changing anything.
+// Inconsistencies between the lists and the cookie hash can be fixed with
+// RepairPool.
+func (j *AmazonSession) VerifyIntegrity(ctx context.Context) (*IntegrityReport, error) {
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+	countries, err := j.storedCountries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &IntegrityReport{
+		Time:       j.clock.Now().Unix(),
+		Countries:  countries,
+		Violations: make([]*IntegrityViolation, 0),
+	}
+	for _, country := range countries {
+		res, err := verifyIntegrityCmd.Run(ctx, j.readClient(ctx), []string{country}, sessionFieldArgs()...).Result()
+		if err != nil {
+			return nil, fmt.Errorf("redis eval error: %v", err)
+		}
+		data, err := replyStrings(res)
+		if err != nil {
+			return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+		}
+		for i := 0; i+2 <= len(data); i += 2 {
+			report.Violations = append(report.Violations, &IntegrityViolation{Country: country, Kind: data[i], SessionID: data[i+1]})
+		}
+	}
+	return report, nil
+}
+
+// IntegrityHandler returns an HTTP handler serving VerifyIntegrity as JSON,
+// with status 409 when violations were found.
+func (j *AmazonSession) IntegrityHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report, err := j.VerifyIntegrity(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !report.OK() {
+			w.WriteHeader(http.StatusConflict)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
@@ -0,0 +1,159 @@
+package amazonsession
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// sessionJSON is the JSON representation of a Session. The cookie jar is
+// not serialized, timestamps are kept in Unix time for compatibility with
+// earlier exports.
+type sessionJSON struct {
+	Country       string            `json:"country"`
+	SessionID     string            `json:"session_id"`
+	Cookies       []cookieJSON      `json:"cookies"`
+	UsageCount    int64             `json:"usage_count"`
+	UsageLastHour int64             `json:"usage_last_hour,omitempty"`
+	UsageLastDay  int64             `json:"usage_last_day,omitempty"`
+	LastCheckedAt int64             `json:"last_checked_at"`
+	CreatedAt     int64             `json:"created_at"`
+	PostalCode    string            `json:"postal_code,omitempty"`
+	Currency      string            `json:"currency,omitempty"`
+	Language      string            `json:"language,omitempty"`
+	AccountRef    string            `json:"account_ref,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Generation    string            `json:"generation,omitempty"`
+	Canary        bool              `json:"canary,omitempty"`
+	Bucket        string            `json:"bucket,omitempty"`
+	Tier          string            `json:"tier,omitempty"`
+	Failures      int64             `json:"failures,omitempty"`
+	ExpiresAt     int64             `json:"expires_at,omitempty"`
+	RawSetCookies []string          `json:"raw_set_cookies,omitempty"`
+	TLSProfile    string            `json:"tls_profile,omitempty"`
+	Proxy         string            `json:"proxy,omitempty"`
+	Residency     string            `json:"residency,omitempty"`
+	ASN           string            `json:"asn,omitempty"`
+	ExitIPHash    string            `json:"exit_ip_hash,omitempty"`
+	FailureScore  float64           `json:"failure_score,omitempty"`
+	CheckHistory  []checkRecord     `json:"check_history,omitempty"`
+	LatencyMs     int64             `json:"latency_ms,omitempty"`
+}
+
+type cookieJSON struct {
+	Name    string    `json:"name"`
+	Value   string    `json:"value"`
+	Domain  string    `json:"domain,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s *Session) MarshalJSON() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cookies := s.sessionCookies()
+	v := sessionJSON{
+		Country:       s.Country,
+		SessionID:     s.SessionID,
+		Cookies:       make([]cookieJSON, len(cookies)),
+		UsageCount:    s.UsageCount,
+		UsageLastHour: s.UsageLastHour,
+		UsageLastDay:  s.UsageLastDay,
+		LastCheckedAt: unixTime(s.LastChecked),
+		CreatedAt:     unixTime(s.CreatedAt),
+		PostalCode:    s.PostalCode,
+		Currency:      s.Currency,
+		Language:      s.Language,
+		AccountRef:    s.AccountRef,
+		Labels:        s.Labels,
+		Generation:    s.Generation,
+		Canary:        s.Canary,
+		Bucket:        s.Bucket,
+		Tier:          s.Tier,
+		Failures:      s.Failures,
+		ExpiresAt:     s.ExpiresAt,
+		RawSetCookies: s.RawSetCookies,
+		TLSProfile:    s.TLSProfile,
+		Proxy:         s.Proxy,
+		Residency:     s.Residency,
+		ASN:           s.ASN,
+		ExitIPHash:    s.ExitIPHash,
+		FailureScore:  s.FailureScore,
+		LatencyMs:     s.Latency.Milliseconds(),
+	}
+	for _, result := range s.CheckHistory {
+		v.CheckHistory = append(v.CheckHistory, newCheckRecord(result))
+	}
+	for i, c := range cookies {
+		v.Cookies[i] = cookieJSON{
+			Name:    c.Name,
+			Value:   c.Value,
+			Domain:  c.Domain,
+			Path:    c.Path,
+			Expires: c.Expires,
+		}
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. The cookie jar is built on
+// demand by CookieJar.
+func (s *Session) UnmarshalJSON(data []byte) error {
+	var v sessionJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	cookies := make([]*http.Cookie, len(v.Cookies))
+	for i, c := range v.Cookies {
+		cookies[i] = &http.Cookie{
+			Name:    c.Name,
+			Value:   c.Value,
+			Domain:  c.Domain,
+			Path:    c.Path,
+			Expires: c.Expires,
+		}
+	}
+
+	*s = Session{
+		Cookies:       cookies,
+		Country:       v.Country,
+		SessionID:     v.SessionID,
+		UsageCount:    v.UsageCount,
+		UsageLastHour: v.UsageLastHour,
+		UsageLastDay:  v.UsageLastDay,
+		LastChecked:   jsonTime(v.LastCheckedAt),
+		CreatedAt:     jsonTime(v.CreatedAt),
+		PostalCode:    v.PostalCode,
+		Currency:      v.Currency,
+		Language:      v.Language,
+		AccountRef:    v.AccountRef,
+		Labels:        v.Labels,
+		Generation:    v.Generation,
+		Canary:        v.Canary,
+		Bucket:        v.Bucket,
+		Tier:          v.Tier,
+		Failures:      v.Failures,
+		ExpiresAt:     v.ExpiresAt,
+		RawSetCookies: v.RawSetCookies,
+		TLSProfile:    v.TLSProfile,
+		Proxy:         v.Proxy,
+		Residency:     v.Residency,
+		ASN:           v.ASN,
+		ExitIPHash:    v.ExitIPHash,
+		FailureScore:  v.FailureScore,
+		CheckHistory:  checkResults(v.CheckHistory),
+		Latency:       time.Duration(v.LatencyMs) * time.Millisecond,
+	}
+	return nil
+}
+
+// jsonTime converts a Unix time from the JSON representation, keeping zero
+// as the zero time.
+func jsonTime(unix int64) time.Time {
+	if unix == 0 {
+		return time.Time{}
+	}
+	return time.Unix(unix, 0)
+}
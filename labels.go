@@ -0,0 +1,134 @@
+package amazonsession
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// labelIndexKey returns the key of the set indexing the sessions of a country
+// carrying a label.
+func labelIndexKey(country, name, value string) string {
+	return fmt.Sprintf("%s:label:%s", country, labelPair(name, value))
+}
+
+// labelRegistryKey returns the key of the set of all label pairs indexed for
+// a country.
+func labelRegistryKey(country string) string {
+	return fmt.Sprintf("%s:labels", country)
+}
+
+func labelPair(name, value string) string {
+	if name == "" && value == "" {
+		return ""
+	}
+	return name + "=" + value
+}
+
+// storedLabels reads the labels currently stored for a session.
+func (j *AmazonSession) storedLabels(ctx context.Context, country, sessionID string) (map[string]string, error) {
+	data, err := j.client.HGet(ctx, cookiesKey(country), sessionFieldKey(sessionID, "labels")).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string)
+	if err := json.Unmarshal([]byte(data), &labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// updateLabelIndexes queues the index updates for the new labels of a
+// session on the pipeline. Nil labels keep the stored ones, empty labels
+// clear them.
+func (j *AmazonSession) updateLabelIndexes(ctx context.Context, pipe redis.Pipeliner, country, sessionID string, labels map[string]string) error {
+	if labels == nil {
+		return nil
+	}
+	if len(labels) == 0 {
+		pipe.HDel(ctx, cookiesKey(country), sessionFieldKey(sessionID, "labels"))
+	}
+	old, err := j.storedLabels(ctx, country, sessionID)
+	if err != nil {
+		return fmt.Errorf("error getting session labels: %v", err)
+	}
+	for name, value := range old {
+		if labels[name] != value {
+			pipe.SRem(ctx, labelIndexKey(country, name, value), sessionID)
+		}
+	}
+	for name, value := range labels {
+		pipe.SAdd(ctx, labelIndexKey(country, name, value), sessionID)
+		pipe.SAdd(ctx, labelRegistryKey(country), labelPair(name, value))
+	}
+	return nil
+}
+
+// ListSessionIDsByLabel returns the IDs of the sessions of a country
+// carrying the label name=value.
+func (j *AmazonSession) ListSessionIDsByLabel(ctx context.Context, country, name, value string) ([]string, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.readClient(ctx).SMembers(ctx, labelIndexKey(country, name, value)).Result()
+}
+
+// ListSessionsByLabel returns the sessions of a country carrying the label
+// name=value, without incrementing their usage counts.
+func (j *AmazonSession) ListSessionsByLabel(ctx context.Context, country, name, value string) ([]*Session, error) {
+	ids, err := j.ListSessionIDsByLabel(ctx, country, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return j.listSessionsByIDs(ctx, normalizeCountry(country), ids)
+}
+
+// listSessionsByIDs loads the sessions with the given IDs, skipping IDs that
+// are no longer stored.
+func (j *AmazonSession) listSessionsByIDs(ctx context.Context, country string, ids []string) ([]*Session, error) {
+	countryURL, err := j.getCountryURL(country)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+
+	argv := make([]interface{}, 0, len(ids)+len(sessionFields)+1)
+	argv = append(argv, len(ids))
+	for _, id := range ids {
+		argv = append(argv, id)
+	}
+	argv = append(argv, sessionFieldArgs()...)
+	res, err := listSessionByIDsCmd.Run(ctx, j.readClient(ctx), []string{cookiesKey(country)}, argv...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis eval error: %v", err)
+	}
+	data, err := replySlice(res)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]*Session, 0)
+	// Each session is returned as session-id, cookies and fields.
+	stride := len(sessionFields) + 2
+	for i := 0; i+stride <= len(data); i += stride {
+		sessionID, err := replyString(data[i])
+		if err != nil {
+			return nil, err
+		}
+		session, err := j.newSessionFromReply(countryURL, country, sessionID, data[i+1:i+stride], j.eagerCookieJar)
+		if err != nil {
+			if err := j.decodeFailed(ctx, country, sessionID, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
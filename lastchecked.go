@@ -0,0 +1,66 @@
+package amazonsession
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// lastCheckedIndexKey is the key of the sorted set indexing the sessions of
+// a country by their last-checked time, maintained on every write of the
+// last-checked timestamp. Sessions stored by older versions of the package
+// are indexed by RebuildIndexes.
+func lastCheckedIndexKey(country string) string {
+	return fmt.Sprintf("%s:by-last-checked", country)
+}
+
+// StaleSessionIDs returns the session-ids of a country not checked within
+// olderThan, least recently checked first, with a range query on the
+// last-checked index.
+func (j *AmazonSession) StaleSessionIDs(ctx context.Context, country string, olderThan time.Duration) ([]string, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	cutoff := j.clock.Now().Add(-olderThan).Unix()
+	return j.readClient(ctx).ZRangeByScore(ctx, lastCheckedIndexKey(country), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(cutoff, 10),
+	}).Result()
+}
+
+// cleanupIndex removes the sessions of a country whose score in the index
+// stored at indexKey is within [min, max], chunk by chunk.
+func (j *AmazonSession) cleanupIndex(ctx context.Context, country, indexKey, min, max string, result *CleanupResult) error {
+	var start int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		argv := append([]interface{}{start, cleanupChunkSize, min, max}, sessionFieldArgs()...)
+		res, err := cleanupIndexCmd.Run(ctx, j.client, []string{country, indexKey}, argv...).Result()
+		if err != nil {
+			return fmt.Errorf("redis eval error: %v", err)
+		}
+		data, err := replySlice(res)
+		if err != nil || len(data) != 3 {
+			return fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+		}
+		counts := make([]int64, 3)
+		for i := range counts {
+			if counts[i], err = replyInt64(data[i]); err != nil {
+				return err
+			}
+		}
+		scanned, removed, dropped := counts[0], counts[1], counts[2]
+		result.Scanned += scanned - dropped
+		result.Removed[country] += removed
+		if scanned < cleanupChunkSize {
+			return nil
+		}
+		// Only the skipped checked out and pinned sessions stay in range.
+		start += scanned - removed - dropped
+	}
+}
@@ -0,0 +1,39 @@
+package amazonsession
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// lowLatencyScale is the latency at which LowLatencySelector picks a session
+// half as often as a session without latency.
+const lowLatencyScale = 500 * time.Millisecond
+
+// RecordLatency records a response latency observed with a session, e.g. by
+// the HTTP transport of the caller. The smoothed latency is exposed as
+// Session.Latency and used by LowLatencySelector; consistently slow sessions
+// are often throttled.
+func (j *AmazonSession) RecordLatency(ctx context.Context, country, sessionID string, latency time.Duration) error {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	if latency <= 0 {
+		return fmt.Errorf("invalid latency: %v", latency)
+	}
+	err := recordLatencyCmd.Run(ctx, j.client, []string{cookiesKey(country)}, sessionID, latency.Milliseconds()).Err()
+	if err != nil {
+		return sessionNotFound(err, sessionID)
+	}
+	return nil
+}
+
+// LowLatencySelector picks a random session weighted by its smoothed
+// latency, so slow sessions are picked less often. Sessions without a
+// recorded latency are preferred, so their latency gets measured.
+func LowLatencySelector() Selector {
+	return &scriptSelector{script: lowLatencySessionCmd, args: func(j *AmazonSession, now int64) []interface{} {
+		return []interface{}{now, rand.Float64(), lowLatencyScale.Milliseconds()}
+	}}
+}
@@ -0,0 +1,63 @@
+package amazonsession
+
+import (
+	"context"
+	"net"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// concurrencyLimiter is a redis.Hook bounding the number of commands and
+// pipelines in flight from one process. Callers over the limit wait for a
+// slot until their context is done, so the operation deadline covers the
+// wait instead of the connection pool timing out under load.
+type concurrencyLimiter struct {
+	slots chan struct{}
+}
+
+func newConcurrencyLimiter(limit int) *concurrencyLimiter {
+	return &concurrencyLimiter{slots: make(chan struct{}, limit)}
+}
+
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
+
+func (l *concurrencyLimiter) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (l *concurrencyLimiter) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := l.acquire(ctx); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		defer l.release()
+		return next(ctx, cmd)
+	}
+}
+
+func (l *concurrencyLimiter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if err := l.acquire(ctx); err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		defer l.release()
+		return next(ctx, cmds)
+	}
+}
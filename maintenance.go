@@ -0,0 +1,124 @@
+package amazonsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MaintenanceMode selects how the background work on a pool behaves during
+// a maintenance window, see ScheduleMaintenance.
+type MaintenanceMode int
+
+const (
+	// MaintenancePause pauses the background work: CleanupSessions skips
+	// the country and validators should not check its sessions.
+	MaintenancePause MaintenanceMode = iota + 1
+
+	// MaintenanceIntensify intensifies the background work: CleanupSessions
+	// halves its thresholds for the country, so stale and overused sessions
+	// are removed twice as early, and validators may check its sessions more
+	// often.
+	MaintenanceIntensify
+)
+
+// MaintenanceWindow is a scheduled maintenance window of a country.
+type MaintenanceWindow struct {
+	Start time.Time       // Start is the beginning of the window
+	End   time.Time       // End is the end of the window, excluded
+	Mode  MaintenanceMode // Mode is the behavior of the background work during the window
+}
+
+// Active reports whether the window covers the given time.
+func (w *MaintenanceWindow) Active(now time.Time) bool {
+	return !now.Before(w.Start) && now.Before(w.End)
+}
+
+func maintenanceKey(country string) string {
+	return fmt.Sprintf("%s:maintenance", country)
+}
+
+// ScheduleMaintenance schedules a maintenance window for a country,
+// replacing the window scheduled before. The window is stored in Redis, so
+// it applies to every process sharing the pools, and expires at its end.
+// Only CleanupSessions applies it by itself: background validators should
+// call ActiveMaintenance before each run.
+func (j *AmazonSession) ScheduleMaintenance(ctx context.Context, country string, window MaintenanceWindow) error {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	if window.Mode != MaintenancePause && window.Mode != MaintenanceIntensify {
+		return fmt.Errorf("invalid maintenance mode: %d", window.Mode)
+	}
+	if !window.End.After(window.Start) {
+		return errors.New("maintenance window must end after its start")
+	}
+	if !window.End.After(j.clock.Now()) {
+		return errors.New("maintenance window is already over")
+	}
+	key := maintenanceKey(country)
+	pipe := j.client.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.HSet(ctx, key, "mode", int(window.Mode), "start", window.Start.Unix(), "end", window.End.Unix())
+	pipe.ExpireAt(ctx, key, window.End)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to schedule maintenance: %v", err)
+	}
+	return nil
+}
+
+// CancelMaintenance cancels the maintenance window of a country.
+func (j *AmazonSession) CancelMaintenance(ctx context.Context, country string) error {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.client.Del(ctx, maintenanceKey(country)).Err()
+}
+
+// GetMaintenance returns the maintenance window scheduled for a country, nil
+// when there is none.
+func (j *AmazonSession) GetMaintenance(ctx context.Context, country string) (*MaintenanceWindow, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.maintenanceWindow(ctx, country)
+}
+
+// ActiveMaintenance returns the mode of the maintenance window of a country
+// in progress, and false when there is none.
+func (j *AmazonSession) ActiveMaintenance(ctx context.Context, country string) (MaintenanceMode, bool, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.activeMaintenance(ctx, country)
+}
+
+func (j *AmazonSession) activeMaintenance(ctx context.Context, country string) (MaintenanceMode, bool, error) {
+	window, err := j.maintenanceWindow(ctx, country)
+	if err != nil || window == nil || !window.Active(j.clock.Now()) {
+		return 0, false, err
+	}
+	return window.Mode, true, nil
+}
+
+func (j *AmazonSession) maintenanceWindow(ctx context.Context, country string) (*MaintenanceWindow, error) {
+	values, err := j.client.HMGet(ctx, maintenanceKey(country), "mode", "start", "end").Result()
+	if err != nil {
+		return nil, fmt.Errorf("error getting maintenance window: %v", err)
+	}
+	if values[0] == nil {
+		return nil, nil
+	}
+	var fields [3]int64
+	for i, value := range values {
+		if fields[i], err = replyInt64(value); err != nil {
+			return nil, fmt.Errorf("invalid maintenance window: %v", err)
+		}
+	}
+	return &MaintenanceWindow{
+		Mode:  MaintenanceMode(fields[0]),
+		Start: time.Unix(fields[1], 0),
+		End:   time.Unix(fields[2], 0),
+	}, nil
+}
@@ -0,0 +1,225 @@
+package amazonsession
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Marketplace describes an Amazon marketplace.
+type Marketplace struct {
+	Country       string // Country is the country code used by this package (e.g. "US")
+	Domain        string // Domain is the marketplace URL (e.g. "https://www.amazon.com")
+	MarketplaceID string // MarketplaceID is the Amazon marketplace ID (e.g. "ATVPDKIKX0DER")
+	Currency      string // Currency is the default currency of the marketplace
+	Language      string // Language is the default language of the marketplace
+}
+
+// defaultCountryMarketplaceIDMap defines the Amazon marketplace IDs of each
+// country.
+var defaultCountryMarketplaceIDMap = map[string]string{
+	"BR": "A2Q3Y263D00KWC",
+	"TR": "A33AVAJ2PDY3EV",
+	"ES": "A1RKKUPIHCS9HS",
+	"FR": "A13V1IB3VIYZZH",
+	"IN": "A21TJRUUN4KGV",
+	"NL": "A1805IZSGTT6HS",
+	"SA": "A17E79C6D8DWNP",
+	"BE": "AMEN7PMS3EDWL",
+	"AU": "A39IBJ37TRP1C6",
+	"US": "ATVPDKIKX0DER",
+	"UK": "A1F83G8C2ARO7P",
+	"DE": "A1PA6795UKMFR9",
+	"SE": "A2NODRKZP88ZB9",
+	"SG": "A19VAU5U5O7RUS",
+	"CA": "A2EUQ1WTGCTBG2",
+	"MX": "A1AM78C64UM0Y8",
+	"IT": "APJ6JRA9NG5V4",
+	"AE": "A2VIGQ35RCS4UG",
+	"PL": "A1C3SOZRARQ6R3",
+	"JP": "A1VC38T7YXB528",
+}
+
+// LookupMarketplace returns the marketplace of a country code.
+func LookupMarketplace(country string) (Marketplace, bool) {
+	country = normalizeCountry(country)
+	domain, found := defaultCountryCodeDomainMap[country]
+	if !found {
+		return Marketplace{}, false
+	}
+	return Marketplace{
+		Country:       country,
+		Domain:        domain,
+		MarketplaceID: defaultCountryMarketplaceIDMap[country],
+		Currency:      defaultCountryCurrencyMap[country],
+		Language:      defaultCountryLanguageMap[country],
+	}, true
+}
+
+// LookupMarketplaceByID returns the marketplace of an Amazon marketplace ID.
+func LookupMarketplaceByID(marketplaceID string) (Marketplace, bool) {
+	for country, id := range defaultCountryMarketplaceIDMap {
+		if id == marketplaceID {
+			return LookupMarketplace(country)
+		}
+	}
+	return Marketplace{}, false
+}
+
+// Marketplaces returns all known marketplaces sorted by country code.
+func Marketplaces() []Marketplace {
+	marketplaces := make([]Marketplace, 0, len(defaultCountryCodeDomainMap))
+	for country := range defaultCountryCodeDomainMap {
+		marketplace, _ := LookupMarketplace(country)
+		marketplaces = append(marketplaces, marketplace)
+	}
+	sort.Slice(marketplaces, func(i, k int) bool {
+		return marketplaces[i].Country < marketplaces[k].Country
+	})
+	return marketplaces
+}
+
+// countryCodeAliases maps alternative country codes to the codes used by
+// this package.
+var countryCodeAliases = map[string]string{
+	"GB": "UK",
+}
+
+// normalizeCountry converts a country code in any case ("us", "Us"), an
+// alias ("GB"), a locale string ("en-GB", "en_GB") or a marketplace URL
+// ("https://www.amazon.co.jp") to the country code used for the Redis keys.
+func normalizeCountry(country string) string {
+	country = strings.TrimSpace(country)
+	if strings.Contains(country, ".") {
+		if code, found := countryFromURL(country); found {
+			return code
+		}
+	}
+	// Locale strings carry the country after the language.
+	if i := strings.LastIndexAny(country, "-_"); i >= 0 {
+		country = country[i+1:]
+	}
+	country = strings.ToUpper(country)
+	if alias, found := countryCodeAliases[country]; found {
+		return alias
+	}
+	return country
+}
+
+// isCountryCode reports whether s has the form of a country code returned
+// by normalizeCountry, which tells the keys of the package apart from the
+// keys of other applications, e.g. user:42:cookies.
+func isCountryCode(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// countryFromURL resolves a marketplace domain or URL to its country code.
+func countryFromURL(rawURL string) (string, bool) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	host := marketplaceHost(u.Hostname())
+	for code, domain := range defaultCountryCodeDomainMap {
+		if du, err := url.Parse(domain); err == nil && marketplaceHost(du.Hostname()) == host {
+			return code, true
+		}
+	}
+	return "", false
+}
+
+// marketplaceHost strips the subdomain from an Amazon host name, so that
+// "www.amazon.de", "smile.amazon.de" and "amazon.de" compare equal.
+func marketplaceHost(host string) string {
+	host = strings.ToLower(host)
+	if i := strings.Index(host, "amazon."); i >= 0 {
+		return host[i:]
+	}
+	return host
+}
+
+// defaultCountryCookieSuffixMap defines the suffix Amazon appends to the
+// marketplace-scoped cookie names (ubid-*, lc-*, at-*, ...) for each country.
+var defaultCountryCookieSuffixMap = map[string]string{
+	"BR": "acbbr",
+	"TR": "acbtr",
+	"ES": "acbes",
+	"FR": "acbfr",
+	"IN": "acbin",
+	"NL": "acbnl",
+	"SA": "acbsa",
+	"BE": "acbbe",
+	"AU": "acbau",
+	"US": "main",
+	"UK": "acbuk",
+	"DE": "acbde",
+	"SE": "acbse",
+	"SG": "acbsg",
+	"CA": "acbca",
+	"MX": "acbmx",
+	"IT": "acbit",
+	"AE": "acbae",
+	"PL": "acbpl",
+	"JP": "acbjp",
+}
+
+// defaultCountryCurrencyMap defines the default currency (i18n-prefs cookie)
+// of each marketplace.
+var defaultCountryCurrencyMap = map[string]string{
+	"BR": "BRL",
+	"TR": "TRY",
+	"ES": "EUR",
+	"FR": "EUR",
+	"IN": "INR",
+	"NL": "EUR",
+	"SA": "SAR",
+	"BE": "EUR",
+	"AU": "AUD",
+	"US": "USD",
+	"UK": "GBP",
+	"DE": "EUR",
+	"SE": "SEK",
+	"SG": "SGD",
+	"CA": "CAD",
+	"MX": "MXN",
+	"IT": "EUR",
+	"AE": "AED",
+	"PL": "PLN",
+	"JP": "JPY",
+}
+
+// defaultCountryLanguageMap defines the default language (lc-* cookie) of
+// each marketplace.
+var defaultCountryLanguageMap = map[string]string{
+	"BR": "pt_BR",
+	"TR": "tr_TR",
+	"ES": "es_ES",
+	"FR": "fr_FR",
+	"IN": "en_IN",
+	"NL": "nl_NL",
+	"SA": "ar_AE",
+	"BE": "fr_BE",
+	"AU": "en_AU",
+	"US": "en_US",
+	"UK": "en_GB",
+	"DE": "de_DE",
+	"SE": "sv_SE",
+	"SG": "en_SG",
+	"CA": "en_CA",
+	"MX": "es_MX",
+	"IT": "it_IT",
+	"AE": "en_AE",
+	"PL": "pl_PL",
+	"JP": "ja_JP",
+}
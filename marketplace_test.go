@@ -0,0 +1,70 @@
+package amazonsession
+
+import "testing"
+
+func TestLookupMarketplace(t *testing.T) {
+	marketplace, found := LookupMarketplace("US")
+	if !found {
+		t.Fatalf("Expected US marketplace")
+	}
+	if marketplace.MarketplaceID != "ATVPDKIKX0DER" || marketplace.Domain != "https://www.amazon.com" {
+		t.Fatalf("Unexpected marketplace: %+v", marketplace)
+	}
+
+	byID, found := LookupMarketplaceByID("A1PA6795UKMFR9")
+	if !found || byID.Country != "DE" {
+		t.Fatalf("Unexpected marketplace for ID: %+v", byID)
+	}
+
+	if _, found := LookupMarketplace("XX"); found {
+		t.Fatalf("Expected no marketplace for XX")
+	}
+
+	marketplaces := Marketplaces()
+	if len(marketplaces) != len(defaultCountryCodeDomainMap) {
+		t.Fatalf("Expected %v marketplaces, got %v", len(defaultCountryCodeDomainMap), len(marketplaces))
+	}
+	for _, marketplace := range marketplaces {
+		if marketplace.MarketplaceID == "" || marketplace.Currency == "" || marketplace.Language == "" {
+			t.Fatalf("Incomplete marketplace: %+v", marketplace)
+		}
+	}
+}
+
+func TestNormalizeCountry(t *testing.T) {
+	tests := map[string]string{
+		"US":    "US",
+		"us":    "US",
+		"Us":    "US",
+		" de ":  "DE",
+		"GB":    "UK",
+		"gb":    "UK",
+		"en-GB": "UK",
+		"en_gb": "UK",
+		"ja-JP": "JP",
+		"pt_BR": "BR",
+		"fr-be": "BE",
+		"zz":    "ZZ",
+		"":      "",
+
+		"https://www.amazon.co.uk/dp/X": "UK",
+		"https://www.amazon.co.jp":      "JP",
+		"amazon.com.br":                 "BR",
+		"www.amazon.de":                 "DE",
+		"AMAZON.COM":                    "US",
+	}
+	for input, want := range tests {
+		if got := normalizeCountry(input); got != want {
+			t.Errorf("normalizeCountry(%q) = %q, want %q", input, got, want)
+		}
+	}
+
+	// Unknown hosts are not resolved to a marketplace.
+	for _, input := range []string{"https://www.example.com/dp/X", "amazon.com.example.org", "shop.example"} {
+		if got := normalizeCountry(input); got != "" {
+			if _, found := LookupMarketplace(got); found {
+				t.Errorf("normalizeCountry(%q) = %q, want no marketplace", input, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package amazonsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// CountryMemoryUsage reports the memory consumed by the keys of a country,
+// in bytes, as estimated by the Redis MEMORY USAGE command.
+type CountryMemoryUsage struct {
+	Country string `json:"country"` // Country is the country code
+	Cookies int64  `json:"cookies"` // Cookies is the size of the cookie hash, including the session fields
+	Lists   int64  `json:"lists"`   // Lists is the size of the main and canary session-id lists, including the shards
+	Indexes int64  `json:"indexes"` // Indexes is the size of the label and generation index sets and their registries
+	Other   int64  `json:"other"`   // Other is the size of the affinity hash, round-robin cursor and circuit breaker
+	Total   int64  `json:"total"`   // Total is the sum of the above
+}
+
+// MemoryUsage reports the memory consumed by the cookie hash, lists and
+// indexes of a country, for capacity planning of large pools.
+func (j *AmazonSession) MemoryUsage(ctx context.Context, country string) (*CountryMemoryUsage, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+
+	indexKeys := make([]string, 0)
+	for _, index := range countryIndexes {
+		registry := fmt.Sprintf("%s:%s", country, index.registry)
+		members, err := j.readClient(ctx).SMembers(ctx, registry).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			indexKeys = append(indexKeys, fmt.Sprintf("%s:%s:%s", country, index.prefix, member))
+		}
+	}
+
+	listKeys, err := poolListKeys(ctx, j.readClient(ctx), country)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &CountryMemoryUsage{Country: country}
+	pipe := j.readClient(ctx).Pipeline()
+	type sized struct {
+		cmd   *redis.IntCmd
+		total *int64
+	}
+	var cmds []sized
+	for _, key := range append(countryKeys(country), countryStateKeys(country)...) {
+		var total *int64
+		switch key {
+		case cookiesKey(country):
+			total = &usage.Cookies
+		case sessionIdsKey(country), shardCountKey(country), canaryIdsKey(country):
+			total = &usage.Lists
+		case labelRegistryKey(country), generationRegistryKey(country), tierRegistryKey(country):
+			total = &usage.Indexes
+		default:
+			total = &usage.Other
+		}
+		cmds = append(cmds, sized{pipe.MemoryUsage(ctx, key), total})
+	}
+	for _, key := range indexKeys {
+		cmds = append(cmds, sized{pipe.MemoryUsage(ctx, key), &usage.Indexes})
+	}
+	if len(listKeys) > 1 {
+		for _, key := range listKeys {
+			cmds = append(cmds, sized{pipe.MemoryUsage(ctx, key), &usage.Lists})
+		}
+	}
+	// Missing keys are reported as redis.Nil.
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	for _, c := range cmds {
+		n, err := c.cmd.Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		*c.total += n
+		usage.Total += n
+	}
+	return usage, nil
+}
@@ -0,0 +1,127 @@
+package amazonsession
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SessionMeta holds the counters, timestamps and labels of a session without
+// its cookies.
+type SessionMeta struct {
+	Country     string            // Country represents the country code for the session
+	SessionID   string            // SessionID is the unique identifier for the session
+	UsageCount  int64             // UsageCount tracks how many times the session has been used
+	Failures    int64             // Failures is the number of consecutive failed validations
+	LastChecked time.Time         // LastChecked stores the last time the session was checked
+	CreatedAt   time.Time         // CreatedAt stores the creation time of the session
+	Labels      map[string]string // Labels are the labels of the session
+}
+
+// sessionMetaFields lists the session fields loaded into SessionMeta, in the
+// order they are returned by the Lua scripts.
+var sessionMetaFields = []interface{}{"usage-count", "last-checked", "created-at", "failures", "labels"}
+
+// GetSessionMeta returns the counters, timestamps and labels of a session,
+// without loading its cookies or counting a use, for monitoring agents
+// polling many sessions. It returns ErrSessionNotFound for sessions that are
+// not stored.
+func (j *AmazonSession) GetSessionMeta(ctx context.Context, country, sessionID string) (*SessionMeta, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	fields := make([]string, len(sessionMetaFields))
+	for i, field := range sessionMetaFields {
+		fields[i] = sessionFieldKey(sessionID, field.(string))
+	}
+	var exists *redis.BoolCmd
+	var values *redis.SliceCmd
+	_, err := j.readClient(ctx).Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		exists = pipe.HExists(ctx, cookiesKey(country), sessionID)
+		values = pipe.HMGet(ctx, cookiesKey(country), fields...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !exists.Val() {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+	meta := &SessionMeta{Country: country, SessionID: sessionID}
+	if err := meta.decode(values.Val()); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// decode sets the fields of the meta from their values, in the order of
+// sessionMetaFields.
+func (m *SessionMeta) decode(values []interface{}) error {
+	var err error
+	if m.UsageCount, err = replyInt64(values[0]); err != nil {
+		return err
+	}
+	if m.LastChecked, err = parseTimestamp(values[1]); err != nil {
+		return err
+	}
+	if m.CreatedAt, err = parseTimestamp(values[2]); err != nil {
+		return err
+	}
+	if m.Failures, err = replyInt64(values[3]); err != nil {
+		return err
+	}
+	if labels, err := replyString(values[4]); err != nil {
+		return err
+	} else if labels != "" {
+		if err := json.Unmarshal([]byte(labels), &m.Labels); err != nil {
+			return fmt.Errorf("unexpected labels returned from Lua script: %v", err)
+		}
+	}
+	return nil
+}
+
+// ListSessionMeta lists the counters and timestamps of the sessions of a
+// country with pagination, without loading cookie payloads.
+func (j *AmazonSession) ListSessionMeta(ctx context.Context, country string, pgn Pagination) ([]*SessionMeta, error) {
+	country = normalizeCountry(country)
+	return j.listSessionMeta(ctx, country, sessionIdsKey(country), pgn)
+}
+
+// listSessionMeta lists the counters and timestamps of the sessions in the
+// id list stored at idsKey.
+func (j *AmazonSession) listSessionMeta(ctx context.Context, country, idsKey string, pgn Pagination) ([]*SessionMeta, error) {
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+	if _, err := j.getCountryURL(country); err != nil {
+		return nil, err
+	}
+	// Use the same range as ListSession.
+	stop := -pgn.start() - 1
+	start := -pgn.stop() - 1
+	argv := append([]interface{}{start, stop}, sessionMetaFields...)
+	res, err := listSessionMetaCmd.Run(ctx, j.readClient(ctx), []string{idsKey, cookiesKey(country)}, argv...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis eval error: %v", err)
+	}
+	data, err := replySlice(res)
+	if err != nil {
+		return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+	}
+	metas := make([]*SessionMeta, 0)
+	// Each session is returned as session-id and fields.
+	stride := len(sessionMetaFields) + 1
+	for i := 0; i+stride <= len(data); i += stride {
+		meta := &SessionMeta{Country: country}
+		if meta.SessionID, err = replyString(data[i]); err != nil {
+			return nil, err
+		}
+		if err := meta.decode(data[i+1 : i+stride]); err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
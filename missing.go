@@ -0,0 +1,55 @@
+package amazonsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrSessionNotFound is returned, wrapped with the session-id, by GetSession,
+// GetSessionMeta, LookupSession, CloneSessionToCountry and Pin for a session
+// that is not stored, e.g. because it was deleted or cleaned up since its id
+// was read.
+var ErrSessionNotFound = errors.New("session not found")
+
+// MissingSessionMode selects how GetSession handles a session that is not
+// stored anymore, see Config.MissingSession.
+type MissingSessionMode int
+
+const (
+	// MissingSessionError returns ErrSessionNotFound.
+	MissingSessionError MissingSessionMode = iota
+
+	// MissingSessionFallback returns a random session of the same country
+	// instead, like GetRandomSession, so the caller can go on with its unit
+	// of work. Callers can tell by comparing the session-ids. The error is
+	// still returned when the country has no session available.
+	MissingSessionFallback
+)
+
+// missingFallbackKey marks the contexts of fallback selections, so a
+// session deleted meanwhile does not trigger another fallback.
+type missingFallbackKey struct{}
+
+// sessionNotFound converts the NOT FOUND error of the session scripts to
+// ErrSessionNotFound.
+func sessionNotFound(err error, sessionID string) error {
+	if strings.Contains(err.Error(), "NOT FOUND") {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+	return fmt.Errorf("redis eval error: %v", err)
+}
+
+// missingSession applies the configured MissingSessionMode to a GetSession
+// error.
+func (j *AmazonSession) missingSession(ctx context.Context, country string, err error) (*Session, error) {
+	if j.missingSessionMode != MissingSessionFallback || !errors.Is(err, ErrSessionNotFound) || ctx.Value(missingFallbackKey{}) != nil {
+		return nil, err
+	}
+	session, fallbackErr := j.GetRandomSession(context.WithValue(ctx, missingFallbackKey{}, true), country)
+	if fallbackErr != nil {
+		return nil, fmt.Errorf("%w, no fallback session: %v", err, fallbackErr)
+	}
+	return session, nil
+}
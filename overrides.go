@@ -0,0 +1,102 @@
+package amazonsession
+
+import (
+	"fmt"
+	"time"
+)
+
+// CountryOverride overrides global parameters for one country, see
+// Config.CountryOverrides. Zero values keep the global parameters.
+type CountryOverride struct {
+	// CleanupMaxIdle replaces the timeDiffThreshold of CleanupSessions:
+	// sessions not checked within it are removed.
+	CleanupMaxIdle time.Duration
+
+	// CleanupMaxUsage replaces the usageCountThreshold of CleanupSessions:
+	// sessions used at least that many times are removed.
+	CleanupMaxUsage int64
+
+	// BreakerCooldown replaces CircuitBreakerConfig.Cooldown. It has no
+	// effect without Config.CircuitBreaker.
+	BreakerCooldown time.Duration
+
+	// RequestBudget replaces RequestBudget, and RequestBudgetPerCountry.
+	RequestBudget int64
+
+	// ProbeRPS replaces ProbeRPS, and ProbeRPSPerCountry.
+	ProbeRPS float64
+
+	// MinPoolSize replaces WebhookConfig.PoolLowThreshold: a pool-low event
+	// is sent when the pool gets smaller. It has no effect without
+	// Config.Webhook.
+	MinPoolSize int64
+}
+
+// validateCountryOverrides checks the overrides of a Config, normalizes
+// their country codes and merges the quotas into RequestBudgetPerCountry
+// and ProbeRPSPerCountry, which are copied so the caller's maps are left
+// untouched.
+func (cfg *Config) validateCountryOverrides() error {
+	if len(cfg.CountryOverrides) == 0 {
+		return nil
+	}
+	overrides := make(map[string]CountryOverride, len(cfg.CountryOverrides))
+	budgets := make(map[string]int64, len(cfg.RequestBudgetPerCountry)+len(cfg.CountryOverrides))
+	for country, budget := range cfg.RequestBudgetPerCountry {
+		budgets[normalizeCountry(country)] = budget
+	}
+	rates := make(map[string]float64, len(cfg.ProbeRPSPerCountry)+len(cfg.CountryOverrides))
+	for country, rate := range cfg.ProbeRPSPerCountry {
+		rates[normalizeCountry(country)] = rate
+	}
+	for country, o := range cfg.CountryOverrides {
+		if o.CleanupMaxIdle < 0 || o.CleanupMaxUsage < 0 || o.BreakerCooldown < 0 || o.RequestBudget < 0 || o.ProbeRPS < 0 || o.MinPoolSize < 0 {
+			return fmt.Errorf("invalid config: overrides must not be negative for country: %s", country)
+		}
+		country = normalizeCountry(country)
+		overrides[country] = o
+		if o.RequestBudget > 0 {
+			budgets[country] = o.RequestBudget
+		}
+		if o.ProbeRPS > 0 {
+			rates[country] = o.ProbeRPS
+		}
+	}
+	cfg.CountryOverrides = overrides
+	cfg.RequestBudgetPerCountry = budgets
+	cfg.ProbeRPSPerCountry = rates
+	return nil
+}
+
+// cleanupThresholds returns the cleanup thresholds of a country, in seconds
+// and uses.
+func (j *AmazonSession) cleanupThresholds(country string, maxIdle, maxUsage int64) (int64, int64) {
+	o := j.countryOverrides[country]
+	if o.CleanupMaxIdle > 0 {
+		maxIdle = int64(o.CleanupMaxIdle / time.Second)
+	}
+	if o.CleanupMaxUsage > 0 {
+		maxUsage = o.CleanupMaxUsage
+	}
+	return maxIdle, maxUsage
+}
+
+// breakerCooldown returns the circuit breaker cooldown of a country.
+func (j *AmazonSession) breakerCooldown(country string) time.Duration {
+	if cooldown := j.countryOverrides[country].BreakerCooldown; cooldown > 0 {
+		return cooldown
+	}
+	return j.circuitBreaker.Cooldown
+}
+
+// poolLowThreshold returns the pool size under which a pool-low event is
+// sent for a country, zero when pool-low events are disabled.
+func (j *AmazonSession) poolLowThreshold(country string) int64 {
+	if j.webhook == nil {
+		return 0
+	}
+	if size := j.countryOverrides[country].MinPoolSize; size > 0 {
+		return size
+	}
+	return j.webhook.cfg.PoolLowThreshold
+}
@@ -0,0 +1,73 @@
+package amazonsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+func pinsKey(country string) string {
+	return fmt.Sprintf("%s:pins", country)
+}
+
+// Pin reserves a session for a multi-request operation, such as a
+// pagination crawl or a checkout flow, for at most ttl. A pinned session is
+// taken out of the pool, so it is neither handed to other callers nor
+// removed by CleanupSessions, while GetSession still loads it. Pin again to
+// extend the reservation; Unpin or the expiry of ttl puts it back. The
+// session is looked up in the session index and pinned in every country it
+// is stored in.
+func (j *AmazonSession) Pin(ctx context.Context, sessionID string, ttl time.Duration) error {
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	if ttl <= 0 {
+		return errors.New("pin ttl must be positive")
+	}
+	countries, err := j.sessionCountries(WithReadPreference(ctx, ReadPrimary), sessionID)
+	if err != nil {
+		return err
+	}
+	if len(countries) == 0 {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+	expiresAt := j.clock.Now().Add(ttl).Unix()
+	for _, country := range countries {
+		if err := j.checkoutGate(ctx, country); err != nil {
+			return err
+		}
+		if err := pinSessionCmd.Run(ctx, j.client, []string{country}, sessionID, expiresAt).Err(); err != nil {
+			return fmt.Errorf("redis eval error: %v", err)
+		}
+	}
+	return nil
+}
+
+// Unpin ends the reservation of a session taken with Pin and puts it back
+// into the pool. Unpinning a session that is not pinned does nothing.
+func (j *AmazonSession) Unpin(ctx context.Context, sessionID string) error {
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	countries, err := j.sessionCountries(WithReadPreference(ctx, ReadPrimary), sessionID)
+	if err != nil {
+		return err
+	}
+	for _, country := range countries {
+		if err := restorePinsCmd.Run(ctx, j.client, []string{country}, j.clock.Now().Unix(), sessionID).Err(); err != nil {
+			return fmt.Errorf("redis eval error: %v", err)
+		}
+		if err := j.checkDrained(ctx, country); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreExpiredPins puts the sessions of a country whose pin expired back
+// into the pool.
+func (j *AmazonSession) restoreExpiredPins(ctx context.Context, country string) error {
+	if err := restorePinsCmd.Run(ctx, j.client, []string{country}, j.clock.Now().Unix()).Err(); err != nil {
+		return fmt.Errorf("redis eval error: %v", err)
+	}
+	return nil
+}
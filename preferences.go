@@ -0,0 +1,44 @@
+package amazonsession
+
+import (
+	"context"
+	"fmt"
+)
+
+// EnsurePreferences sets the i18n-prefs and lc-* cookies of the session to
+// its Currency and Language, falling back to the marketplace defaults when
+// they are empty, and stores the session in Redis.
+func (j *AmazonSession) EnsurePreferences(ctx context.Context, session *Session) error {
+	session.mu.Lock()
+	err := j.setPreferenceCookies(session)
+	session.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return j.PushSession(ctx, session)
+}
+
+// setPreferenceCookies sets the preference cookies of EnsurePreferences. The
+// caller must hold session.mu.
+func (j *AmazonSession) setPreferenceCookies(session *Session) error {
+	session.Country = normalizeCountry(session.Country)
+	countryURL, err := j.getCountryURL(session.Country)
+	if err != nil {
+		return err
+	}
+
+	if session.Currency == "" {
+		session.Currency = defaultCountryCurrencyMap[session.Country]
+	}
+	if session.Language == "" {
+		session.Language = defaultCountryLanguageMap[session.Country]
+	}
+	if session.Currency == "" || session.Language == "" {
+		return fmt.Errorf("preferences not found for country: %s", session.Country)
+	}
+
+	expires := j.clock.Now().AddDate(1, 0, 0)
+	session.setCookie(countryURL, "i18n-prefs", session.Currency, expires)
+	session.setCookie(countryURL, "lc-"+defaultCountryCookieSuffixMap[session.Country], session.Language, expires)
+	return nil
+}
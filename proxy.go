@@ -0,0 +1,52 @@
+package amazonsession
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// HashExitIP returns the hash stored as Session.ExitIPHash for an exit IP,
+// so sessions can be grouped by origin without storing the IP itself.
+func HashExitIP(ip string) string {
+	sum := sha256.Sum256([]byte(ip))
+	return hex.EncodeToString(sum[:8])
+}
+
+// checkProxyGeo checks the exit country of a proxy against the marketplace
+// country of the session, when Config.ProxyExitCountry is set.
+func (j *AmazonSession) checkProxyGeo(ctx context.Context, session *Session, proxy string) error {
+	if j.proxyExitCountry == nil {
+		return nil
+	}
+	exitCountry, err := j.proxyExitCountry(ctx, proxy)
+	if err != nil {
+		return fmt.Errorf("error resolving proxy exit country: %v", err)
+	}
+	if exitCountry = normalizeCountry(exitCountry); exitCountry == session.Country {
+		return nil
+	}
+	if j.onProxyGeoMismatch != nil {
+		j.onProxyGeoMismatch(session, exitCountry)
+		return nil
+	}
+	return fmt.Errorf("proxy exit country %s does not match session country %s", exitCountry, session.Country)
+}
+
+// BindProxy binds a proxy to a stored session after checking its exit
+// country, see Config.ProxyExitCountry.
+func (j *AmazonSession) BindProxy(ctx context.Context, country, sessionID, proxy string) error {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	session := &Session{Country: country, SessionID: sessionID, Proxy: proxy}
+	if err := j.checkProxyGeo(ctx, session, proxy); err != nil {
+		return err
+	}
+	err := setSessionFieldCmd.Run(ctx, j.client, []string{cookiesKey(country)}, sessionID, "proxy", proxy).Err()
+	if err != nil {
+		return fmt.Errorf("redis eval error: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package amazonsession
+
+import (
+	"context"
+	"fmt"
+)
+
+// DecodeMode selects how stored sessions that cannot be decoded are handled
+// by the list and get paths, see Config.DecodeMode and WithDecodeMode.
+type DecodeMode int
+
+const (
+	// DecodeSkip skips undecodable sessions in listings and reports them to
+	// Hooks.OnCorruptSession. It is the default.
+	DecodeSkip DecodeMode = iota
+	// DecodeStrict fails listings on the first undecodable session, e.g.
+	// for admin tools that must see the whole pool.
+	DecodeStrict
+	// DecodeRepair is like DecodeSkip and also moves undecodable sessions
+	// out of the pool to the repair queue of their country, see
+	// ListQuarantined.
+	DecodeRepair
+)
+
+type decodeModeKey struct{}
+
+// WithDecodeMode returns a context that makes the AmazonSession methods
+// called with it handle undecodable sessions according to mode instead of
+// Config.DecodeMode, so consumers sharing an AmazonSession can differ.
+func WithDecodeMode(ctx context.Context, mode DecodeMode) context.Context {
+	return context.WithValue(ctx, decodeModeKey{}, mode)
+}
+
+// decodeMode returns the DecodeMode to use with ctx.
+func (j *AmazonSession) decodeMode(ctx context.Context) DecodeMode {
+	if mode, ok := ctx.Value(decodeModeKey{}).(DecodeMode); ok {
+		return mode
+	}
+	return j.defaultDecodeMode
+}
+
+func quarantineKey(country string) string {
+	return fmt.Sprintf("%s:quarantine", country)
+}
+
+// decodeFailed handles a stored session that failed to decode with err
+// according to the DecodeMode. It returns the error the caller must fail
+// with, or nil when the session is to be skipped. Single gets fail with err
+// whatever the mode.
+func (j *AmazonSession) decodeFailed(ctx context.Context, country, sessionID string, err error) error {
+	mode := j.decodeMode(ctx)
+	if mode == DecodeStrict {
+		return err
+	}
+	if j.hooks.OnCorruptSession != nil {
+		j.hooks.OnCorruptSession(ctx, country, sessionID, err)
+	}
+	if mode == DecodeRepair {
+		args := append([]interface{}{sessionID}, sessionFieldArgs()...)
+		res, qErr := quarantineSessionCmd.Run(ctx, j.client, []string{country}, args...).Result()
+		if qErr != nil {
+			return fmt.Errorf("redis eval error: %v", qErr)
+		}
+		if moved, _ := replyInt64(res); moved == 1 && j.webhook != nil {
+			j.webhook.sessionQuarantined(country, sessionID, err)
+			j.checkPoolLow(ctx, country)
+		}
+	}
+	return nil
+}
+
+// ListQuarantined returns the raw cookie data of the sessions moved to the
+// repair queue of a country by session-id, see DecodeRepair.
+func (j *AmazonSession) ListQuarantined(ctx context.Context, country string) (map[string]string, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.client.HGetAll(ctx, quarantineKey(country)).Result()
+}
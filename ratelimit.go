@@ -0,0 +1,100 @@
+package amazonsession
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket refilled at rate tokens per second, holding
+// at most burst tokens. Callers reserve a token and wait until it is due, so
+// concurrent callers are spaced evenly.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until a token is available or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Give the reserved token back.
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// probeLimiter holds the per-marketplace token buckets shared by all
+// outbound requests to Amazon made by the package.
+type probeLimiter struct {
+	mu         sync.Mutex
+	rate       float64
+	perCountry map[string]float64
+	buckets    map[string]*tokenBucket
+}
+
+func newProbeLimiter(rate float64, perCountry map[string]float64) *probeLimiter {
+	if rate <= 0 && len(perCountry) == 0 {
+		return nil
+	}
+	normalized := make(map[string]float64, len(perCountry))
+	for country, r := range perCountry {
+		normalized[normalizeCountry(country)] = r
+	}
+	return &probeLimiter{rate: rate, perCountry: normalized, buckets: make(map[string]*tokenBucket)}
+}
+
+// wait blocks until a request to the marketplace of country may be sent.
+func (l *probeLimiter) wait(ctx context.Context, country string) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	bucket, found := l.buckets[country]
+	if !found {
+		rate := l.rate
+		if r, ok := l.perCountry[country]; ok {
+			rate = r
+		}
+		if rate > 0 {
+			bucket = newTokenBucket(rate)
+		}
+		l.buckets[country] = bucket
+	}
+	l.mu.Unlock()
+	if bucket == nil {
+		return nil
+	}
+	return bucket.wait(ctx)
+}
@@ -0,0 +1,40 @@
+package amazonsession
+
+import "net/http"
+
+// parseSetCookies parses raw Set-Cookie header values the way net/http does
+// for responses, skipping values it cannot parse.
+func parseSetCookies(raw []string) []*http.Cookie {
+	resp := &http.Response{Header: http.Header{"Set-Cookie": raw}}
+	return resp.Cookies()
+}
+
+// filterRawSetCookies drops the Set-Cookie values that cannot be parsed and,
+// for anonymous sessions, the ones setting auth cookies.
+func filterRawSetCookies(raw []string, keepAuth bool) []string {
+	filtered := make([]string, 0, len(raw))
+	for _, value := range raw {
+		cookies := parseSetCookies([]string{value})
+		if len(cookies) == 0 || (!keepAuth && isAuthCookie(cookies[0].Name)) {
+			continue
+		}
+		filtered = append(filtered, value)
+	}
+	return filtered
+}
+
+// mergeRawSetCookies returns the cookies rehydrated from the raw Set-Cookie
+// values, followed by the parsed cookies not set by any of them.
+func mergeRawSetCookies(cookies []*http.Cookie, raw []string) []*http.Cookie {
+	merged := parseSetCookies(raw)
+	seen := make(map[string]bool, len(merged))
+	for _, cookie := range merged {
+		seen[cookie.Name] = true
+	}
+	for _, cookie := range cookies {
+		if !seen[cookie.Name] {
+			merged = append(merged, cookie)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,39 @@
+package amazonsession
+
+import (
+	"context"
+	"math/rand"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ReadPreference selects the Redis server read-only operations are sent to.
+type ReadPreference int
+
+const (
+	// ReadPrimary reads from the primary, so reads see all previous writes.
+	// It is the default.
+	ReadPrimary ReadPreference = iota
+	// ReadReplica reads from one of Config.ReplicaAddrs, which may lag
+	// behind the primary. Without replicas it reads from the primary.
+	ReadReplica
+)
+
+type readPreferenceKey struct{}
+
+// WithReadPreference returns a context that makes the read-only AmazonSession
+// methods called with it (ListSession, GetAllSessions, GetSummary, ...) read
+// according to pref. Methods changing sessions, such as GetSession or
+// PopSession, always use the primary.
+func WithReadPreference(ctx context.Context, pref ReadPreference) context.Context {
+	return context.WithValue(ctx, readPreferenceKey{}, pref)
+}
+
+// readClient returns the client read-only operations use with ctx.
+func (j *AmazonSession) readClient(ctx context.Context) redis.UniversalClient {
+	pref, _ := ctx.Value(readPreferenceKey{}).(ReadPreference)
+	if pref != ReadReplica || len(j.replicas) == 0 {
+		return j.client
+	}
+	return j.replicas[rand.Intn(len(j.replicas))]
+}
@@ -0,0 +1,46 @@
+package amazonsession
+
+import (
+	"context"
+	"fmt"
+)
+
+// RepairReport describes the inconsistencies fixed by RepairPool.
+type RepairReport struct {
+	Country      string   // Country is the country code of the repaired pool
+	RemovedIDs   []string // RemovedIDs are the session-ids listed in the pool without cookie data, now removed
+	RestoredIDs  []string // RestoredIDs are the sessions with cookie data missing from the pool, now listed again
+	OrphanFields int64    // OrphanFields is the number of deleted field entries of sessions without cookie data
+}
+
+// RepairPool fixes the inconsistencies between the session-id lists and the
+// cookie hash of a country left behind by interrupted operations: listed
+// session-ids without cookie data are removed, sessions with cookie data but
+// missing from the lists are appended again and re-indexed, and fields of
+// sessions without cookie data are deleted. Pinned sessions and sessions
+// checked out with PopSession are not missing from the lists and stay out of
+// them. The repair runs in one script.
+func (j *AmazonSession) RepairPool(ctx context.Context, country string) (*RepairReport, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+	res, err := repairPoolCmd.Run(ctx, j.client, []string{country}, sessionFieldArgs()...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis eval error: %v", err)
+	}
+	data, err := replySlice(res)
+	if err != nil || len(data) != 3 {
+		return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+	}
+	report := &RepairReport{Country: country}
+	if report.RemovedIDs, err = replyStrings(data[0]); err != nil {
+		return nil, err
+	}
+	if report.RestoredIDs, err = replyStrings(data[1]); err != nil {
+		return nil, err
+	}
+	if report.OrphanFields, err = replyInt64(data[2]); err != nil {
+		return nil, fmt.Errorf("unexpected value returned from Lua script")
+	}
+	return report, nil
+}
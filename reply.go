@@ -0,0 +1,68 @@
+package amazonsession
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// The helpers below decode the values returned by the Lua scripts with
+// direct type switches on the go-redis reply types.
+
+func replySlice(v interface{}) ([]interface{}, error) {
+	switch v := v.(type) {
+	case []interface{}:
+		return v, nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", v)
+}
+
+func replyString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("unexpected value returned from Lua script")
+}
+
+func replyInt64(v interface{}) (int64, error) {
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case string:
+		if v == "" {
+			return 0, nil
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected value returned from Lua script")
+		}
+		return n, nil
+	case nil:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("unexpected value returned from Lua script")
+}
+
+func replyStrings(v interface{}) ([]string, error) {
+	items, err := replySlice(v)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		s, err := replyString(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
@@ -0,0 +1,125 @@
+package amazonsession
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func benchmarkReply() []interface{} {
+	reply := []interface{}{
+		`{"session-id":"123-1234567-1234567","session-token":"token","ubid-main":"123-1234567-1234567","i18n-prefs":"USD"}`,
+		int64(42),
+		"1700000000",
+		"1690000000",
+	}
+	for len(reply) < len(sessionFields)+1 {
+		reply = append(reply, nil)
+	}
+	return reply
+}
+
+func BenchmarkNewSessionFromReply(b *testing.B) {
+	countryURL, _ := url.Parse(defaultCountryCodeDomainMap["US"])
+	reply := benchmarkReply()
+	sessionManager := &AmazonSession{clock: systemClock{}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := sessionManager.newSessionFromReply(countryURL, "US", "123-1234567-1234567", reply, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSessionFields(b *testing.B) {
+	reply := benchmarkReply()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		session := &Session{}
+		for k, field := range sessionFields {
+			if err := session.setField(field, reply[k+1]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestReplyDecoding(t *testing.T) {
+	if n, err := replyInt64("42"); err != nil || n != 42 {
+		t.Fatalf("replyInt64(\"42\") = %v, %v", n, err)
+	}
+	if n, err := replyInt64(nil); err != nil || n != 0 {
+		t.Fatalf("replyInt64(nil) = %v, %v", n, err)
+	}
+	if _, err := replyInt64("abc"); err == nil {
+		t.Fatalf("Expected error for non-numeric value")
+	}
+	if s, err := replyString(int64(7)); err != nil || s != "7" {
+		t.Fatalf("replyString(7) = %v, %v", s, err)
+	}
+	if values, err := replyStrings([]interface{}{"a", int64(1)}); err != nil || len(values) != 2 || values[1] != "1" {
+		t.Fatalf("replyStrings = %v, %v", values, err)
+	}
+	if _, err := replySlice("value"); err == nil {
+		t.Fatalf("Expected error for non-slice value")
+	}
+}
+
+// fuzzFieldSeparator separates the stored fields in the fuzz inputs of
+// FuzzNewSessionFromReply.
+const fuzzFieldSeparator = "\x1f"
+
+func FuzzNewSessionFromReply(f *testing.F) {
+	reply := benchmarkReply()
+	fields := make([]string, len(sessionFields))
+	for i := range fields {
+		fields[i], _ = replyString(reply[i+1])
+	}
+	f.Add(reply[0].(string), strings.Join(fields, fuzzFieldSeparator))
+	f.Add(`{"session-id":"123-1234567-1234567","session-id-time":"2082787201l"}`, "1\x1f2024-01-01T00:00:00Z\x1f\x1f\x1f\x1f\x1f\x1f{\"a\":\"b\"}")
+	f.Add(`{}`, "")
+	f.Add(`[]`, "x\x1fy\x1fz")
+	f.Add(`null`, strings.Repeat(`{"t":1}`+fuzzFieldSeparator, len(sessionFields)))
+
+	countryURL, _ := url.Parse(defaultCountryCodeDomainMap["US"])
+	sessionManager := &AmazonSession{clock: systemClock{}, failureHalfLife: time.Hour}
+	f.Fuzz(func(t *testing.T, cookies, fields string) {
+		values := make([]interface{}, len(sessionFields)+1)
+		values[0] = cookies
+		for i, field := range strings.Split(fields, fuzzFieldSeparator) {
+			if i >= len(sessionFields) {
+				break
+			}
+			values[i+1] = field
+		}
+		// Corrupted contents must fail with an error, not panic.
+		session, err := sessionManager.newSessionFromReply(countryURL, "US", "123-1234567-1234567", values, true)
+		if err != nil {
+			return
+		}
+		if _, err := session.MarshalJSON(); err != nil {
+			t.Fatalf("MarshalJSON error for a decoded session: %v", err)
+		}
+		session.CookieHeader()
+	})
+}
+
+func FuzzReplyDecoding(f *testing.F) {
+	f.Add("42")
+	f.Add("")
+	f.Add("-9223372036854775808")
+	f.Add("1700000000.5")
+	f.Add("2024-01-01T00:00:00Z")
+	f.Add(`[{"t":1700000000,"ok":true,"ms":12,"status":200}]`)
+	f.Fuzz(func(t *testing.T, value string) {
+		replyInt64(value)
+		replyString(value)
+		replySlice(value)
+		replyStrings([]interface{}{value, nil, int64(len(value))})
+		parseTimestamp(value)
+		parseSessionIDTime(value)
+		decodeCheckHistory(value)
+		parseSetCookies([]string{value})
+	})
+}
@@ -0,0 +1,133 @@
+package amazonsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RenameSession moves a stored session of a country to a new session-id,
+// keeping its usage stats, fields, position in the pool and indexes, in a
+// single atomic script. If newID is already stored, the session stored as
+// oldID is removed instead. It reports whether oldID was stored.
+//
+// PushSession calls it automatically when the session-id cookie of a loaded
+// session was rotated by Amazon, so the old id is not left behind.
+func (j *AmazonSession) RenameSession(ctx context.Context, country, oldID, newID string) (bool, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.renameSession(ctx, country, oldID, newID)
+}
+
+func (j *AmazonSession) renameSession(ctx context.Context, country, oldID, newID string) (bool, error) {
+	if oldID == "" || newID == "" {
+		return false, fmt.Errorf("session-id not found in session")
+	}
+	args := append([]interface{}{oldID, newID}, sessionFieldArgs()...)
+	res, err := renameSessionCmd.Run(ctx, j.client, []string{country}, args...).Result()
+	if err != nil {
+		return false, fmt.Errorf("redis eval error: %v", err)
+	}
+	renamed, err := replyInt64(res)
+	if err != nil {
+		return false, fmt.Errorf("cast error: Lua script returned unexpected value: %v", err)
+	}
+	return renamed == 1, nil
+}
+
+// maxRotationAttempts bounds the sessions rotated in a row by a checkout.
+const maxRotationAttempts = 5
+
+// SessionProvider creates new sessions for a country, e.g. by harvesting
+// them from Amazon, to replace the sessions rotated by RotationPolicy.
+type SessionProvider interface {
+	NewSession(ctx context.Context, country string) (*Session, error)
+}
+
+// RotationPolicy describes when a session must be rotated. A session is due
+// as soon as one of the set conditions holds; zero values are ignored.
+type RotationPolicy struct {
+	// MaxRequests rotates sessions used more than MaxRequests times.
+	MaxRequests int64
+
+	// MaxAge rotates sessions created longer than MaxAge ago.
+	MaxAge time.Duration
+
+	// RotateOnFailure rotates sessions with a failure recorded by
+	// RecordFailure, e.g. after the first captcha.
+	RotateOnFailure bool
+
+	// Schedule rotates sessions created before the start of the current
+	// period, the current time truncated to Schedule, e.g. 24 hours rotates
+	// all sessions daily at midnight UTC.
+	Schedule time.Duration
+}
+
+// Due reports whether the session must be rotated at the given time.
+func (p *RotationPolicy) Due(s *Session, now time.Time) bool {
+	if p.MaxRequests > 0 && s.UsageCount > p.MaxRequests {
+		return true
+	}
+	if p.MaxAge > 0 && !s.CreatedAt.IsZero() && now.Sub(s.CreatedAt) > p.MaxAge {
+		return true
+	}
+	if p.RotateOnFailure && s.Failures > 0 {
+		return true
+	}
+	if p.Schedule > 0 && !s.CreatedAt.IsZero() && s.CreatedAt.Before(now.Truncate(p.Schedule)) {
+		return true
+	}
+	return false
+}
+
+// checkout returns the session loaded by next, after passing the checkout
+// gate (expired pins, freeze and drain modes), and rotates it, see rotate.
+func (j *AmazonSession) checkout(ctx context.Context, country string, next func() (*Session, error)) (*Session, error) {
+	if err := j.checkoutGate(ctx, country); err != nil {
+		return nil, err
+	}
+	session, err := next()
+	if err != nil {
+		return nil, err
+	}
+	return j.rotate(ctx, session, next)
+}
+
+// rotate returns the session checked out by next, or, when it is due
+// according to the rotation policy, deletes it, pushes a new one from the
+// session provider if there is one, and checks out the next session. A
+// popped session is deleted with its borrow, so the next one is popped as
+// well.
+func (j *AmazonSession) rotate(ctx context.Context, session *Session, next func() (*Session, error)) (*Session, error) {
+	if j.rotationPolicy == nil {
+		return session, nil
+	}
+	for attempt := 1; j.rotationPolicy.Due(session, j.clock.Now()); attempt++ {
+		if _, err := j.DeleteSession(ctx, session.Country, session.SessionID); err != nil {
+			return nil, err
+		}
+		if j.sessionProvider != nil {
+			replacement, err := j.sessionProvider.NewSession(ctx, session.Country)
+			if err != nil {
+				return nil, fmt.Errorf("session provider error: %v", err)
+			}
+			if replacement == nil {
+				return nil, errors.New("session provider returned no session")
+			}
+			replacement.Country = session.Country
+			if err := j.PushSession(ctx, replacement); err != nil {
+				return nil, err
+			}
+		}
+		if attempt == maxRotationAttempts {
+			return nil, errors.New("no sessions available for the specified country")
+		}
+		var err error
+		if session, err = next(); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
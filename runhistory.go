@@ -0,0 +1,116 @@
+package amazonsession
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultRunHistoryRetention is how long sweep runs are kept when
+// Config.RunHistoryRetention is not set.
+const defaultRunHistoryRetention = 7 * 24 * time.Hour
+
+// runHistoryKey is the sorted set of the recorded sweep runs, scored by
+// start time. It is not tied to a country.
+const runHistoryKey = "sweep-runs"
+
+// SweepRun is one run of a background sweep, see LastRuns.
+type SweepRun struct {
+	Name     string        `json:"name"`              // Name is the sweep, "cleanup" for CleanupSessions
+	Instance string        `json:"instance"`          // Instance is the process that ran the sweep, see Config.InstanceName
+	Start    time.Time     `json:"start"`             // Start is when the run started
+	End      time.Time     `json:"end"`               // End is when the run ended
+	Duration time.Duration `json:"duration"`          // Duration is the duration of the run
+	Error    string        `json:"error,omitempty"`   // Error is the error the run ended with, empty on success
+	Removed  int64         `json:"removed,omitempty"` // Removed is the number of sessions removed by the run
+}
+
+// OK reports whether the run succeeded.
+func (r *SweepRun) OK() bool {
+	return r.Error == ""
+}
+
+// defaultInstanceName identifies the process by host name and process id.
+func defaultInstanceName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return host + ":" + strconv.Itoa(os.Getpid())
+}
+
+// RecordRun records a run of a sweep, e.g. of a session validator run on a
+// schedule, in the run history shared by all processes. Runs older than
+// Config.RunHistoryRetention are dropped. An empty Instance is set to
+// Config.InstanceName and a zero Duration is computed from Start and End.
+// CleanupSessions records its runs by itself.
+func (j *AmazonSession) RecordRun(ctx context.Context, run SweepRun) error {
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	if run.Name == "" {
+		return fmt.Errorf("sweep name must not be empty")
+	}
+	if run.Instance == "" {
+		run.Instance = j.instanceName
+	}
+	if run.Duration == 0 {
+		run.Duration = run.End.Sub(run.Start)
+	}
+	member, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	cutoff := j.clock.Now().Add(-j.runRetention).UnixMilli()
+	pipe := j.client.TxPipeline()
+	pipe.ZAdd(ctx, runHistoryKey, redis.Z{Score: float64(run.Start.UnixMilli()), Member: member})
+	pipe.ZRemRangeByScore(ctx, runHistoryKey, "-inf", "("+strconv.FormatInt(cutoff, 10))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record sweep run: %v", err)
+	}
+	return nil
+}
+
+// LastRuns returns the sweep runs recorded by all processes within
+// Config.RunHistoryRetention, newest first, so operators can verify that
+// the sweeps ran on schedule across the fleet.
+func (j *AmazonSession) LastRuns(ctx context.Context) ([]*SweepRun, error) {
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	cutoff := j.clock.Now().Add(-j.runRetention).UnixMilli()
+	members, err := j.readClient(ctx).ZRevRangeByScore(ctx, runHistoryKey, &redis.ZRangeBy{
+		Min: strconv.FormatInt(cutoff, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error getting sweep runs: %v", err)
+	}
+	runs := make([]*SweepRun, 0, len(members))
+	for _, member := range members {
+		run := &SweepRun{}
+		if err := json.Unmarshal([]byte(member), run); err != nil {
+			return nil, fmt.Errorf("invalid sweep run: %v", err)
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// recordCleanupRun records a run of CleanupSessions. Failing to record it
+// does not fail the cleanup.
+func (j *AmazonSession) recordCleanupRun(ctx context.Context, start time.Time, result *CleanupResult, err error) {
+	run := SweepRun{Name: "cleanup", Start: start, End: j.clock.Now()}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	if result != nil {
+		for _, n := range result.Removed {
+			run.Removed += n
+		}
+	}
+	_ = j.RecordRun(context.WithoutCancel(ctx), run)
+}
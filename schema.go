@@ -0,0 +1,150 @@
+package amazonsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SchemaVersion is the version of the Redis layout written by this version
+// of the package. Version 1 is the layout of the pools created before the
+// schema was versioned, which may lack the session, last-checked and usage
+// indexes; version 2 has them; version 3 adds the tier indexes.
+const SchemaVersion = 3
+
+// schemaVersionKey holds the schema version of the stored pools. It is not
+// tied to a country. ClearAllCookies deletes it with the pools, the empty
+// database is marked again by the next NewAmazonSession.
+const schemaVersionKey = "schema-version"
+
+// ErrSchemaTooNew is returned by NewAmazonSession when the stored pools were
+// written by a newer version of the package, whose layout this version
+// could misread.
+var ErrSchemaTooNew = errors.New("stored schema is newer than supported")
+
+// ErrSchemaOutdated is returned by NewAmazonSession for pools of an older
+// schema in SchemaMigrationRefuse mode, see MigrateSchema.
+var ErrSchemaOutdated = errors.New("stored schema is outdated")
+
+// SchemaMigrationMode selects how NewAmazonSession handles pools of an older
+// schema, see Config.SchemaMigration. Pools of a newer schema are always
+// refused with ErrSchemaTooNew.
+type SchemaMigrationMode int
+
+const (
+	// SchemaMigrationManual uses the pools as they are, like the versions
+	// before the schema was versioned: MigrateSchema upgrades them.
+	SchemaMigrationManual SchemaMigrationMode = iota
+
+	// SchemaMigrationAuto upgrades the pools while connecting, see
+	// MigrateSchema.
+	SchemaMigrationAuto
+
+	// SchemaMigrationRefuse returns ErrSchemaOutdated.
+	SchemaMigrationRefuse
+)
+
+// schemaMigrations upgrade the pools from version i+1 to version i+2.
+var schemaMigrations = []func(ctx context.Context, j *AmazonSession) error{
+	func(ctx context.Context, j *AmazonSession) error {
+		_, err := j.RebuildIndexes(ctx)
+		return err
+	},
+	// Version 3 backfills the tier indexes.
+	func(ctx context.Context, j *AmazonSession) error {
+		_, err := j.RebuildIndexes(ctx)
+		return err
+	},
+}
+
+// storedSchemaVersion returns the schema version of the stored pools: 0 for
+// an empty database, 1 for pools created before the schema was versioned.
+func (j *AmazonSession) storedSchemaVersion(ctx context.Context) (int, error) {
+	version, err := j.client.Get(ctx, schemaVersionKey).Int()
+	if err == nil {
+		return version, nil
+	}
+	if err != redis.Nil {
+		return 0, fmt.Errorf("error getting schema version: %v", err)
+	}
+	countries, err := j.storedCountries(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(countries) == 0 {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// setSchemaVersion raises the stored schema version.
+func (j *AmazonSession) setSchemaVersion(ctx context.Context, version int) error {
+	if err := setSchemaVersionCmd.Run(ctx, j.client, []string{schemaVersionKey}, version).Err(); err != nil {
+		return fmt.Errorf("redis eval error: %v", err)
+	}
+	return nil
+}
+
+// checkSchema negotiates the schema version while connecting: an empty
+// database is marked with SchemaVersion, newer pools are refused and older
+// ones are handled according to Config.SchemaMigration.
+func (j *AmazonSession) checkSchema(ctx context.Context, mode SchemaMigrationMode) error {
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+	version, err := j.storedSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case version == 0:
+		return j.setSchemaVersion(ctx, SchemaVersion)
+	case version > SchemaVersion:
+		return fmt.Errorf("%w: version %d, this package supports up to %d", ErrSchemaTooNew, version, SchemaVersion)
+	case version == SchemaVersion || mode == SchemaMigrationManual:
+		return nil
+	case mode == SchemaMigrationRefuse:
+		return fmt.Errorf("%w: version %d, this package writes %d", ErrSchemaOutdated, version, SchemaVersion)
+	}
+	return j.migrateSchema(ctx, version)
+}
+
+// StoredSchemaVersion returns the schema version of the stored pools, 0 for
+// an empty database.
+func (j *AmazonSession) StoredSchemaVersion(ctx context.Context) (int, error) {
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.storedSchemaVersion(ctx)
+}
+
+// MigrateSchema upgrades the stored pools to SchemaVersion, e.g. by
+// backfilling the indexes with RebuildIndexes, and records the new version.
+// The migrations are safe to run on a live pool and to run again.
+func (j *AmazonSession) MigrateSchema(ctx context.Context) error {
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+	version, err := j.storedSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("%w: version %d, this package supports up to %d", ErrSchemaTooNew, version, SchemaVersion)
+	}
+	if version == 0 {
+		return j.setSchemaVersion(ctx, SchemaVersion)
+	}
+	return j.migrateSchema(ctx, version)
+}
+
+func (j *AmazonSession) migrateSchema(ctx context.Context, version int) error {
+	for ; version < SchemaVersion; version++ {
+		if err := schemaMigrations[version-1](ctx, j); err != nil {
+			return fmt.Errorf("schema migration to version %d failed: %v", version+1, err)
+		}
+		if err := j.setSchemaVersion(ctx, version+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,89 +1,1650 @@
 package amazonsession
 
-import "github.com/redis/go-redis/v9"
+import (
+	"math/rand"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// scriptRand returns a random number for the scripts picking a session. Lua
+// reads numbers as doubles, so it stays below 2^53 to keep its low bits.
+func scriptRand() int64 {
+	return rand.Int63n(1 << 53)
+}
+
+// sessionIndexLua defines index_add(id, country) and index_remove(id,
+// country), which maintain the global session-index hash mapping each
+// session-id to the comma-separated countries it is stored in.
+const sessionIndexLua = `
+	local function index_add(id, country)
+		local countries = redis.call("HGET", "session-index", id)
+		if not countries then
+			redis.call("HSET", "session-index", id, country)
+			return
+		end
+		for c in string.gmatch(countries, "[^,]+") do
+			if c == country then
+				return
+			end
+		end
+		redis.call("HSET", "session-index", id, countries .. "," .. country)
+	end
+	local function index_remove(id, country)
+		local countries = redis.call("HGET", "session-index", id)
+		if not countries then
+			return
+		end
+		local kept = {}
+		for c in string.gmatch(countries, "[^,]+") do
+			if c ~= country then
+				table.insert(kept, c)
+			end
+		end
+		if #kept == 0 then
+			redis.call("HDEL", "session-index", id)
+		else
+			redis.call("HSET", "session-index", id, table.concat(kept, ","))
+		end
+	end
+`
+
+// poolLua defines the helpers over the id list of a pool, kept at base
+// (e.g. US:session-ids). Once sharded with ShardPool, the ids are spread
+// over the lists base:0 to base:<n-1> by a hash of the session-id, the
+// shard count n being kept at base:shards. shard_of must match shardOf.
+const poolLua = `
+	local function pool_shards(base)
+		return tonumber(redis.call("GET", base .. ":shards")) or 0
+	end
+	local function shard_of(id, n)
+		local h = 0
+		for i = 1, #id do
+			h = (h * 31 + string.byte(id, i)) % 2147483647
+		end
+		return h % n
+	end
+	local function pool_lists(base, first)
+		local n = pool_shards(base)
+		if n <= 1 then
+			return {base}
+		end
+		local lists = {}
+		for i = 0, n - 1 do
+			table.insert(lists, base .. ":" .. ((first or 0) + i) % n)
+		end
+		return lists
+	end
+	local function id_list(base, id)
+		local n = pool_shards(base)
+		if n <= 1 then
+			return base
+		end
+		return base .. ":" .. shard_of(id, n)
+	end
+	local function pool_ids(base)
+		local ids = {}
+		for _, list in ipairs(pool_lists(base)) do
+			for _, id in ipairs(redis.call("LRANGE", list, 0, -1)) do
+				table.insert(ids, id)
+			end
+		end
+		return ids
+	end
+	local function pool_len(base)
+		local count = 0
+		for _, list in ipairs(pool_lists(base)) do
+			count = count + redis.call("LLEN", list)
+		end
+		return count
+	end
+	local function pool_range(base, start, stop)
+		local lists = pool_lists(base)
+		if #lists == 1 then
+			return redis.call("LRANGE", base, start, stop)
+		end
+		local count = pool_len(base)
+		if start < 0 then
+			start = math.max(count + start, 0)
+		end
+		if stop < 0 then
+			stop = count + stop
+		end
+		local ids, offset = {}, 0
+		for _, list in ipairs(lists) do
+			if offset > stop then
+				break
+			end
+			local n = redis.call("LLEN", list)
+			if start < offset + n then
+				for _, id in ipairs(redis.call("LRANGE", list, math.max(start - offset, 0), stop - offset)) do
+					table.insert(ids, id)
+				end
+			end
+			offset = offset + n
+		end
+		return ids
+	end
+	local function pool_index(base, i)
+		for _, list in ipairs(pool_lists(base)) do
+			local n = redis.call("LLEN", list)
+			if i < n then
+				return redis.call("LINDEX", list, i)
+			end
+			i = i - n
+		end
+		return nil
+	end
+	local function pool_push(base, id)
+		local list = id_list(base, id)
+		if not redis.call("LPOS", list, id) then
+			redis.call("RPUSH", list, id)
+		end
+	end
+	local function pool_remove(base, id)
+		redis.call("LREM", id_list(base, id), 0, id)
+	end
+	local function pool_pop(base, cookies, now)
+		local lists = {}
+		for i, list in ipairs(pool_lists(base)) do
+			table.insert(lists, {list, redis.call("LLEN", list), i})
+		end
+		table.sort(lists, function(a, b)
+			return a[2] > b[2] or (a[2] == b[2] and a[3] < b[3])
+		end)
+		for _, entry in ipairs(lists) do
+			for _ = 1, entry[2] do
+				local id = redis.call("LPOP", entry[1])
+				local expiresAt = redis.call("HGET", cookies, id .. ":amazon-expires-at")
+				if not expiresAt or tonumber(expiresAt) > now then
+					return id
+				end
+				-- Expired sessions stay in the pool until the cleanup.
+				redis.call("RPUSH", entry[1], id)
+			end
+		end
+		return nil
+	end
+`
+
+// removeSessionLua defines remove_session(country, id, fields), which deletes
+// a session with its fields and drops it from the secondary indexes.
+const removeSessionLua = sessionIndexLua + poolLua + `
+	local function remove_session(country, id, fields)
+		local key = country .. ":cookies"
+		local labels = redis.call("HGET", key, id .. ":labels")
+		if labels then
+			for name, value in pairs(cjson.decode(labels)) do
+				redis.call("SREM", country .. ":label:" .. name .. "=" .. value, id)
+			end
+		end
+		local generation = redis.call("HGET", key, id .. ":generation")
+		if generation then
+			redis.call("SREM", country .. ":generation:" .. generation, id)
+		end
+		local tier = redis.call("HGET", key, id .. ":tier")
+		if tier then
+			redis.call("SREM", country .. ":tier:" .. tier, id)
+		end
+		pool_remove(country .. ":session-ids", id)
+		redis.call("LREM", country .. ":canary-ids", 0, id)
+		redis.call("HDEL", key, id)
+		for _, field in ipairs(fields) do
+			redis.call("HDEL", key, id .. ":" .. field)
+		end
+		redis.call("ZREM", country .. ":pins", id)
+		redis.call("ZREM", country .. ":by-last-checked", id)
+		redis.call("ZREM", country .. ":by-usage", id)
+		local borrower = redis.call("HGET", country .. ":borrowers", id)
+		if borrower then
+			redis.call("HDEL", country .. ":borrowers", id)
+			if borrower ~= "" and redis.call("HINCRBY", country .. ":borrows", borrower, -1) <= 0 then
+				redis.call("HDEL", country .. ":borrows", borrower)
+			end
+		end
+		index_remove(id, country)
+	end
+`
+
+// timestampLua defines to_unix(value), which converts a stored timestamp,
+// either Unix time or an RFC 3339 string, to Unix time. It returns nil for
+// missing or malformed values.
+const timestampLua = `
+	local function to_unix(value)
+		if not value then
+			return nil
+		end
+		local n = tonumber(value)
+		if n then
+			return n
+		end
+		local y, mo, d, h, mi, s, rest = string.match(value, "^(%d+)-(%d+)-(%d+)T(%d+):(%d+):(%d+)(.*)$")
+		if not y then
+			return nil
+		end
+		y, mo, d = tonumber(y), tonumber(mo), tonumber(d)
+		if mo <= 2 then
+			y = y - 1
+		end
+		local era = math.floor(y / 400)
+		local yoe = y - era * 400
+		local doy = math.floor((153 * ((mo + 9) % 12) + 2) / 5) + d - 1
+		local days = era * 146097 + yoe * 365 + math.floor(yoe / 4) - math.floor(yoe / 100) + doy - 719468
+		local t = days * 86400 + tonumber(h) * 3600 + tonumber(mi) * 60 + tonumber(s)
+		local sign, oh, om = string.match(rest, "([+-])(%d+):(%d+)$")
+		if sign == "+" then
+			t = t - tonumber(oh) * 3600 - tonumber(om) * 60
+		elseif sign == "-" then
+			t = t + tonumber(oh) * 3600 + tonumber(om) * 60
+		end
+		return t
+	end
+`
+
+// pinsLua defines unpin(country, id), which ends the pin of a session and
+// puts it back into its id list if it is still stored.
+const pinsLua = poolLua + `
+	local function unpin(country, id)
+		local key = country .. ":cookies"
+		redis.call("ZREM", country .. ":pins", id)
+		if redis.call("HEXISTS", key, id) == 1 then
+			if redis.call("HGET", key, id .. ":canary") == "1" then
+				local list = country .. ":canary-ids"
+				if not redis.call("LPOS", list, id) then
+					redis.call("RPUSH", list, id)
+				end
+			else
+				pool_push(country .. ":session-ids", id)
+			end
+		end
+	end
+`
+
+// usageWindowLua defines window_add(value, now), which returns the encoded
+// usage window of a session with one use at now added, and
+// window_count(value, now, seconds), which returns the uses within the last
+// seconds. The window holds "<bucket>:<count>" pairs of 10 minute buckets,
+// comma separated, and keeps the last 24 hours.
+const usageWindowLua = `
+	local usage_bucket = 600
+	local function window_add(value, now)
+		local current = math.floor(now / usage_bucket)
+		local oldest = current - 86400 / usage_bucket + 1
+		local out, found = {}, false
+		for b, n in string.gmatch(value or "", "(%d+):(%d+)") do
+			b, n = tonumber(b), tonumber(n)
+			if b == current then
+				n = n + 1
+				found = true
+			end
+			if b >= oldest then
+				table.insert(out, b .. ":" .. n)
+			end
+		end
+		if not found then
+			table.insert(out, current .. ":1")
+		end
+		return table.concat(out, ",")
+	end
+	local function window_count(value, now, seconds)
+		local oldest = math.floor(now / usage_bucket) - math.ceil(seconds / usage_bucket) + 1
+		local count = 0
+		for b, n in string.gmatch(value or "", "(%d+):(%d+)") do
+			if tonumber(b) >= oldest then
+				count = count + tonumber(n)
+			end
+		end
+		return count
+	end
+`
+
+// decayLua defines decayed_score(key, id, now, halfLife), which returns the
+// failure score of a session decayed exponentially since it was last scored.
+const decayLua = `
+	local function decayed_score(key, id, now, halfLife)
+		local score = tonumber(redis.call("HGET", key, id .. ":failure-score")) or 0
+		local scoredAt = tonumber(redis.call("HGET", key, id .. ":failure-scored-at")) or now
+		if halfLife > 0 and now > scoredAt then
+			score = score * math.pow(0.5, (now - scoredAt) / halfLife)
+		end
+		return score
+	end
+`
+
+// latencyLua defines record_latency(key, id, ms), which folds a response
+// latency into the smoothed latency of a session, an exponentially weighted
+// moving average giving 30% weight to the new value.
+const latencyLua = `
+	local function record_latency(key, id, ms)
+		local field = id .. ":latency-ms"
+		local current = tonumber(redis.call("HGET", key, field))
+		if current then
+			ms = current + 0.3 * (ms - current)
+		end
+		redis.call("HSET", key, field, math.floor(ms + 0.5))
+	end
+`
 
 var (
-	allSessionCmd = redis.NewScript(`
-		local keys = redis.call("KEYS", "*:cookies")
-		local res = {}
-		for _, key in ipairs(keys) do
-			local countryCode = string.match(key, "(.-):cookies")
-			local sessionIdsKey = countryCode .. ":session-ids"
-			local sessionIds = redis.call("LRANGE", sessionIdsKey, 0, -1)
-			for _, sessionId in ipairs(sessionIds) do
-				local lastCheckedKey = sessionId .. ":last-checked"
-				local usageCountKey = sessionId .. ":usage-count"
-				local createdAtKey = sessionId .. ":created-at"
-				table.insert(res, countryCode)
-				table.insert(res, sessionId)
-				table.insert(res, redis.call("HGET", key, sessionId))
-				table.insert(res, redis.call("HGET", key, lastCheckedKey))
-				table.insert(res, redis.call("HGET", key, usageCountKey))
-				table.insert(res, redis.call("HGET", key, createdAtKey))
+	// KEYS[1] -> key for id list (e.g. {<country>}:session-ids)
+	// KEYS[2] -> key for id list (e.g. {<country>}:cookies)
+	// ARGV[1] -> start offset
+	// ARGV[2] -> stop offset
+	// ARGV[3..n] -> session fields (e.g. usage-count)
+	listSessionCmd = redis.NewScript(poolLua + `
+		local ids = pool_range(KEYS[1], tonumber(ARGV[1]), tonumber(ARGV[2]))
+		local data = {}
+		for _, id in ipairs(ids) do
+			table.insert(data, id)
+			table.insert(data, redis.call("HGET", KEYS[2], id))
+			for i = 3, #ARGV do
+				table.insert(data, redis.call("HGET", KEYS[2], id .. ":" .. ARGV[i]))
 			end
 		end
-		return res
+		return data
 	`)
 	// KEYS[1] -> key for id list (e.g. {<country>}:session-ids)
 	// KEYS[2] -> key for id list (e.g. {<country>}:cookies)
 	// ARGV[1] -> start offset
 	// ARGV[2] -> stop offset
-	listSessionCmd = redis.NewScript(`
-		local ids = redis.call("LRange", KEYS[1], ARGV[1], ARGV[2])
+	// ARGV[3..n] -> session fields (e.g. usage-count)
+	listSessionMetaCmd = redis.NewScript(poolLua + `
+		local ids = pool_range(KEYS[1], tonumber(ARGV[1]), tonumber(ARGV[2]))
 		local data = {}
 		for _, id in ipairs(ids) do
-			local lastCheckedKey = id .. ":last-checked"
-			local usageCountKey = id .. ":usage-count"
-			local createdAtKey = sessionId .. ":created-at"
 			table.insert(data, id)
-			table.insert(data, redis.call("HGET", KEYS[2], id))
-			table.insert(data, redis.call("HGET", KEYS[2], usageCountKey))
-			table.insert(data, redis.call("HGET", KEYS[2], lastCheckedKey))
-			table.insert(data, redis.call("HGET", KEYS[2], createdAtKey))
+			for i = 3, #ARGV do
+				table.insert(data, redis.call("HGET", KEYS[2], id .. ":" .. ARGV[i]))
+			end
 		end
 		return data
 	`)
 	// KEYS[1] -> key for id list (e.g. {<country>}:cookies)
+	// KEYS[2] -> key for the usage index (e.g. {<country>}:by-usage)
 	// ARGV[1] -> session id key
-	// ARGV[2] -> usageCount Key
-	// ARGV[3] -> lastChecked Key
-	getSessionCmd = redis.NewScript(`
+	// ARGV[2] -> current time
+	// ARGV[3..n] -> session fields, usage-count is incremented and the use
+	// is added to usage-window
+	getSessionCmd = redis.NewScript(usageWindowLua + `
 		local cookies = redis.call("HGET", KEYS[1], ARGV[1])
-		local usageCount = redis.call("HINCRBY", KEYS[1], ARGV[2], 1)
-		local lastCheck = redis.call("HGET", KEYS[1], ARGV[3])
-		local createdAt = redis.call("HGET", KEYS[1], ARGV[4])
 		if not cookies then
 			return redis.error_reply("NOT FOUND")
 		end
-		return {cookies, usageCount, lastCheck, createdAt}
-	`)
-	// ARGV[1] -> currentTime
-	// ARGV[2] -> timeDiff
-	// ARGV[3] -> usageCount
-	cleanupSessionsCmd = redis.NewScript(`
-		local keys = redis.call("KEYS", "*:cookies")
-		for _, key in ipairs(keys) do
-			local countryCode = string.match(key, "(.-):cookies")
-			local sessionIdsKey = countryCode .. ":session-ids"
-			local sessionIds = redis.call("LRANGE", sessionIdsKey, 0, -1)
-			for _, sessionId in ipairs(sessionIds) do
-				local lastCheckedKey = sessionId .. ":last-checked"
-				local usageCountKey = sessionId .. ":usage-count"
-				local lastChecked = redis.call("HGET", key, lastCheckedKey)
-				local usageCount = redis.call("HGET", key, usageCountKey)
+		local res = {cookies}
+		for i = 3, #ARGV do
+			local field = ARGV[1] .. ":" .. ARGV[i]
+			if ARGV[i] == "usage-count" then
+				local usage = redis.call("HINCRBY", KEYS[1], field, 1)
+				redis.call("ZADD", KEYS[2], usage, ARGV[1])
+				table.insert(res, usage)
+				local window = ARGV[1] .. ":usage-window"
+				redis.call("HSET", KEYS[1], window, window_add(redis.call("HGET", KEYS[1], window), tonumber(ARGV[2])))
+			else
+				table.insert(res, redis.call("HGET", KEYS[1], field))
+			end
+		end
+		return res
+	`)
+	// KEYS[1] -> country code (e.g. US)
+	// KEYS[2] -> key for the id list to scan (e.g. {<country>}:session-ids)
+	// ARGV[1] -> start offset of the chunk
+	// ARGV[2] -> chunk size
+	// ARGV[3] -> currentTime
+	// ARGV[4] -> timeDiff
+	// ARGV[5] -> usageCount
+	// ARGV[6] -> maxAge, 0 to disable
+	// ARGV[7] -> usage window in seconds usageCount applies to, 0 for the
+	// lifetime usage count
+	// ARGV[8..n] -> session fields to delete
+	// Returns the number of scanned and removed sessions.
+	cleanupChunkCmd = redis.NewScript(removeSessionLua + timestampLua + usageWindowLua + `
+		local key = KEYS[1] .. ":cookies"
+		local fields = {unpack(ARGV, 8)}
+		local usageWindow = tonumber(ARGV[7])
+		local currentTime = tonumber(ARGV[3])
+		local maxAge = tonumber(ARGV[6])
+		local start = tonumber(ARGV[1])
+		local sessionIds = redis.call("LRANGE", KEYS[2], start, start + tonumber(ARGV[2]) - 1)
+		local removed = 0
+		for _, sessionId in ipairs(sessionIds) do
+			local lastChecked = to_unix(redis.call("HGET", key, sessionId .. ":last-checked"))
+			local usageCount = redis.call("HGET", key, sessionId .. ":usage-count")
+			if usageWindow > 0 then
+				usageCount = window_count(redis.call("HGET", key, sessionId .. ":usage-window"), currentTime, usageWindow)
+			end
+			if lastChecked then
+				local timeDiff = currentTime - lastChecked
+				local createdAt = to_unix(redis.call("HGET", key, sessionId .. ":created-at"))
+				local expired = maxAge > 0 and createdAt and currentTime - createdAt >= maxAge
+				local amazonExpiresAt = redis.call("HGET", key, sessionId .. ":amazon-expires-at")
+				if amazonExpiresAt and tonumber(amazonExpiresAt) <= currentTime then
+					expired = true
+				end
+				if timeDiff >= tonumber(ARGV[4]) or (usageCount and tonumber(usageCount) >= tonumber(ARGV[5])) or expired then
+					remove_session(KEYS[1], sessionId, fields)
+					removed = removed + 1
+				end
+			end
+		end
+		return {#sessionIds, removed}
+	`)
+	// KEYS[1] -> key for id list (e.g. {<country>}:session-ids)
+	// KEYS[2] -> key for cookies (e.g. {<country>}:cookies)
+	// ARGV[1] -> random number used to pick a matching session
+	// ARGV[2] -> current time, sessions past their amazon-expires-at are skipped
+	// ARGV[3] -> comma separated tiers in order of preference, may be empty
+	// ARGV[4..n] -> pairs of session field and expected value
+	// Only the matching sessions of the most preferred tier are considered;
+	// sessions of unlisted tiers rank last.
+	getFilteredSessionCmd = redis.NewScript(poolLua + `
+		local ids = pool_ids(KEYS[1])
+		local now = tonumber(ARGV[2])
+		local ranks, unlisted = {}, 1
+		for tier in string.gmatch(ARGV[3], "[^,]+") do
+			ranks[tier] = unlisted
+			unlisted = unlisted + 1
+		end
+		local matches, best = {}, nil
+		for _, id in ipairs(ids) do
+			local expiresAt = redis.call("HGET", KEYS[2], id .. ":amazon-expires-at")
+			local match = not expiresAt or tonumber(expiresAt) > now
+			for i = 4, #ARGV, 2 do
+				if not match or redis.call("HGET", KEYS[2], id .. ":" .. ARGV[i]) ~= ARGV[i + 1] then
+					match = false
+					break
+				end
+			end
+			if match then
+				local rank = unlisted
+				if ARGV[3] ~= "" then
+					rank = ranks[redis.call("HGET", KEYS[2], id .. ":tier") or ""] or unlisted
+				end
+				if not best or rank < best then
+					best, matches = rank, {}
+				end
+				if rank == best then
+					table.insert(matches, id)
+				end
+			end
+		end
+		if #matches == 0 then
+			return redis.error_reply("NOT FOUND")
+		end
+		return matches[(tonumber(ARGV[1]) % #matches) + 1]
+	`)
+	// KEYS[1] -> country code (e.g. US)
+	// ARGV[1] -> current time, sessions past their amazon-expires-at are skipped
+	// ARGV[2..n] -> tiers in order of preference
+	// Picks a random session of the first tier with one in the pool from the
+	// tier indexes. A sample of each tier is checked, the whole tier only when
+	// none of the sample is in the pool. Returns NOT FOUND when no listed tier
+	// has a session in the pool.
+	getTierSessionCmd = redis.NewScript(`
+		local key = KEYS[1] .. ":cookies"
+		local now = tonumber(ARGV[1])
+		local function available(id)
+			if redis.call("HEXISTS", key, id) == 0 or redis.call("HGET", key, id .. ":canary") == "1" or
+				redis.call("HEXISTS", KEYS[1] .. ":borrowers", id) == 1 or redis.call("ZSCORE", KEYS[1] .. ":pins", id) then
+				return false
+			end
+			local expiresAt = redis.call("HGET", key, id .. ":amazon-expires-at")
+			return not expiresAt or tonumber(expiresAt) > now
+		end
+		local function pick(ids)
+			for _, id in ipairs(ids) do
+				if available(id) then
+					return id
+				end
+			end
+			return nil
+		end
+		for i = 2, #ARGV do
+			local set = KEYS[1] .. ":tier:" .. ARGV[i]
+			local sample = redis.call("SRANDMEMBER", set, 16)
+			local id = pick(sample)
+			if not id and redis.call("SCARD", set) > #sample then
+				id = pick(redis.call("SMEMBERS", set))
+			end
+			if id then
+				return id
+			end
+		end
+		return redis.error_reply("NOT FOUND")
+	`)
+	// KEYS[1] -> key for id list (e.g. {<country>}:session-ids)
+	// KEYS[2] -> key for cookies (e.g. {<country>}:cookies)
+	// ARGV[1] -> random number used as the start shard and index
+	// ARGV[2] -> current time, sessions past their amazon-expires-at are skipped
+	getRandomSessionCmd = redis.NewScript(poolLua + `
+		local r = tonumber(ARGV[1])
+		local lists = pool_lists(KEYS[1], r)
+		for _, list in ipairs(lists) do
+			local count = redis.call("LLEN", list)
+			local start = math.floor(r / #lists) % math.max(count, 1)
+			for i = 0, count - 1 do
+				local id = redis.call("LINDEX", list, (start + i) % count)
+				local expiresAt = redis.call("HGET", KEYS[2], id .. ":amazon-expires-at")
+				if not expiresAt or tonumber(expiresAt) > tonumber(ARGV[2]) then
+					return id
+				end
+			end
+		end
+		return redis.error_reply("NOT FOUND")
+	`)
+	// KEYS[1..n] -> countries of the group
+	// ARGV[1] -> random number used to pick a session
+	// ARGV[2] -> current time, sessions past their amazon-expires-at are skipped
+	// Picks a random session across the pools of the countries, so each
+	// country is weighted by its number of sessions. Returns the index of the
+	// country and the session id.
+	getGroupSessionCmd = redis.NewScript(poolLua + `
+		local lists, total = {}, 0
+		for i, country in ipairs(KEYS) do
+			for _, list in ipairs(pool_lists(country .. ":session-ids")) do
+				local n = redis.call("LLEN", list)
+				table.insert(lists, {i, list, n})
+				total = total + n
+			end
+		end
+		local start = tonumber(ARGV[1]) % math.max(total, 1)
+		for k = 0, total - 1 do
+			local pos = (start + k) % total
+			for _, entry in ipairs(lists) do
+				if pos < entry[3] then
+					local id = redis.call("LINDEX", entry[2], pos)
+					local expiresAt = redis.call("HGET", KEYS[entry[1]] .. ":cookies", id .. ":amazon-expires-at")
+					if not expiresAt or tonumber(expiresAt) > tonumber(ARGV[2]) then
+						return {entry[1], id}
+					end
+					break
+				end
+				pos = pos - entry[3]
+			end
+		end
+		return redis.error_reply("NOT FOUND")
+	`)
+	// KEYS[1] -> key for id list (e.g. {<country>}:session-ids)
+	// KEYS[2] -> key for cookies (e.g. {<country>}:cookies)
+	// KEYS[3] -> key for affinity map (e.g. {<country>}:affinity)
+	// KEYS[4] -> key for the borrowers (e.g. {<country>}:borrowers)
+	// KEYS[5] -> key for the pins (e.g. {<country>}:pins)
+	// ARGV[1] -> affinity key
+	// ARGV[2] -> random number used to pick a new session
+	// ARGV[3] -> current time, sessions past their amazon-expires-at are skipped
+	// The bound session is reused while it is in the pool, not checked out,
+	// not pinned and not expired; otherwise a new session is bound.
+	getAffinitySessionCmd = redis.NewScript(poolLua + `
+		local now = tonumber(ARGV[3])
+		local function fresh(id)
+			local expiresAt = redis.call("HGET", KEYS[2], id .. ":amazon-expires-at")
+			return not expiresAt or tonumber(expiresAt) > now
+		end
+		local id = redis.call("HGET", KEYS[3], ARGV[1])
+		if id and redis.call("HEXISTS", KEYS[2], id) == 1 and
+			redis.call("LPOS", id_list(KEYS[1], id), id) and
+			redis.call("HEXISTS", KEYS[4], id) == 0 and
+			not redis.call("ZSCORE", KEYS[5], id) and fresh(id) then
+			return id
+		end
+		local r = tonumber(ARGV[2])
+		local lists = pool_lists(KEYS[1], r)
+		for _, list in ipairs(lists) do
+			local count = redis.call("LLEN", list)
+			local start = math.floor(r / #lists) % math.max(count, 1)
+			for i = 0, count - 1 do
+				id = redis.call("LINDEX", list, (start + i) % count)
+				if fresh(id) then
+					redis.call("HSET", KEYS[3], ARGV[1], id)
+					return id
+				end
+			end
+		end
+		return redis.error_reply("NOT FOUND")
+	`)
+	// KEYS[1..n] -> per-country keys (e.g. {<country>}:cookies)
+	// ARGV[1] -> country code
+	// ARGV[2] -> delete command, UNLINK or DEL
+	// ARGV[3..n] -> pairs of index registry key and index key prefix
+	flushCountryCmd = redis.NewScript(sessionIndexLua + poolLua + `
+		for _, entry in ipairs(redis.call("HKEYS", ARGV[1] .. ":cookies")) do
+			index_remove(entry, ARGV[1])
+		end
+		for _, list in ipairs(pool_lists(ARGV[1] .. ":session-ids")) do
+			redis.call(ARGV[2], list)
+		end
+		for i = 3, #ARGV, 2 do
+			for _, member in ipairs(redis.call("SMEMBERS", ARGV[i])) do
+				redis.call(ARGV[2], ARGV[i + 1] .. member)
+			end
+		end
+		redis.call(ARGV[2], unpack(KEYS))
+		return redis.status_reply("OK")
+	`)
+	// KEYS[1] -> country code (e.g. US)
+	// ARGV[1] -> session id
+	// ARGV[2..n] -> session fields to delete
+	// Returns 1 if the session existed, 0 otherwise.
+	deleteSessionCmd = redis.NewScript(removeSessionLua + `
+		local existed = redis.call("HEXISTS", KEYS[1] .. ":cookies", ARGV[1])
+		remove_session(KEYS[1], ARGV[1], {unpack(ARGV, 2)})
+		return existed
+	`)
+	// KEYS[1] -> country code (e.g. US)
+	// ARGV[1] -> generation
+	// ARGV[2] -> delete command, UNLINK or DEL
+	// ARGV[3..n] -> session fields to delete
+	purgeGenerationCmd = redis.NewScript(removeSessionLua + `
+		local key = KEYS[1] .. ":generation:" .. ARGV[1]
+		local ids = redis.call("SMEMBERS", key)
+		local fields = {unpack(ARGV, 3)}
+		for _, id in ipairs(ids) do
+			remove_session(KEYS[1], id, fields)
+		end
+		redis.call(ARGV[2], key)
+		redis.call("SREM", KEYS[1] .. ":generations", ARGV[1])
+		return #ids
+	`)
+	// KEYS[1] -> key for cookies (e.g. {<country>}:cookies)
+	// ARGV[1] -> number of session ids n
+	// ARGV[2..n+1] -> session ids
+	// ARGV[n+2..] -> session fields (e.g. usage-count)
+	listSessionByIDsCmd = redis.NewScript(`
+		local n = tonumber(ARGV[1])
+		local data = {}
+		for i = 2, n + 1 do
+			local id = ARGV[i]
+			local cookies = redis.call("HGET", KEYS[1], id)
+			if cookies then
+				table.insert(data, id)
+				table.insert(data, cookies)
+				for k = n + 2, #ARGV do
+					table.insert(data, redis.call("HGET", KEYS[1], id .. ":" .. ARGV[k]))
+				end
+			end
+		end
+		return data
+	`)
+	// KEYS[1] -> key for cookies (e.g. {<country>}:cookies)
+	// KEYS[2] -> key for the last-checked index (e.g. {<country>}:by-last-checked)
+	// ARGV[1] -> session id
+	// ARGV[2] -> current time, in the configured timestamp format
+	// ARGV[3] -> "1" to reset the failure counter
+	// ARGV[4] -> current time
+	touchSessionCmd = redis.NewScript(`
+		if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+			return redis.error_reply("NOT FOUND")
+		end
+		redis.call("HSET", KEYS[1], ARGV[1] .. ":last-checked", ARGV[2])
+		redis.call("ZADD", KEYS[2], ARGV[4], ARGV[1])
+		if ARGV[3] == "1" then
+			redis.call("HDEL", KEYS[1], ARGV[1] .. ":failures")
+		end
+		return redis.status_reply("OK")
+	`)
+	// KEYS[1] -> key for cookies (e.g. {<country>}:cookies)
+	// ARGV[1] -> session id
+	// ARGV[2] -> current time
+	// ARGV[3] -> half-life of the failure score in seconds, 0 to disable decay
+	recordFailureCmd = redis.NewScript(decayLua + `
+		if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+			return redis.error_reply("NOT FOUND")
+		end
+		local score = decayed_score(KEYS[1], ARGV[1], tonumber(ARGV[2]), tonumber(ARGV[3])) + 1
+		redis.call("HSET", KEYS[1], ARGV[1] .. ":failure-score", tostring(score), ARGV[1] .. ":failure-scored-at", ARGV[2])
+		return redis.call("HINCRBY", KEYS[1], ARGV[1] .. ":failures", 1)
+	`)
+	// KEYS[1] -> key for id list (e.g. {<country>}:session-ids)
+	// KEYS[2] -> key for cookies (e.g. {<country>}:cookies)
+	// KEYS[3] -> key for canary id list (e.g. {<country>}:canary-ids)
+	// ARGV[1] -> session id
+	returnSessionCmd = redis.NewScript(poolLua + `
+		if redis.call("HEXISTS", KEYS[2], ARGV[1]) == 0 then
+			return redis.error_reply("NOT FOUND")
+		end
+		if redis.call("HGET", KEYS[2], ARGV[1] .. ":canary") == "1" then
+			if not redis.call("LPOS", KEYS[3], ARGV[1]) then
+				redis.call("RPUSH", KEYS[3], ARGV[1])
+			end
+		else
+			pool_push(KEYS[1], ARGV[1])
+		end
+		return redis.status_reply("OK")
+	`)
+	// KEYS[1] -> key for cookies (e.g. {<country>}:cookies)
+	// ARGV[1] -> session id
+	// ARGV[2] -> session field
+	// ARGV[3] -> value
+	setSessionFieldCmd = redis.NewScript(`
+		if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+			return redis.error_reply("NOT FOUND")
+		end
+		redis.call("HSET", KEYS[1], ARGV[1] .. ":" .. ARGV[2], ARGV[3])
+		return redis.status_reply("OK")
+	`)
+	// ARGV[1..n] -> country codes
+	// Returns the country code, pool size, canary count, number of sessions
+	// with consecutive failures, oldest last-checked time and the numbers of
+	// checked out and pinned sessions of each country.
+	summaryCmd = redis.NewScript(timestampLua + poolLua + `
+		local res = {}
+		for _, country in ipairs(ARGV) do
+			local key = country .. ":cookies"
+			local ids = pool_ids(country .. ":session-ids")
+			local failing = 0
+			local oldest = 0
+			for _, id in ipairs(ids) do
+				local failures = redis.call("HGET", key, id .. ":failures")
+				if failures and tonumber(failures) > 0 then
+					failing = failing + 1
+				end
+				local lastChecked = to_unix(redis.call("HGET", key, id .. ":last-checked"))
+				if lastChecked and (oldest == 0 or lastChecked < oldest) then
+					oldest = lastChecked
+				end
+			end
+			table.insert(res, country)
+			table.insert(res, #ids)
+			table.insert(res, redis.call("LLEN", country .. ":canary-ids"))
+			table.insert(res, failing)
+			table.insert(res, oldest)
+			table.insert(res, redis.call("HLEN", country .. ":borrowers"))
+			table.insert(res, redis.call("ZCARD", country .. ":pins"))
+		end
+		return res
+	`)
+	// KEYS[1] -> key for id list (e.g. {<country>}:session-ids)
+	// KEYS[2] -> key for cookies (e.g. {<country>}:cookies)
+	// KEYS[3] -> key for the round-robin cursor (e.g. {<country>}:rr-cursor)
+	// ARGV[1] -> current time, sessions past their amazon-expires-at are skipped
+	roundRobinSessionCmd = redis.NewScript(poolLua + `
+		local count = pool_len(KEYS[1])
+		for i = 1, count do
+			local cursor = redis.call("INCR", KEYS[3])
+			local id = pool_index(KEYS[1], (cursor - 1) % count)
+			local expiresAt = redis.call("HGET", KEYS[2], id .. ":amazon-expires-at")
+			if not expiresAt or tonumber(expiresAt) > tonumber(ARGV[1]) then
+				return id
+			end
+		end
+		return redis.error_reply("NOT FOUND")
+	`)
+	// KEYS[1] -> key for id list (e.g. {<country>}:session-ids)
+	// KEYS[2] -> key for cookies (e.g. {<country>}:cookies)
+	// KEYS[3] -> key for the usage index (e.g. {<country>}:by-usage)
+	// KEYS[4] -> key for the borrowers (e.g. {<country>}:borrowers)
+	// KEYS[5] -> key for the pins (e.g. {<country>}:pins)
+	// ARGV[1] -> current time, sessions past their amazon-expires-at are skipped
+	// The usage index is walked from the least used session, skipping the
+	// sessions outside the pool. Pools not indexed yet are scanned.
+	leastUsedSessionCmd = redis.NewScript(poolLua + `
+		local now = tonumber(ARGV[1])
+		if redis.call("EXISTS", KEYS[3]) == 1 then
+			local offset = 0
+			while true do
+				local ids = redis.call("ZRANGE", KEYS[3], offset, offset + 99)
+				if #ids == 0 then
+					return redis.error_reply("NOT FOUND")
+				end
+				for _, id in ipairs(ids) do
+					local expiresAt = redis.call("HGET", KEYS[2], id .. ":amazon-expires-at")
+					if redis.call("HEXISTS", KEYS[2], id) == 1
+						and redis.call("HEXISTS", KEYS[2], id .. ":canary") == 0
+						and redis.call("HEXISTS", KEYS[4], id) == 0
+						and not redis.call("ZSCORE", KEYS[5], id)
+						and (not expiresAt or tonumber(expiresAt) > now) then
+						return id
+					end
+				end
+				offset = offset + #ids
+			end
+		end
+		local best, bestUsage
+		for _, id in ipairs(pool_ids(KEYS[1])) do
+			local expiresAt = redis.call("HGET", KEYS[2], id .. ":amazon-expires-at")
+			if not expiresAt or tonumber(expiresAt) > now then
+				local usage = tonumber(redis.call("HGET", KEYS[2], id .. ":usage-count")) or 0
+				if not bestUsage or usage < bestUsage then
+					best, bestUsage = id, usage
+				end
+			end
+		end
+		if not best then
+			return redis.error_reply("NOT FOUND")
+		end
+		return best
+	`)
+	// KEYS[1] -> key for id list (e.g. {<country>}:session-ids)
+	// KEYS[2] -> key for cookies (e.g. {<country>}:cookies)
+	// ARGV[1] -> current time, sessions past their amazon-expires-at are skipped
+	// ARGV[2] -> usage window in seconds
+	leastRecentlyUsedSessionCmd = redis.NewScript(usageWindowLua + poolLua + `
+		local now = tonumber(ARGV[1])
+		local best, bestUsage
+		for _, id in ipairs(pool_ids(KEYS[1])) do
+			local expiresAt = redis.call("HGET", KEYS[2], id .. ":amazon-expires-at")
+			if not expiresAt or tonumber(expiresAt) > now then
+				local usage = window_count(redis.call("HGET", KEYS[2], id .. ":usage-window"), now, tonumber(ARGV[2]))
+				if not bestUsage or usage < bestUsage then
+					best, bestUsage = id, usage
+				end
+			end
+		end
+		if not best then
+			return redis.error_reply("NOT FOUND")
+		end
+		return best
+	`)
+	// KEYS[1] -> key for id list (e.g. {<country>}:session-ids)
+	// KEYS[2] -> key for cookies (e.g. {<country>}:cookies)
+	// ARGV[1] -> current time, sessions past their amazon-expires-at are skipped
+	// ARGV[2] -> random number in [0, 1)
+	// ARGV[3] -> half-life of the failure score in seconds, 0 to disable decay
+	// Sessions are weighted by 1 / (1 + decayed failure score).
+	scoreWeightedSessionCmd = redis.NewScript(decayLua + poolLua + `
+		local ids, weights, total = {}, {}, 0
+		for _, id in ipairs(pool_ids(KEYS[1])) do
+			local expiresAt = redis.call("HGET", KEYS[2], id .. ":amazon-expires-at")
+			if not expiresAt or tonumber(expiresAt) > tonumber(ARGV[1]) then
+				local weight = 1 / (1 + decayed_score(KEYS[2], id, tonumber(ARGV[1]), tonumber(ARGV[3])))
+				table.insert(ids, id)
+				table.insert(weights, weight)
+				total = total + weight
+			end
+		end
+		if #ids == 0 then
+			return redis.error_reply("NOT FOUND")
+		end
+		local target = tonumber(ARGV[2]) * total
+		for i, weight in ipairs(weights) do
+			target = target - weight
+			if target < 0 then
+				return ids[i]
+			end
+		end
+		return ids[#ids]
+	`)
+	// KEYS[1] -> key for the circuit breaker (e.g. {<country>}:breaker)
+	// ARGV[1] -> current time
+	// ARGV[2] -> cooldown in seconds before probing a tripped breaker
+	// ARGV[3] -> number of probes allowed while half-open
+	// ARGV[4] -> "1" to consume a probe
+	// Returns 1 when requests are allowed, 0 when the breaker is tripped.
+	breakerAllowCmd = redis.NewScript(`
+		local state = redis.call("HGET", KEYS[1], "state")
+		if state == "open" then
+			local openedAt = tonumber(redis.call("HGET", KEYS[1], "opened-at")) or 0
+			if tonumber(ARGV[1]) - openedAt < tonumber(ARGV[2]) then
+				return 0
+			end
+			if ARGV[4] ~= "1" then
+				return 1
+			end
+			redis.call("HSET", KEYS[1], "state", "half-open", "probes", 0)
+			state = "half-open"
+		end
+		if state == "half-open" and ARGV[4] == "1" then
+			if redis.call("HINCRBY", KEYS[1], "probes", 1) > tonumber(ARGV[3]) then
+				return 0
+			end
+		end
+		return 1
+	`)
+	// KEYS[1] -> key for the circuit breaker (e.g. {<country>}:breaker)
+	// ARGV[1] -> current time
+	// ARGV[2] -> "1" for a failure, "0" for a success
+	// ARGV[3] -> window in seconds over which failures are counted
+	// ARGV[4] -> number of failures within the window tripping the breaker
+	breakerRecordCmd = redis.NewScript(`
+		local state = redis.call("HGET", KEYS[1], "state")
+		local now = tonumber(ARGV[1])
+		if ARGV[2] == "0" then
+			if state == "half-open" then
+				redis.call("DEL", KEYS[1])
+			end
+			return redis.status_reply("OK")
+		end
+		if state == "half-open" then
+			redis.call("HSET", KEYS[1], "state", "open", "opened-at", now)
+			return redis.status_reply("OK")
+		end
+		local windowStart = tonumber(redis.call("HGET", KEYS[1], "window-start"))
+		if not windowStart or now - windowStart >= tonumber(ARGV[3]) then
+			redis.call("HSET", KEYS[1], "window-start", now, "failures", 0)
+		end
+		local failures = redis.call("HINCRBY", KEYS[1], "failures", 1)
+		if state ~= "open" and failures >= tonumber(ARGV[4]) then
+			redis.call("HSET", KEYS[1], "state", "open", "opened-at", now)
+		end
+		return redis.status_reply("OK")
+	`)
+	// KEYS[1] -> country code (e.g. US)
+	// ARGV[1..n] -> session fields
+	// Returns the ids removed from the lists, the ids restored to the lists
+	// and the number of orphaned field entries deleted.
+	repairPoolCmd = redis.NewScript(removeSessionLua + `
+		local key = KEYS[1] .. ":cookies"
+		local removed = {}
+		local seen = {}
+		local lists = pool_lists(KEYS[1] .. ":session-ids")
+		table.insert(lists, KEYS[1] .. ":canary-ids")
+		for _, list in ipairs(lists) do
+			for _, id in ipairs(redis.call("LRANGE", list, 0, -1)) do
+				if redis.call("HEXISTS", key, id) == 0 then
+					if not seen[id] then
+						remove_session(KEYS[1], id, ARGV)
+						table.insert(removed, id)
+					end
+				end
+				seen[id] = true
+			end
+		end
+		local restored = {}
+		local orphanFields = 0
+		for _, entry in ipairs(redis.call("HKEYS", key)) do
+			local owner = nil
+			for _, field in ipairs(ARGV) do
+				if string.sub(entry, -(#field + 1)) == ":" .. field then
+					owner = string.sub(entry, 1, #entry - #field - 1)
+					break
+				end
+			end
+			if owner then
+				if redis.call("HEXISTS", key, owner) == 0 then
+					redis.call("HDEL", key, entry)
+					orphanFields = orphanFields + 1
+				end
+			elseif not seen[entry] and not redis.call("ZSCORE", KEYS[1] .. ":pins", entry) and
+				redis.call("HEXISTS", KEYS[1] .. ":borrowers", entry) == 0 then
+				seen[entry] = true
+				if redis.call("HGET", key, entry .. ":canary") == "1" then
+					redis.call("RPUSH", KEYS[1] .. ":canary-ids", entry)
+				else
+					redis.call("RPUSH", id_list(KEYS[1] .. ":session-ids", entry), entry)
+				end
+				local labels = redis.call("HGET", key, entry .. ":labels")
+				if labels then
+					for name, value in pairs(cjson.decode(labels)) do
+						redis.call("SADD", KEYS[1] .. ":label:" .. name .. "=" .. value, entry)
+						redis.call("SADD", KEYS[1] .. ":labels", name .. "=" .. value)
+					end
+				end
+				local generation = redis.call("HGET", key, entry .. ":generation")
+				if generation then
+					redis.call("SADD", KEYS[1] .. ":generation:" .. generation, entry)
+					redis.call("SADD", KEYS[1] .. ":generations", generation)
+				end
+				local tier = redis.call("HGET", key, entry .. ":tier")
+				if tier then
+					redis.call("SADD", KEYS[1] .. ":tier:" .. tier, entry)
+					redis.call("SADD", KEYS[1] .. ":tiers", tier)
+				end
+				index_add(entry, KEYS[1])
+				table.insert(restored, entry)
+			end
+		end
+		return {removed, restored, orphanFields}
+	`)
+	// KEYS[1] -> country code (e.g. US)
+	// ARGV[1..n] -> session fields
+	// Returns pairs of violation kind and session id, see IntegrityViolation.
+	verifyIntegrityCmd = redis.NewScript(poolLua + `
+		local key = KEYS[1] .. ":cookies"
+		local res = {}
+		local listed = {}
+		local lists = pool_lists(KEYS[1] .. ":session-ids")
+		table.insert(lists, KEYS[1] .. ":canary-ids")
+		for _, list in ipairs(lists) do
+			for _, id in ipairs(redis.call("LRANGE", list, 0, -1)) do
+				if listed[id] then
+					table.insert(res, "duplicate-id")
+					table.insert(res, id)
+				elseif redis.call("HEXISTS", key, id) == 0 then
+					table.insert(res, "missing-cookies")
+					table.insert(res, id)
+				end
+				listed[id] = true
+			end
+		end
+		for _, entry in ipairs(redis.call("HKEYS", key)) do
+			local field = false
+			for _, name in ipairs(ARGV) do
+				if string.sub(entry, -(#name + 1)) == ":" .. name then
+					field = true
+					break
+				end
+			end
+			if not field then
+				if not listed[entry] and not redis.call("ZSCORE", KEYS[1] .. ":pins", entry) and
+					redis.call("HEXISTS", KEYS[1] .. ":borrowers", entry) == 0 then
+					table.insert(res, "unlisted")
+					table.insert(res, entry)
+				end
+				for _, counter in ipairs({"usage-count", "last-checked", "created-at"}) do
+					if redis.call("HEXISTS", key, entry .. ":" .. counter) == 0 then
+						table.insert(res, "missing-counter")
+						table.insert(res, entry)
+						break
+					end
+				end
+			end
+		end
+		local affinity = redis.call("HGETALL", KEYS[1] .. ":affinity")
+		for i = 2, #affinity, 2 do
+			if redis.call("HEXISTS", key, affinity[i]) == 0 then
+				table.insert(res, "stale-affinity")
+				table.insert(res, affinity[i])
+			end
+		end
+		for _, index in ipairs({{"labels", "label"}, {"generations", "generation"}, {"tiers", "tier"}}) do
+			for _, member in ipairs(redis.call("SMEMBERS", KEYS[1] .. ":" .. index[1])) do
+				for _, id in ipairs(redis.call("SMEMBERS", KEYS[1] .. ":" .. index[2] .. ":" .. member)) do
+					if redis.call("HEXISTS", key, id) == 0 then
+						table.insert(res, "stale-index")
+						table.insert(res, id)
+					end
+				end
+			end
+		end
+		return res
+	`)
+	// ARGV[1] -> session id
+	// ARGV[2] -> country code
+	sessionIndexAddCmd = redis.NewScript(sessionIndexLua + `
+		index_add(ARGV[1], ARGV[2])
+		return redis.status_reply("OK")
+	`)
+	// KEYS[1] -> country code (e.g. US)
+	// ARGV[1..n] -> session fields
+	// Returns the number of sessions indexed.
+	rebuildIndexesCmd = redis.NewScript(sessionIndexLua + timestampLua + `
+		local key = KEYS[1] .. ":cookies"
+		for _, index in ipairs({{"labels", "label"}, {"generations", "generation"}, {"tiers", "tier"}}) do
+			local registry = KEYS[1] .. ":" .. index[1]
+			for _, member in ipairs(redis.call("SMEMBERS", registry)) do
+				local set = KEYS[1] .. ":" .. index[2] .. ":" .. member
+				for _, id in ipairs(redis.call("SMEMBERS", set)) do
+					if redis.call("HEXISTS", key, id) == 0 then
+						redis.call("SREM", set, id)
+					end
+				end
+				if redis.call("SCARD", set) == 0 then
+					redis.call("SREM", registry, member)
+				end
+			end
+		end
+		local indexed = 0
+		for _, entry in ipairs(redis.call("HKEYS", key)) do
+			local field = false
+			for _, name in ipairs(ARGV) do
+				if string.sub(entry, -(#name + 1)) == ":" .. name then
+					field = true
+					break
+				end
+			end
+			if not field then
+				index_add(entry, KEYS[1])
+				local labels = redis.call("HGET", key, entry .. ":labels")
+				if labels then
+					for name, value in pairs(cjson.decode(labels)) do
+						redis.call("SADD", KEYS[1] .. ":label:" .. name .. "=" .. value, entry)
+						redis.call("SADD", KEYS[1] .. ":labels", name .. "=" .. value)
+					end
+				end
+				local generation = redis.call("HGET", key, entry .. ":generation")
+				if generation then
+					redis.call("SADD", KEYS[1] .. ":generation:" .. generation, entry)
+					redis.call("SADD", KEYS[1] .. ":generations", generation)
+				end
+				local tier = redis.call("HGET", key, entry .. ":tier")
+				if tier then
+					redis.call("SADD", KEYS[1] .. ":tier:" .. tier, entry)
+					redis.call("SADD", KEYS[1] .. ":tiers", tier)
+				end
+				local lastChecked = to_unix(redis.call("HGET", key, entry .. ":last-checked"))
 				if lastChecked then
-					local lastCheckedTime = tonumber(lastChecked)
-					local currentTime = tonumber(ARGV[1])
-					local timeDiff = currentTime - lastCheckedTime
-					if timeDiff >= tonumber(ARGV[2]) or (usageCount and tonumber(usageCount) >= tonumber(ARGV[3])) then
-						redis.call("LREM", sessionIdsKey,0, sessionId)
-						redis.call("HDEL",key, sessionId)
-						redis.call("HDEL",key, lastCheckedKey)
-						redis.call("HDEL",key, usageCountKey)
+					redis.call("ZADD", KEYS[1] .. ":by-last-checked", lastChecked, entry)
+				end
+				local usage = tonumber(redis.call("HGET", key, entry .. ":usage-count")) or 0
+				redis.call("ZADD", KEYS[1] .. ":by-usage", usage, entry)
+				indexed = indexed + 1
+			end
+		end
+		return indexed
+	`)
+	// ARGV[1..n] -> session ids
+	// Drops the countries no longer storing the sessions from the session
+	// index and returns the number of entries changed.
+	pruneSessionIndexCmd = redis.NewScript(`
+		local pruned = 0
+		for _, id in ipairs(ARGV) do
+			local countries = redis.call("HGET", "session-index", id)
+			if countries then
+				local kept = {}
+				for c in string.gmatch(countries, "[^,]+") do
+					if redis.call("HEXISTS", c .. ":cookies", id) == 1 then
+						table.insert(kept, c)
+					end
+				end
+				local value = table.concat(kept, ",")
+				if value ~= countries then
+					pruned = pruned + 1
+					if #kept == 0 then
+						redis.call("HDEL", "session-index", id)
+					else
+						redis.call("HSET", "session-index", id, value)
+					end
+				end
+			end
+		end
+		return pruned
+	`)
+	// KEYS[1] -> country
+	// ARGV[1] -> old session id
+	// ARGV[2] -> new session id
+	// ARGV[3..n] -> session fields
+	// Moves a stored session to a new id, keeping its fields, stats, list
+	// position and indexes. When the new id is already stored the old session
+	// is removed. Returns 1 if the old session existed, 0 otherwise.
+	renameSessionCmd = redis.NewScript(removeSessionLua + `
+		local key = KEYS[1] .. ":cookies"
+		local old, new = ARGV[1], ARGV[2]
+		if old == new or redis.call("HEXISTS", key, old) == 0 then
+			return 0
+		end
+		local fields = {unpack(ARGV, 3)}
+		if redis.call("HEXISTS", key, new) == 1 then
+			remove_session(KEYS[1], old, fields)
+			return 1
+		end
+		local labels = redis.call("HGET", key, old .. ":labels")
+		if labels then
+			for name, value in pairs(cjson.decode(labels)) do
+				local set = KEYS[1] .. ":label:" .. name .. "=" .. value
+				redis.call("SREM", set, old)
+				redis.call("SADD", set, new)
+			end
+		end
+		local generation = redis.call("HGET", key, old .. ":generation")
+		if generation then
+			local set = KEYS[1] .. ":generation:" .. generation
+			redis.call("SREM", set, old)
+			redis.call("SADD", set, new)
+		end
+		local tier = redis.call("HGET", key, old .. ":tier")
+		if tier then
+			local set = KEYS[1] .. ":tier:" .. tier
+			redis.call("SREM", set, old)
+			redis.call("SADD", set, new)
+		end
+		-- The ids keep their position, except in sharded pools where the new
+		-- id may belong to another shard.
+		local base = KEYS[1] .. ":session-ids"
+		local lists = {KEYS[1] .. ":canary-ids"}
+		if pool_shards(base) <= 1 then
+			table.insert(lists, base)
+		elseif redis.call("LREM", id_list(base, old), 0, old) > 0 then
+			pool_push(base, new)
+		end
+		for _, list in ipairs(lists) do
+			for i, id in ipairs(redis.call("LRANGE", list, 0, -1)) do
+				if id == old then
+					redis.call("LSET", list, i - 1, new)
+				end
+			end
+		end
+		redis.call("HSET", key, new, redis.call("HGET", key, old))
+		redis.call("HDEL", key, old)
+		for _, field in ipairs(fields) do
+			local value = redis.call("HGET", key, old .. ":" .. field)
+			if value then
+				redis.call("HSET", key, new .. ":" .. field, value)
+				redis.call("HDEL", key, old .. ":" .. field)
+			end
+		end
+		local affinity = redis.call("HGETALL", KEYS[1] .. ":affinity")
+		for i = 1, #affinity, 2 do
+			if affinity[i + 1] == old then
+				redis.call("HSET", KEYS[1] .. ":affinity", affinity[i], new)
+			end
+		end
+		for _, zset in ipairs({KEYS[1] .. ":pins", KEYS[1] .. ":by-last-checked", KEYS[1] .. ":by-usage"}) do
+			local score = redis.call("ZSCORE", zset, old)
+			if score then
+				redis.call("ZREM", zset, old)
+				redis.call("ZADD", zset, score, new)
+			end
+		end
+		index_remove(old, KEYS[1])
+		index_add(new, KEYS[1])
+		return 1
+	`)
+	// KEYS[1] -> key for id list (e.g. {<country>}:session-ids)
+	// KEYS[2] -> key for cookies (e.g. {<country>}:cookies)
+	// Returns the tier, number of sessions, total usage count and total
+	// consecutive failures of each tier, flattened.
+	tierStatsCmd = redis.NewScript(poolLua + `
+		local stats, order = {}, {}
+		for _, id in ipairs(pool_ids(KEYS[1])) do
+			local tier = redis.call("HGET", KEYS[2], id .. ":tier") or ""
+			local stat = stats[tier]
+			if not stat then
+				stat = {0, 0, 0}
+				stats[tier] = stat
+				table.insert(order, tier)
+			end
+			stat[1] = stat[1] + 1
+			stat[2] = stat[2] + (tonumber(redis.call("HGET", KEYS[2], id .. ":usage-count")) or 0)
+			stat[3] = stat[3] + (tonumber(redis.call("HGET", KEYS[2], id .. ":failures")) or 0)
+		end
+		local result = {}
+		for _, tier in ipairs(order) do
+			local stat = stats[tier]
+			table.insert(result, tier)
+			table.insert(result, stat[1])
+			table.insert(result, stat[2])
+			table.insert(result, stat[3])
+		end
+		return result
+	`)
+	// KEYS[1..n] -> countries in order of preference
+	// ARGV[1] -> caller, empty for untracked callers
+	// ARGV[2] -> name of the default borrow limit
+	// ARGV[3] -> current time, sessions past their amazon-expires-at are skipped
+	// Pops a session-id from the first country with sessions where the
+	// caller holds fewer sessions than its borrow limit, and records the
+	// borrow. Returns the index of the country and the session id.
+	borrowSessionCmd = redis.NewScript(poolLua + `
+		local caller = ARGV[1]
+		local limited = false
+		for i, country in ipairs(KEYS) do
+			local limit, borrowed = nil, 0
+			if caller ~= "" then
+				limit = redis.call("HGET", country .. ":borrow-limits", caller) or redis.call("HGET", country .. ":borrow-limits", ARGV[2])
+				borrowed = tonumber(redis.call("HGET", country .. ":borrows", caller)) or 0
+			end
+			if limit and borrowed >= tonumber(limit) then
+				limited = true
+			else
+				local id = pool_pop(country .. ":session-ids", country .. ":cookies", tonumber(ARGV[3]))
+				if id then
+					if caller ~= "" then
+						redis.call("HINCRBY", country .. ":borrows", caller, 1)
+						redis.call("HINCRBY", country .. ":borrow-totals", caller, 1)
 					end
+					redis.call("HSET", country .. ":borrowers", id, caller)
+					return {i, id}
 				end
 			end
 		end
+		if limited then
+			return redis.error_reply("FAIR SHARE EXCEEDED")
+		end
+		return redis.error_reply("NOT FOUND")
+	`)
+	// KEYS[1] -> country
+	// ARGV[1] -> session id
+	// Ends the borrow of a session by its caller, if any.
+	releaseBorrowCmd = redis.NewScript(`
+		local caller = redis.call("HGET", KEYS[1] .. ":borrowers", ARGV[1])
+		if not caller then
+			return 0
+		end
+		redis.call("HDEL", KEYS[1] .. ":borrowers", ARGV[1])
+		if caller ~= "" and redis.call("HINCRBY", KEYS[1] .. ":borrows", caller, -1) <= 0 then
+			redis.call("HDEL", KEYS[1] .. ":borrows", caller)
+		end
+		return 1
+	`)
+	// KEYS[1] -> key for the request budget (e.g. {<country>}:budget)
+	// ARGV[1] -> current time
+	// ARGV[2] -> budget window in seconds
+	// ARGV[3] -> requests allowed per window
+	// ARGV[4] -> "1" to take a request from the budget
+	// Returns 0 when the request is allowed, otherwise the time the budget is
+	// renewed. Windows start at multiples of the window length.
+	budgetAllowCmd = redis.NewScript(`
+		local now, window, limit = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+		local start = now - now % window
+		local used = 0
+		if tonumber(redis.call("HGET", KEYS[1], "window-start")) == start then
+			used = tonumber(redis.call("HGET", KEYS[1], "used")) or 0
+		end
+		if used >= limit then
+			return start + window
+		end
+		if ARGV[4] == "1" then
+			redis.call("HSET", KEYS[1], "window-start", start, "used", used + 1)
+		end
+		return 0
+	`)
+	// KEYS[1] -> country
+	// ARGV[1] -> session id
+	// ARGV[2] -> time the pin expires
+	// Takes a session out of its id list and records the pin.
+	pinSessionCmd = redis.NewScript(poolLua + `
+		if redis.call("HEXISTS", KEYS[1] .. ":cookies", ARGV[1]) == 0 then
+			return redis.error_reply("NOT FOUND")
+		end
+		pool_remove(KEYS[1] .. ":session-ids", ARGV[1])
+		redis.call("LREM", KEYS[1] .. ":canary-ids", 0, ARGV[1])
+		redis.call("ZADD", KEYS[1] .. ":pins", ARGV[2], ARGV[1])
+		return redis.status_reply("OK")
+	`)
+	// KEYS[1] -> country
+	// ARGV[1] -> current time
+	// ARGV[2] -> session id to unpin, optional
+	// Puts the given pinned session, or all sessions whose pin expired, back
+	// into their id list. Returns the number of restored sessions.
+	restorePinsCmd = redis.NewScript(pinsLua + `
+		local ids = {}
+		if ARGV[2] then
+			if redis.call("ZSCORE", KEYS[1] .. ":pins", ARGV[2]) then
+				ids = {ARGV[2]}
+			end
+		else
+			ids = redis.call("ZRANGEBYSCORE", KEYS[1] .. ":pins", "-inf", ARGV[1])
+		end
+		for _, id in ipairs(ids) do
+			unpin(KEYS[1], id)
+		end
+		return #ids
+	`)
+	// KEYS[1] -> country
+	// ARGV[1] -> current time
+	// Puts the sessions whose pin expired back into their id list and returns
+	// 2 when the pool is frozen, 1 when it is draining, 0 otherwise.
+	checkoutGateCmd = redis.NewScript(pinsLua + `
+		for _, id in ipairs(redis.call("ZRANGEBYSCORE", KEYS[1] .. ":pins", "-inf", ARGV[1])) do
+			unpin(KEYS[1], id)
+		end
+		if redis.call("EXISTS", KEYS[1] .. ":frozen") == 1 then
+			return 2
+		end
+		return redis.call("EXISTS", KEYS[1] .. ":drain")
+	`)
+	// KEYS[1] -> country
+	// ARGV[1] -> current time
+	// Marks a draining pool as drained once no session is borrowed or
+	// pinned. Returns 1 the first time the pool is found drained.
+	drainIdleCmd = redis.NewScript(`
+		local drain = KEYS[1] .. ":drain"
+		if redis.call("EXISTS", drain) == 0 or redis.call("HEXISTS", drain, "drained-at") == 1 then
+			return 0
+		end
+		if redis.call("HLEN", KEYS[1] .. ":borrowers") > 0 or redis.call("ZCARD", KEYS[1] .. ":pins") > 0 then
+			return 0
+		end
+		redis.call("HSET", drain, "drained-at", ARGV[1])
+		return 1
+	`)
+	// KEYS[1] -> country code (e.g. US)
+	// ARGV[1] -> session id
+	// ARGV[2..n] -> session fields to delete
+	// Moves the raw cookie data of a session to <country>:quarantine and
+	// deletes the session. Returns 1 if the session existed, 0 otherwise.
+	quarantineSessionCmd = redis.NewScript(removeSessionLua + `
+		local cookies = redis.call("HGET", KEYS[1] .. ":cookies", ARGV[1])
+		if not cookies then
+			return 0
+		end
+		redis.call("HSET", KEYS[1] .. ":quarantine", ARGV[1], cookies)
+		remove_session(KEYS[1], ARGV[1], {unpack(ARGV, 2)})
+		return 1
+	`)
+	// KEYS[1] -> country code (e.g. US)
+	// KEYS[2] -> key for the index (e.g. {<country>}:by-last-checked)
+	// ARGV[1] -> start offset in the score range
+	// ARGV[2] -> chunk size
+	// ARGV[3] -> min score of the sessions to remove
+	// ARGV[4] -> max score of the sessions to remove
+	// ARGV[5..n] -> session fields to delete
+	// Removes the sessions of a chunk of a score range of an index, except
+	// the checked out and pinned ones, and drops the entries of deleted
+	// sessions. Returns the number of scanned, removed and dropped entries.
+	cleanupIndexCmd = redis.NewScript(removeSessionLua + `
+		local key = KEYS[1] .. ":cookies"
+		local index = KEYS[2]
+		local fields = {unpack(ARGV, 5)}
+		local ids = redis.call("ZRANGEBYSCORE", index, ARGV[3], ARGV[4], "LIMIT", ARGV[1], ARGV[2])
+		local removed, dropped = 0, 0
+		for _, id in ipairs(ids) do
+			if redis.call("HEXISTS", key, id) == 0 then
+				redis.call("ZREM", index, id)
+				dropped = dropped + 1
+			elseif redis.call("HEXISTS", KEYS[1] .. ":borrowers", id) == 0 and not redis.call("ZSCORE", KEYS[1] .. ":pins", id) then
+				remove_session(KEYS[1], id, fields)
+				removed = removed + 1
+			end
+		end
+		return {#ids, removed, dropped}
+	`)
+	// KEYS[1] -> key for id list (e.g. {<country>}:session-ids)
+	// ARGV[1] -> shard count, 0 or 1 to merge the shards
+	// Moves the ids to their new lists in order and returns their number.
+	shardPoolCmd = redis.NewScript(poolLua + `
+		local ids = pool_ids(KEYS[1])
+		for _, list in ipairs(pool_lists(KEYS[1])) do
+			redis.call("DEL", list)
+		end
+		local n = tonumber(ARGV[1])
+		if n <= 1 then
+			redis.call("DEL", KEYS[1] .. ":shards")
+		else
+			redis.call("SET", KEYS[1] .. ":shards", n)
+		end
+		for _, id in ipairs(ids) do
+			local list = KEYS[1]
+			if n > 1 then
+				list = KEYS[1] .. ":" .. shard_of(id, n)
+			end
+			redis.call("RPUSH", list, id)
+		end
+		return #ids
+	`)
+	// KEYS[1] -> key for cookies (e.g. {<country>}:cookies)
+	// ARGV[1] -> session id
+	// ARGV[2] -> check result, JSON encoded
+	// ARGV[3] -> number of results to keep
+	// A stored history that cannot be decoded is replaced. The latency of the
+	// result, if any, is also recorded.
+	recordCheckCmd = redis.NewScript(latencyLua + `
+		if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+			return redis.error_reply("NOT FOUND")
+		end
+		local field = ARGV[1] .. ":check-history"
+		local history = {}
+		local stored = redis.call("HGET", KEYS[1], field)
+		if stored then
+			local ok, decoded = pcall(cjson.decode, stored)
+			if ok and type(decoded) == "table" then
+				history = decoded
+			end
+		end
+		table.insert(history, cjson.decode(ARGV[2]))
+		while #history > tonumber(ARGV[3]) do
+			table.remove(history, 1)
+		end
+		redis.call("HSET", KEYS[1], field, cjson.encode(history))
+		local latency = tonumber(history[#history].ms) or 0
+		if latency > 0 then
+			record_latency(KEYS[1], ARGV[1], latency)
+		end
+		return #history
+	`)
+	// KEYS[1] -> key for cookies (e.g. {<country>}:cookies)
+	// ARGV[1] -> session id
+	// ARGV[2] -> latency in milliseconds
+	recordLatencyCmd = redis.NewScript(latencyLua + `
+		if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+			return redis.error_reply("NOT FOUND")
+		end
+		record_latency(KEYS[1], ARGV[1], tonumber(ARGV[2]))
 		return redis.status_reply("OK")
 	`)
+	// KEYS[1] -> key for id list (e.g. {<country>}:session-ids)
+	// KEYS[2] -> key for cookies (e.g. {<country>}:cookies)
+	// ARGV[1] -> current time, sessions past their amazon-expires-at are skipped
+	// ARGV[2] -> random number in [0, 1)
+	// ARGV[3] -> latency scale in milliseconds
+	// Sessions are weighted by 1 / (1 + latency / scale); sessions without a
+	// recorded latency get the highest weight, so they are measured soon.
+	lowLatencySessionCmd = redis.NewScript(poolLua + `
+		local ids, weights, total = {}, {}, 0
+		for _, id in ipairs(pool_ids(KEYS[1])) do
+			local expiresAt = redis.call("HGET", KEYS[2], id .. ":amazon-expires-at")
+			if not expiresAt or tonumber(expiresAt) > tonumber(ARGV[1]) then
+				local latency = tonumber(redis.call("HGET", KEYS[2], id .. ":latency-ms")) or 0
+				local weight = 1 / (1 + latency / tonumber(ARGV[3]))
+				table.insert(ids, id)
+				table.insert(weights, weight)
+				total = total + weight
+			end
+		end
+		if #ids == 0 then
+			return redis.error_reply("NOT FOUND")
+		end
+		local target = tonumber(ARGV[2]) * total
+		for i, weight in ipairs(weights) do
+			target = target - weight
+			if target < 0 then
+				return ids[i]
+			end
+		end
+		return ids[#ids]
+	`)
+	// KEYS[1] -> schema version key
+	// ARGV[1] -> schema version
+	// Raises the stored schema version to ARGV[1], never lowering it, and
+	// returns the stored version.
+	setSchemaVersionCmd = redis.NewScript(`
+		local current = tonumber(redis.call("GET", KEYS[1]))
+		if current and current >= tonumber(ARGV[1]) then
+			return current
+		end
+		redis.call("SET", KEYS[1], ARGV[1])
+		return tonumber(ARGV[1])
+	`)
+	// KEYS[1] -> staging key of an atomic import, a list of JSON records
+	// ARGV[1] -> current timestamp, in the configured format
+	// ARGV[2] -> current time, the score of the last-checked index
+	// ARGV[3..n] -> session fields
+	// Stores the staged sessions like storeSession, moves them out of the
+	// countries in remove_from, ends their borrows and deletes the staging
+	// key. Every record is decoded before the first write. Returns the number
+	// of sessions stored.
+	commitImportCmd = redis.NewScript(removeSessionLua + `
+		local records = {}
+		for _, data in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
+			table.insert(records, cjson.decode(data))
+		end
+		local fields = {}
+		for i = 3, #ARGV do
+			table.insert(fields, ARGV[i])
+		end
+		for _, rec in ipairs(records) do
+			local country, id = rec.country, rec.id
+			local key = country .. ":cookies"
+			local exists = redis.call("HEXISTS", key, id) == 1
+			local oldLabels = redis.call("HGET", key, id .. ":labels")
+			local oldGeneration = redis.call("HGET", key, id .. ":generation")
+			local oldTier = redis.call("HGET", key, id .. ":tier")
+			redis.call("HSET", key, id, rec.cookies)
+			if rec.expires_at then
+				redis.call("HSET", key, id .. ":amazon-expires-at", rec.expires_at)
+			else
+				redis.call("HDEL", key, id .. ":amazon-expires-at")
+			end
+			if not exists then
+				redis.call("HSET", key, id .. ":created-at", ARGV[1], id .. ":last-checked", ARGV[1], id .. ":usage-count", 0)
+				redis.call("ZADD", country .. ":by-last-checked", ARGV[2], id)
+				redis.call("ZADD", country .. ":by-usage", 0, id)
+			end
+			if rec.created_at then
+				redis.call("HSET", key, id .. ":created-at", rec.created_at)
+			end
+			if rec.last_checked then
+				redis.call("HSET", key, id .. ":last-checked", rec.last_checked)
+				redis.call("ZADD", country .. ":by-last-checked", rec.last_checked_unix, id)
+			end
+			if rec.usage_count then
+				redis.call("HSET", key, id .. ":usage-count", rec.usage_count)
+				redis.call("ZADD", country .. ":by-usage", rec.usage_count, id)
+			end
+			for name, value in pairs(rec.fields) do
+				redis.call("HSET", key, id .. ":" .. name, value)
+			end
+			if rec.raw_set_cookies then
+				redis.call("HSET", key, id .. ":raw-set-cookies", rec.raw_set_cookies)
+			end
+			if rec.labels ~= cjson.null then
+				if oldLabels then
+					for name, value in pairs(cjson.decode(oldLabels)) do
+						if rec.labels[name] ~= value then
+							redis.call("SREM", country .. ":label:" .. name .. "=" .. value, id)
+						end
+					end
+				end
+				for name, value in pairs(rec.labels) do
+					redis.call("SADD", country .. ":label:" .. name .. "=" .. value, id)
+					redis.call("SADD", country .. ":labels", name .. "=" .. value)
+				end
+				if next(rec.labels) == nil then
+					redis.call("HDEL", key, id .. ":labels")
+				end
+			end
+			if rec.generation then
+				if oldGeneration and oldGeneration ~= rec.generation then
+					redis.call("SREM", country .. ":generation:" .. oldGeneration, id)
+				end
+				redis.call("SADD", country .. ":generation:" .. rec.generation, id)
+				redis.call("SADD", country .. ":generations", rec.generation)
+			end
+			local tier = rec.fields.tier
+			if tier then
+				if oldTier and oldTier ~= tier then
+					redis.call("SREM", country .. ":tier:" .. oldTier, id)
+				end
+				redis.call("SADD", country .. ":tier:" .. tier, id)
+				redis.call("SADD", country .. ":tiers", tier)
+			end
+			local list = id_list(country .. ":session-ids", id)
+			local ids = list
+			if rec.canary then
+				ids = country .. ":canary-ids"
+				redis.call("LREM", list, 0, id)
+			else
+				redis.call("LREM", country .. ":canary-ids", 0, id)
+				redis.call("HDEL", key, id .. ":canary")
+			end
+			local pinned = tonumber(redis.call("ZSCORE", country .. ":pins", id) or 0) > 0
+			if not redis.call("LPOS", ids, id) and not pinned then
+				redis.call("RPUSH", ids, id)
+			end
+			index_add(id, country)
+			for _, other in ipairs(rec.remove_from or {}) do
+				remove_session(other, id, fields)
+			end
+			local borrower = redis.call("HGET", country .. ":borrowers", id)
+			if borrower then
+				redis.call("HDEL", country .. ":borrowers", id)
+				if borrower ~= "" and redis.call("HINCRBY", country .. ":borrows", borrower, -1) <= 0 then
+					redis.call("HDEL", country .. ":borrows", borrower)
+				end
+			end
+		end
+		redis.call("DEL", KEYS[1])
+		return #records
+	`)
+	// KEYS[1] -> idempotency key of a push
+	// ARGV[1] -> session id stored by the push
+	// ARGV[2] -> idempotency window, in milliseconds
+	// Claims the key for the session id. Returns an empty string when it was
+	// claimed, otherwise the session id it was already claimed for.
+	claimIdempotencyKeyCmd = redis.NewScript(`
+		local stored = redis.call("GET", KEYS[1])
+		if stored then
+			return stored
+		end
+		redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+		return ""
+	`)
 )
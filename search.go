@@ -0,0 +1,41 @@
+package amazonsession
+
+import (
+	"context"
+	"strings"
+)
+
+// globEscaper escapes the characters with a special meaning in Redis MATCH
+// patterns.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// SearchSessionIDs returns up to limit session IDs of a country starting with
+// the given prefix, without listing the entire pool. A limit of zero or less
+// returns all matches.
+func (j *AmazonSession) SearchSessionIDs(ctx context.Context, country, prefix string, limit int) ([]string, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+
+	ids := make([]string, 0)
+	iter := j.readClient(ctx).HScan(ctx, cookiesKey(country), 0, globEscaper.Replace(prefix)+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		field := iter.Val()
+		// HSCAN returns fields and values alternately; the value is skipped.
+		if !iter.Next(ctx) {
+			break
+		}
+		// Skip the session fields stored as "<session-id>:<field>".
+		if strings.Contains(field, ":") {
+			continue
+		}
+		ids = append(ids, field)
+		if limit > 0 && len(ids) >= limit {
+			break
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
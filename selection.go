@@ -0,0 +1,103 @@
+package amazonsession
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// SelectOption restricts the sessions considered by GetRandomSession.
+type SelectOption func(*selectOptions)
+
+type selectOptions struct {
+	// filters holds pairs of session field and expected value.
+	filters []interface{}
+	// tiers lists the preferred tiers in order, nil to use
+	// Config.TierPreference.
+	tiers []string
+}
+
+func newSelectOptions(opts []SelectOption) *selectOptions {
+	o := &selectOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func (o *selectOptions) filter(field, value string) {
+	o.filters = append(o.filters, field, value)
+}
+
+// WithPostalCode only selects sessions whose delivery location is set to
+// the given zip/postal code.
+func WithPostalCode(postalCode string) SelectOption {
+	return func(o *selectOptions) {
+		o.filter("postal-code", postalCode)
+	}
+}
+
+// WithBucket only selects sessions assigned to the given A/B experiment
+// bucket.
+func WithBucket(bucket string) SelectOption {
+	return func(o *selectOptions) {
+		o.filter("bucket", bucket)
+	}
+}
+
+// WithTLSProfile only selects sessions created under the given TLS
+// fingerprint profile, so the HTTP layer can reuse the same fingerprint.
+func WithTLSProfile(profile string) SelectOption {
+	return func(o *selectOptions) {
+		o.filter("tls-profile", profile)
+	}
+}
+
+// WithResidency only selects sessions created from the given type of
+// network, e.g. "residential" or "datacenter".
+func WithResidency(residency string) SelectOption {
+	return func(o *selectOptions) {
+		o.filter("residency", residency)
+	}
+}
+
+// WithASN only selects sessions created from an exit IP of the given
+// autonomous system.
+func WithASN(asn string) SelectOption {
+	return func(o *selectOptions) {
+		o.filter("asn", asn)
+	}
+}
+
+// WithTier only selects sessions of the given priority tier.
+func WithTier(tier string) SelectOption {
+	return func(o *selectOptions) {
+		o.filter("tier", tier)
+	}
+}
+
+// WithTierPreference prefers sessions of the given priority tiers in order,
+// overriding Config.TierPreference. A session of a later tier is only
+// selected when no session of an earlier tier matches; sessions of other
+// tiers rank last.
+func WithTierPreference(tiers ...string) SelectOption {
+	return func(o *selectOptions) {
+		o.tiers = append([]string{}, tiers...)
+	}
+}
+
+// getFilteredSessionID picks a random session-id among the sessions matching
+// all field filters, within the most preferred tier with a match.
+func (j *AmazonSession) getFilteredSessionID(ctx context.Context, country string, o *selectOptions) (string, error) {
+	keys := []string{sessionIdsKey(country), cookiesKey(country)}
+	argv := append([]interface{}{scriptRand(), j.clock.Now().Unix(), strings.Join(o.tiers, ",")}, o.filters...)
+	res, err := getFilteredSessionCmd.Run(ctx, j.client, keys, argv...).Result()
+	if err != nil {
+		return "", fmt.Errorf("redis eval error: %v", err)
+	}
+	sessionID, err := replyString(res)
+	if err != nil {
+		return "", fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+	}
+	return sessionID, nil
+}
@@ -0,0 +1,127 @@
+package amazonsession
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Selector picks the session-id of the next session to use for a country.
+// Custom strategies can implement it and be set as Config.Selector.
+type Selector interface {
+	Select(ctx context.Context, country string) (string, error)
+}
+
+// scriptSelector is a built-in Selector running a selection script. It is
+// bound to its AmazonSession by NewAmazonSession.
+type scriptSelector struct {
+	j      *AmazonSession
+	script *redis.Script
+	// args returns the ARGV of the script for the current time.
+	args func(j *AmazonSession, now int64) []interface{}
+	// keys returns the keys the script takes after the id list and cookies
+	// keys, if any.
+	keys func(country string) []string
+}
+
+// RandomSelector picks a random session, like GetRandomSession.
+func RandomSelector() Selector {
+	return &scriptSelector{script: getRandomSessionCmd, args: func(j *AmazonSession, now int64) []interface{} {
+		return []interface{}{scriptRand(), now}
+	}}
+}
+
+// RoundRobinSelector cycles through the sessions of a country using a
+// cursor shared by all processes.
+func RoundRobinSelector() Selector {
+	return &scriptSelector{script: roundRobinSessionCmd, args: nowArgs, keys: func(country string) []string {
+		return []string{roundRobinCursorKey(country)}
+	}}
+}
+
+// LeastUsedSelector picks the session with the lowest usage count, using
+// the usage index of the country.
+func LeastUsedSelector() Selector {
+	return &scriptSelector{script: leastUsedSessionCmd, args: nowArgs, keys: func(country string) []string {
+		return []string{usageIndexKey(country), borrowersKey(country), pinsKey(country)}
+	}}
+}
+
+// LeastRecentlyUsedSelector picks the session with the fewest uses within
+// the last window, at most 24 hours, so sessions used heavily a long time
+// ago are not penalized like LeastUsedSelector does.
+func LeastRecentlyUsedSelector(window time.Duration) Selector {
+	if window <= 0 || window > usageWindowMax {
+		window = usageWindowMax
+	}
+	return &scriptSelector{script: leastRecentlyUsedSessionCmd, args: func(j *AmazonSession, now int64) []interface{} {
+		return []interface{}{now, int64(window / time.Second)}
+	}}
+}
+
+// ScoreWeightedSelector picks a random session weighted by its health, so
+// sessions with consecutive failures are picked less often.
+func ScoreWeightedSelector() Selector {
+	return &scriptSelector{script: scoreWeightedSessionCmd, args: func(j *AmazonSession, now int64) []interface{} {
+		return []interface{}{now, rand.Float64(), int64(j.failureHalfLife / time.Second)}
+	}}
+}
+
+func (s *scriptSelector) Select(ctx context.Context, country string) (string, error) {
+	if s.j == nil {
+		return "", fmt.Errorf("selector is not bound to an AmazonSession")
+	}
+	keys := []string{sessionIdsKey(country), cookiesKey(country)}
+	if s.keys != nil {
+		keys = append(keys, s.keys(country)...)
+	}
+	res, err := s.script.Run(ctx, s.j.client, keys, s.args(s.j, s.j.clock.Now().Unix())...).Result()
+	if err != nil {
+		return "", fmt.Errorf("redis eval error: %v", err)
+	}
+	sessionID, err := replyString(res)
+	if err != nil {
+		return "", fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+	}
+	return sessionID, nil
+}
+
+func nowArgs(j *AmazonSession, now int64) []interface{} {
+	return []interface{}{now}
+}
+
+func roundRobinCursorKey(country string) string {
+	return fmt.Sprintf("%s:rr-cursor", country)
+}
+
+// bindSelector binds a built-in selector to the AmazonSession, defaulting
+// to RandomSelector.
+func (j *AmazonSession) bindSelector(selector Selector) Selector {
+	if selector == nil {
+		selector = RandomSelector()
+	}
+	if s, ok := selector.(*scriptSelector); ok {
+		bound := *s
+		bound.j = j
+		return &bound
+	}
+	return selector
+}
+
+// SelectSession returns a session of a country picked by the configured
+// Selector.
+func (j *AmazonSession) SelectSession(ctx context.Context, country string) (*Session, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.checkout(ctx, country, func() (*Session, error) {
+		sessionID, err := j.selector.Select(ctx, country)
+		if err != nil {
+			return nil, err
+		}
+		return j.GetSession(ctx, country, sessionID)
+	})
+}
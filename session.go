@@ -0,0 +1,440 @@
+package amazonsession
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionFields lists the per-session fields stored next to the cookies in
+// the cookies hash as "<session-id>:<field>". The Lua scripts return them in
+// this order after the cookie data.
+var sessionFields = []string{
+	"usage-count",
+	"last-checked",
+	"created-at",
+	"postal-code",
+	"currency",
+	"language",
+	"account-ref",
+	"labels",
+	"generation",
+	"canary",
+	"bucket",
+	"failures",
+	"amazon-expires-at",
+	"raw-set-cookies",
+	"tls-profile",
+	"proxy",
+	"residency",
+	"asn",
+	"exit-ip-hash",
+	"failure-score",
+	"failure-scored-at",
+	"tier",
+	"usage-window",
+	"check-history",
+	"latency-ms",
+}
+
+func sessionFieldArgs() []interface{} {
+	args := make([]interface{}, len(sessionFields))
+	for i, field := range sessionFields {
+		args[i] = field
+	}
+	return args
+}
+
+// newSessionFromReply creates a session from the cookie data followed by the
+// values of sessionFields, as returned by the Lua scripts. The cookie jar is
+// only built when withJar is set.
+func (j *AmazonSession) newSessionFromReply(countryURL *url.URL, country, sessionID string, values []interface{}, withJar bool) (*Session, error) {
+	if len(values) != len(sessionFields)+1 {
+		return nil, fmt.Errorf("unepxected number of values returned from Lua script")
+	}
+
+	cookieData, err := replyString(values[0])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected value returned from Lua script")
+	}
+
+	// Deserialize the JSON data to recreate the cookiejar.Jar.
+	cookiesMap := make(map[string]string)
+	err = json.Unmarshal([]byte(cookieData), &cookiesMap)
+	if err != nil {
+		return nil, err
+	}
+
+	cookies := buildCookies(countryURL, cookiesMap, cookieExpiry(cookiesMap, j.clock.Now()))
+
+	session := &Session{
+		Country:   country,
+		Cookies:   cookies,
+		SessionID: sessionID,
+	}
+	for i, field := range sessionFields {
+		if err := session.setField(field, values[i+1]); err != nil {
+			return nil, err
+		}
+	}
+	if len(session.RawSetCookies) > 0 {
+		session.Cookies = mergeRawSetCookies(session.Cookies, session.RawSetCookies)
+	}
+	if withJar {
+		session.Jar = newCookieJar(countryURL, session.Cookies)
+	}
+	session.UsageLastHour = usageWithin(session.usageWindow, j.clock.Now(), time.Hour)
+	session.UsageLastDay = usageWithin(session.usageWindow, j.clock.Now(), usageWindowMax)
+	session.ExpiresAt = j.sessionExpiry(unixTime(session.CreatedAt), cookiesMap)
+	session.FailureScore = decayScore(session.FailureScore, session.failureScoredAt, j.clock.Now().Unix(), j.failureHalfLife)
+	return session, nil
+}
+
+// setField sets the struct field matching a stored session field.
+func (s *Session) setField(field string, value interface{}) error {
+	var err error
+	switch field {
+	case "usage-count":
+		s.UsageCount, err = replyInt64(value)
+	case "last-checked":
+		s.LastChecked, err = parseTimestamp(value)
+	case "created-at":
+		s.CreatedAt, err = parseTimestamp(value)
+	case "postal-code":
+		s.PostalCode, err = replyString(value)
+	case "currency":
+		s.Currency, err = replyString(value)
+	case "language":
+		s.Language, err = replyString(value)
+	case "account-ref":
+		s.AccountRef, err = replyString(value)
+	case "canary":
+		var flag string
+		flag, err = replyString(value)
+		s.Canary = flag == "1"
+	case "amazon-expires-at":
+		// Derived from the session-id-time cookie, see sessionExpiry.
+	case "raw-set-cookies":
+		var data string
+		if data, err = replyString(value); err == nil && data != "" {
+			err = json.Unmarshal([]byte(data), &s.RawSetCookies)
+		}
+	case "failure-score":
+		var score string
+		if score, err = replyString(value); err == nil && score != "" {
+			s.FailureScore, err = strconv.ParseFloat(score, 64)
+		}
+	case "failure-scored-at":
+		s.failureScoredAt, err = replyInt64(value)
+	case "failures":
+		s.Failures, err = replyInt64(value)
+	case "residency":
+		s.Residency, err = replyString(value)
+	case "asn":
+		s.ASN, err = replyString(value)
+	case "exit-ip-hash":
+		s.ExitIPHash, err = replyString(value)
+	case "proxy":
+		s.Proxy, err = replyString(value)
+	case "tls-profile":
+		s.TLSProfile, err = replyString(value)
+	case "bucket":
+		s.Bucket, err = replyString(value)
+	case "tier":
+		s.Tier, err = replyString(value)
+	case "usage-window":
+		s.usageWindow, err = replyString(value)
+	case "generation":
+		s.Generation, err = replyString(value)
+	case "latency-ms":
+		var ms int64
+		ms, err = replyInt64(value)
+		s.Latency = time.Duration(ms) * time.Millisecond
+	case "check-history":
+		var data string
+		if data, err = replyString(value); err == nil && data != "" {
+			s.CheckHistory, err = decodeCheckHistory(data)
+		}
+	case "labels":
+		var data string
+		if data, err = replyString(value); err == nil && data != "" {
+			err = json.Unmarshal([]byte(data), &s.Labels)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("unexpected value returned from Lua script")
+	}
+	return nil
+}
+
+// fieldValues returns the optional session fields to store on push. Empty
+// values are skipped so they don't overwrite previously stored ones.
+func (s *Session) fieldValues() map[string]interface{} {
+	fields := make(map[string]interface{})
+	if s.PostalCode != "" {
+		fields["postal-code"] = s.PostalCode
+	}
+	if s.Currency != "" {
+		fields["currency"] = s.Currency
+	}
+	if s.Language != "" {
+		fields["language"] = s.Language
+	}
+	if s.AccountRef != "" {
+		fields["account-ref"] = s.AccountRef
+	}
+	if s.Canary {
+		fields["canary"] = "1"
+	}
+	if s.Residency != "" {
+		fields["residency"] = s.Residency
+	}
+	if s.ASN != "" {
+		fields["asn"] = s.ASN
+	}
+	if s.ExitIPHash != "" {
+		fields["exit-ip-hash"] = s.ExitIPHash
+	}
+	if s.Proxy != "" {
+		fields["proxy"] = s.Proxy
+	}
+	if s.TLSProfile != "" {
+		fields["tls-profile"] = s.TLSProfile
+	}
+	if s.Bucket != "" {
+		fields["bucket"] = s.Bucket
+	}
+	if s.Tier != "" {
+		fields["tier"] = s.Tier
+	}
+	if s.Generation != "" {
+		fields["generation"] = s.Generation
+	}
+	if len(s.Labels) > 0 {
+		if data, err := json.Marshal(s.Labels); err == nil {
+			fields["labels"] = string(data)
+		}
+	}
+	return fields
+}
+
+// NewSession returns a session of a country with the given cookies, to be
+// stored with PushSession. The cookies are copied.
+func NewSession(country, sessionID string, cookies []*http.Cookie) *Session {
+	s := &Session{Country: normalizeCountry(country), SessionID: sessionID}
+	for _, c := range cookies {
+		cookie := *c
+		s.Cookies = append(s.Cookies, &cookie)
+	}
+	return s
+}
+
+// Cookie returns the cookie of the session with the given name.
+func (s *Session) Cookie(name string) (*http.Cookie, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.sessionCookies() {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// SetCookie sets a cookie on the session for its marketplace domain,
+// replacing any cookie with the same name and keeping the cookie jar in sync.
+func (s *Session) SetCookie(name, value string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	countryURL, err := s.countryURL()
+	if err != nil {
+		return err
+	}
+	s.Cookies = s.sessionCookies()
+	s.setCookie(countryURL, name, value, expires)
+	return nil
+}
+
+// DeleteCookie removes the cookie with the given name from the session. The
+// cookie jar, if built, is rebuilt from the remaining cookies.
+func (s *Session) DeleteCookie(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cookies := s.sessionCookies()
+	kept := make([]*http.Cookie, 0, len(cookies))
+	for _, c := range cookies {
+		if c.Name != name {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) == len(cookies) {
+		return
+	}
+	s.Cookies = kept
+	if !telemetryCookies[name] {
+		s.dirty = true
+	}
+	if s.Jar != nil {
+		s.Jar = nil
+		s.cookieJar()
+	}
+}
+
+// Dirty reports whether the cookies of the session were changed since it was
+// loaded or last pushed, see PushSessionIfDirty. Changes of the telemetry
+// cookies set by RefreshTelemetryCookies are not tracked.
+func (s *Session) Dirty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dirty
+}
+
+// Clone returns a deep copy of the session. The cookie jar is not copied and
+// is built on demand by CookieJar.
+func (s *Session) Clone() *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &Session{
+		Country:         s.Country,
+		SessionID:       s.SessionID,
+		UsageCount:      s.UsageCount,
+		UsageLastHour:   s.UsageLastHour,
+		UsageLastDay:    s.UsageLastDay,
+		LastChecked:     s.LastChecked,
+		CreatedAt:       s.CreatedAt,
+		PostalCode:      s.PostalCode,
+		Currency:        s.Currency,
+		Language:        s.Language,
+		AccountRef:      s.AccountRef,
+		Generation:      s.Generation,
+		Canary:          s.Canary,
+		Residency:       s.Residency,
+		ASN:             s.ASN,
+		ExitIPHash:      s.ExitIPHash,
+		Proxy:           s.Proxy,
+		TLSProfile:      s.TLSProfile,
+		Bucket:          s.Bucket,
+		Tier:            s.Tier,
+		RawSetCookies:   append([]string(nil), s.RawSetCookies...),
+		ExpiresAt:       s.ExpiresAt,
+		FailureScore:    s.FailureScore,
+		Failures:        s.Failures,
+		Latency:         s.Latency,
+		failureScoredAt: s.failureScoredAt,
+		usageWindow:     s.usageWindow,
+		dirty:           s.dirty,
+	}
+	for _, cookie := range s.sessionCookies() {
+		cookie := *cookie
+		c.Cookies = append(c.Cookies, &cookie)
+	}
+	if s.Labels != nil {
+		c.Labels = make(map[string]string, len(s.Labels))
+		for name, value := range s.Labels {
+			c.Labels[name] = value
+		}
+	}
+	if s.CheckHistory != nil {
+		c.CheckHistory = append([]CheckResult(nil), s.CheckHistory...)
+	}
+	return c
+}
+
+// countryURL returns the marketplace URL of the session country.
+func (s *Session) countryURL() (*url.URL, error) {
+	marketplace, found := LookupMarketplace(s.Country)
+	if !found {
+		return nil, fmt.Errorf("domain not found for country: %s", s.Country)
+	}
+	return url.Parse(marketplace.Domain)
+}
+
+// setCookie sets a cookie on the session, replacing any cookie with the same
+// name, and keeps the cookie jar in sync. The caller must hold s.mu.
+func (s *Session) setCookie(countryURL *url.URL, name, value string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:    name,
+		Value:   value,
+		Path:    "/",
+		Domain:  countryURL.Host,
+		Expires: expires,
+	}
+
+	replaced := false
+	for i, item := range s.Cookies {
+		if item.Name == name {
+			s.Cookies[i] = cookie
+			replaced = true
+		}
+	}
+	if !replaced {
+		s.Cookies = append(s.Cookies, cookie)
+	}
+	if !telemetryCookies[name] {
+		s.dirty = true
+	}
+
+	if s.Jar != nil {
+		s.Jar.SetCookies(countryURL, []*http.Cookie{cookie})
+	}
+}
+
+// CookieJar returns the cookie jar of the session, building it from the
+// cookies on first use when the session was loaded without one.
+func (s *Session) CookieJar() (*cookiejar.Jar, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cookieJar()
+}
+
+func (s *Session) cookieJar() (*cookiejar.Jar, error) {
+	if s.Jar != nil {
+		return s.Jar, nil
+	}
+	countryURL, err := s.countryURL()
+	if err != nil {
+		return nil, err
+	}
+	s.Jar = newCookieJar(countryURL, s.Cookies)
+	return s.Jar, nil
+}
+
+// sessionCookies returns the cookies of the session, falling back to the
+// cookie jar when the Cookies slice is empty. The caller must hold s.mu.
+func (s *Session) sessionCookies() []*http.Cookie {
+	if len(s.Cookies) > 0 || s.Jar == nil {
+		return s.Cookies
+	}
+	countryURL, err := s.countryURL()
+	if err != nil {
+		return nil
+	}
+	return s.Jar.Cookies(countryURL)
+}
+
+// CookieHeader returns the session cookies formatted as the value of a
+// Cookie request header, for HTTP stacks that don't use a cookie jar.
+func (s *Session) CookieHeader() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cookies := s.sessionCookies()
+	pairs := make([]string, 0, len(cookies))
+	for _, c := range cookies {
+		pairs = append(pairs, (&http.Cookie{Name: c.Name, Value: c.Value}).String())
+	}
+	return strings.Join(pairs, "; ")
+}
+
+// ApplyTo adds the session cookies to the request.
+func (s *Session) ApplyTo(req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.sessionCookies() {
+		req.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	}
+}
@@ -0,0 +1,219 @@
+package amazonsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sessionIndexKey is the key of the global hash mapping each session-id to
+// the comma-separated countries it is stored in.
+const sessionIndexKey = "session-index"
+
+// CrossCountryMode selects how PushSession handles a session-id already
+// stored under another country, see Config.CrossCountryPush.
+type CrossCountryMode int
+
+const (
+	// CrossCountryAllow stores the session in both countries and records
+	// both in the session index.
+	CrossCountryAllow CrossCountryMode = iota
+	// CrossCountryReject refuses the push with a *SessionConflictError.
+	CrossCountryReject
+	// CrossCountryMerge moves the session to the pushed country: stored
+	// metadata and counters fill in what the pushed session leaves empty,
+	// and the session is deleted from the other countries.
+	CrossCountryMerge
+)
+
+// SessionConflictError is returned by PushSession in CrossCountryReject mode
+// for a session-id already stored under other countries.
+type SessionConflictError struct {
+	SessionID string   // SessionID is the conflicting session-id
+	Countries []string // Countries are the countries the session is stored in
+}
+
+func (e *SessionConflictError) Error() string {
+	return fmt.Sprintf("session %s already stored for countries: %s", e.SessionID, strings.Join(e.Countries, ","))
+}
+
+// sessionCountries returns the countries a session-id is stored in,
+// according to the session index.
+func (j *AmazonSession) sessionCountries(ctx context.Context, sessionID string) ([]string, error) {
+	countries, err := j.readClient(ctx).HGet(ctx, sessionIndexKey, sessionID).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(countries, ","), nil
+}
+
+// resolveCrossCountry applies the CrossCountryMode to a session about to be
+// pushed to country. It returns the push options to use and the other
+// countries the session must be deleted from once stored.
+func (j *AmazonSession) resolveCrossCountry(ctx context.Context, session *Session, country, sessionID string, opts *PushOptions) (*PushOptions, []string, error) {
+	if j.crossCountryPush == CrossCountryAllow {
+		return opts, nil, nil
+	}
+	// Conflicts are resolved against the primary.
+	ctx = WithReadPreference(ctx, ReadPrimary)
+	countries, err := j.sessionCountries(ctx, sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var others []string
+	for _, c := range countries {
+		if c != country {
+			others = append(others, c)
+		}
+	}
+	if len(others) == 0 {
+		return opts, nil, nil
+	}
+	if j.crossCountryPush == CrossCountryReject {
+		return nil, nil, &SessionConflictError{SessionID: sessionID, Countries: others}
+	}
+
+	stored, err := j.listSessionsByIDs(ctx, others[0], []string{sessionID})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(stored) == 0 {
+		return opts, others, nil
+	}
+	session.mergeMetadata(stored[0])
+	merged := &PushOptions{}
+	if opts != nil {
+		*merged = *opts
+	}
+	if merged.UsageCount == 0 {
+		merged.UsageCount = stored[0].UsageCount
+	}
+	if merged.CreatedAt.IsZero() {
+		merged.CreatedAt = stored[0].CreatedAt
+	}
+	if merged.LastChecked.IsZero() {
+		merged.LastChecked = stored[0].LastChecked
+	}
+	return merged, others, nil
+}
+
+// mergeMetadata fills the empty optional fields of s from other.
+func (s *Session) mergeMetadata(other *Session) {
+	fill := func(dst *string, src string) {
+		if *dst == "" {
+			*dst = src
+		}
+	}
+	fill(&s.PostalCode, other.PostalCode)
+	fill(&s.Currency, other.Currency)
+	fill(&s.Language, other.Language)
+	fill(&s.AccountRef, other.AccountRef)
+	fill(&s.Generation, other.Generation)
+	fill(&s.Bucket, other.Bucket)
+	fill(&s.Tier, other.Tier)
+	fill(&s.TLSProfile, other.TLSProfile)
+	fill(&s.Proxy, other.Proxy)
+	fill(&s.Residency, other.Residency)
+	fill(&s.ASN, other.ASN)
+	fill(&s.ExitIPHash, other.ExitIPHash)
+	if s.Labels == nil {
+		s.Labels = other.Labels
+	}
+}
+
+// removeFromCountries deletes a session from the given countries.
+func (j *AmazonSession) removeFromCountries(ctx context.Context, sessionID string, countries []string) error {
+	args := append([]interface{}{sessionID}, sessionFieldArgs()...)
+	for _, country := range countries {
+		if err := deleteSessionCmd.Run(ctx, j.client, []string{country}, args...).Err(); err != nil {
+			return fmt.Errorf("redis eval error: %v", err)
+		}
+	}
+	return nil
+}
+
+// LookupSession returns a session by its session-id alone, resolving the
+// country it is stored in through the session index maintained on push and
+// delete. A session stored in several countries (see CrossCountryAllow) is
+// returned from the country it was first pushed to. Like GetSession, it
+// increments the usage count.
+func (j *AmazonSession) LookupSession(ctx context.Context, sessionID string) (*Session, error) {
+	countries, err := j.LookupSessionCountries(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if len(countries) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+	return j.GetSession(ctx, countries[0], sessionID)
+}
+
+// LookupSessionCountries returns the countries a session-id is stored in,
+// according to the session index.
+func (j *AmazonSession) LookupSessionCountries(ctx context.Context, sessionID string) ([]string, error) {
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return j.sessionCountries(ctx, sessionID)
+}
+
+// RebuildResult reports the work done by RebuildIndexes.
+type RebuildResult struct {
+	Indexed map[string]int64 // Indexed is the number of sessions indexed per country
+	Pruned  int64            // Pruned is the number of session index entries that referenced deleted sessions
+}
+
+// RebuildIndexes backfills the session index and the label and generation
+// indexes of all stored countries, e.g. for pools created by older versions
+// of the package, and drops index entries of deleted sessions. Each country
+// is rebuilt by one script, so it is safe to run on a live pool.
+func (j *AmazonSession) RebuildIndexes(ctx context.Context) (*RebuildResult, error) {
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+	countries, err := j.storedCountries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := &RebuildResult{Indexed: make(map[string]int64)}
+	for _, country := range countries {
+		res, err := rebuildIndexesCmd.Run(ctx, j.client, []string{country}, sessionFieldArgs()...).Result()
+		if err != nil {
+			return nil, fmt.Errorf("redis eval error: %v", err)
+		}
+		if result.Indexed[country], err = replyInt64(res); err != nil {
+			return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+		}
+	}
+
+	var cursor uint64
+	for {
+		entries, next, err := j.client.HScan(ctx, sessionIndexKey, cursor, "*", 100).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session index: %v", err)
+		}
+		// HSCAN returns field/value pairs.
+		ids := make([]interface{}, 0, len(entries)/2)
+		for i := 0; i < len(entries); i += 2 {
+			ids = append(ids, entries[i])
+		}
+		if len(ids) > 0 {
+			res, err := pruneSessionIndexCmd.Run(ctx, j.client, []string{}, ids...).Result()
+			if err != nil {
+				return nil, fmt.Errorf("redis eval error: %v", err)
+			}
+			pruned, err := replyInt64(res)
+			if err != nil {
+				return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+			}
+			result.Pruned += pruned
+		}
+		if cursor = next; cursor == 0 {
+			return result, nil
+		}
+	}
+}
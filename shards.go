@@ -0,0 +1,149 @@
+package amazonsession
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// maxPoolShards is the highest shard count accepted by ShardPool.
+const maxPoolShards = 1024
+
+// shardCountKey returns the key holding the shard count of the pool of a
+// country. It is missing for pools that are not sharded.
+func shardCountKey(country string) string {
+	return fmt.Sprintf("%s:shards", sessionIdsKey(country))
+}
+
+// shardKey returns the key of one shard of the id list of a country.
+func shardKey(country string, shard int) string {
+	return fmt.Sprintf("%s:%d", sessionIdsKey(country), shard)
+}
+
+// shardOf returns the shard of a session-id in a pool of the given number of
+// shards. It must match shard_of in poolLua.
+func shardOf(sessionID string, shards int) int {
+	var h int64
+	for i := 0; i < len(sessionID); i++ {
+		h = (h*31 + int64(sessionID[i])) % 2147483647
+	}
+	return int(h % int64(shards))
+}
+
+// poolShards returns the shard count of the pool of a country, 0 for pools
+// that are not sharded.
+func poolShards(ctx context.Context, c redis.Cmdable, country string) (int, error) {
+	shards, err := c.Get(ctx, shardCountKey(country)).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error getting shard count: %v", err)
+	}
+	return shards, nil
+}
+
+// poolListKeys returns the keys of the id lists of the pool of a country:
+// the session-ids list, or its shards.
+func poolListKeys(ctx context.Context, c redis.Cmdable, country string) ([]string, error) {
+	shards, err := poolShards(ctx, c, country)
+	if err != nil {
+		return nil, err
+	}
+	if shards <= 1 {
+		return []string{sessionIdsKey(country)}, nil
+	}
+	keys := make([]string, shards)
+	for i := range keys {
+		keys[i] = shardKey(country, i)
+	}
+	return keys, nil
+}
+
+// idListKey returns the key of the id list holding a session-id in the pool
+// of a country.
+func idListKey(ctx context.Context, c redis.Cmdable, country, sessionID string) (string, error) {
+	shards, err := poolShards(ctx, c, country)
+	if err != nil {
+		return "", err
+	}
+	if shards <= 1 {
+		return sessionIdsKey(country), nil
+	}
+	return shardKey(country, shardOf(sessionID, shards)), nil
+}
+
+// poolSize returns the number of session-ids in the pool of a country.
+func poolSize(ctx context.Context, c redis.Cmdable, country string) (int64, error) {
+	keys, err := poolListKeys(ctx, c, country)
+	if err != nil {
+		return 0, err
+	}
+	cmds := make([]*redis.IntCmd, len(keys))
+	_, err = c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.LLen(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, cmd := range cmds {
+		size += cmd.Val()
+	}
+	return size, nil
+}
+
+// poolIDs returns the session-ids in the pool of a country, shard by shard.
+func poolIDs(ctx context.Context, c redis.Cmdable, country string) ([]string, error) {
+	keys, err := poolListKeys(ctx, c, country)
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]*redis.StringSliceCmd, len(keys))
+	_, err = c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.LRange(ctx, key, 0, -1)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, cmd := range cmds {
+		ids = append(ids, cmd.Val()...)
+	}
+	return ids, nil
+}
+
+// ShardPool spreads the id list of a country over the given number of
+// shards, by a hash of the session-id, to keep the lists of very large pools
+// small. Selection then picks a shard first. A shard count of 0 or 1 merges
+// the shards back into a single list. The shard count is stored in Redis and
+// applies to all processes sharing the pool; the ids are moved in a single
+// script, which blocks Redis for the time of the move.
+func (j *AmazonSession) ShardPool(ctx context.Context, country string, shards int) error {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+	if shards < 0 || shards > maxPoolShards {
+		return fmt.Errorf("invalid shard count %d: must be between 0 and %d", shards, maxPoolShards)
+	}
+	if err := shardPoolCmd.Run(ctx, j.client, []string{sessionIdsKey(country)}, shards).Err(); err != nil {
+		return fmt.Errorf("redis eval error: %v", err)
+	}
+	return nil
+}
+
+// PoolShards returns the shard count of the pool of a country, 0 for pools
+// that are not sharded.
+func (j *AmazonSession) PoolShards(ctx context.Context, country string) (int, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	return poolShards(ctx, j.readClient(ctx), country)
+}
@@ -0,0 +1,170 @@
+package amazonsession
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// snapshotVolatileFields are the JSON fields of sessions that change with
+// every use and are not compared by DiffSnapshots.
+var snapshotVolatileFields = map[string]bool{
+	"usage_count":     true,
+	"usage_last_hour": true,
+	"usage_last_day":  true,
+	"last_checked_at": true,
+}
+
+// SnapshotDiff is the difference between two exports, see DiffSnapshots.
+// The sessions are sorted by country and session-id.
+type SnapshotDiff struct {
+	Added   []*Session       // Added are the sessions only in the second export
+	Removed []*Session       // Removed are the sessions only in the first export
+	Changed []*SessionChange // Changed are the sessions in both exports whose fields differ
+}
+
+// SessionChange is a session that differs between two exports.
+type SessionChange struct {
+	Before *Session // Before is the session in the first export
+	After  *Session // After is the session in the second export
+	Fields []string // Fields are the JSON names of the changed fields, sorted
+}
+
+// ExportSessions writes the sessions of all countries to w, one JSON session
+// per line, in the format read by ImportSessions and DiffSnapshots. Like
+// GetAllSessions, the export is not a consistent snapshot of a pool in use.
+func (j *AmazonSession) ExportSessions(ctx context.Context, w io.Writer) error {
+	sessions, err := j.GetAllSessions(ctx)
+	if err != nil {
+		return err
+	}
+	sortSessions(sessions)
+	enc := json.NewEncoder(w)
+	for _, session := range sessions {
+		if err := enc.Encode(session); err != nil {
+			return fmt.Errorf("failed to write export: %v", err)
+		}
+	}
+	return nil
+}
+
+// DiffSnapshots compares two exports in the format of ExportSessions and
+// returns the sessions added, removed and changed from a to b, matched by
+// country and session-id. Cookies are compared by name and value; the usage
+// counters and the last-checked time are ignored as they change with every
+// use.
+func DiffSnapshots(a, b io.Reader) (*SnapshotDiff, error) {
+	before, err := readSnapshot(a)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot a: %v", err)
+	}
+	after, err := readSnapshot(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot b: %v", err)
+	}
+
+	diff := &SnapshotDiff{}
+	for key, session := range after {
+		previous, found := before[key]
+		if !found {
+			diff.Added = append(diff.Added, session)
+			continue
+		}
+		fields, err := changedFields(previous, session)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) > 0 {
+			diff.Changed = append(diff.Changed, &SessionChange{Before: previous, After: session, Fields: fields})
+		}
+	}
+	for key, session := range before {
+		if _, found := after[key]; !found {
+			diff.Removed = append(diff.Removed, session)
+		}
+	}
+	sortSessions(diff.Added)
+	sortSessions(diff.Removed)
+	sort.Slice(diff.Changed, func(x, y int) bool {
+		return sessionLess(diff.Changed[x].After, diff.Changed[y].After)
+	})
+	return diff, nil
+}
+
+// readSnapshot reads an export, keyed by country and session-id.
+func readSnapshot(r io.Reader) (map[string]*Session, error) {
+	sessions, errs, err := readImportRecords(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := errs.result(len(sessions)); err != nil {
+		return nil, err
+	}
+	snapshot := make(map[string]*Session, len(sessions))
+	for _, session := range sessions {
+		session.Country = normalizeCountry(session.Country)
+		snapshot[session.Country+":"+itemSessionID(session)] = session
+	}
+	return snapshot, nil
+}
+
+// changedFields returns the JSON names of the fields that differ between
+// two versions of a session.
+func changedFields(before, after *Session) ([]string, error) {
+	x, err := snapshotFields(before)
+	if err != nil {
+		return nil, err
+	}
+	y, err := snapshotFields(after)
+	if err != nil {
+		return nil, err
+	}
+	var fields []string
+	for name, value := range y {
+		if !reflect.DeepEqual(x[name], value) {
+			fields = append(fields, name)
+		}
+	}
+	for name := range x {
+		if _, found := y[name]; !found {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
+
+// snapshotFields returns the compared fields of a session by JSON name.
+func snapshotFields(session *Session) (map[string]interface{}, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name := range snapshotVolatileFields {
+		delete(fields, name)
+	}
+	cookies := make(map[string]string)
+	for _, c := range session.Cookies {
+		cookies[c.Name] = c.Value
+	}
+	fields["cookies"] = cookies
+	return fields, nil
+}
+
+func sortSessions(sessions []*Session) {
+	sort.Slice(sessions, func(x, y int) bool { return sessionLess(sessions[x], sessions[y]) })
+}
+
+func sessionLess(a, b *Session) bool {
+	if a.Country != b.Country {
+		return a.Country < b.Country
+	}
+	return itemSessionID(a) < itemSessionID(b)
+}
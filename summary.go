@@ -0,0 +1,89 @@
+package amazonsession
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// CountrySummary holds the pool statistics of a country.
+type CountrySummary struct {
+	Country      string  `json:"country"`      // Country is the country code
+	PoolSize     int64   `json:"pool_size"`    // PoolSize is the number of sessions in the main pool
+	Canaries     int64   `json:"canaries"`     // Canaries is the number of canary sessions
+	FailingCount int64   `json:"failing"`      // FailingCount is the number of sessions with consecutive failures
+	FailureRate  float64 `json:"failure_rate"` // FailureRate is FailingCount relative to PoolSize
+	StalestAge   int64   `json:"stalest_age"`  // StalestAge is the time since the least recently checked session was checked, in seconds
+	CheckedOut   int64   `json:"checked_out"`  // CheckedOut is the number of sessions taken with PopSession and not returned yet
+	Pinned       int64   `json:"pinned"`       // Pinned is the number of sessions reserved with Pin
+	Utilization  float64 `json:"utilization"`  // Utilization is the share of sessions checked out or pinned, of all sessions of the pool
+}
+
+// Summary is the pool summary of all marketplaces.
+type Summary struct {
+	Time      int64             `json:"time"` // Time is the time of the summary, in Unix time
+	Countries []*CountrySummary `json:"countries"`
+}
+
+// GetSummary returns the pool sizes, failure rates and stalest session age
+// of every marketplace, computed in a single script.
+func (j *AmazonSession) GetSummary(ctx context.Context) (*Summary, error) {
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+	marketplaces := Marketplaces()
+	argv := make([]interface{}, len(marketplaces))
+	for i, marketplace := range marketplaces {
+		argv[i] = marketplace.Country
+	}
+	res, err := summaryCmd.Run(ctx, j.readClient(ctx), []string{}, argv...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis eval error: %v", err)
+	}
+	data, err := replySlice(res)
+	if err != nil {
+		return nil, err
+	}
+
+	now := j.clock.Now().Unix()
+	summary := &Summary{Time: now, Countries: make([]*CountrySummary, 0, len(marketplaces))}
+	for i := 0; i+7 <= len(data); i += 7 {
+		country, err := replyString(data[i])
+		if err != nil {
+			return nil, err
+		}
+		values := make([]int64, 6)
+		for k := range values {
+			if values[k], err = replyInt64(data[i+1+k]); err != nil {
+				return nil, err
+			}
+		}
+		cs := &CountrySummary{Country: country, PoolSize: values[0], Canaries: values[1], FailingCount: values[2], CheckedOut: values[4], Pinned: values[5]}
+		if cs.PoolSize > 0 {
+			cs.FailureRate = float64(cs.FailingCount) / float64(cs.PoolSize)
+		}
+		if values[3] > 0 {
+			cs.StalestAge = now - values[3]
+		}
+		// Sessions in the pool are idle, the others are in use.
+		if inUse := cs.CheckedOut + cs.Pinned; inUse > 0 {
+			cs.Utilization = float64(inUse) / float64(inUse+cs.PoolSize)
+		}
+		summary.Countries = append(summary.Countries, cs)
+	}
+	return summary, nil
+}
+
+// SummaryHandler returns an HTTP handler serving GetSummary as JSON, to be
+// scraped by Grafana's JSON datasource or a cron job.
+func (j *AmazonSession) SummaryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		summary, err := j.GetSummary(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summary)
+	})
+}
@@ -0,0 +1,50 @@
+package amazonsession
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const requestIDAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// generateRequestID returns a random ID in the 20 character format of the
+// x-amz-rid request IDs referenced by the csm-hit cookie.
+func generateRequestID() string {
+	var b strings.Builder
+	for i := 0; i < 20; i++ {
+		b.WriteByte(requestIDAlphabet[rand.Intn(len(requestIDAlphabet))])
+	}
+	return b.String()
+}
+
+// NewCSMHit returns a csm-hit cookie value for a page load at now, in the
+// "tb:s-<request-id>|<ms>&t:<ms>&adb:adblk_no" format written by Amazon's
+// client-side metrics script in browsers.
+func NewCSMHit(now time.Time) string {
+	ms := now.UnixNano() / int64(time.Millisecond)
+	return fmt.Sprintf("tb:s-%s|%d&t:%d&adb:adblk_no", generateRequestID(), ms, ms)
+}
+
+// telemetryCookies are the cookies refreshed on every request, which do not
+// mark a session dirty.
+var telemetryCookies = map[string]bool{"csm-hit": true}
+
+// RefreshTelemetryCookies sets a fresh csm-hit cookie on the session, as a
+// browser does on every page load, so requests don't all carry the same
+// static telemetry cookie. Call it before each request; the cookie is not
+// stored in Redis unless the session is pushed again, and does not mark the
+// session dirty, see PushSessionIfDirty.
+func (j *AmazonSession) RefreshTelemetryCookies(session *Session) error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.Country = normalizeCountry(session.Country)
+	countryURL, err := j.getCountryURL(session.Country)
+	if err != nil {
+		return err
+	}
+	now := j.clock.Now()
+	session.setCookie(countryURL, "csm-hit", NewCSMHit(now), now.AddDate(1, 0, 0))
+	return nil
+}
@@ -0,0 +1,105 @@
+package amazonsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// tierIndexKey returns the key of the set indexing the sessions of a country
+// in a priority tier.
+func tierIndexKey(country, tier string) string {
+	return fmt.Sprintf("%s:tier:%s", country, tier)
+}
+
+// tierRegistryKey returns the key of the set of all tiers indexed for a
+// country.
+func tierRegistryKey(country string) string {
+	return fmt.Sprintf("%s:tiers", country)
+}
+
+// updateTierIndex queues the index update for the tier of a session on the
+// pipeline. An empty tier keeps the stored one.
+func (j *AmazonSession) updateTierIndex(ctx context.Context, pipe redis.Pipeliner, country, sessionID, tier string) error {
+	if tier == "" {
+		return nil
+	}
+	old, err := j.client.HGet(ctx, cookiesKey(country), sessionFieldKey(sessionID, "tier")).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("error getting session tier: %v", err)
+	}
+	if old != "" && old != tier {
+		pipe.SRem(ctx, tierIndexKey(country, old), sessionID)
+	}
+	pipe.SAdd(ctx, tierIndexKey(country, tier), sessionID)
+	pipe.SAdd(ctx, tierRegistryKey(country), tier)
+	return nil
+}
+
+// getTierSessionID picks a random session-id of the first of the tiers with
+// a session in the pool, from the tier indexes. It returns an empty id when
+// none of the tiers has one.
+func (j *AmazonSession) getTierSessionID(ctx context.Context, country string, tiers []string) (string, error) {
+	argv := []interface{}{j.clock.Now().Unix()}
+	for _, tier := range tiers {
+		argv = append(argv, tier)
+	}
+	res, err := getTierSessionCmd.Run(ctx, j.client, []string{country}, argv...).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "NOT FOUND") {
+			return "", nil
+		}
+		return "", fmt.Errorf("redis eval error: %v", err)
+	}
+	sessionID, err := replyString(res)
+	if err != nil {
+		return "", fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+	}
+	return sessionID, nil
+}
+
+// TierStat holds the statistics of a priority tier of a country pool.
+type TierStat struct {
+	Tier       string `json:"tier"`        // Tier is the tier name, empty for sessions without a tier
+	Sessions   int64  `json:"sessions"`    // Sessions is the number of sessions in the pool
+	UsageCount int64  `json:"usage_count"` // UsageCount is the total usage count of the sessions
+	Failures   int64  `json:"failures"`    // Failures is the total number of consecutive failed checks of the sessions
+}
+
+// TierStats returns the statistics of each priority tier of the sessions in
+// the pool of a country, in order of first appearance in the pool.
+func (j *AmazonSession) TierStats(ctx context.Context, country string) ([]TierStat, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opLong)
+	defer cancel()
+	keys := []string{sessionIdsKey(country), cookiesKey(country)}
+	res, err := tierStatsCmd.Run(ctx, j.readClient(ctx), keys).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis eval error: %v", err)
+	}
+	values, err := replySlice(res)
+	if err != nil || len(values)%4 != 0 {
+		return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+	}
+	stats := make([]TierStat, 0, len(values)/4)
+	for i := 0; i < len(values); i += 4 {
+		var stat TierStat
+		if stat.Tier, err = replyString(values[i]); err != nil {
+			return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", err)
+		}
+		if stat.Sessions, err = replyInt64(values[i+1]); err != nil {
+			return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", err)
+		}
+		if stat.UsageCount, err = replyInt64(values[i+2]); err != nil {
+			return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", err)
+		}
+		if stat.Failures, err = replyInt64(values[i+3]); err != nil {
+			return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", err)
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
@@ -0,0 +1,40 @@
+package amazonsession
+
+import (
+	"context"
+	"time"
+)
+
+type opTimeoutKey struct{}
+
+// WithOpTimeout returns a context that makes the AmazonSession methods
+// called with it use the given deadline for each Redis operation, instead of
+// the OpTimeout or ScriptTimeout of the Config.
+func WithOpTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, opTimeoutKey{}, timeout)
+}
+
+// opKind distinguishes single-key operations from long-running scripts that
+// scan whole pools.
+type opKind int
+
+const (
+	opShort opKind = iota
+	opLong
+)
+
+// opContext applies the operation deadline to the context. A timeout set
+// with WithOpTimeout takes precedence over the configured defaults.
+func (j *AmazonSession) opContext(ctx context.Context, kind opKind) (context.Context, context.CancelFunc) {
+	timeout, found := ctx.Value(opTimeoutKey{}).(time.Duration)
+	if !found {
+		timeout = j.opTimeout
+		if kind == opLong {
+			timeout = j.scriptTimeout
+		}
+	}
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
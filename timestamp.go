@@ -0,0 +1,53 @@
+package amazonsession
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// TimestampFormat is the format the created-at and last-checked timestamps
+// of sessions are stored in.
+type TimestampFormat int
+
+const (
+	// TimestampUnix stores timestamps as Unix time in seconds.
+	TimestampUnix TimestampFormat = iota
+	// TimestampRFC3339 stores timestamps as RFC 3339 strings in UTC, which
+	// are easier to read when inspecting Redis directly.
+	TimestampRFC3339
+)
+
+// formatTimestamp returns the stored representation of t.
+func (j *AmazonSession) formatTimestamp(t time.Time) interface{} {
+	if j.timestampFormat == TimestampRFC3339 {
+		return t.UTC().Format(time.RFC3339)
+	}
+	return t.Unix()
+}
+
+// parseTimestamp reads a stored timestamp in either format, so pools
+// written before a format change stay readable. Missing values are returned
+// as the zero time.
+func parseTimestamp(value interface{}) (time.Time, error) {
+	s, err := replyString(value)
+	if err != nil || s == "" {
+		return time.Time{}, err
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unexpected timestamp returned from Lua script: %q", s)
+	}
+	return t, nil
+}
+
+// unixTime returns t in Unix time, or zero for the zero time.
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,81 @@
+package amazonsession
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// TouchOption configures TouchSession.
+type TouchOption func(*touchOptions)
+
+type touchOptions struct {
+	resetFailures bool
+}
+
+// WithResetFailures also resets the consecutive-failure counter of the
+// session.
+func WithResetFailures() TouchOption {
+	return func(o *touchOptions) {
+		o.resetFailures = true
+	}
+}
+
+// TouchSession marks a successful check of a session: it updates the "last
+// checked" timestamp and, with WithResetFailures, clears the
+// consecutive-failure counter in the same script.
+func (j *AmazonSession) TouchSession(ctx context.Context, country, sessionID string, opts ...TouchOption) error {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	o := &touchOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	reset := "0"
+	if o.resetFailures {
+		reset = "1"
+	}
+	now := j.clock.Now()
+	keys := []string{cookiesKey(country), lastCheckedIndexKey(country)}
+	err := touchSessionCmd.Run(ctx, j.client, keys, sessionID, j.formatTimestamp(now), reset, now.Unix()).Err()
+	if err != nil {
+		return fmt.Errorf("redis eval error: %v", err)
+	}
+	return j.breakerRecord(ctx, country, false)
+}
+
+// RecordFailure increments the consecutive-failure counter of a session and
+// returns the new count. It also adds one to the failure score of the
+// session, which decays over time with Config.FailureHalfLife.
+func (j *AmazonSession) RecordFailure(ctx context.Context, country, sessionID string) (int64, error) {
+	country = normalizeCountry(country)
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	args := []interface{}{sessionID, j.clock.Now().Unix(), int64(j.failureHalfLife / time.Second)}
+	res, err := recordFailureCmd.Run(ctx, j.client, []string{cookiesKey(country)}, args...).Result()
+	if err != nil {
+		return 0, fmt.Errorf("redis eval error: %v", err)
+	}
+	failures, err := replyInt64(res)
+	if err != nil {
+		return 0, err
+	}
+	if err := j.breakerRecord(ctx, country, true); err != nil {
+		return failures, err
+	}
+	if j.hooks.OnValidationFail != nil {
+		j.hooks.OnValidationFail(ctx, country, sessionID, failures)
+	}
+	return failures, nil
+}
+
+// decayScore decays a failure score recorded at scoredAt to now, halving it
+// every halfLife. It mirrors decayed_score in the Lua scripts.
+func decayScore(score float64, scoredAt, now int64, halfLife time.Duration) float64 {
+	if score == 0 || halfLife <= 0 || now <= scoredAt {
+		return score
+	}
+	return score * math.Pow(0.5, float64(now-scoredAt)/halfLife.Seconds())
+}
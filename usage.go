@@ -0,0 +1,37 @@
+package amazonsession
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Usage windows are stored as 10 minute buckets covering the last 24 hours,
+// see usageWindowLua.
+const (
+	usageBucket    = 10 * time.Minute
+	usageWindowMax = 24 * time.Hour
+)
+
+// usageWithin returns the uses recorded in the encoded usage window within
+// the given duration before now.
+func usageWithin(window string, now time.Time, d time.Duration) int64 {
+	bucketSeconds := int64(usageBucket / time.Second)
+	buckets := (int64(d/time.Second) + bucketSeconds - 1) / bucketSeconds
+	oldest := now.Unix()/bucketSeconds - buckets + 1
+	var count int64
+	for _, pair := range strings.Split(window, ",") {
+		bucket, n, found := strings.Cut(pair, ":")
+		if !found {
+			continue
+		}
+		b, err := strconv.ParseInt(bucket, 10, 64)
+		if err != nil || b < oldest {
+			continue
+		}
+		if n, err := strconv.ParseInt(n, 10, 64); err == nil {
+			count += n
+		}
+	}
+	return count
+}
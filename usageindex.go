@@ -0,0 +1,51 @@
+package amazonsession
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// usageIndexKey is the key of the sorted set indexing the sessions of a
+// country by their usage count, maintained on every change of the count.
+// Sessions stored by older versions of the package are indexed by
+// RebuildIndexes.
+func usageIndexKey(country string) string {
+	return fmt.Sprintf("%s:by-usage", country)
+}
+
+// UsageHistogram counts the sessions of a country by usage count in the
+// buckets delimited by the increasing bounds: the first count is of the
+// sessions used fewer than bounds[0] times, the count i of the sessions
+// used at least bounds[i-1] and fewer than bounds[i] times, and the last
+// count of the sessions used at least bounds[len(bounds)-1] times. Checked
+// out and pinned sessions are included.
+func (j *AmazonSession) UsageHistogram(ctx context.Context, country string, bounds ...int64) ([]int64, error) {
+	country = normalizeCountry(country)
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return nil, fmt.Errorf("histogram bounds must be increasing")
+		}
+	}
+	ctx, cancel := j.opContext(ctx, opShort)
+	defer cancel()
+	pipe := j.readClient(ctx).Pipeline()
+	counts := make([]*redis.IntCmd, 0, len(bounds)+1)
+	min := "-inf"
+	for _, bound := range bounds {
+		// Usage counts are integers, so "< bound" is "<= bound-1".
+		counts = append(counts, pipe.ZCount(ctx, usageIndexKey(country), min, strconv.FormatInt(bound-1, 10)))
+		min = strconv.FormatInt(bound, 10)
+	}
+	counts = append(counts, pipe.ZCount(ctx, usageIndexKey(country), min, "+inf"))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	histogram := make([]int64, len(counts))
+	for i, count := range counts {
+		histogram[i] = count.Val()
+	}
+	return histogram, nil
+}
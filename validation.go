@@ -0,0 +1,80 @@
+package amazonsession
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ValidationMode selects how PushSession handles sessions with malformed
+// cookies, see Config.CookieValidation.
+type ValidationMode int
+
+const (
+	// ValidationOff stores sessions without validating their cookies.
+	ValidationOff ValidationMode = iota
+	// ValidationReport stores malformed sessions and reports the problems
+	// to Hooks.OnInvalidCookies.
+	ValidationReport
+	// ValidationStrict rejects malformed sessions with a
+	// *CookieValidationError.
+	ValidationStrict
+)
+
+// CookieValidationError is returned by PushSession in ValidationStrict mode
+// for sessions with malformed cookies.
+type CookieValidationError struct {
+	SessionID string   // SessionID is the session-id of the rejected session
+	Problems  []string // Problems describes each malformed cookie
+}
+
+func (e *CookieValidationError) Error() string {
+	return fmt.Sprintf("invalid cookies for session %s: %s", e.SessionID, strings.Join(e.Problems, "; "))
+}
+
+// amazonIDPattern matches session-id and ubid values, e.g. 123-1234567-1234567.
+var amazonIDPattern = regexp.MustCompile(`^\d{3}-\d{7}-\d{7}$`)
+
+// validateCookies checks the structure of the cookies of a session about to
+// be stored and returns the problems found. cookiesMap holds the cookies to
+// store, cookies the input cookies whose domains are checked.
+func validateCookies(country string, cookiesMap map[string]string, cookies []*http.Cookie) []string {
+	var problems []string
+	if id := cookiesMap["session-id"]; !amazonIDPattern.MatchString(id) {
+		problems = append(problems, fmt.Sprintf("malformed session-id %q", id))
+	}
+	for name, value := range cookiesMap {
+		if strings.HasPrefix(name, "ubid-") && !amazonIDPattern.MatchString(value) {
+			problems = append(problems, fmt.Sprintf("malformed %s %q", name, value))
+		}
+	}
+	if value, found := cookiesMap["session-id-time"]; found {
+		if _, ok := parseSessionIDTime(value); !ok {
+			problems = append(problems, fmt.Sprintf("malformed session-id-time %q", value))
+		}
+	}
+	if value, found := cookiesMap["i18n-prefs"]; found && !knownCurrency(value) {
+		problems = append(problems, fmt.Sprintf("unknown i18n-prefs currency %q", value))
+	}
+	if countryURL, err := (&Session{Country: country}).countryURL(); err == nil {
+		host := countryURL.Hostname()
+		for _, c := range cookies {
+			domain := strings.TrimPrefix(c.Domain, ".")
+			if domain != "" && host != domain && !strings.HasSuffix(host, "."+domain) {
+				problems = append(problems, fmt.Sprintf("cookie %s has domain %s, not matching %s", c.Name, c.Domain, host))
+			}
+		}
+	}
+	return problems
+}
+
+// knownCurrency reports whether currency is the currency of a marketplace.
+func knownCurrency(currency string) bool {
+	for _, c := range defaultCountryCurrencyMap {
+		if c == currency {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package amazonsession
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Webhook event types.
+const (
+	// WebhookPoolLow is sent when the pool of a country drops below
+	// WebhookConfig.PoolLowThreshold after a pop, delete or cleanup.
+	WebhookPoolLow = "pool-low"
+
+	// WebhookCleanupSummary is sent after CleanupSessions with the number
+	// of removed and remaining sessions per country.
+	WebhookCleanupSummary = "cleanup-summary"
+
+	// WebhookSessionQuarantined is sent when a session that failed to
+	// decode is moved to the repair queue, see DecodeRepair.
+	WebhookSessionQuarantined = "session-quarantined"
+)
+
+// Defaults used when they are not set in WebhookConfig.
+const (
+	defaultWebhookRetries = 3
+	defaultWebhookBackoff = time.Second
+	defaultWebhookTimeout = 10 * time.Second
+)
+
+// WebhookConfig configures the webhook notifications of pool events.
+type WebhookConfig struct {
+	// URLs are the endpoints the events are POSTed to as JSON.
+	URLs []string
+
+	// Secret, when set, signs every payload with HMAC-SHA256. The signature
+	// is sent in the X-Signature-256 header as "sha256=<hex>".
+	Secret string
+
+	// PoolLowThreshold is the pool size under which a pool-low event is sent
+	// for a country. The event is sent once when the pool drops below it,
+	// and again only after it recovered. Zero disables pool-low events.
+	PoolLowThreshold int64
+
+	// MaxRetries is the number of retries of a failed delivery. Defaults
+	// to 3.
+	MaxRetries int
+
+	// RetryBackoff is the delay before the first retry, doubled on every
+	// further retry. Defaults to 1s.
+	RetryBackoff time.Duration
+
+	// Client is the HTTP client used for deliveries. Defaults to a client
+	// with a 10s timeout.
+	Client *http.Client
+}
+
+// WebhookEvent is the JSON payload of a webhook notification.
+type WebhookEvent struct {
+	Type    string                 `json:"type"`
+	Country string                 `json:"country,omitempty"`
+	Time    int64                  `json:"time"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// validate checks the WebhookConfig and fills unset values with their
+// defaults.
+func (cfg *WebhookConfig) validate() error {
+	if len(cfg.URLs) == 0 {
+		return errors.New("invalid config: webhook URLs are required")
+	}
+	for _, rawURL := range cfg.URLs {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid config: invalid webhook URL: %q", rawURL)
+		}
+	}
+	if cfg.PoolLowThreshold < 0 || cfg.MaxRetries < 0 || cfg.RetryBackoff < 0 {
+		return errors.New("invalid config: webhook thresholds and retries must not be negative")
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = defaultWebhookRetries
+	}
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = defaultWebhookBackoff
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	return nil
+}
+
+// webhookDispatcher delivers webhook events in the background.
+type webhookDispatcher struct {
+	cfg   WebhookConfig
+	clock Clock
+
+	mu  sync.Mutex
+	low map[string]bool // countries whose pool-low event was sent
+}
+
+func newWebhookDispatcher(cfg *WebhookConfig, clock Clock) *webhookDispatcher {
+	if cfg == nil {
+		return nil
+	}
+	return &webhookDispatcher{cfg: *cfg, clock: clock, low: make(map[string]bool)}
+}
+
+// poolSize records the pool size of a country and sends a pool-low event
+// when it dropped below the threshold.
+func (d *webhookDispatcher) poolSize(country string, size, threshold int64) {
+	if threshold <= 0 {
+		return
+	}
+	d.mu.Lock()
+	low := size < threshold
+	send := low && !d.low[country]
+	d.low[country] = low
+	d.mu.Unlock()
+	if send {
+		d.send(&WebhookEvent{
+			Type:    WebhookPoolLow,
+			Country: country,
+			Data:    map[string]interface{}{"size": size, "threshold": threshold},
+		})
+	}
+}
+
+// cleanupSummary sends the cleanup-summary event for a cleanup run, and
+// checks the remaining pool sizes against the given thresholds.
+func (d *webhookDispatcher) cleanupSummary(result *CleanupResult, threshold func(country string) int64) {
+	var total int64
+	for _, n := range result.Removed {
+		total += n
+	}
+	d.send(&WebhookEvent{
+		Type: WebhookCleanupSummary,
+		Data: map[string]interface{}{"removed": result.Removed, "remaining": result.Remaining, "total_removed": total},
+	})
+	for country, size := range result.Remaining {
+		d.poolSize(country, size, threshold(country))
+	}
+}
+
+// sessionQuarantined sends the session-quarantined event for a session
+// moved to the repair queue after failing to decode with err.
+func (d *webhookDispatcher) sessionQuarantined(country, sessionID string, err error) {
+	d.send(&WebhookEvent{
+		Type:    WebhookSessionQuarantined,
+		Country: country,
+		Data:    map[string]interface{}{"session_id": sessionID, "error": err.Error()},
+	})
+}
+
+// send delivers an event to all URLs in the background.
+func (d *webhookDispatcher) send(event *WebhookEvent) {
+	event.Time = d.clock.Now().Unix()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	for _, u := range d.cfg.URLs {
+		go d.deliver(u, payload)
+	}
+}
+
+// deliver POSTs a payload to a URL, retrying failed attempts with
+// exponential backoff.
+func (d *webhookDispatcher) deliver(u string, payload []byte) {
+	backoff := d.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		if err := d.post(u, payload); err == nil || attempt >= d.cfg.MaxRetries {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (d *webhookDispatcher) post(u string, payload []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, u, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.cfg.Secret != "" {
+		req.Header.Set("X-Signature-256", "sha256="+signWebhookPayload(d.cfg.Secret, payload))
+	}
+	resp, err := d.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signWebhookPayload returns the hex HMAC-SHA256 of a payload.
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkPoolLow reports the pool size of a country to the webhook
+// dispatcher, when pool-low events are enabled.
+func (j *AmazonSession) checkPoolLow(ctx context.Context, country string) {
+	threshold := j.poolLowThreshold(country)
+	if threshold <= 0 {
+		return
+	}
+	size, err := poolSize(ctx, j.client, country)
+	if err != nil {
+		return
+	}
+	j.webhook.poolSize(country, size, threshold)
+}